@@ -10,8 +10,10 @@ import (
 
 	"github.com/filecoin-project/specs-actors/actors/abi"
 	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/cron"
 	"github.com/filecoin-project/specs-actors/actors/builtin/market"
 	"github.com/filecoin-project/specs-actors/actors/builtin/miner"
+	"github.com/filecoin-project/specs-actors/actors/builtin/verifreg"
 	"github.com/filecoin-project/specs-actors/actors/util/adt"
 
 	"github.com/filecoin-project/lotus/api/apibstore"
@@ -488,3 +490,176 @@ func (sp *StatePredicates) OnMinerPreCommitChange() DiffMinerActorStateFunc {
 		return true, precommitChanges, nil
 	}
 }
+
+type DiffVerifiedRegistryStateFunc func(ctx context.Context, oldState *verifreg.State, newState *verifreg.State) (changed bool, user UserData, err error)
+
+// OnVerifiedRegistryActorChanged calls diffVerifiedRegistryState when the state changes for the verified registry actor
+func (sp *StatePredicates) OnVerifiedRegistryActorChanged(diffVerifiedRegistryState DiffVerifiedRegistryStateFunc) DiffTipSetKeyFunc {
+	return sp.OnActorStateChanged(builtin.VerifiedRegistryActorAddr, func(ctx context.Context, oldActorStateHead, newActorStateHead cid.Cid) (changed bool, user UserData, err error) {
+		var oldState verifreg.State
+		if err := sp.cst.Get(ctx, oldActorStateHead, &oldState); err != nil {
+			return false, nil, err
+		}
+		var newState verifreg.State
+		if err := sp.cst.Get(ctx, newActorStateHead, &newState); err != nil {
+			return false, nil, err
+		}
+		return diffVerifiedRegistryState(ctx, &oldState, &newState)
+	})
+}
+
+// DataCapChanges are the addresses added to, modified in or removed from a HAMT of datacap keyed by address
+type DataCapChanges struct {
+	Added    []AddressDataCap
+	Modified []AddressDataCapChange
+	Removed  []AddressDataCap
+}
+
+type AddressDataCap struct {
+	Address address.Address
+	DataCap verifreg.DataCap
+}
+
+type AddressDataCapChange struct {
+	Address address.Address
+	From    verifreg.DataCap
+	To      verifreg.DataCap
+}
+
+func (m *DataCapChanges) AsKey(key string) (adt.Keyer, error) {
+	addr, err := address.NewFromBytes([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return adt.AddrKey(addr), nil
+}
+
+func (m *DataCapChanges) Add(key string, val *typegen.Deferred) error {
+	dc, err := dataCapEntry(key, val)
+	if err != nil {
+		return err
+	}
+	m.Added = append(m.Added, dc)
+	return nil
+}
+
+func (m *DataCapChanges) Modify(key string, from, to *typegen.Deferred) error {
+	fromDc, err := dataCapEntry(key, from)
+	if err != nil {
+		return err
+	}
+	toDc, err := dataCapEntry(key, to)
+	if err != nil {
+		return err
+	}
+	m.Modified = append(m.Modified, AddressDataCapChange{Address: toDc.Address, From: fromDc.DataCap, To: toDc.DataCap})
+	return nil
+}
+
+func (m *DataCapChanges) Remove(key string, val *typegen.Deferred) error {
+	dc, err := dataCapEntry(key, val)
+	if err != nil {
+		return err
+	}
+	m.Removed = append(m.Removed, dc)
+	return nil
+}
+
+func dataCapEntry(key string, val *typegen.Deferred) (AddressDataCap, error) {
+	addr, err := address.NewFromBytes([]byte(key))
+	if err != nil {
+		return AddressDataCap{}, err
+	}
+	var dc verifreg.DataCap
+	if err := dc.UnmarshalCBOR(bytes.NewReader(val.Raw)); err != nil {
+		return AddressDataCap{}, err
+	}
+	return AddressDataCap{Address: addr, DataCap: dc}, nil
+}
+
+// OnVerifiersChanged diffs the datacap held by each verifier
+func (sp *StatePredicates) OnVerifiersChanged() DiffVerifiedRegistryStateFunc {
+	return func(ctx context.Context, oldState, newState *verifreg.State) (changed bool, user UserData, err error) {
+		return sp.diffDataCaps(ctx, oldState.Verifiers, newState.Verifiers)
+	}
+}
+
+// OnVerifiedClientsChanged diffs the datacap held by each verified client
+func (sp *StatePredicates) OnVerifiedClientsChanged() DiffVerifiedRegistryStateFunc {
+	return func(ctx context.Context, oldState, newState *verifreg.State) (changed bool, user UserData, err error) {
+		return sp.diffDataCaps(ctx, oldState.VerifiedClients, newState.VerifiedClients)
+	}
+}
+
+func (sp *StatePredicates) diffDataCaps(ctx context.Context, oldRoot, newRoot cid.Cid) (changed bool, user UserData, err error) {
+	if oldRoot.Equals(newRoot) {
+		return false, nil, nil
+	}
+
+	ctxStore := &contextStore{
+		ctx: ctx,
+		cst: sp.cst,
+	}
+
+	oldMap, err := adt.AsMap(ctxStore, oldRoot)
+	if err != nil {
+		return false, nil, err
+	}
+	newMap, err := adt.AsMap(ctxStore, newRoot)
+	if err != nil {
+		return false, nil, err
+	}
+
+	changes := &DataCapChanges{}
+	if err := DiffAdtMap(oldMap, newMap, changes); err != nil {
+		return false, nil, err
+	}
+
+	if len(changes.Added)+len(changes.Modified)+len(changes.Removed) == 0 {
+		return false, nil, nil
+	}
+	return true, changes, nil
+}
+
+type DiffCronStateFunc func(ctx context.Context, oldState *cron.State, newState *cron.State) (changed bool, user UserData, err error)
+
+// OnCronActorChanged calls diffCronState when the state changes for the cron actor
+func (sp *StatePredicates) OnCronActorChanged(diffCronState DiffCronStateFunc) DiffTipSetKeyFunc {
+	return sp.OnActorStateChanged(builtin.CronActorAddr, func(ctx context.Context, oldActorStateHead, newActorStateHead cid.Cid) (changed bool, user UserData, err error) {
+		var oldState cron.State
+		if err := sp.cst.Get(ctx, oldActorStateHead, &oldState); err != nil {
+			return false, nil, err
+		}
+		var newState cron.State
+		if err := sp.cst.Get(ctx, newActorStateHead, &newState); err != nil {
+			return false, nil, err
+		}
+		return diffCronState(ctx, &oldState, &newState)
+	})
+}
+
+// CronEntriesChange is the entries registered with the cron actor before and after they changed
+type CronEntriesChange struct {
+	From []cron.Entry
+	To   []cron.Entry
+}
+
+// OnCronEntriesChanged compares the entries registered with the cron actor, which calls them in order so a reordering
+// is a change too
+func (sp *StatePredicates) OnCronEntriesChanged() DiffCronStateFunc {
+	return func(ctx context.Context, oldState, newState *cron.State) (changed bool, user UserData, err error) {
+		if len(oldState.Entries) == len(newState.Entries) {
+			same := true
+			for i := range oldState.Entries {
+				if oldState.Entries[i] != newState.Entries[i] {
+					same = false
+					break
+				}
+			}
+			if same {
+				return false, nil, nil
+			}
+		}
+		return true, &CronEntriesChange{From: oldState.Entries, To: newState.Entries}, nil
+	}
+}
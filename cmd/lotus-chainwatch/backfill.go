@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	_ "github.com/lib/pq"
+
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var backfillCmd = &cli.Command{
+	Name:  "backfill",
+	Usage: "Store the common actor state of the heights missing from the database",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:  "from",
+			Usage: "lowest height to backfill, with --to, instead of the gaps found in the database",
+		},
+		&cli.Int64Flag{
+			Name:  "to",
+			Usage: "highest height to backfill, with --from, instead of the gaps found in the database",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "number of chunks of heights backfilled concurrently",
+			Value: processor.DefaultBackfillWorkers,
+		},
+		&cli.Float64Flag{
+			Name:  "node-qps",
+			Usage: "most calls per second made to the lotus node, 0 for no limit, reading a CAR file is not limited",
+			Value: processor.DefaultNodeQPS,
+		},
+		&cli.IntFlag{
+			Name:  "node-burst",
+			Usage: "number of calls made to the lotus node at once before --node-qps applies",
+			Value: processor.DefaultNodeBurst,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only list the gaps found",
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-grace",
+			Usage: "time the chunks in flight when interrupted are given to commit before they are cancelled",
+			Value: processor.DefaultShutdownGrace,
+		},
+		&cli.StringFlag{
+			Name:  "car",
+			Usage: "read the chain from the CAR file at this path instead of a lotus node, it must hold the state trees of the heights backfilled",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+
+		// the first interrupt closes the processor so in flight chunks get the shutdown grace, a second one cancels them.
+		ctx, cancel := context.WithCancel(lcli.DaemonContext(cctx))
+		defer cancel()
+
+		var node processor.Node
+		if path := cctx.String("car"); path != "" {
+			car, err := processor.OpenCARNode(path)
+			if err != nil {
+				return err
+			}
+			node = car
+		} else {
+			api, closer, err := lcli.GetFullNodeAPI(cctx)
+			if err != nil {
+				return err
+			}
+			defer closer()
+
+			if err := processor.CheckNodeVersion(ctx, api); err != nil {
+				return err
+			}
+			node = api
+		}
+
+		proc, err := openProcessor(cctx, node)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+		proc.BackfillWorkers = cctx.Int("workers")
+		proc.NodeQPS = cctx.Float64("node-qps")
+		proc.NodeBurst = cctx.Int("node-burst")
+		proc.ShutdownGrace = cctx.Duration("shutdown-grace")
+		if cctx.String("car") != "" {
+			proc.NodeQPS = 0
+		}
+
+		sigCh := make(chan os.Signal, 2)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+		defer signal.Stop(sigCh)
+		go func() {
+			select {
+			case <-sigCh:
+			case <-ctx.Done():
+				return
+			}
+			log.Infow("Closing backfill, chunks in flight are given the shutdown grace to commit", "grace", proc.ShutdownGrace)
+			proc.Close()
+			select {
+			case <-sigCh:
+				log.Warn("Cancelling the chunks in flight")
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		// no processor is started on a SQLite database, its tables are created by the backfill.
+		if proc.Backend == processor.BackendSQLite {
+			if !cctx.IsSet("from") || !cctx.IsSet("to") {
+				return xerrors.Errorf("--from and --to must be set to backfill a SQLite database, gaps are found from the heights the syncer stores in Postgres")
+			}
+			if !cctx.Bool("dry-run") {
+				if err := proc.Setup(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		var ranges []processor.EpochRange
+		if cctx.IsSet("from") || cctx.IsSet("to") {
+			if !cctx.IsSet("from") || !cctx.IsSet("to") {
+				return xerrors.Errorf("--from and --to must be set together")
+			}
+			ranges = []processor.EpochRange{{From: abi.ChainEpoch(cctx.Int64("from")), To: abi.ChainEpoch(cctx.Int64("to"))}}
+		} else {
+			if ranges, err = proc.FindGaps(ctx); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range ranges {
+			log.Infow("Gap to backfill", "range", r.String())
+		}
+		if cctx.Bool("dry-run") || len(ranges) == 0 {
+			return nil
+		}
+
+		err = proc.Backfill(ctx, ranges)
+		if xerrors.Is(err, processor.ErrProcessorClosed) {
+			log.Infow("Backfill closed, run it again to resume")
+			return nil
+		}
+		return err
+	},
+}
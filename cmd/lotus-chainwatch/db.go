@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+// dbOptions are the connection pool options set by the database flags.
+func dbOptions(cctx *cli.Context) []processor.Option {
+	return []processor.Option{
+		processor.WithMaxOpenConns(cctx.Int("db-max-open-conns")),
+		processor.WithMaxIdleConns(cctx.Int("db-max-idle-conns")),
+		processor.WithConnMaxLifetime(cctx.Duration("db-conn-max-lifetime")),
+		processor.WithSSLMode(cctx.String("db-sslmode")),
+	}
+}
+
+// openDB opens the database of --db with the connection pool set by the other database flags, and checks it
+// responds.
+func openDB(cctx *cli.Context) (*sql.DB, error) {
+	db, err := processor.OpenDB(cctx.String("db"), dbOptions(cctx)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := pingDB(db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// openProcessor returns a processor reading the chain from node and writing to the database of --db, opened as openDB
+// does. The database is closed with closeDB.
+func openProcessor(cctx *cli.Context, node processor.Node) (*processor.Processor, error) {
+	proc, err := processor.NewProcessor(cctx.String("db"), append(dbOptions(cctx), processor.WithNode(node))...)
+	if err != nil {
+		return nil, err
+	}
+	if err := pingDB(proc.DB()); err != nil {
+		return nil, err
+	}
+	return proc, nil
+}
+
+// pingDB checks db responds, closing it if it does not.
+func pingDB(db *sql.DB) error {
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return xerrors.Errorf("Database failed to respond to ping (is it online?): %w", err)
+	}
+	return nil
+}
+
+// closeDB closes db, logging a failure.
+func closeDB(db *sql.DB) {
+	if err := db.Close(); err != nil {
+		log.Errorw("Failed to close database", "error", err)
+	}
+}
@@ -22,7 +22,7 @@ var dotCmd = &cli.Command{
 			return err
 		}
 
-		db, err := sql.Open("postgres", cctx.String("db"))
+		db, err := openDB(cctx)
 		if err != nil {
 			return err
 		}
@@ -32,10 +32,6 @@ var dotCmd = &cli.Command{
 			}
 		}()
 
-		if err := db.Ping(); err != nil {
-			return xerrors.Errorf("Database failed to respond to ping (is it online?): %w", err)
-		}
-
 		minH, err := strconv.ParseInt(cctx.Args().Get(0), 10, 32)
 		if err != nil {
 			return err
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var exportCmd = &cli.Command{
+	Name:  "export",
+	Usage: "Write the actor states stored in a range of heights as JSON Lines",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:     "from",
+			Usage:    "lowest height to export",
+			Required: true,
+		},
+		&cli.Int64Flag{
+			Name:     "to",
+			Usage:    "highest height to export",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "file to write to, stdout if not set",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+		ctx := lcli.ReqContext(cctx)
+
+		from, to := abi.ChainEpoch(cctx.Int64("from")), abi.ChainEpoch(cctx.Int64("to"))
+		if from > to {
+			return xerrors.Errorf("--from %d is above --to %d", from, to)
+		}
+
+		// the export only reads the database, no node is needed.
+		proc, err := openProcessor(cctx, nil)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+
+		path := cctx.String("output")
+		if path == "" {
+			return proc.ExportRange(ctx, from, to, os.Stdout)
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return xerrors.Errorf("create export file: %w", err)
+		}
+		if err := proc.ExportRange(ctx, from, to, f); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	},
+}
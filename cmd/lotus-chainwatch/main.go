@@ -7,6 +7,8 @@ import (
 	"github.com/filecoin-project/lotus/build"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/urfave/cli/v2"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
 )
 
 var log = logging.Logger("chainwatch")
@@ -30,8 +32,27 @@ func main() {
 			&cli.StringFlag{
 				Name:    "db",
 				EnvVars: []string{"LOTUS_DB"},
+				Usage:   "Postgres connection string, or sqlite:// followed by the path of a SQLite database file for backfill and repair, which only store the common actor tables and need a build with -tags sqlite",
 				Value:   "",
 			},
+			&cli.IntFlag{
+				Name:  "db-max-open-conns",
+				Usage: "maximum number of connections open to the database, 0 for no limit",
+				Value: processor.DefaultMaxOpenConns,
+			},
+			&cli.IntFlag{
+				Name:  "db-max-idle-conns",
+				Usage: "number of idle connections to the database kept open",
+				Value: processor.DefaultMaxIdleConns,
+			},
+			&cli.DurationFlag{
+				Name:  "db-conn-max-lifetime",
+				Usage: "close connections to the database once open for this long, 0 to keep them",
+			},
+			&cli.StringFlag{
+				Name:  "db-sslmode",
+				Usage: "sslmode of the connections to the database: disable, require, verify-ca or verify-full, the one of --db if not set",
+			},
 			&cli.StringFlag{
 				Name:    "log-level",
 				EnvVars: []string{"GOLOG_LOG_LEVEL"},
@@ -41,6 +62,12 @@ func main() {
 		Commands: []*cli.Command{
 			dotCmd,
 			runCmd,
+			backfillCmd,
+			exportCmd,
+			verifyCmd,
+			repairCmd,
+			replayCmd,
+			redecodeCmd,
 		},
 	}
 
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/account"
+
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// accountPubkey is the pubkey address held in the state of an account actor.
+type accountPubkey struct {
+	id     address.Address
+	pubkey address.Address
+}
+
+func (p *Processor) setupAccounts() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/*
+* the pubkey address of every account actor, read from its state. an account
+* keeps the address it was created with so a row is never updated
+*/
+create table if not exists account_pubkeys
+(
+	id text not null
+		constraint account_pubkeys_pk
+			primary key,
+	pubkey_address text not null
+);
+
+create index if not exists account_pubkeys_pubkey_address_index
+	on account_pubkeys (pubkey_address);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandleAccountChanges(ctx context.Context, accountTips ActorTips) error {
+	pubkeys, err := p.processAccounts(ctx, accountTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process accounts: %w", err)
+	}
+
+	return p.storeAccountPubkeys(ctx, pubkeys)
+}
+
+// processAccounts reads the pubkey address of every account actor changed. The state of an account never changes, every
+// account is read once however many times it changed. Accounts holding an address which is not a key, such as the burnt
+// funds actor, are left out.
+func (p *Processor) processAccounts(ctx context.Context, accountTips ActorTips) ([]accountPubkey, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Processed Accounts", "duration", time.Since(start).String())
+	}()
+
+	ids, err := p.resolveIDs(ctx, map[cid.Cid]ActorTips{builtin.AccountActorCodeID: accountTips})
+	if err != nil {
+		return nil, xerrors.Errorf("resolve account ID addresses: %w", err)
+	}
+
+	store := cw_util.NewAPIIpldStore(ctx, p.node)
+	seen := map[address.Address]struct{}{}
+	var out []accountPubkey
+	for _, accounts := range accountTips {
+		for _, a := range accounts {
+			id, ok := ids[a.addr]
+			if !ok || id == address.Undef {
+				continue
+			}
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+
+			var st account.State
+			if err := store.Get(ctx, a.act.Head, &st); err != nil {
+				return nil, xerrors.Errorf("read account state of %s (@ %s): %w", a.addr, a.stateroot, err)
+			}
+			if st.Address.Protocol() != address.SECP256K1 && st.Address.Protocol() != address.BLS {
+				p.logger().Debugw("Account without a pubkey address", "id", id, "address", st.Address)
+				continue
+			}
+			out = append(out, accountPubkey{id: id, pubkey: st.Address})
+		}
+	}
+	return out, nil
+}
+
+func (p *Processor) storeAccountPubkeys(ctx context.Context, pubkeys []accountPubkey) error {
+	if len(pubkeys) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Account Pubkeys", "duration", time.Since(start).String())
+	}()
+
+	rows := make([][]interface{}, len(pubkeys))
+	for i, pk := range pubkeys {
+		rows[i] = []interface{}{pk.id.String(), pk.pubkey.String()}
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin account_pubkeys tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		// an account stored already holds the same address, the conflict on id is skipped.
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "account_pubkeys", []string{"id", "pubkey_address"}, rows); err != nil {
+			return xerrors.Errorf("store account pubkeys: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
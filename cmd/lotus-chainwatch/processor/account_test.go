@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/account"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// accountFixture returns a node holding the state of a secp and a BLS account, and of an account holding an ID address
+// like the burnt funds actor, along with the tips of two tipsets changing all of them.
+func accountFixture(t *testing.T) (*testNode, ActorTips, map[address.Address]address.Address) {
+	node := newTestNode()
+
+	secp, err := address.NewSecp256k1Address(bytes.Repeat([]byte{1}, 65))
+	require.NoError(t, err)
+	bls, err := address.NewBLSAddress(bytes.Repeat([]byte{2}, 48))
+	require.NoError(t, err)
+
+	pubkeys := map[address.Address]address.Address{}
+	tips := ActorTips{}
+	for i, pk := range []address.Address{secp, bls, builtin.BurntFundsActorAddr} {
+		id, err := address.NewIDAddress(uint64(1000 + i))
+		require.NoError(t, err)
+		head := node.put(t, &account.State{Address: pk})
+		if pk.Protocol() != address.ID {
+			pubkeys[id] = pk
+		}
+
+		for ts := 0; ts < 2; ts++ {
+			tsk := types.NewTipSetKey(testCid(t, fmt.Sprintf("block-%d", ts)))
+			tips[tsk] = append(tips[tsk], actorInfo{
+				act:       types.Actor{Code: builtin.AccountActorCodeID, Head: head, Nonce: uint64(ts), Balance: types.NewInt(0)},
+				addr:      id,
+				stateroot: testCid(t, fmt.Sprintf("stateroot-%d", ts)),
+				tsKey:     tsk,
+			})
+		}
+	}
+	return node, tips, pubkeys
+}
+
+func TestProcessAccounts(t *testing.T) {
+	node, tips, want := accountFixture(t)
+	p := &Processor{node: node}
+
+	pubkeys, err := p.processAccounts(context.Background(), tips)
+	require.NoError(t, err)
+
+	// every account is read once, the burnt funds like account is left out.
+	got := map[address.Address]address.Address{}
+	for _, pk := range pubkeys {
+		_, dup := got[pk.id]
+		require.False(t, dup, pk.id)
+		got[pk.id] = pk.pubkey
+	}
+	require.Equal(t, want, got)
+}
+
+func TestStoreAccountPubkeys(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	node, tips, want := accountFixture(t)
+
+	p := &Processor{db: db, node: node}
+	require.NoError(t, p.setupAccounts())
+	_, err := db.Exec(`truncate account_pubkeys`)
+	require.NoError(t, err)
+
+	require.NoError(t, p.HandleAccountChanges(ctx, tips))
+	require.Equal(t, len(want), countRows(t, db, `select count(*) from account_pubkeys`))
+	for id, pk := range want {
+		require.Equal(t, 1, countRows(t, db, `select count(*) from account_pubkeys where id = $1 and pubkey_address = $2`, id.String(), pk.String()))
+	}
+
+	// a stored account is left as it is.
+	other, err := address.NewSecp256k1Address(bytes.Repeat([]byte{3}, 65))
+	require.NoError(t, err)
+	var id address.Address
+	for id = range want {
+		break
+	}
+	require.NoError(t, p.storeAccountPubkeys(ctx, []accountPubkey{{id: id, pubkey: other}}))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from account_pubkeys where id = $1 and pubkey_address = $2`, id.String(), want[id].String()))
+}
@@ -0,0 +1,229 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// actorEventType is whether an actor_events row records the creation or the deletion of an actor.
+type actorEventType string
+
+const (
+	actorCreated actorEventType = "created"
+	actorDeleted actorEventType = "deleted"
+)
+
+// actorEvent is a row of actor_events.
+type actorEvent struct {
+	id        string
+	code      cid.Cid
+	eventType actorEventType
+	epoch     abi.ChainEpoch
+	stateroot cid.Cid
+	tsKey     types.TipSetKey
+}
+
+func (p *Processor) setupActorEvents() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/*
+* the actors created and deleted by executing a tipset, found by diffing the
+* state tree before it against the one after it. tipset_key is the tipset
+* executed, the events of a tipset are removed once it is reverted
+*/
+create table if not exists actor_events
+(
+	id text not null,
+	code text not null,
+	event_type text not null
+		constraint actor_events_type_check
+			check (event_type in ('created', 'deleted')),
+	epoch bigint not null,
+	state_root text not null,
+	tipset_key text not null,
+	constraint actor_events_pk
+		primary key (tipset_key, id, event_type)
+);
+
+create index if not exists actor_events_id_epoch_index
+	on actor_events (id, epoch);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandleActorEvents(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader) error {
+	events, err := p.collectActorEvents(ctx, blocks)
+	if err != nil {
+		return xerrors.Errorf("Failed to collect actor events: %w", err)
+	}
+
+	return p.storeActorEvents(ctx, events)
+}
+
+// collectActorEvents returns the actors created and deleted by the parent tipset of every block in blocks. The changed
+// actors only hold the ones in the new state, so they are also taken the other way round to find the deleted ones: an
+// actor in only one of the two was created or deleted, one in both was changed.
+func (p *Processor) collectActorEvents(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader) ([]actorEvent, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Collected Actor Events", "duration", time.Since(start).String())
+	}()
+
+	// the blocks of a tipset share their parent, it is diffed once.
+	seen := map[types.TipSetKey]struct{}{}
+	byParent := map[cid.Cid]*types.BlockHeader{}
+	for c, bh := range blocks {
+		tsk := types.NewTipSetKey(bh.Parents...)
+		if _, ok := seen[tsk]; ok {
+			continue
+		}
+		seen[tsk] = struct{}{}
+		byParent[c] = bh
+	}
+
+	var out []actorEvent
+	var outMu sync.Mutex
+	err := parBlocks(50, byParent, func(bh *types.BlockHeader) error {
+		pts, err := p.Source.TipSet(ctx, types.NewTipSetKey(bh.Parents...))
+		if err != nil {
+			return xerrors.Errorf("get parent tipset of %s: %w", bh.Cid(), err)
+		}
+		if pts.ParentState() == bh.ParentStateRoot {
+			return nil
+		}
+
+		added, err := p.Source.ChangedActors(ctx, pts.ParentState(), bh.ParentStateRoot)
+		if err != nil {
+			return xerrors.Errorf("get actors changed at %s: %w", bh.ParentStateRoot, err)
+		}
+		removed, err := p.Source.ChangedActors(ctx, bh.ParentStateRoot, pts.ParentState())
+		if err != nil {
+			return xerrors.Errorf("get actors changed at %s from %s: %w", pts.ParentState(), bh.ParentStateRoot, err)
+		}
+
+		var events []actorEvent
+		event := func(id string, code cid.Cid, typ actorEventType) {
+			events = append(events, actorEvent{
+				id:        id,
+				code:      code,
+				eventType: typ,
+				epoch:     bh.Height,
+				stateroot: bh.ParentStateRoot,
+				tsKey:     pts.Key(),
+			})
+		}
+		for id, act := range added {
+			if _, ok := removed[id]; !ok {
+				event(id, act.Code, actorCreated)
+			}
+		}
+		for id, act := range removed {
+			if _, ok := added[id]; !ok {
+				event(id, act.Code, actorDeleted)
+			}
+		}
+
+		outMu.Lock()
+		out = append(out, events...)
+		outMu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// genesisActorEvents returns the creation of every actor in the genesis state, which no tipset is diffed against.
+func genesisActorEvents(actors map[cid.Cid]ActorTips) []actorEvent {
+	var out []actorEvent
+	for code, tips := range actors {
+		for _, infos := range tips {
+			for _, a := range infos {
+				out = append(out, actorEvent{
+					id:        a.addr.String(),
+					code:      code,
+					eventType: actorCreated,
+					epoch:     a.height,
+					stateroot: a.stateroot,
+					tsKey:     a.tsKey,
+				})
+			}
+		}
+	}
+	return out
+}
+
+func (p *Processor) storeActorEvents(ctx context.Context, events []actorEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Actor Events", "duration", time.Since(start).String())
+	}()
+
+	rows := make([][]interface{}, len(events))
+	for i, e := range events {
+		rows[i] = []interface{}{e.id, e.code.String(), string(e.eventType), e.epoch, e.stateroot.String(), e.tsKey.String()}
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin actor_events tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		cols := []string{"id", "code", "event_type", "epoch", "state_root", "tipset_key"}
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "actor_events", cols, rows); err != nil {
+			return xerrors.Errorf("store actor events: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+// revertActorEvents removes the events of the tipsets from old down to the common ancestor of a reorg, excluding the
+// ancestor. They were never executed on the chain the node switched to, and the actors they created or deleted are
+// seen again as the new chain is processed.
+func (p *Processor) revertActorEvents(ctx context.Context, old, ancestor *types.TipSet) error {
+	var keys []string
+	for ts := old; !ts.Equals(ancestor); {
+		keys = append(keys, ts.Key().String())
+		var err error
+		if ts, err = p.Source.TipSet(ctx, ts.Parents()); err != nil {
+			return xerrors.Errorf("walk back reverted tipsets: %w", err)
+		}
+	}
+
+	res, err := p.db.ExecContext(ctx, `delete from actor_events where tipset_key = any($1)`, pq.Array(keys))
+	if err != nil {
+		return xerrors.Errorf("delete reverted actor events: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		p.logger().Infow("Removed actor events of reverted tipsets", "tipsets", len(keys), "events", n)
+	}
+	return nil
+}
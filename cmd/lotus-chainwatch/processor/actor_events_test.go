@@ -0,0 +1,137 @@
+package processor
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// treeSource serves the actors changed between two state roots from the whole state tree at each of them.
+type treeSource struct {
+	TipSetSource
+
+	trees map[cid.Cid]map[string]types.Actor
+}
+
+func (s *treeSource) ChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error) {
+	out := map[string]types.Actor{}
+	for id, act := range s.trees[new] {
+		if prev, ok := s.trees[old][id]; !ok || prev.Head != act.Head {
+			out[id] = act
+		}
+	}
+	return out, nil
+}
+
+// executedBy returns a block to process whose parent is ts, its parent state root is the state after executing ts.
+func executedBy(ts *types.TipSet, root cid.Cid) map[cid.Cid]*types.BlockHeader {
+	bh := mock.MkBlock(ts, 1, 3)
+	bh.ParentStateRoot = root
+	return map[cid.Cid]*types.BlockHeader{bh.Cid(): bh}
+}
+
+func eventActor(t *testing.T, code cid.Cid, id string) types.Actor {
+	return types.Actor{Code: code, Head: testCid(t, "head-"+id)}
+}
+
+func eventStrings(events []actorEvent) []string {
+	var out []string
+	for _, e := range events {
+		out = append(out, string(e.eventType)+" "+e.id+" "+e.code.String())
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestCollectActorEvents(t *testing.T) {
+	ctx := context.Background()
+
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	s1, s2 := testCid(t, "stateroot-1"), testCid(t, "stateroot-2")
+	b1 := mock.MkBlock(gen, 1, 1)
+	b1.ParentStateRoot = s1
+	ts1 := mock.TipSet(b1)
+
+	account, miner := eventActor(t, builtin.AccountActorCodeID, "t01000"), eventActor(t, builtin.StorageMinerActorCodeID, "t01001")
+	changed := miner
+	changed.Head = testCid(t, "head-t01001-changed")
+	src := &treeSource{
+		TipSetSource: newRecordedSource(&RecordedChain{TipSets: []*types.TipSet{gen, ts1}}),
+		trees: map[cid.Cid]map[string]types.Actor{
+			gen.ParentState(): {"t01000": account},
+			s1:                {"t01000": account, "t01001": miner},
+			s2:                {"t01001": changed},
+		},
+	}
+	p := &Processor{Source: src}
+
+	// the miner is created, the account is left as it is.
+	events, err := p.collectActorEvents(ctx, executedBy(gen, s1))
+	require.NoError(t, err)
+	require.Equal(t, []string{"created t01001 " + builtin.StorageMinerActorCodeID.String()}, eventStrings(events))
+	require.Equal(t, gen.Key(), events[0].tsKey)
+	require.Equal(t, gen.Height()+1, events[0].epoch)
+
+	// the account is deleted, the miner changing is not an event.
+	events, err = p.collectActorEvents(ctx, executedBy(ts1, s2))
+	require.NoError(t, err)
+	require.Equal(t, []string{"deleted t01000 " + builtin.AccountActorCodeID.String()}, eventStrings(events))
+	require.Equal(t, s2, events[0].stateroot)
+
+	// a tipset leaving the state as it is has no events.
+	events, err = p.collectActorEvents(ctx, executedBy(ts1, ts1.ParentState()))
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func TestActorEventsReorg(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	oldChain, newChain := forkedChain(gen, 1, 1)
+	sOld, sNew := testCid(t, "stateroot-old"), testCid(t, "stateroot-new")
+
+	miner, created := eventActor(t, builtin.StorageMinerActorCodeID, "t01000"), eventActor(t, builtin.AccountActorCodeID, "t01001")
+	src := &treeSource{
+		TipSetSource: newRecordedSource(&RecordedChain{TipSets: []*types.TipSet{gen, oldChain[0], newChain[0]}}),
+		trees: map[cid.Cid]map[string]types.Actor{
+			gen.ParentState(): {"t01000": miner},
+			// the old chain terminates the miner and creates an account.
+			sOld: {"t01001": created},
+			// the new chain keeps the miner.
+			sNew: {"t01000": miner, "t01002": eventActor(t, builtin.AccountActorCodeID, "t01002")},
+		},
+	}
+
+	p := &Processor{db: db, Source: src}
+	require.NoError(t, p.setupReorgs())
+	require.NoError(t, p.setupActorEvents())
+	_, err := db.Exec(`truncate reorgs, actor_events`)
+	require.NoError(t, err)
+
+	process := func(blocks map[cid.Cid]*types.BlockHeader) {
+		require.NoError(t, p.observeTipSets(ctx, blocks))
+		require.NoError(t, p.HandleActorEvents(ctx, blocks))
+	}
+
+	process(executedBy(oldChain[0], sOld))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from actor_events where id = 't01000' and event_type = 'deleted'`))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from actor_events where id = 't01001' and event_type = 'created'`))
+
+	// the old tipset is reverted, the miner it deleted never was and the account it created neither.
+	process(executedBy(newChain[0], sNew))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from reorgs`))
+	require.Equal(t, 0, countRows(t, db, `select count(*) from actor_events where tipset_key = $1`, oldChain[0].Key().String()))
+	require.Equal(t, 0, countRows(t, db, `select count(*) from actor_events where event_type = 'deleted'`))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from actor_events`))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from actor_events where id = 't01002' and event_type = 'created' and tipset_key = $1`, newChain[0].Key().String()))
+}
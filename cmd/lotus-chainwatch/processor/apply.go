@@ -0,0 +1,150 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ApplyDecoder hands the stored history of the actors with the given code to the custom processors registered for it.
+// A processor registered after those actors were processed fills its tables from what is already in the database
+// rather than needing a resync. States are read from actor_states, the node is only asked for the ones not stored.
+// Changes are handed over in height order, backfillHeights heights at a time.
+func (p *Processor) ApplyDecoder(ctx context.Context, code cid.Cid) error {
+	var handlers []customProcessor
+	for _, cp := range p.custom {
+		for _, c := range cp.codes {
+			if c == code {
+				handlers = append(handlers, cp)
+				break
+			}
+		}
+	}
+	if len(handlers) == 0 {
+		return xerrors.Errorf("no processor registered for code %s", code)
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+select a.id, a.head, a.nonce, a.balance, a.stateroot, b.height, b.cid, s.state
+from actors a
+	inner join (
+		select distinct on (parentstateroot) parentstateroot, height, cid
+		from blocks
+		order by parentstateroot, cid
+	) b on b.parentstateroot = a.stateroot
+	left join actor_states s on s.head = a.head and s.code = a.code
+where a.code = $1
+order by b.height, a.id
+`, code.String())
+	if err != nil {
+		return xerrors.Errorf("query stored actors: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	pred := state.NewStatePredicates(p.node)
+	// the tipsets a state root is the parent state of, looked up once per state root.
+	tipsets := map[cid.Cid][2]types.TipSetKey{}
+
+	flush := func(changes map[types.TipSetKey][]ActorChange) error {
+		for _, cp := range handlers {
+			if err := cp.handler.HandleActorChanges(ctx, pred, p.db, changes); err != nil {
+				return xerrors.Errorf("apply decoder of processor %s: %w", cp.name, err)
+			}
+		}
+		return nil
+	}
+
+	changes := map[types.TipSetKey][]ActorChange{}
+	heights := 0
+	lastHeight := abi.ChainEpoch(-1)
+	for rows.Next() {
+		var (
+			id, head, balance, stateroot, block string
+			height                              int64
+			nonce                               uint64
+			raw                                 sql.NullString
+		)
+		if err := rows.Scan(&id, &head, &nonce, &balance, &stateroot, &height, &block, &raw); err != nil {
+			return xerrors.Errorf("scan stored actor: %w", err)
+		}
+
+		if abi.ChainEpoch(height) != lastHeight {
+			if heights == backfillHeights {
+				if err := flush(changes); err != nil {
+					return err
+				}
+				changes = map[types.TipSetKey][]ActorChange{}
+				heights = 0
+			}
+			lastHeight = abi.ChainEpoch(height)
+			heights++
+		}
+
+		c := ActorChange{Height: abi.ChainEpoch(height), Actor: types.Actor{Code: code, Nonce: nonce}}
+		if c.Address, err = address.NewFromString(id); err != nil {
+			return xerrors.Errorf("parse actor id %s: %w", id, err)
+		}
+		if c.Actor.Head, err = cid.Decode(head); err != nil {
+			return xerrors.Errorf("parse head of %s: %w", id, err)
+		}
+		if c.Actor.Balance, err = types.BigFromString(balance); err != nil {
+			return xerrors.Errorf("parse balance of %s: %w", id, err)
+		}
+		if c.StateRoot, err = cid.Decode(stateroot); err != nil {
+			return xerrors.Errorf("parse stateroot of %s: %w", id, err)
+		}
+
+		tsks, ok := tipsets[c.StateRoot]
+		if !ok {
+			if tsks, err = p.parentTipSets(ctx, block); err != nil {
+				return err
+			}
+			tipsets[c.StateRoot] = tsks
+		}
+		c.TipSet, c.ParentTipSet = tsks[0], tsks[1]
+
+		if raw.Valid {
+			c.State = raw.String
+		} else if c.State, err = p.decodedState(ctx, c.Address, c.TipSet, c.Actor); err != nil {
+			return xerrors.Errorf("read state of %s at %s: %w", id, c.StateRoot, err)
+		}
+
+		changes[c.TipSet] = append(changes[c.TipSet], c)
+	}
+	if err := rows.Err(); err != nil {
+		return xerrors.Errorf("read stored actors: %w", err)
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return flush(changes)
+}
+
+// parentTipSets returns the key of the parent of the block with cid c, the tipset whose execution produced the block's
+// parent state root, and the key of that tipset's own parent.
+func (p *Processor) parentTipSets(ctx context.Context, c string) ([2]types.TipSetKey, error) {
+	bc, err := cid.Decode(c)
+	if err != nil {
+		return [2]types.TipSetKey{}, xerrors.Errorf("parse block cid %s: %w", c, err)
+	}
+	bh, err := p.Source.Block(ctx, bc)
+	if err != nil {
+		return [2]types.TipSetKey{}, xerrors.Errorf("get block %s: %w", c, err)
+	}
+	tsk := types.NewTipSetKey(bh.Parents...)
+	pts, err := p.Source.TipSet(ctx, tsk)
+	if err != nil {
+		return [2]types.TipSetKey{}, xerrors.Errorf("get parent tipset of block %s: %w", c, err)
+	}
+	return [2]types.TipSetKey{tsk, pts.Parents()}, nil
+}
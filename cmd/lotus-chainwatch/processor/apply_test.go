@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestApplyDecoderBackfillsRegisteredProcessor(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	child := mock.MkBlock(gen, 1, 1)
+	child.ParentStateRoot = testCid(t, "stateroot-1")
+	_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+		child.Cid().String(), child.ParentStateRoot.String(), child.Height)
+	require.NoError(t, err)
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	stored, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	unstored, err := address.NewIDAddress(1001)
+	require.NoError(t, err)
+
+	tips := ActorTips{}
+	for _, addr := range []address.Address{stored, unstored} {
+		tips[gen.Key()] = append(tips[gen.Key()], actorInfo{
+			act: types.Actor{
+				Code:    builtin.AccountActorCodeID,
+				Head:    testCid(t, "head-"+addr.String()),
+				Balance: types.NewInt(1),
+			},
+			stateroot:   child.ParentStateRoot,
+			height:      child.Height,
+			tsKey:       gen.Key(),
+			parentTsKey: gen.Parents(),
+			addr:        addr,
+			state:       `{"Address":"` + addr.String() + `"}`,
+		})
+	}
+	actors := map[cid.Cid]ActorTips{builtin.AccountActorCodeID: tips}
+
+	// the processor runs before any decoder is registered, only one of the states makes it to actor_states.
+	p := &Processor{db: db}
+	seedAddresses(t, db, []address.Address{stored, unstored})
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.NoError(t, p.storeActorStates(ctx, map[cid.Cid]ActorTips{builtin.AccountActorCodeID: {gen.Key(): tips[gen.Key()][:1]}}))
+
+	p.Source = newRecordedSource(&RecordedChain{
+		Blocks:  []*types.BlockHeader{child},
+		TipSets: []*types.TipSet{gen},
+		States: []RecordedState{{
+			Address: unstored,
+			TipSet:  gen.Key(),
+			State:   api.ActorState{Balance: types.NewInt(1), State: map[string]interface{}{"Address": unstored.String()}},
+		}},
+	})
+
+	rh := &recordingHandler{}
+	p.RegisterProcessor("accounts", []cid.Cid{builtin.AccountActorCodeID}, rh)
+	require.Error(t, p.ApplyDecoder(ctx, builtin.MultisigActorCodeID))
+	require.NoError(t, p.ApplyDecoder(ctx, builtin.AccountActorCodeID))
+
+	require.Len(t, rh.changes, 1)
+	changes := rh.changes[gen.Key()]
+	require.Len(t, changes, 2)
+	for _, c := range changes {
+		require.Equal(t, child.Height, c.Height)
+		require.Equal(t, child.ParentStateRoot, c.StateRoot)
+		require.Equal(t, gen.Parents(), c.ParentTipSet)
+		require.Equal(t, testCid(t, "head-"+c.Address.String()), c.Actor.Head)
+		require.JSONEq(t, `{"Address":"`+c.Address.String()+`"}`, c.State)
+	}
+}
@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+)
+
+// storeRange is the transaction every store of a range writes in when the Processor's AtomicRange is set.
+type storeRange struct {
+	tx *sql.Tx
+	// onCommit are run once tx committed, for the side effects a store makes on its commit.
+	onCommit []func()
+}
+
+type storeRangeKey struct{}
+
+// rangeTx returns the range ctx is stored within by atomicRange, nil if it is not.
+func rangeTx(ctx context.Context) *storeRange {
+	r, _ := ctx.Value(storeRangeKey{}).(*storeRange)
+	return r
+}
+
+// atomicRange runs store with a ctx whose store transactions are all a single one, committed once store returned
+// without an error and rolled back otherwise. The statements of the transaction run one at a time, store must not run
+// the stores of the range concurrently. A transient failure runs store again in a new transaction.
+func (p *Processor) atomicRange(ctx context.Context, store func(ctx context.Context) error) error {
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+
+		r := &storeRange{tx: tx}
+		if err := store(context.WithValue(ctx, storeRangeKey{}, r)); err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.commitStoreTx(ctx, tx); err != nil {
+			return err
+		}
+		for _, fn := range r.onCommit {
+			fn()
+		}
+		return nil
+	})
+}
+
+// afterCommit runs fn once the store transaction just written in is committed: right away, or when the range it is
+// part of is.
+func afterCommit(ctx context.Context, fn func()) {
+	if r := rangeTx(ctx); r != nil {
+		r.onCommit = append(r.onCommit, fn)
+		return
+	}
+	fn()
+}
+
+// storeQueryer is what the stores read the database with.
+type storeQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// storeReader returns what a store of ctx reads with: the transaction of its range, so the rows written by the stores
+// before it are seen and the single connection of a SQLite database is not waited for, or the database.
+func (p *Processor) storeReader(ctx context.Context) storeQueryer {
+	if r := rangeTx(ctx); r != nil {
+		return r.tx
+	}
+	return p.db
+}
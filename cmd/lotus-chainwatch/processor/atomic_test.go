@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestAtomicRangeRollsBackEveryPhase(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		f := newCARFixture(t)
+
+		node, err := NewCARNode(bytes.NewReader(f.car))
+		require.NoError(t, err)
+		p.node = node
+		p.Source = NewNodeSource(node)
+		p.AtomicRange = true
+		p.stateCache, err = newStateCache(100)
+		require.NoError(t, err)
+		seedAddresses(t, p.db, []address.Address{builtin.InitActorAddr, f.account})
+
+		actors, err := p.collectActorChanges(ctx, f.blocks)
+		require.NoError(t, err)
+
+		counts := func() []int {
+			return []int{
+				countRows(t, p.db, `select count(*) from id_address_map where address = $1`, f.robust.String()),
+				countRows(t, p.db, `select count(*) from actors`),
+				countRows(t, p.db, `select count(*) from actor_states`),
+				countRows(t, p.db, `select count(*) from processor_checkpoint`),
+			}
+		}
+		require.Equal(t, []int{0, 0, 0, 0}, counts())
+
+		// the balance deltas phase fails after the addresses, heads and states were written.
+		_, err = p.db.Exec(`alter table balance_deltas rename to balance_deltas_hidden`)
+		require.NoError(t, err)
+		hidden := true
+		t.Cleanup(func() {
+			if hidden {
+				_, _ = p.db.Exec(`alter table balance_deltas_hidden rename to balance_deltas`)
+			}
+		})
+
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "balance_deltas")
+		require.Equal(t, []int{0, 0, 0, 0}, counts())
+
+		_, err = p.db.Exec(`alter table balance_deltas_hidden rename to balance_deltas`)
+		require.NoError(t, err)
+		hidden = false
+
+		// the states of the rolled back range are not remembered as stored.
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.NoError(t, err)
+		stored := counts()
+		require.Equal(t, 1, stored[0])
+		require.NotZero(t, stored[1])
+		require.NotZero(t, stored[2])
+		require.Equal(t, 1, stored[3])
+	})
+}
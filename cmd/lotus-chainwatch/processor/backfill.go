@@ -0,0 +1,392 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// backfillHeights is the default number of heights collected and handed to the processor at a time during a backfill.
+const backfillHeights = 100
+
+// DefaultBackfillWorkers is the default number of backfill chunks processed concurrently.
+const DefaultBackfillWorkers = 4
+
+// DefaultShutdownGrace is the default time in flight backfill chunks are given to commit once the processor is closed
+// or the backfill context is cancelled.
+const DefaultShutdownGrace = 30 * time.Second
+
+// ErrProcessorClosed is returned by a backfill stopped by Close.
+var ErrProcessorClosed = xerrors.New("processor closed")
+
+// Close stops the backfills in progress. Chunks being processed are given ShutdownGrace to commit, as they are when
+// the context of the backfill is cancelled, nothing new is started, and the watermark of every backfill is left at its
+// last contiguously committed chunk so running the same backfill again resumes from there. A closed processor does not
+// backfill again.
+func (p *Processor) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh())
+	})
+}
+
+func (p *Processor) closeCh() chan struct{} {
+	p.closeInit.Do(func() {
+		p.closing = make(chan struct{})
+	})
+	return p.closing
+}
+
+// watermarks persists the progress of backfills.
+type watermarks interface {
+	// watermark returns the stored watermark of the backfill identified by key, ok is false if there is none.
+	watermark(key string) (h abi.ChainEpoch, ok bool, err error)
+	setWatermark(key string, h abi.ChainEpoch) error
+}
+
+// metaWatermarks keeps watermarks in chainwatch_meta.
+type metaWatermarks struct {
+	p *Processor
+}
+
+func (m metaWatermarks) watermark(key string) (abi.ChainEpoch, bool, error) {
+	v, ok, err := m.p.metaValue(key)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	h, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false, xerrors.Errorf("parse watermark %s: %w", key, err)
+	}
+	return abi.ChainEpoch(h), true, nil
+}
+
+func (m metaWatermarks) setWatermark(key string, h abi.ChainEpoch) error {
+	return m.p.setMeta(key, strconv.FormatInt(int64(h), 10))
+}
+
+func (p *Processor) watermarks() watermarks {
+	if p.marks == nil {
+		return metaWatermarks{p: p}
+	}
+	return p.marks
+}
+
+// backfillKey identifies the backfill of a processor over a range, the watermark is only reused by the same backfill.
+func backfillKey(name string, from, to abi.ChainEpoch) string {
+	return fmt.Sprintf("backfill/%s/%d-%d", name, from, to)
+}
+
+// backfillChunk is a run of consecutive heights of a backfill. Chunks are numbered in the order they are walked, from
+// the top of the range down.
+type backfillChunk struct {
+	seq    int
+	low    abi.ChainEpoch
+	blocks map[cid.Cid]*types.BlockHeader
+}
+
+// backfillProgress tracks the chunks of a backfill that committed. Chunks commit out of order when processed
+// concurrently, the watermark only moves down past chunks with no uncommitted chunk above them.
+type backfillProgress struct {
+	next      int
+	committed map[int]abi.ChainEpoch
+	mark      abi.ChainEpoch
+}
+
+func newBackfillProgress(mark abi.ChainEpoch) *backfillProgress {
+	return &backfillProgress{committed: map[int]abi.ChainEpoch{}, mark: mark}
+}
+
+// commit records that chunk seq, whose lowest height is low, committed. It returns true if the watermark moved.
+func (b *backfillProgress) commit(seq int, low abi.ChainEpoch) bool {
+	b.committed[seq] = low
+	moved := false
+	for {
+		low, ok := b.committed[b.next]
+		if !ok {
+			return moved
+		}
+		delete(b.committed, b.next)
+		b.next++
+		b.mark = low
+		moved = true
+	}
+}
+
+// BackfillProcessor runs the processor called name over the heights [from, to], for instance after enabling a processor
+// on a deployment that has already processed that range. Tipsets are read from the node rather than the blocks table
+// and only the tables of that processor are written, blocks are not marked processed again.
+//
+// The range is processed in chunks of BackfillHeights heights by BackfillWorkers workers. The lowest height such that
+// every height above it in the range committed is kept as the watermark of the backfill, running it again after it
+// was interrupted picks up below the watermark.
+func (p *Processor) BackfillProcessor(ctx context.Context, name string, from, to abi.ChainEpoch) error {
+	var proc *namedProcessor
+	for _, np := range p.processors() {
+		if np.name == name {
+			np := np
+			proc = &np
+			break
+		}
+	}
+	if proc == nil {
+		return xerrors.Errorf("unknown processor %q", name)
+	}
+	if from > to {
+		return xerrors.Errorf("invalid backfill range [%d, %d]", from, to)
+	}
+	// genesis has no parent to diff against, its state is stored by the genesis seed.
+	if from < 1 {
+		from = 1
+	}
+
+	key := backfillKey(name, from, to)
+	top := to
+	mark, ok, err := p.watermarks().watermark(key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if mark <= from {
+			p.logger().Infow("Processor already backfilled", "processor", name, "from", from, "to", to)
+			return nil
+		}
+		p.logger().Infow("Resuming backfill", "processor", name, "from", from, "to", to, "watermark", mark)
+		top = mark - 1
+	} else {
+		mark = to + 1
+	}
+
+	closing := p.closeCh()
+	select {
+	case <-closing:
+		return ErrProcessorClosed
+	default:
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Infow("Backfilled processor", "processor", name, "from", from, "to", to, "duration", time.Since(start).String())
+	}()
+
+	ts, err := p.node.ChainGetTipSetByHeight(ctx, top, types.EmptyTSK)
+	if err != nil {
+		return xerrors.Errorf("get tipset at %d: %w", top, err)
+	}
+
+	// in flight chunks run under workCtx so they can outlive a Close, or the cancellation of ctx, by the grace period.
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	halt := func() {
+		stopOnce.Do(func() {
+			close(stop)
+		})
+	}
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		case <-closing:
+			return true
+		default:
+			return false
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-closing:
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		halt()
+		grace := time.NewTimer(p.ShutdownGrace)
+		defer grace.Stop()
+		select {
+		case <-grace.C:
+			cancelWork()
+		case <-done:
+		}
+	}()
+
+	type chunkResult struct {
+		chunk backfillChunk
+		err   error
+	}
+
+	chunks := make(chan backfillChunk)
+	results := make(chan chunkResult)
+
+	workers := p.BackfillWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				// chunks handed over after a Close are dropped, only those already running get the grace period.
+				if stopped() {
+					continue
+				}
+				results <- chunkResult{chunk: c, err: p.backfillBatch(workCtx, proc, c.blocks)}
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		defer func() {
+			close(chunks)
+			wg.Wait()
+			close(results)
+		}()
+		walkErr = p.walkBackfill(ctx, ts, from, chunks, stop, closing)
+	}()
+
+	progress := newBackfillProgress(mark)
+	var chunkErr error
+	for r := range results {
+		if r.err != nil {
+			if chunkErr == nil {
+				chunkErr = r.err
+			}
+			halt()
+			continue
+		}
+		if progress.commit(r.chunk.seq, r.chunk.low) {
+			if err := p.watermarks().setWatermark(key, progress.mark); err != nil {
+				if chunkErr == nil {
+					chunkErr = err
+				}
+				halt()
+			}
+		}
+	}
+
+	select {
+	case <-closing:
+		p.logger().Infow("Backfill stopped by close", "processor", name, "watermark", progress.mark)
+		return ErrProcessorClosed
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		p.logger().Infow("Backfill cancelled", "processor", name, "watermark", progress.mark)
+		return err
+	}
+	if chunkErr != nil {
+		return chunkErr
+	}
+	if walkErr != nil {
+		return walkErr
+	}
+
+	// null rounds at the bottom of the range leave the last chunk above from.
+	return p.watermarks().setWatermark(key, from)
+}
+
+// walkBackfill walks from ts down to the height from, handing the blocks over in chunks until done or stopped.
+func (p *Processor) walkBackfill(ctx context.Context, ts *types.TipSet, from abi.ChainEpoch, chunks chan<- backfillChunk, stop, closing <-chan struct{}) error {
+	heights := p.BackfillHeights
+	if heights < 1 {
+		heights = backfillHeights
+	}
+
+	seq := 0
+	c := backfillChunk{blocks: map[cid.Cid]*types.BlockHeader{}}
+	send := func() bool {
+		if len(c.blocks) == 0 {
+			return true
+		}
+		c.seq = seq
+		select {
+		case chunks <- c:
+			seq++
+			c = backfillChunk{blocks: map[cid.Cid]*types.BlockHeader{}}
+			return true
+		case <-stop:
+			return false
+		case <-closing:
+			return false
+		}
+	}
+
+	n := 0
+	for ts.Height() >= from {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-closing:
+			return nil
+		default:
+		}
+
+		for _, bh := range ts.Blocks() {
+			c.blocks[bh.Cid()] = bh
+		}
+		c.low = ts.Height()
+		n++
+
+		if n == heights {
+			if !send() {
+				return nil
+			}
+			n = 0
+		}
+
+		if ts.Height() == 0 {
+			break
+		}
+		pts, err := p.Source.TipSet(ctx, ts.Parents())
+		if err != nil {
+			return xerrors.Errorf("get parent of tipset at %d: %w", ts.Height(), err)
+		}
+		ts = pts
+	}
+
+	send()
+	return nil
+}
+
+func (p *Processor) backfillBatch(ctx context.Context, proc *namedProcessor, blocks map[cid.Cid]*types.BlockHeader) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	if proc.stream != nil {
+		if err := p.streamActorChanges(ctx, blocks, proc.stream); err != nil {
+			return xerrors.Errorf("Failed to backfill %s: %w", proc.name, err)
+		}
+		return nil
+	}
+
+	actorChanges, err := p.collectActorChanges(ctx, blocks)
+	if err != nil {
+		return xerrors.Errorf("Failed to collect actor changes: %w", err)
+	}
+
+	if err := proc.run(ctx, actorChanges, blocks); err != nil {
+		return xerrors.Errorf("Failed to backfill %s: %w", proc.name, err)
+	}
+	return nil
+}
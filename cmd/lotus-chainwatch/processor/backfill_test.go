@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+type memWatermarks map[string]abi.ChainEpoch
+
+func (m memWatermarks) watermark(key string) (abi.ChainEpoch, bool, error) {
+	h, ok := m[key]
+	return h, ok, nil
+}
+
+func (m memWatermarks) setWatermark(key string, h abi.ChainEpoch) error {
+	m[key] = h
+	return nil
+}
+
+// backfillChain builds a chain of the given length above genesis where one account actor changes at every height.
+func backfillChain(t *testing.T, length int) (*testNode, *RecordedChain) {
+	node := newTestNode()
+	rec := &RecordedChain{}
+	addr := mock.Address(1000)
+
+	var parent *types.TipSet
+	for h := 0; h <= length; h++ {
+		blk := mock.MkBlock(parent, 1, 1)
+		blk.ParentStateRoot = testCid(t, fmt.Sprintf("stateroot-%d", h))
+		ts := mock.TipSet(blk)
+
+		if parent != nil {
+			rec.Changes = append(rec.Changes, RecordedChanges{
+				Old: parent.ParentState(),
+				New: blk.ParentStateRoot,
+				Actors: map[string]types.Actor{addr.String(): {
+					Code:    builtin.AccountActorCodeID,
+					Head:    testCid(t, fmt.Sprintf("head-%d", h)),
+					Nonce:   uint64(h),
+					Balance: types.NewInt(0),
+				}},
+			})
+			rec.States = append(rec.States, RecordedState{
+				Address: addr,
+				TipSet:  parent.Key(),
+				State:   api.ActorState{Balance: types.NewInt(0), State: map[string]interface{}{}},
+			})
+		}
+
+		node.addTipSet(ts)
+		rec.TipSets = append(rec.TipSets, ts)
+		parent = ts
+	}
+	return node, rec
+}
+
+func TestBackfillProcessor(t *testing.T) {
+	ctx := context.Background()
+	node, rec := backfillChain(t, 3)
+
+	p := &Processor{node: node, Source: newRecordedSource(rec), marks: memWatermarks{}}
+
+	// the processor is enabled after the chain was already processed.
+	rh := &recordingHandler{}
+	p.RegisterProcessor("accounts", []cid.Cid{builtin.AccountActorCodeID}, rh)
+
+	require.NoError(t, p.BackfillProcessor(ctx, "accounts", 2, 3))
+
+	// the changes of a tipset are keyed by its parent.
+	require.Len(t, rh.changes, 2)
+	for _, h := range []abi.ChainEpoch{1, 2} {
+		changes, ok := rh.changes[node.byHeight[h].Key()]
+		require.True(t, ok, "height %d", h)
+		require.Len(t, changes, 1)
+		require.Equal(t, testCid(t, fmt.Sprintf("stateroot-%d", h+1)), changes[0].StateRoot)
+	}
+
+	require.Error(t, p.BackfillProcessor(ctx, "unknown", 2, 3))
+}
+
+func TestBackfillProgress(t *testing.T) {
+	b := newBackfillProgress(11)
+
+	// chunk 1 commits before chunk 0, the watermark can't move past the uncommitted chunk above it.
+	require.False(t, b.commit(1, 6))
+	require.Equal(t, abi.ChainEpoch(11), b.mark)
+
+	require.True(t, b.commit(0, 9))
+	require.Equal(t, abi.ChainEpoch(6), b.mark)
+
+	require.False(t, b.commit(3, 1))
+	require.True(t, b.commit(2, 3))
+	require.Equal(t, abi.ChainEpoch(1), b.mark)
+}
+
+// closingHandler closes the processor, or calls cancel if set, while handling its closeAt-th batch. With block set it
+// holds on to that batch until its context is cancelled, otherwise the batch commits within the grace period.
+type closingHandler struct {
+	p       *Processor
+	cancel  context.CancelFunc
+	closeAt int
+	block   bool
+
+	lk      sync.Mutex
+	calls   int
+	heights []abi.ChainEpoch
+}
+
+func (h *closingHandler) Setup(db *sql.DB) error {
+	return nil
+}
+
+func (h *closingHandler) HandleActorChanges(ctx context.Context, pred *state.StatePredicates, db *sql.DB, changes map[types.TipSetKey][]ActorChange) error {
+	h.lk.Lock()
+	defer h.lk.Unlock()
+
+	h.calls++
+	if h.calls == h.closeAt {
+		if h.cancel != nil {
+			h.cancel()
+		} else {
+			h.p.Close()
+		}
+		if h.block {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+	}
+	for _, cs := range changes {
+		for _, c := range cs {
+			h.heights = append(h.heights, c.Height)
+		}
+	}
+	return nil
+}
+
+func TestBackfillCloseResumes(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name  string
+		block bool
+		// heights committed before the close and the watermark left behind.
+		committed []abi.ChainEpoch
+		mark      abi.ChainEpoch
+	}{
+		{name: "commits within grace", committed: []abi.ChainEpoch{6, 5}, mark: 5},
+		{name: "cancelled after grace", block: true, committed: []abi.ChainEpoch{6}, mark: 6},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			node, rec := backfillChain(t, 6)
+			marks := memWatermarks{}
+			newProcessor := func(h *closingHandler) *Processor {
+				p := &Processor{
+					node:            node,
+					Source:          newRecordedSource(rec),
+					marks:           marks,
+					BackfillWorkers: 1,
+					BackfillHeights: 1,
+					ShutdownGrace:   10 * time.Millisecond,
+				}
+				h.p = p
+				p.RegisterProcessor("accounts", []cid.Cid{builtin.AccountActorCodeID}, h)
+				return p
+			}
+
+			h := &closingHandler{closeAt: 2, block: tc.block}
+			p := newProcessor(h)
+			require.True(t, xerrors.Is(p.BackfillProcessor(ctx, "accounts", 1, 6), ErrProcessorClosed))
+			require.Equal(t, tc.committed, h.heights)
+			require.Equal(t, tc.mark, marks[backfillKey("accounts", 1, 6)])
+
+			// a closed processor doesn't start again, a new one resumes below the watermark.
+			require.True(t, xerrors.Is(p.BackfillProcessor(ctx, "accounts", 1, 6), ErrProcessorClosed))
+
+			resumed := &closingHandler{}
+			require.NoError(t, newProcessor(resumed).BackfillProcessor(ctx, "accounts", 1, 6))
+			var want []abi.ChainEpoch
+			for h := tc.mark - 1; h >= 1; h-- {
+				want = append(want, h)
+			}
+			require.Equal(t, want, resumed.heights)
+			require.Equal(t, abi.ChainEpoch(1), marks[backfillKey("accounts", 1, 6)])
+		})
+	}
+}
+
+func TestBackfillCancelGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node, rec := backfillChain(t, 6)
+	marks := memWatermarks{}
+	p := &Processor{
+		node:            node,
+		Source:          newRecordedSource(rec),
+		marks:           marks,
+		BackfillWorkers: 1,
+		BackfillHeights: 1,
+		ShutdownGrace:   time.Minute,
+	}
+	h := &closingHandler{p: p, cancel: cancel, closeAt: 2}
+	p.RegisterProcessor("accounts", []cid.Cid{builtin.AccountActorCodeID}, h)
+
+	// the batch in flight when the context is cancelled still commits, nothing is started after it.
+	require.True(t, xerrors.Is(p.BackfillProcessor(ctx, "accounts", 1, 6), context.Canceled))
+	require.Equal(t, []abi.ChainEpoch{6, 5}, h.heights)
+	require.Equal(t, abi.ChainEpoch(5), marks[backfillKey("accounts", 1, 6)])
+}
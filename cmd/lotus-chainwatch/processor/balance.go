@@ -0,0 +1,200 @@
+package processor
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// balanceDeltasTable is the definition of balance_deltas shared by both backends. delta and new_balance are encoded
+// like actors.balance.
+const balanceDeltasTable = `
+/* how the balance of an actor changed at each epoch it changed at */
+create table if not exists balance_deltas
+(
+	id text not null,
+	epoch bigint not null,
+	delta text not null,
+	new_balance text not null,
+	constraint balance_deltas_pk
+		primary key (id, epoch)
+)`
+
+// balanceDelta is a row of balance_deltas, along with the tipset the change was made on and its parent.
+type balanceDelta struct {
+	id      address.Address
+	epoch   abi.ChainEpoch
+	delta   big.Int
+	balance big.Int
+
+	tsKey       types.TipSetKey
+	parentTsKey types.TipSetKey
+}
+
+// storeBalanceDeltas writes how the balance of every actor in actors changed since its previous change. The balance an
+// actor held before its first change in the batch is read from the state that change was made on, so batches can be
+// stored in any order, as the chunks of a backfill are. An actor not in that state is created with its whole balance.
+func (p *Processor) storeBalanceDeltas(ctx context.Context, actors map[cid.Cid]ActorTips) (err error) {
+	start := time.Now()
+	var stored int
+	defer func() {
+		p.recordStore(ctx, "balance_deltas", start, stored, err)
+		p.logger().Debugw("Stored Balance Deltas", "duration", time.Since(start).String())
+	}()
+
+	ids, err := p.resolveIDs(ctx, actors)
+	if err != nil {
+		return xerrors.Errorf("resolve actor ID addresses: %w", err)
+	}
+
+	changes := balanceChanges(actors, ids)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	prev, err := p.prevBalances(ctx, changes)
+	if err != nil {
+		return err
+	}
+	deltas := balanceDeltas(changes, prev)
+
+	rows := make([][]interface{}, len(deltas))
+	for i, d := range deltas {
+		rows[i] = []interface{}{d.id.String(), d.epoch, d.delta.String(), d.balance.String()}
+	}
+	cols := []string{"id", "epoch", "delta", "new_balance"}
+
+	for _, b := range batchRanges(len(rows), p.BatchSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := rows[b[0]:b[1]]
+		if err := withRetry(ctx, func() error {
+			tx, err := p.beginStoreTx(ctx)
+			if err != nil {
+				return err
+			}
+			defer p.rollbackStoreTx(ctx, tx)
+
+			// a reorg replaces the balance an actor had at an epoch.
+			if err := p.bulkInserter(tx).BulkUpsert(ctx, "balance_deltas", cols, []string{"id", "epoch"}, "", batch); err != nil {
+				return xerrors.Errorf("balance delta put: %w", err)
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return p.commitStoreTx(ctx, tx)
+		}); err != nil {
+			return err
+		}
+		stored += len(batch)
+	}
+	return nil
+}
+
+// balanceChanges returns the balance of each actor in actors at every epoch it changed at, by ID address and epoch.
+// Actors whose ID is not known are left out, as are missing actors.
+func balanceChanges(actors map[cid.Cid]ActorTips, ids map[address.Address]address.Address) []balanceDelta {
+	seen := map[address.Address]map[abi.ChainEpoch]struct{}{}
+	var out []balanceDelta
+	for code, actTips := range actors {
+		for _, actorInfo := range actTips {
+			for _, a := range actorInfo {
+				if missingActor(code, a) {
+					continue
+				}
+				id, ok := ids[a.addr]
+				if !ok || id == address.Undef {
+					continue
+				}
+				if _, ok := seen[id][a.height]; ok {
+					continue
+				}
+				if seen[id] == nil {
+					seen[id] = map[abi.ChainEpoch]struct{}{}
+				}
+				seen[id][a.height] = struct{}{}
+				out = append(out, balanceDelta{id: id, epoch: a.height, balance: a.act.Balance, tsKey: a.tsKey, parentTsKey: a.parentTsKey})
+			}
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].id != out[j].id {
+			return out[i].id.String() < out[j].id.String()
+		}
+		return out[i].epoch < out[j].epoch
+	})
+	return out
+}
+
+// balanceDeltas sets the delta of each of changes, sorted by ID address and epoch, from the balance before it. prev holds
+// the balance of the actors changed before the first of their changes.
+func balanceDeltas(changes []balanceDelta, prev map[address.Address]big.Int) []balanceDelta {
+	out := make([]balanceDelta, len(changes))
+	for i, c := range changes {
+		before, ok := prev[c.id]
+		if i > 0 && changes[i-1].id == c.id {
+			before, ok = changes[i-1].balance, true
+		}
+		if !ok {
+			before = big.Zero()
+		}
+		c.delta = big.Sub(c.balance, before)
+		out[i] = c
+	}
+	return out
+}
+
+// prevBalances returns the balance each actor of changes held before the first of its changes, in the parent state of
+// the tipset the change was made on. Actors not in that state and actors changed at genesis are left out, they held
+// nothing before.
+func (p *Processor) prevBalances(ctx context.Context, changes []balanceDelta) (map[address.Address]big.Int, error) {
+	store := cw_util.NewAPIIpldStore(ctx, p.node)
+	trees := map[types.TipSetKey]*state.StateTree{}
+
+	out := map[address.Address]big.Int{}
+	for i, c := range changes {
+		if i > 0 && changes[i-1].id == c.id {
+			continue
+		}
+		if c.parentTsKey == types.EmptyTSK {
+			continue
+		}
+
+		st, ok := trees[c.tsKey]
+		if !ok {
+			ts, err := p.node.ChainGetTipSet(ctx, c.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("get tipset %s: %w", c.tsKey, err)
+			}
+			if st, err = state.LoadStateTree(store, ts.ParentState()); err != nil {
+				return nil, xerrors.Errorf("load state tree %s: %w", ts.ParentState(), err)
+			}
+			trees[c.tsKey] = st
+		}
+
+		act, err := st.GetActor(c.id)
+		if xerrors.Is(err, types.ErrActorNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("get previous actor %s (@ %s): %w", c.id, c.tsKey, err)
+		}
+		out[c.id] = act.Balance
+	}
+	return out, nil
+}
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// balanceTips returns the account actor at addr changing to its balance in history at each of epochs. The changes are
+// made on tipsets added to n whose parent state holds the balance of the actor's change before, or no actor below its
+// first change.
+func balanceTips(t *testing.T, n *testNode, addr address.Address, history map[abi.ChainEpoch]int64, epochs ...abi.ChainEpoch) map[cid.Cid]ActorTips {
+	ctx := context.Background()
+	parent := mock.TipSet(mock.MkBlock(nil, 1, 0))
+
+	tips := ActorTips{}
+	for _, epoch := range epochs {
+		st, err := state.NewStateTree(n.store)
+		require.NoError(t, err)
+		var prev abi.ChainEpoch = -1
+		for e := range history {
+			if e < epoch && e > prev {
+				prev = e
+			}
+		}
+		if prev >= 0 {
+			require.NoError(t, st.SetActor(addr, &types.Actor{
+				Code:    builtin.AccountActorCodeID,
+				Head:    testCid(t, fmt.Sprintf("head-%s-%d", addr, prev)),
+				Balance: big.NewInt(history[prev]),
+			}))
+		}
+		root, err := st.Flush(ctx)
+		require.NoError(t, err)
+
+		bh := mock.MkBlock(parent, 1, uint64(epoch))
+		bh.ParentStateRoot = root
+		ts := mock.TipSet(bh)
+		n.addTipSet(ts)
+
+		tips[ts.Key()] = append(tips[ts.Key()], actorInfo{
+			act: types.Actor{
+				Code:    builtin.AccountActorCodeID,
+				Head:    testCid(t, fmt.Sprintf("head-%s-%d", addr, epoch)),
+				Balance: big.NewInt(history[epoch]),
+			},
+			stateroot:   testCid(t, fmt.Sprintf("stateroot-%d", epoch)),
+			height:      epoch,
+			tsKey:       ts.Key(),
+			parentTsKey: parent.Key(),
+			addr:        addr,
+			state:       `{}`,
+		})
+	}
+	return map[cid.Cid]ActorTips{builtin.AccountActorCodeID: tips}
+}
+
+func TestBalanceDeltas(t *testing.T) {
+	a, b := mock.Address(1000), mock.Address(1001)
+	changes := []balanceDelta{
+		{id: a, epoch: 1, balance: big.NewInt(100)},
+		{id: a, epoch: 2, balance: big.NewInt(150)},
+		{id: a, epoch: 4, balance: big.NewInt(30)},
+		{id: b, epoch: 3, balance: big.NewInt(5)},
+	}
+
+	// a is created in the batch, b held 20 before it.
+	deltas := balanceDeltas(changes, map[address.Address]big.Int{b: big.NewInt(20)})
+	var got []string
+	for _, d := range deltas {
+		got = append(got, d.delta.String())
+	}
+	require.Equal(t, []string{"100", "50", "-120", "-15"}, got)
+	require.Equal(t, big.NewInt(30), deltas[2].balance)
+}
+
+func TestStoreBalanceDeltas(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		addr := mock.Address(1000)
+
+		n := newTestNode()
+		p.node = n
+		history := map[abi.ChainEpoch]int64{1: 100, 2: 150, 3: 30}
+
+		// the higher batch is stored first, as a backfill chunk can be, it still decreases from the balance before.
+		require.NoError(t, p.storeBalanceDeltas(ctx, balanceTips(t, n, addr, history, 3)))
+		// created, then increased.
+		require.NoError(t, p.storeBalanceDeltas(ctx, balanceTips(t, n, addr, history, 1, 2)))
+		// storing a batch again changes nothing.
+		require.NoError(t, p.storeBalanceDeltas(ctx, balanceTips(t, n, addr, history, 3)))
+
+		rows, err := p.db.Query(`select epoch, delta, new_balance from balance_deltas where id = $1 order by epoch`, addr.String())
+		require.NoError(t, err)
+		defer rows.Close() //nolint:errcheck
+
+		type delta struct {
+			epoch          int64
+			delta, balance string
+		}
+		var deltas []delta
+		for rows.Next() {
+			var d delta
+			require.NoError(t, rows.Scan(&d.epoch, &d.delta, &d.balance))
+			deltas = append(deltas, d)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t, []delta{
+			{1, "100", "100"},
+			{2, "50", "150"},
+			{3, "-120", "30"},
+		}, deltas)
+	})
+}
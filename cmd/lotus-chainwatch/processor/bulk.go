@@ -0,0 +1,207 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+// Backend is the database the processor writes to.
+type Backend int
+
+const (
+	// BackendPostgres writes with COPY through temporary tables, it is the default and fastest backend.
+	BackendPostgres Backend = iota
+	// BackendSQLite writes with batched inserts, for local analysis without standing up Postgres. Only the common
+	// actor tables are supported.
+	BackendSQLite
+)
+
+// BulkInserter writes rows to a table within a transaction.
+type BulkInserter interface {
+	// BulkInsert writes rows of cols to table, rows conflicting with stored ones are skipped.
+	BulkInsert(ctx context.Context, table string, cols []string, rows [][]interface{}) error
+	// BulkUpsert writes rows of cols to table, the stored rows conflicting on key are updated to the written ones. If
+	// newer names a column, a stored row is only updated by a written one whose newer is at least as high, or if the
+	// stored one has none.
+	BulkUpsert(ctx context.Context, table string, cols, key []string, newer string, rows [][]interface{}) error
+}
+
+// RowError is the failure to write one of the rows given to a BulkInserter.
+type RowError struct {
+	Table string
+	// Row is the index of the failed row in the rows written.
+	Row int
+	Err error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("%s row %d: %s", e.Table, e.Row, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// copyLine matches the context Postgres gives the errors raised by a row it copies, lines count from 1.
+var copyLine = regexp.MustCompile(`^COPY \S+, line (\d+)`)
+
+// copyRowError attributes err, returned while copying row, to the row it was raised by. The server reports a row it
+// rejects on a later write or when the copy is closed, with the row's line in the error context. Other server errors
+// can't be attributed, errors raised by the client are raised by row itself. row is negative once the rows are sent.
+func copyRowError(table string, row int, err error) error {
+	var pqErr *pq.Error
+	if xerrors.As(err, &pqErr) {
+		m := copyLine.FindStringSubmatch(pqErr.Where)
+		if m == nil {
+			return err
+		}
+		line, convErr := strconv.Atoi(m[1])
+		if convErr != nil {
+			return err
+		}
+		return &RowError{Table: table, Row: line - 1, Err: err}
+	}
+	if row < 0 {
+		return err
+	}
+	return &RowError{Table: table, Row: row, Err: err}
+}
+
+// bulkInserter returns the BulkInserter of the processor's backend writing within tx.
+func (p *Processor) bulkInserter(tx *sql.Tx) BulkInserter {
+	var bulk BulkInserter = &copyInserter{tx: tx}
+	if p.Backend == BackendSQLite {
+		bulk = &sqliteInserter{tx: tx}
+	}
+	if p.DryRun {
+		return &dryRunInserter{BulkInserter: bulk}
+	}
+	return bulk
+}
+
+// dryRunSampleRows is the number of rows of every write logged at debug level in a DryRun.
+const dryRunSampleRows = 3
+
+// dryRunInserter logs the writes of a DryRun, it still writes them so they are checked by the database before the
+// transaction is rolled back.
+type dryRunInserter struct {
+	BulkInserter
+}
+
+func (d *dryRunInserter) BulkInsert(ctx context.Context, table string, cols []string, rows [][]interface{}) error {
+	d.log(table, cols, rows)
+	return d.BulkInserter.BulkInsert(ctx, table, cols, rows)
+}
+
+func (d *dryRunInserter) BulkUpsert(ctx context.Context, table string, cols, key []string, newer string, rows [][]interface{}) error {
+	d.log(table, cols, rows)
+	return d.BulkInserter.BulkUpsert(ctx, table, cols, key, newer, rows)
+}
+
+func (d *dryRunInserter) log(table string, cols []string, rows [][]interface{}) {
+	log.Infow("Dry run write", "table", table, "rows", len(rows))
+	for i := 0; i < len(rows) && i < dryRunSampleRows; i++ {
+		log.Debugw("Dry run row", "table", table, "columns", cols, "row", rows[i])
+	}
+}
+
+// upsertConflict is the conflict clause replacing every column of cols not in key of the stored row of table, unless
+// newer names a column the stored row holds a higher value of. Both backends share its syntax.
+func upsertConflict(table string, cols, key []string, newer string) string {
+	isKey := map[string]bool{}
+	for _, k := range key {
+		isKey[k] = true
+	}
+
+	var set []string
+	for _, c := range cols {
+		if !isKey[c] {
+			set = append(set, c+"=excluded."+c)
+		}
+	}
+	conflict := "(" + strings.Join(key, ", ") + ") do update set " + strings.Join(set, ", ")
+	if newer != "" {
+		conflict += " where " + table + "." + newer + " is null or excluded." + newer + " >= " + table + "." + newer
+	}
+	return conflict
+}
+
+// copyInserter copies rows into a temporary table and inserts them from there, resolving conflicts in a single
+// statement.
+type copyInserter struct {
+	tx *sql.Tx
+}
+
+func (c *copyInserter) BulkInsert(ctx context.Context, table string, cols []string, rows [][]interface{}) error {
+	return c.insert(ctx, table, cols, rows, "do nothing")
+}
+
+func (c *copyInserter) BulkUpsert(ctx context.Context, table string, cols, key []string, newer string, rows [][]interface{}) error {
+	return c.insert(ctx, table, cols, rows, upsertConflict(table, cols, key, newer))
+}
+
+// tempTableSeq numbers the temporary tables copied into, so writes in the same session never share one.
+var tempTableSeq uint64
+
+func (c *copyInserter) insert(ctx context.Context, table string, cols []string, rows [][]interface{}, conflict string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	tmp, err := c.copyToTemp(ctx, table, cols, rows)
+	if err != nil {
+		return err
+	}
+	return c.insertFromTemp(ctx, tmp, table, cols, conflict)
+}
+
+// copyToTemp copies rows into a temporary table of its own, dropped on commit, and returns its name.
+func (c *copyInserter) copyToTemp(ctx context.Context, table string, cols []string, rows [][]interface{}) (string, error) {
+	tmp := fmt.Sprintf("bulk_%s_%d", table, atomic.AddUint64(&tempTableSeq, 1))
+	if _, err := c.tx.ExecContext(ctx, `create temp table `+tmp+` (like `+table+` excluding constraints) on commit drop`); err != nil {
+		return "", xerrors.Errorf("prep %s temp: %w", table, err)
+	}
+
+	stmt, err := c.tx.Prepare(pq.CopyIn(tmp, cols...))
+	if err != nil {
+		return "", xerrors.Errorf("prepare tmp %s: %w", table, err)
+	}
+
+	for i, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return "", copyRowError(table, i, err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return "", xerrors.Errorf("close prepared %s: %w", table, copyRowError(table, -1, err))
+	}
+	return tmp, nil
+}
+
+// insertFromTemp inserts the rows copied to tmp into table and drops tmp.
+func (c *copyInserter) insertFromTemp(ctx context.Context, tmp, table string, cols []string, conflict string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// insert in a consistent order so concurrent writers acquire the index locks in the same order.
+	list := strings.Join(cols, ", ")
+	if _, err := c.tx.ExecContext(ctx, `insert into `+table+` (`+list+`) select `+list+` from `+tmp+` order by `+cols[0]+` on conflict `+conflict); err != nil {
+		return xerrors.Errorf("insert %s from tmp: %w", table, err)
+	}
+
+	// the temporary tables otherwise pile up until the transaction commits.
+	if _, err := c.tx.ExecContext(ctx, `drop table `+tmp); err != nil {
+		return xerrors.Errorf("drop %s temp: %w", table, err)
+	}
+	return nil
+}
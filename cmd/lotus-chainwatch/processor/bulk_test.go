@@ -0,0 +1,241 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+// testSQLiteDB returns an in-memory SQLite database with the common actor tables created.
+func testSQLiteDB(tb testing.TB) *sql.DB {
+	db, err := openSQLite(":memory:")
+	if xerrors.Is(err, errNoSQLite) {
+		tb.Skip("built without the sqlite build tag")
+	}
+	require.NoError(tb, err)
+	tb.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	p := &Processor{db: db, Backend: BackendSQLite}
+	require.NoError(tb, p.setupCommonActors())
+	return db
+}
+
+// testSQLiteDSN returns the DSN of a SQLite database file in a directory removed once the test is done.
+func testSQLiteDSN(t *testing.T) string {
+	if _, err := openSQLite(":memory:"); xerrors.Is(err, errNoSQLite) {
+		t.Skip("built without the sqlite build tag")
+	}
+	dir, err := ioutil.TempDir("", "chainwatch-processor-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return SQLiteScheme + filepath.Join(dir, "chainwatch.db")
+}
+
+// testBackends runs the test against a processor writing to each backend, the Postgres one is skipped unless
+// LOTUS_CHAINWATCH_TEST_DB is set.
+func testBackends(t *testing.T, test func(t *testing.T, p *Processor)) {
+	t.Run("postgres", func(t *testing.T) {
+		test(t, &Processor{db: testDB(t)})
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, &Processor{db: testSQLiteDB(t), Backend: BackendSQLite})
+	})
+}
+
+func countRows(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	var n int
+	require.NoError(t, db.QueryRow(query, args...).Scan(&n))
+	return n
+}
+
+func TestStoreCommonActorsBackends(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		actors, addrs := syntheticActorTips(t, 3, 2)
+		known, err := address.NewActorAddress([]byte("known"))
+		require.NoError(t, err)
+		require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{known: addrs[0], addrs[1]: addrs[1]}))
+
+		// the first actor changes under its robust address, it is stored under its ID.
+		for _, tips := range actors {
+			for _, infos := range tips {
+				for i := range infos {
+					if infos[i].addr == addrs[0] {
+						infos[i].addr = known
+					}
+				}
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, p.storeActorHeads(ctx, actors))
+			require.NoError(t, p.storeActorStates(ctx, actors))
+		}
+
+		require.Equal(t, 2, countRows(t, p.db, `select count(*) from id_address_map`))
+		require.Equal(t, 6, countRows(t, p.db, `select count(*) from actors`))
+		require.Equal(t, 3, countRows(t, p.db, `select count(*) from actors where id = $1`, addrs[0].String()))
+		require.Equal(t, 6, countRows(t, p.db, `select count(*) from actor_states`))
+
+		// a reorg assigned the ID to another robust address.
+		moved, err := address.NewActorAddress([]byte("moved"))
+		require.NoError(t, err)
+		require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{moved: addrs[0], addrs[1]: addrs[1]}))
+
+		var stored string
+		require.NoError(t, p.db.QueryRow(`select address from id_address_map where id = $1`, addrs[0].String()).Scan(&stored))
+		require.Equal(t, moved.String(), stored)
+		require.Equal(t, 2, countRows(t, p.db, `select count(*) from id_address_map`))
+	})
+}
+
+func TestStoreActorHeadsLatestBackends(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		p.Mode = ModeLatest
+		require.NoError(t, p.setupCommonActors())
+		t.Cleanup(func() {
+			_, _ = p.db.Exec(`drop index if exists actors_id_uindex`)
+		})
+
+		actors, addrs := syntheticActorTips(t, 3, 2)
+		heightsFromNonces(actors)
+		seedAddresses(t, p.db, addrs)
+
+		require.NoError(t, p.storeActorHeads(ctx, actors))
+		require.NoError(t, p.storeActorHeads(ctx, actors))
+
+		require.Equal(t, 2, countRows(t, p.db, `select count(*) from actors`))
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from actors where id = $1 and nonce = 2`, addrs[0].String()))
+
+		// an older epoch written second does not replace the latest head.
+		older, _ := syntheticActorTips(t, 1, 2)
+		heightsFromNonces(older)
+		require.NoError(t, p.storeActorHeads(ctx, older))
+		require.Equal(t, 2, countRows(t, p.db, `select count(*) from actors`))
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from actors where id = $1 and nonce = 2 and epoch = 2`, addrs[0].String()))
+	})
+}
+
+func TestCopyTempTablesDoNotCollide(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	_, addrs := syntheticActorTips(t, 1, 2)
+	seedAddresses(t, db, addrs)
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback() //nolint:errcheck
+
+	// two writes of the same table copied in the session before either inserts.
+	c := &copyInserter{tx: tx}
+	cols := []string{"id", "code", "head", "nonce", "balance", "stateroot"}
+	var tmps []string
+	for i, addr := range addrs {
+		tmp, err := c.copyToTemp(ctx, "actors", cols, [][]interface{}{
+			{addr.String(), builtin.AccountActorCodeID.String(), testCid(t, fmt.Sprintf("head-%d", i)).String(), i, "0", testCid(t, "stateroot").String()},
+		})
+		require.NoError(t, err)
+		tmps = append(tmps, tmp)
+	}
+	require.NotEqual(t, tmps[0], tmps[1])
+	for _, tmp := range tmps {
+		require.NoError(t, c.insertFromTemp(ctx, tmp, "actors", cols, "do nothing"))
+	}
+	require.NoError(t, tx.Commit())
+
+	require.Equal(t, 2, countRows(t, db, `select count(*) from actors`))
+}
+
+func TestCopyRowError(t *testing.T) {
+	clientErr := xerrors.New("unsupported type")
+	err := copyRowError("actors", 3, clientErr)
+	var re *RowError
+	require.True(t, xerrors.As(err, &re))
+	require.Equal(t, 3, re.Row)
+	require.True(t, xerrors.Is(err, clientErr))
+
+	// the server names the line of the row it rejected, it is not the row being sent.
+	err = copyRowError("actors", 3, &pq.Error{Code: "22P02", Where: "COPY bulk_actors_1, line 2, column nonce: \"x\""})
+	require.True(t, xerrors.As(err, &re))
+	require.Equal(t, 1, re.Row)
+
+	// other server errors can't be attributed.
+	serverErr := &pq.Error{Code: "08006"}
+	require.Equal(t, error(serverErr), copyRowError("actors", 3, serverErr))
+	require.Equal(t, clientErr, copyRowError("actors", -1, clientErr))
+}
+
+func TestStoreErrorsIdentifyRow(t *testing.T) {
+	ctx := context.Background()
+	actors, addrs := syntheticActorTips(t, 1, 2)
+	bad := addrs[1]
+	var badHead string
+	for _, tips := range actors {
+		for _, infos := range tips {
+			badHead = infos[1].act.Head.String()
+		}
+	}
+
+	for _, tc := range []struct {
+		table string
+		store func(p *Processor) error
+		// the value of the first column of the bad row.
+		key  string
+		want []string
+	}{
+		{
+			table: "actors",
+			store: func(p *Processor) error { return p.storeActorHeads(ctx, actors) },
+			key:   bad.String(),
+			want:  []string{bad.String(), builtin.AccountActorCodeID.String(), testCid(t, "stateroot-0").String()},
+		},
+		{
+			table: "actor_states",
+			store: func(p *Processor) error { return p.storeActorStates(ctx, actors) },
+			key:   badHead,
+			want:  []string{badHead, builtin.AccountActorCodeID.String()},
+		},
+		{
+			table: "id_address_map",
+			store: func(p *Processor) error {
+				return p.storeAddressMap(ctx, map[address.Address]address.Address{addrs[0]: addrs[0], bad: bad})
+			},
+			key:  bad.String(),
+			want: []string{bad.String()},
+		},
+	} {
+		fake := &flakyDB{execErr: func(args []driver.Value) error {
+			if len(args) > 0 && args[0] == tc.key {
+				return xerrors.New("unsupported value")
+			}
+			return nil
+		}}
+		err := tc.store(&Processor{db: sql.OpenDB(fake)})
+		require.Error(t, err, tc.table)
+
+		var re *RowError
+		require.True(t, xerrors.As(err, &re), tc.table)
+		for _, s := range tc.want {
+			require.Contains(t, err.Error(), s, tc.table)
+		}
+	}
+}
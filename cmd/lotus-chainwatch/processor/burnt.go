@@ -0,0 +1,93 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+// burntFundsSchema creates burnt_funds, the balance of the burnt funds actor at every epoch it changed at, so the
+// amount burnt over time is read without scanning actors. The balance is encoded like actors.balance.
+func (p *Processor) burntFundsSchema(tx *sql.Tx) error {
+	balance := "numeric"
+	if p.Backend == BackendSQLite {
+		balance = "text"
+	}
+
+	_, err := tx.Exec(`
+create table if not exists burnt_funds
+(
+	epoch bigint not null
+		constraint burnt_funds_pk
+			primary key,
+	balance ` + balance + ` not null
+)`)
+	return err
+}
+
+// storeBurntFunds writes the balance of the burnt funds actor at every epoch of actors it changed at. A fork changing
+// it at an epoch already stored leaves the stored balance as it is.
+func (p *Processor) storeBurntFunds(ctx context.Context, actors map[cid.Cid]ActorTips) (err error) {
+	start := time.Now()
+	var stored int
+	defer func() {
+		p.recordStore(ctx, "burnt_funds", start, stored, err)
+		p.logger().Debugw("Stored Burnt Funds", "duration", time.Since(start).String())
+	}()
+
+	balances := map[abi.ChainEpoch]string{}
+	for _, infos := range actors[builtin.AccountActorCodeID] {
+		for _, a := range infos {
+			if a.addr != builtin.BurntFundsActorAddr || missingActor(builtin.AccountActorCodeID, a) {
+				continue
+			}
+			if _, ok := balances[a.height]; ok {
+				continue
+			}
+			balance, err := dbBalance(a.act.Balance)
+			if err != nil {
+				return xerrors.Errorf("burnt funds balance at %d: %w", a.height, err)
+			}
+			balances[a.height] = balance
+		}
+	}
+	if len(balances) == 0 {
+		return nil
+	}
+
+	rows := make([][]interface{}, 0, len(balances))
+	for epoch, balance := range balances {
+		rows = append(rows, []interface{}{int64(epoch), balance})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i][0].(int64) < rows[j][0].(int64)
+	})
+
+	if err := withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "burnt_funds", []string{"epoch", "balance"}, rows); err != nil {
+			return xerrors.Errorf("burnt funds put: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	}); err != nil {
+		return err
+	}
+	stored = len(rows)
+	return nil
+}
@@ -0,0 +1,69 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// burntFundsTips returns the changes of the burnt funds actor to each balance, at epochs from 10, in tipsets named
+// after prefix. Every tipset also changes another account.
+func burntFundsTips(t *testing.T, prefix string, balances ...uint64) map[cid.Cid]ActorTips {
+	tips := ActorTips{}
+	for i, balance := range balances {
+		tsKey := types.NewTipSetKey(testCid(t, fmt.Sprintf("%s-%d", prefix, i)))
+		info := actorInfo{
+			act: types.Actor{
+				Code:    builtin.AccountActorCodeID,
+				Head:    testCid(t, fmt.Sprintf("burnt-head-%s-%d", prefix, i)),
+				Balance: types.NewInt(balance),
+			},
+			stateroot: testCid(t, fmt.Sprintf("stateroot-%s-%d", prefix, i)),
+			height:    abi.ChainEpoch(10 + i),
+			tsKey:     tsKey,
+			addr:      builtin.BurntFundsActorAddr,
+		}
+		other := info
+		other.addr = builtin.InitActorAddr
+		other.act.Balance = types.NewInt(1)
+		tips[tsKey] = []actorInfo{info, other}
+	}
+	return map[cid.Cid]ActorTips{builtin.AccountActorCodeID: tips}
+}
+
+func TestStoreBurntFunds(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		series := func() []string {
+			rows, err := p.db.Query(`select epoch, balance from burnt_funds order by epoch`)
+			require.NoError(t, err)
+			defer rows.Close() //nolint:errcheck
+
+			var out []string
+			for rows.Next() {
+				var epoch int64
+				var balance string
+				require.NoError(t, rows.Scan(&epoch, &balance))
+				out = append(out, fmt.Sprintf("%d:%s", epoch, balance))
+			}
+			require.NoError(t, rows.Err())
+			return out
+		}
+
+		require.NoError(t, p.storeBurntFunds(ctx, burntFundsTips(t, "block", 100, 150, 175)))
+		require.Equal(t, []string{"10:100", "11:150", "12:175"}, series())
+
+		// a fork at the stored epochs keeps the first balance stored, a later epoch is added.
+		require.NoError(t, p.storeBurntFunds(ctx, burntFundsTips(t, "fork", 100, 160, 180, 200)))
+		require.Equal(t, []string{"10:100", "11:150", "12:175", "13:200"}, series())
+	})
+}
@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// canonicalJSON re-encodes a JSON document so that semantically equal documents are byte identical: object keys are
+// sorted, insignificant whitespace is dropped and numbers are written in a single form. Integers keep their full
+// precision, other numbers are written in the shortest form that round trips a float64.
+func canonicalJSON(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, xerrors.Errorf("decode state json: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			kb, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			buf.Write(kb)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		n, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(n)
+	default:
+		// strings, booleans and null have a single encoding.
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+func canonicalNumber(n json.Number) (string, error) {
+	if i, ok := new(big.Int).SetString(n.String(), 10); ok {
+		return i.String(), nil
+	}
+
+	// integral values written with a fraction or exponent, such as 1.0 or 1e3, are written as integers.
+	f, _, err := big.ParseFloat(n.String(), 10, 256, big.ToNearestEven)
+	if err != nil {
+		return "", xerrors.Errorf("parse number %s: %w", n, err)
+	}
+	if f.IsInt() {
+		i, _ := f.Int(nil)
+		return i.String(), nil
+	}
+	f64, _ := f.Float64()
+	return strconv.FormatFloat(f64, 'g', -1, 64), nil
+}
+
+// hashState returns the sha256 of the canonical encoding of a JSON state.
+func hashState(raw []byte) ([sha256.Size]byte, error) {
+	c, err := canonicalJSON(raw)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(c), nil
+}
+
+// encodeState serializes a decoded actor state for the actor_states state column.
+func (p *Processor) encodeState(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if p.CanonicalStateJSON {
+		if b, err = canonicalJSON(b); err != nil {
+			return "", err
+		}
+	}
+	return string(b), nil
+}
@@ -0,0 +1,31 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	c, err := canonicalJSON([]byte(`{ "b": 1.0, "a": [1e3, "x", null, true], "c": {"z": 12345678901234567890123, "y": 0.5} }`))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":[1000,"x",null,true],"b":1,"c":{"y":0.5,"z":12345678901234567890123}}`, string(c))
+}
+
+func TestHashStateSemanticallyEqual(t *testing.T) {
+	a, err := hashState([]byte(`{"Balance":"100","Nonce":1,"Signers":["t01000","t01001"]}`))
+	require.NoError(t, err)
+
+	b, err := hashState([]byte(`{
+  "Signers": ["t01000", "t01001"],
+  "Nonce": 1.0,
+  "Balance": "100"
+}`))
+	require.NoError(t, err)
+	require.Equal(t, a, b)
+
+	// order within arrays is significant.
+	c, err := hashState([]byte(`{"Balance":"100","Nonce":1,"Signers":["t01001","t01000"]}`))
+	require.NoError(t, err)
+	require.NotEqual(t, a, c)
+}
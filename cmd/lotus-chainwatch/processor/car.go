@@ -0,0 +1,400 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/go-hamt-ipld"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	cbor "github.com/ipfs/go-ipld-cbor"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	_init "github.com/filecoin-project/specs-actors/actors/builtin/init"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/store"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/vm"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
+)
+
+// CARNode is a Node reading an exported chain from a CAR file instead of a live node, so the processor can be run
+// offline and reproducibly. The chain is the one ending at the roots of the CAR, down to genesis or to the first
+// tipset whose parents it does not contain.
+//
+// Nothing is executed: the state after a tipset is the parent state of its child, read from the state trees in the
+// CAR, which must hold the ones of the tipsets processed (lotus chain export only writes the genesis state). The state
+// after the head cannot be read, the state queries for types.EmptyTSK read the newest state there is instead. The
+// deals, sectors and message pool are not supported, the market and miner processors must be disabled.
+type CARNode struct {
+	cs  *store.ChainStore
+	bs  blockstore.Blockstore
+	cst cbor.IpldStore
+
+	head    *types.TipSet
+	genesis *types.TipSet
+	// states is the state root after executing each tipset of the chain but the head.
+	states map[types.TipSetKey]cid.Cid
+}
+
+var _ Node = (*CARNode)(nil)
+
+// OpenCARNode imports the CAR file at path into memory and returns a CARNode reading from it.
+func OpenCARNode(path string) (*CARNode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("open car: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	return NewCARNode(f)
+}
+
+// NewCARNode imports the CAR read from r into memory and returns a CARNode reading from it.
+func NewCARNode(r io.Reader) (*CARNode, error) {
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	cs := store.NewChainStore(bs, dssync.MutexWrap(datastore.NewMapDatastore()), nil)
+
+	head, err := cs.Import(r)
+	if err != nil {
+		return nil, xerrors.Errorf("import car: %w", err)
+	}
+
+	n := &CARNode{
+		cs:     cs,
+		bs:     bs,
+		cst:    cbor.NewCborStore(bs),
+		head:   head,
+		states: map[types.TipSetKey]cid.Cid{},
+	}
+
+	ts := head
+	for ts.Height() > 0 {
+		pts, err := cs.LoadTipSet(ts.Parents())
+		if xerrors.Is(err, blockstore.ErrNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("load parents of %s: %w", ts.Key(), err)
+		}
+		n.states[pts.Key()] = ts.ParentState()
+		ts = pts
+	}
+	if ts.Height() == 0 {
+		n.genesis = ts
+	}
+
+	log.Infow("Opened CAR node", "head", head.Height(), "tail", ts.Height(), "tipsets", len(n.states)+1)
+	return n, nil
+}
+
+// tipSet returns the tipset of tsk, the head for types.EmptyTSK as a node does.
+func (n *CARNode) tipSet(tsk types.TipSetKey) (*types.TipSet, error) {
+	if tsk == types.EmptyTSK {
+		return n.head, nil
+	}
+	ts, err := n.cs.LoadTipSet(tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("loading tipset %s: %w", tsk, err)
+	}
+	return ts, nil
+}
+
+// stateRoot returns the state root after executing the tipset of tsk. The head was not executed, the newest state the
+// CAR holds is returned for types.EmptyTSK instead, the state after the parents of the head.
+func (n *CARNode) stateRoot(tsk types.TipSetKey) (cid.Cid, error) {
+	if tsk == types.EmptyTSK {
+		return n.head.ParentState(), nil
+	}
+	ts, err := n.tipSet(tsk)
+	if err != nil {
+		return cid.Undef, err
+	}
+	root, ok := n.states[ts.Key()]
+	if !ok {
+		return cid.Undef, xerrors.Errorf("state after tipset %s at height %d is not in the car", ts.Key(), ts.Height())
+	}
+	return root, nil
+}
+
+// stateTree returns the state tree after executing the tipset of tsk.
+func (n *CARNode) stateTree(tsk types.TipSetKey) (*state.StateTree, error) {
+	root, err := n.stateRoot(tsk)
+	if err != nil {
+		return nil, err
+	}
+	st, err := state.LoadStateTree(n.cst, root)
+	if err != nil {
+		return nil, xerrors.Errorf("load state tree %s: %w", root, err)
+	}
+	return st, nil
+}
+
+func (n *CARNode) ChainHead(context.Context) (*types.TipSet, error) {
+	return n.head, nil
+}
+
+func (n *CARNode) ChainGetGenesis(context.Context) (*types.TipSet, error) {
+	if n.genesis == nil {
+		return nil, xerrors.Errorf("car does not contain the chain down to genesis")
+	}
+	return n.genesis, nil
+}
+
+func (n *CARNode) ChainGetBlock(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	return n.cs.GetBlock(c)
+}
+
+func (n *CARNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	return n.cs.LoadTipSet(tsk)
+}
+
+func (n *CARNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, err := n.tipSet(tsk)
+	if err != nil {
+		return nil, err
+	}
+	return n.cs.GetTipsetByHeight(ctx, h, ts, true)
+}
+
+func (n *CARNode) ChainGetBlockMessages(ctx context.Context, blockCid cid.Cid) (*api.BlockMessages, error) {
+	b, err := n.cs.GetBlock(blockCid)
+	if err != nil {
+		return nil, err
+	}
+
+	bmsgs, smsgs, err := n.cs.MessagesForBlock(b)
+	if err != nil {
+		return nil, err
+	}
+
+	cids := make([]cid.Cid, len(bmsgs)+len(smsgs))
+	for i, m := range bmsgs {
+		cids[i] = m.Cid()
+	}
+	for i, m := range smsgs {
+		cids[i+len(bmsgs)] = m.Cid()
+	}
+
+	return &api.BlockMessages{
+		BlsMessages:   bmsgs,
+		SecpkMessages: smsgs,
+		Cids:          cids,
+	}, nil
+}
+
+// parentMessages returns the block of blockCid and the messages of its parent tipset, nil for genesis.
+func (n *CARNode) parentMessages(blockCid cid.Cid) (*types.BlockHeader, []types.ChainMsg, error) {
+	b, err := n.cs.GetBlock(blockCid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b.Height == 0 {
+		return b, nil, nil
+	}
+
+	pts, err := n.cs.LoadTipSet(types.NewTipSetKey(b.Parents...))
+	if err != nil {
+		return nil, nil, err
+	}
+	cm, err := n.cs.MessagesForTipset(pts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, cm, nil
+}
+
+func (n *CARNode) ChainGetParentReceipts(ctx context.Context, blockCid cid.Cid) ([]*types.MessageReceipt, error) {
+	b, cm, err := n.parentMessages(blockCid)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*types.MessageReceipt
+	for i := range cm {
+		r, err := n.cs.GetParentReceipt(b, i)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func (n *CARNode) ChainGetParentMessages(ctx context.Context, blockCid cid.Cid) ([]api.Message, error) {
+	_, cm, err := n.parentMessages(blockCid)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []api.Message
+	for _, m := range cm {
+		out = append(out, api.Message{
+			Cid:     m.Cid(),
+			Message: m.VMMessage(),
+		})
+	}
+	return out, nil
+}
+
+func (n *CARNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	blk, err := n.bs.Get(c)
+	if err != nil {
+		return nil, xerrors.Errorf("blockstore get: %w", err)
+	}
+	return blk.RawData(), nil
+}
+
+func (n *CARNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	return n.bs.Has(c)
+}
+
+func (n *CARNode) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	st, err := n.stateTree(tsk)
+	if err != nil {
+		return nil, err
+	}
+	return st.GetActor(actor)
+}
+
+func (n *CARNode) StateReadState(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	act, err := n.StateGetActor(ctx, actor, tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, err := n.bs.Get(act.Head)
+	if err != nil {
+		return nil, err
+	}
+
+	oif, err := vm.DumpActorState(act.Code, blk.RawData())
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.ActorState{
+		Balance: act.Balance,
+		State:   oif,
+	}, nil
+}
+
+func (n *CARNode) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	st, err := n.stateTree(tsk)
+	if err != nil {
+		return address.Undef, err
+	}
+	return st.LookupID(addr)
+}
+
+func (n *CARNode) StateListActors(ctx context.Context, tsk types.TipSetKey) ([]address.Address, error) {
+	root, err := n.stateRoot(tsk)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := hamt.LoadNode(ctx, n.cst, root, hamt.UseTreeBitWidth(5))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []address.Address
+	err = r.ForEach(ctx, func(k string, val interface{}) error {
+		addr, err := address.NewFromBytes([]byte(k))
+		if err != nil {
+			return xerrors.Errorf("address in state tree was not valid: %w", err)
+		}
+		out = append(out, addr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (n *CARNode) StateChangedActors(ctx context.Context, old cid.Cid, new cid.Cid) (map[string]types.Actor, error) {
+	nh, err := hamt.LoadNode(ctx, n.cst, new, hamt.UseTreeBitWidth(5))
+	if err != nil {
+		return nil, err
+	}
+
+	oh, err := hamt.LoadNode(ctx, n.cst, old, hamt.UseTreeBitWidth(5))
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]types.Actor{}
+	err = nh.ForEach(ctx, func(k string, nval interface{}) error {
+		ncval := nval.(*cbg.Deferred)
+		var act types.Actor
+
+		var ocval cbg.Deferred
+		switch err := oh.Find(ctx, k, &ocval); err {
+		case nil:
+			if bytes.Equal(ocval.Raw, ncval.Raw) {
+				return nil // not changed
+			}
+			fallthrough
+		case hamt.ErrNotFound:
+			if err := act.UnmarshalCBOR(bytes.NewReader(ncval.Raw)); err != nil {
+				return err
+			}
+
+			addr, err := address.NewFromBytes([]byte(k))
+			if err != nil {
+				return xerrors.Errorf("address in state tree was not valid: %w", err)
+			}
+
+			out[addr.String()] = act
+		default:
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StateNetworkName reads the network name from the init actor as of the parent state of the head, as a node does.
+func (n *CARNode) StateNetworkName(ctx context.Context) (dtypes.NetworkName, error) {
+	st, err := state.LoadStateTree(n.cst, n.head.ParentState())
+	if err != nil {
+		return "", xerrors.Errorf("load state tree: %w", err)
+	}
+	act, err := st.GetActor(builtin.InitActorAddr)
+	if err != nil {
+		return "", xerrors.Errorf("get init actor: %w", err)
+	}
+
+	var ist _init.State
+	if err := n.cst.Get(ctx, act.Head, &ist); err != nil {
+		return "", xerrors.Errorf("load init actor state: %w", err)
+	}
+	return dtypes.NetworkName(ist.NetworkName), nil
+}
+
+func (n *CARNode) StateMarketDeals(context.Context, types.TipSetKey) (map[string]api.MarketDeal, error) {
+	return nil, xerrors.Errorf("market deals are not supported by a car node")
+}
+
+func (n *CARNode) StateMinerSectors(context.Context, address.Address, *abi.BitField, bool, types.TipSetKey) ([]*api.ChainSectorInfo, error) {
+	return nil, xerrors.Errorf("miner sectors are not supported by a car node")
+}
+
+func (n *CARNode) MpoolSub(context.Context) (<-chan api.MpoolUpdate, error) {
+	return nil, xerrors.Errorf("the message pool is not supported by a car node")
+}
@@ -0,0 +1,237 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/ipld/go-car"
+	carutil "github.com/ipld/go-car/util"
+	"github.com/stretchr/testify/require"
+	cbg "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/account"
+	_init "github.com/filecoin-project/specs-actors/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// carFixture is a CAR of a chain of three tipsets. An account actor changes after each of the first two, the second
+// also creates an account known by a robust address.
+type carFixture struct {
+	car     []byte
+	blocks  map[cid.Cid]*types.BlockHeader
+	account address.Address
+	created address.Address
+	robust  address.Address
+	network string
+}
+
+func newCARFixture(t *testing.T) *carFixture {
+	ctx := context.Background()
+	bs := bstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	cst := cbornode.NewCborStore(bs)
+	store := adt.WrapStore(ctx, cst)
+
+	f := &carFixture{blocks: map[cid.Cid]*types.BlockHeader{}, network: "car-test"}
+	var err error
+	f.account, err = address.NewIDAddress(1000)
+	require.NoError(t, err)
+	f.created, err = address.NewIDAddress(1001)
+	require.NoError(t, err)
+	f.robust, err = address.NewActorAddress([]byte("created"))
+	require.NoError(t, err)
+
+	put := func(v cbg.CBORMarshaler) cid.Cid {
+		c, err := store.Put(ctx, v)
+		require.NoError(t, err)
+		return c
+	}
+	initActor := func(known map[address.Address]address.Address) *types.Actor {
+		addrs := adt.MakeEmptyMap(store)
+		for a, id := range known {
+			actorID, err := address.IDFromAddress(id)
+			require.NoError(t, err)
+			v := cbg.CborInt(actorID)
+			require.NoError(t, addrs.Put(adt.AddrKey(a), &v))
+		}
+		root, err := addrs.Root()
+		require.NoError(t, err)
+		return &types.Actor{Code: builtin.InitActorCodeID, Head: put(_init.ConstructState(root, f.network)), Balance: big.Zero()}
+	}
+	accountActor := func(addr address.Address, nonce uint64) *types.Actor {
+		return &types.Actor{Code: builtin.AccountActorCodeID, Head: put(&account.State{Address: addr}), Nonce: nonce, Balance: types.NewInt(nonce * 10)}
+	}
+	stateRoot := func(actors map[address.Address]*types.Actor) cid.Cid {
+		st, err := state.NewStateTree(cst)
+		require.NoError(t, err)
+		for addr, act := range actors {
+			require.NoError(t, st.SetActor(addr, act))
+		}
+		root, err := st.Flush(ctx)
+		require.NoError(t, err)
+		return root
+	}
+	block := func(parent *types.TipSet, stateroot cid.Cid) *types.TipSet {
+		bh := mock.MkBlock(parent, 1, 1)
+		bh.ParentStateRoot = stateroot
+		sb, err := bh.ToStorageBlock()
+		require.NoError(t, err)
+		require.NoError(t, bs.Put(sb))
+		f.blocks[bh.Cid()] = bh
+		return mock.TipSet(bh)
+	}
+
+	// the state after each tipset is the parent state of the next one.
+	gen := block(nil, stateRoot(map[address.Address]*types.Actor{
+		builtin.InitActorAddr: initActor(nil),
+		f.account:             accountActor(f.account, 0),
+	}))
+	ts1 := block(gen, stateRoot(map[address.Address]*types.Actor{
+		builtin.InitActorAddr: initActor(nil),
+		f.account:             accountActor(f.account, 1),
+	}))
+	head := block(ts1, stateRoot(map[address.Address]*types.Actor{
+		builtin.InitActorAddr: initActor(map[address.Address]address.Address{f.robust: f.created}),
+		f.account:             accountActor(f.account, 2),
+		f.created:             accountActor(f.robust, 0),
+	}))
+	delete(f.blocks, gen.Cids()[0])
+
+	// the chain and every object linked from it, the messages and receipts of mock blocks are not there.
+	var buf bytes.Buffer
+	require.NoError(t, car.WriteHeader(&car.CarHeader{Roots: head.Cids(), Version: 1}, &buf))
+	seen := cid.NewSet()
+	var walk func(c cid.Cid)
+	walk = func(c cid.Cid) {
+		if !seen.Visit(c) {
+			return
+		}
+		blk, err := bs.Get(c)
+		if err == bstore.ErrNotFound {
+			return
+		}
+		require.NoError(t, err)
+		require.NoError(t, carutil.LdWrite(&buf, c.Bytes(), blk.RawData()))
+
+		links, err := cbg.ScanForLinks(bytes.NewReader(blk.RawData()))
+		require.NoError(t, err)
+		for _, l := range links {
+			walk(l)
+		}
+	}
+	for _, c := range head.Cids() {
+		walk(c)
+	}
+	f.car = buf.Bytes()
+	return f
+}
+
+func TestCARNode(t *testing.T) {
+	ctx := context.Background()
+	f := newCARFixture(t)
+
+	node, err := NewCARNode(bytes.NewReader(f.car))
+	require.NoError(t, err)
+
+	head, err := node.ChainHead(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, head.Height())
+	gen, err := node.ChainGetGenesis(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, gen.Height())
+	ts1, err := node.ChainGetTipSetByHeight(ctx, 1, types.EmptyTSK)
+	require.NoError(t, err)
+	require.Equal(t, head.Parents(), ts1.Key())
+
+	// the state after a tipset is the parent state of its child.
+	act, err := node.StateGetActor(ctx, f.account, ts1.Key())
+	require.NoError(t, err)
+	require.EqualValues(t, 2, act.Nonce)
+	id, err := node.StateLookupID(ctx, f.robust, ts1.Key())
+	require.NoError(t, err)
+	require.Equal(t, f.created, id)
+	_, err = node.StateLookupID(ctx, f.robust, gen.Key())
+	require.Error(t, err)
+	addrs, err := node.StateListActors(ctx, gen.Key())
+	require.NoError(t, err)
+	require.ElementsMatch(t, []address.Address{builtin.InitActorAddr, f.account}, addrs)
+
+	name, err := node.StateNetworkName(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, f.network, name)
+
+	// nothing executed the head, the newest state is the one after its parents.
+	_, err = node.StateGetActor(ctx, f.account, head.Key())
+	require.Error(t, err)
+	act, err = node.StateGetActor(ctx, f.account, types.EmptyTSK)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, act.Nonce)
+}
+
+func TestHandleCommonActorsChangesCAR(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		f := newCARFixture(t)
+
+		node, err := NewCARNode(bytes.NewReader(f.car))
+		require.NoError(t, err)
+		p.node = node
+		p.Source = NewNodeSource(node)
+		seedAddresses(t, p.db, []address.Address{builtin.InitActorAddr, f.account})
+
+		actors, err := p.collectActorChanges(ctx, f.blocks)
+		require.NoError(t, err)
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.NoError(t, err)
+
+		rows, err := p.db.Query(`select id, nonce from actors where code = $1`, builtin.AccountActorCodeID.String())
+		require.NoError(t, err)
+		defer rows.Close() //nolint:errcheck
+		var nonces []string
+		for rows.Next() {
+			var id string
+			var nonce int
+			require.NoError(t, rows.Scan(&id, &nonce))
+			nonces = append(nonces, fmt.Sprintf("%s:%d", id, nonce))
+		}
+		require.NoError(t, rows.Err())
+		require.ElementsMatch(t, []string{f.account.String() + ":1", f.account.String() + ":2", f.created.String() + ":0"}, nonces)
+
+		// the robust address of the created account is read from the init actor in the car.
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from id_address_map where id = $1 and address = $2`, f.created.String(), f.robust.String()))
+	})
+}
+
+func TestBackfillSQLiteCAR(t *testing.T) {
+	ctx := context.Background()
+	f := newCARFixture(t)
+	node, err := NewCARNode(bytes.NewReader(f.car))
+	require.NoError(t, err)
+
+	p, err := NewProcessor(testSQLiteDSN(t), WithNode(node))
+	require.NoError(t, err)
+	db := p.DB()
+	defer db.Close() //nolint:errcheck
+	require.Equal(t, BackendSQLite, p.Backend)
+
+	// the tables and the genesis state of a database no processor ran on are created by Setup.
+	require.NoError(t, p.Setup(ctx))
+	require.Equal(t, 2, countRows(t, db, `select count(*) from actors where epoch = 0`))
+
+	require.NoError(t, p.Backfill(ctx, []EpochRange{{From: 1, To: 2}}))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from id_address_map where id = $1 and address = $2`, f.created.String(), f.robust.String()))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from actors where id = $1`, f.created.String()))
+}
@@ -0,0 +1,208 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// commonActorsCheckpoint is the processor_checkpoint row of the common actors processor.
+const commonActorsCheckpoint = "common_actors"
+
+// checkpoint is the highest epoch whose actor changes a processor fully stored, along with the tipset whose state they
+// were changed in.
+type checkpoint struct {
+	epoch abi.ChainEpoch
+	tsKey types.TipSetKey
+}
+
+// checkpointSchema creates processor_checkpoint, it is valid in both backends.
+func (p *Processor) checkpointSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+/*
+* the highest epoch fully stored by a processor and the key of the tipset
+* whose state it stored, written once every table of a batch committed
+*/
+create table if not exists processor_checkpoint
+(
+	processor text not null
+		constraint processor_checkpoint_pk
+			primary key,
+	epoch bigint not null,
+	tipset_key text not null,
+	updated_at bigint not null
+)`)
+	return err
+}
+
+// loadCheckpoint reads the checkpoint of the common actors processor, the first batch handled after it is loaded skips
+// the tipsets it covers.
+func (p *Processor) loadCheckpoint() error {
+	var (
+		epoch int64
+		tsk   string
+	)
+	err := p.db.QueryRow(`select epoch, tipset_key from processor_checkpoint where processor = $1`, commonActorsCheckpoint).Scan(&epoch, &tsk)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("query processor_checkpoint: %w", err)
+	}
+
+	key, err := parseTipSetKey(tsk)
+	if err != nil {
+		return xerrors.Errorf("parse checkpoint tipset key %s: %w", tsk, err)
+	}
+	p.resumeLk.Lock()
+	p.resume = &checkpoint{epoch: abi.ChainEpoch(epoch), tsKey: key}
+	p.resumeLk.Unlock()
+	p.logger().Infow("Resuming from checkpoint", "epoch", epoch, "tipset", tsk)
+	return nil
+}
+
+// storeCheckpoint records the highest epoch of actors, and the tipset it was changed in, as the checkpoint of the common
+// actors processor. It is written in the transaction of the last phase of the batch by storeLastPhase. A checkpoint is
+// only moved forward, a batch reprocessing lower epochs leaves it as it is.
+func (p *Processor) storeCheckpoint(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+	var cp *checkpoint
+	for _, tips := range actors {
+		for _, infos := range tips {
+			for _, info := range infos {
+				if cp == nil || info.height > cp.epoch {
+					cp = &checkpoint{epoch: info.height, tsKey: info.tsKey}
+				}
+			}
+		}
+	}
+	if cp == nil {
+		return nil
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin processor_checkpoint tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if _, err := tx.ExecContext(ctx, `
+insert into processor_checkpoint (processor, epoch, tipset_key, updated_at) values ($1, $2, $3, $4)
+on conflict (processor) do update set epoch = excluded.epoch, tipset_key = excluded.tipset_key, updated_at = excluded.updated_at
+where excluded.epoch >= processor_checkpoint.epoch
+`, commonActorsCheckpoint, int64(cp.epoch), cp.tsKey.String(), time.Now().Unix()); err != nil {
+			return xerrors.Errorf("store processor checkpoint: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+// resumeCheckpoint returns the checkpoint read on start, nil if there was none or the processing loop committed a batch
+// since.
+func (p *Processor) resumeCheckpoint() *checkpoint {
+	p.resumeLk.Lock()
+	defer p.resumeLk.Unlock()
+	return p.resume
+}
+
+// clearResume stops skipping the tipsets covered by the checkpoint read on start. The processing loop calls it once its
+// first batch committed, the batches after it are above the checkpoint.
+func (p *Processor) clearResume() {
+	p.resumeLk.Lock()
+	defer p.resumeLk.Unlock()
+	p.resume = nil
+}
+
+// skipCheckpointed returns actors without the changes of the tipsets covered by the checkpoint loaded on start, which
+// are the checkpoint tipset and its ancestors. A tipset at a checkpointed height on another fork is kept.
+func (p *Processor) skipCheckpointed(ctx context.Context, actors map[cid.Cid]ActorTips) (map[cid.Cid]ActorTips, error) {
+	resume := p.resumeCheckpoint()
+	if resume == nil {
+		return actors, nil
+	}
+
+	// the lowest tipset holding changes the checkpoint may cover bounds the walk down its ancestors.
+	var lowest *types.TipSet
+	for _, tips := range actors {
+		for tsk, infos := range tips {
+			if len(infos) == 0 || infos[0].height > resume.epoch {
+				continue
+			}
+			ts, err := p.Source.TipSet(ctx, tsk)
+			if err != nil {
+				return nil, xerrors.Errorf("get tipset %s: %w", tsk, err)
+			}
+			if lowest == nil || ts.Height() < lowest.Height() {
+				lowest = ts
+			}
+		}
+	}
+	if lowest == nil {
+		return actors, nil
+	}
+
+	covered := map[types.TipSetKey]struct{}{}
+	ts, err := p.Source.TipSet(ctx, resume.tsKey)
+	if err != nil {
+		return nil, xerrors.Errorf("get checkpoint tipset %s: %w", resume.tsKey, err)
+	}
+	for {
+		covered[ts.Key()] = struct{}{}
+		if ts.Height() <= lowest.Height() || ts.Height() == 0 {
+			break
+		}
+		parent, err := p.Source.TipSet(ctx, ts.Parents())
+		if err != nil {
+			return nil, xerrors.Errorf("get tipset %s: %w", ts.Parents(), err)
+		}
+		ts = parent
+	}
+
+	out := make(map[cid.Cid]ActorTips, len(actors))
+	var skipped int
+	for code, tips := range actors {
+		kept := ActorTips{}
+		for tsk, infos := range tips {
+			if _, ok := covered[tsk]; ok {
+				skipped += len(infos)
+				continue
+			}
+			kept[tsk] = infos
+		}
+		out[code] = kept
+	}
+	p.logger().Infow("Skipped actor changes stored before the checkpoint", "skipped", skipped, "epoch", resume.epoch)
+	return out, nil
+}
+
+// parseTipSetKey parses a tipset key in the form types.TipSetKey.String() writes it.
+func parseTipSetKey(s string) (types.TipSetKey, error) {
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return types.EmptyTSK, xerrors.Errorf("not a tipset key")
+	}
+	var cids []cid.Cid
+	for _, c := range strings.Split(strings.Trim(s, "{}"), ",") {
+		if c == "" {
+			continue
+		}
+		ci, err := cid.Parse(c)
+		if err != nil {
+			return types.EmptyTSK, err
+		}
+		cids = append(cids, ci)
+	}
+	return types.NewTipSetKey(cids...), nil
+}
@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// checkpointTips returns the changes of actor in the state of each of tipsets, as collected from the blocks executing
+// them.
+func checkpointTips(t *testing.T, actor address.Address, tipsets ...*types.TipSet) map[cid.Cid]ActorTips {
+	tips := ActorTips{}
+	for _, ts := range tipsets {
+		tips[ts.Key()] = append(tips[ts.Key()], actorInfo{
+			act: types.Actor{
+				Code:    builtin.AccountActorCodeID,
+				Head:    testCid(t, fmt.Sprintf("head-%s", ts.Key())),
+				Balance: types.NewInt(0),
+			},
+			addr:      actor,
+			stateroot: testCid(t, fmt.Sprintf("stateroot-%s", ts.Key())),
+			height:    ts.Height() + 1,
+			tsKey:     ts.Key(),
+			state:     `{"Address":"` + actor.String() + `"}`,
+		})
+	}
+	return map[cid.Cid]ActorTips{builtin.AccountActorCodeID: tips}
+}
+
+func TestCommonActorsCheckpoint(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		actor, err := address.NewIDAddress(1000)
+		require.NoError(t, err)
+		p.node = newGenesisNode(t, nil)
+		seedAddresses(t, p.db, []address.Address{actor})
+
+		gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+		ts1 := mock.TipSet(mock.MkBlock(gen, 1, 1))
+		ts2 := mock.TipSet(mock.MkBlock(ts1, 1, 1))
+		ts3 := mock.TipSet(mock.MkBlock(ts2, 1, 1))
+		fork2 := mock.TipSet(mock.MkBlock(ts1, 1, 2))
+		p.Source = newRecordedSource(&RecordedChain{TipSets: []*types.TipSet{gen, ts1, ts2, ts3, fork2}})
+
+		// nothing was checkpointed yet, a fresh processor starts from genesis.
+		require.NoError(t, p.loadCheckpoint())
+		require.Nil(t, p.resume)
+
+		_, err = p.HandleCommonActorsChanges(ctx, checkpointTips(t, actor, ts1, ts2))
+		require.NoError(t, err)
+		// a batch of lower epochs does not move the checkpoint back.
+		_, err = p.HandleCommonActorsChanges(ctx, checkpointTips(t, actor, gen))
+		require.NoError(t, err)
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from processor_checkpoint where epoch = $1 and tipset_key = $2`, ts2.Height()+1, ts2.Key().String()))
+
+		// the batch is handled again after a restart as its blocks were never marked processed, the tipsets checkpointed
+		// are skipped while the fork at a checkpointed height is not.
+		_, err = p.db.Exec(`delete from actors`)
+		require.NoError(t, err)
+		restarted := &Processor{db: p.db, Backend: p.Backend, node: p.node, Source: p.Source}
+		require.NoError(t, restarted.loadCheckpoint())
+		require.Equal(t, &checkpoint{epoch: ts2.Height() + 1, tsKey: ts2.Key()}, restarted.resume)
+
+		_, err = restarted.HandleCommonActorsChanges(ctx, checkpointTips(t, actor, ts1, ts2, fork2, ts3))
+		require.NoError(t, err)
+		for _, tc := range []struct {
+			ts     *types.TipSet
+			stored bool
+		}{{ts1, false}, {ts2, false}, {fork2, true}, {ts3, true}} {
+			n := countRows(t, p.db, `select count(*) from actors where tipset_key = $1`, tc.ts.Key().String())
+			require.Equal(t, tc.stored, n == 1, tc.ts.Key())
+		}
+		// only the processing loop clears the checkpoint, once its batch committed.
+		require.NotNil(t, restarted.resumeCheckpoint())
+		restarted.clearResume()
+		require.Nil(t, restarted.resumeCheckpoint())
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from processor_checkpoint where epoch = $1 and tipset_key = $2`, ts3.Height()+1, ts3.Key().String()))
+	})
+}
+
+func TestCheckpointCommitsWithLastPhase(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		p.node = newGenesisNode(t, nil)
+		seedAddresses(t, p.db, []address.Address{builtin.BurntFundsActorAddr})
+
+		gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+		ts1 := mock.TipSet(mock.MkBlock(gen, 1, 1))
+		p.Source = newRecordedSource(&RecordedChain{TipSets: []*types.TipSet{gen, ts1}})
+		actors := checkpointTips(t, builtin.BurntFundsActorAddr, ts1)
+
+		hide := func(table string) func() {
+			_, err := p.db.Exec(fmt.Sprintf(`alter table %s rename to %s_hidden`, table, table))
+			require.NoError(t, err)
+			hidden := true
+			restore := func() {
+				if hidden {
+					_, err := p.db.Exec(fmt.Sprintf(`alter table %s_hidden rename to %s`, table, table))
+					require.NoError(t, err)
+					hidden = false
+				}
+			}
+			t.Cleanup(restore)
+			return restore
+		}
+
+		// a phase before the last one fails, the last one and the checkpoint are not written.
+		restore := hide("balance_deltas")
+		_, err := p.HandleCommonActorsChanges(ctx, actors)
+		var pce *PartialCommitError
+		require.True(t, xerrors.As(err, &pce), "%v", err)
+		require.Contains(t, pce.Committed, "actors")
+		require.Contains(t, pce.Failed, "burnt_funds")
+		require.Zero(t, countRows(t, p.db, `select count(*) from processor_checkpoint`))
+		restore()
+
+		// the burnt funds fail to store, the checkpoint written in the same transaction is rolled back with them.
+		restore = hide("burnt_funds")
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.True(t, xerrors.As(err, &pce), "%v", err)
+		require.Contains(t, pce.Failed, "processor_checkpoint")
+		require.Zero(t, countRows(t, p.db, `select count(*) from processor_checkpoint`))
+		restore()
+
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.NoError(t, err)
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from burnt_funds`))
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from processor_checkpoint where epoch = $1`, ts1.Height()+1))
+	})
+}
+
+func TestParseTipSetKey(t *testing.T) {
+	for _, tsk := range []types.TipSetKey{
+		types.EmptyTSK,
+		types.NewTipSetKey(testCid(t, "block-0")),
+		types.NewTipSetKey(testCid(t, "block-0"), testCid(t, "block-1")),
+	} {
+		got, err := parseTipSetKey(tsk.String())
+		require.NoError(t, err)
+		require.Equal(t, tsk, got)
+	}
+
+	_, err := parseTipSetKey("block-0")
+	require.Error(t, err)
+}
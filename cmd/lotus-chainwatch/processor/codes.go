@@ -0,0 +1,132 @@
+package processor
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// actorKind is the logical type of a builtin actor, the same for its code CID in every actors version.
+type actorKind string
+
+// The kinds are named as in the code CIDs of the builtin actors, fil/<version>/<kind>.
+const (
+	kindSystem           actorKind = "system"
+	kindInit             actorKind = "init"
+	kindCron             actorKind = "cron"
+	kindAccount          actorKind = "account"
+	kindStoragePower     actorKind = "storagepower"
+	kindStorageMiner     actorKind = "storageminer"
+	kindStorageMarket    actorKind = "storagemarket"
+	kindPaymentChannel   actorKind = "paymentchannel"
+	kindMultisig         actorKind = "multisig"
+	kindReward           actorKind = "reward"
+	kindVerifiedRegistry actorKind = "verifiedregistry"
+)
+
+var actorKinds = map[actorKind]struct{}{
+	kindSystem:           {},
+	kindInit:             {},
+	kindCron:             {},
+	kindAccount:          {},
+	kindStoragePower:     {},
+	kindStorageMiner:     {},
+	kindStorageMarket:    {},
+	kindPaymentChannel:   {},
+	kindMultisig:         {},
+	kindReward:           {},
+	kindVerifiedRegistry: {},
+}
+
+// maxActorsVersion is the newest actors version whose code CIDs are resolved. The builtin.*CodeID constants of
+// specs-actors v0 are of version 1.
+const maxActorsVersion = 2
+
+// decodedActorsVersion is the newest actors version the processors of a kind of actor decode the states of. They
+// decode with the types of specs-actors v0, the actors of a newer version only have their common actor state stored.
+const decodedActorsVersion = 1
+
+// codeKind resolves the kind of the builtin actor whose code is code, for every actors version up to maxActorsVersion.
+// ok is false for any other code.
+func codeKind(code cid.Cid) (kind actorKind, ok bool) {
+	kind, _, ok = codeKindVersion(code)
+	return kind, ok
+}
+
+// codeKindVersion resolves the kind and the actors version of the builtin actor whose code is code, as codeKind does.
+func codeKindVersion(code cid.Cid) (kind actorKind, version int, ok bool) {
+	if !code.Defined() || code.Prefix().MhType != mh.IDENTITY {
+		return "", 0, false
+	}
+	dmh, err := mh.Decode(code.Hash())
+	if err != nil {
+		return "", 0, false
+	}
+
+	parts := strings.Split(string(dmh.Digest), "/")
+	if len(parts) != 3 || parts[0] != "fil" {
+		return "", 0, false
+	}
+	version, err = strconv.Atoi(parts[1])
+	if err != nil || version < 1 || version > maxActorsVersion {
+		return "", 0, false
+	}
+	kind = actorKind(parts[2])
+	if _, ok := actorKinds[kind]; !ok {
+		return "", 0, false
+	}
+	return kind, version, true
+}
+
+// actorsOfKind returns the changes of the actors of kind whose states the processors decode, of any actors version up to
+// decodedActorsVersion. It returns the tips of actors as they are when a single code is of kind.
+func actorsOfKind(actors map[cid.Cid]ActorTips, kind actorKind) ActorTips {
+	var out ActorTips
+	merged := false
+	for code, tips := range actors {
+		if k, version, ok := codeKindVersion(code); !ok || k != kind || version > decodedActorsVersion {
+			continue
+		}
+		if out == nil {
+			out = tips
+			continue
+		}
+		if !merged {
+			out = mergeActorTips(ActorTips{}, out)
+			merged = true
+		}
+		out = mergeActorTips(out, tips)
+	}
+	return out
+}
+
+// mergeActorTips appends the tips of src to the ones of dst, which is returned.
+func mergeActorTips(dst, src ActorTips) ActorTips {
+	for tsk, infos := range src {
+		dst[tsk] = append(dst[tsk], infos...)
+	}
+	return dst
+}
+
+// warnUnknownCodes logs the codes of actors which are not of a builtin actor of a supported actors version, or of one
+// newer than decodedActorsVersion. Their changes are only stored in the common actor tables, none of the processors of
+// a kind of actor sees them.
+func warnUnknownCodes(actors map[cid.Cid]ActorTips) {
+	for code, tips := range actors {
+		_, version, ok := codeKindVersion(code)
+		if ok && version <= decodedActorsVersion {
+			continue
+		}
+		n := 0
+		for _, infos := range tips {
+			n += len(infos)
+		}
+		if ok {
+			log.Warnw("Actors of an actors version the processors don't decode, only their common actor state is stored", "code", code.String(), "actors", n, "decodedActorsVersion", decodedActorsVersion)
+			continue
+		}
+		log.Warnw("Actors of an unknown code, only their common actor state is stored", "code", code.String(), "actors", n, "maxActorsVersion", maxActorsVersion)
+	}
+}
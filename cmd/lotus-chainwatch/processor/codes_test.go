@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// builtinCode returns the code CID of a builtin actor as the actors of every version make it.
+func builtinCode(t *testing.T, name string) cid.Cid {
+	c, err := cid.V1Builder{Codec: cid.Raw, MhType: mh.IDENTITY}.Sum([]byte(name))
+	require.NoError(t, err)
+	return c
+}
+
+func TestCodeKind(t *testing.T) {
+	for code, want := range map[cid.Cid]actorKind{
+		builtin.StorageMinerActorCodeID:          kindStorageMiner,
+		builtin.AccountActorCodeID:               kindAccount,
+		builtinCode(t, "fil/2/storageminer"):     kindStorageMiner,
+		builtinCode(t, "fil/2/verifiedregistry"): kindVerifiedRegistry,
+		builtinCode(t, "fil/1/paymentchannel"):   kindPaymentChannel,
+	} {
+		kind, ok := codeKind(code)
+		require.True(t, ok, code)
+		require.Equal(t, want, kind, code)
+	}
+
+	for _, code := range []cid.Cid{
+		builtinCode(t, "fil/3/storageminer"),
+		builtinCode(t, "fil/0/storageminer"),
+		builtinCode(t, "fil/1/bogus"),
+		builtinCode(t, "storageminer"),
+		testCid(t, "fil/1/storageminer"),
+		cid.Undef,
+	} {
+		_, ok := codeKind(code)
+		require.False(t, ok, code)
+	}
+}
+
+func TestActorsOfKind(t *testing.T) {
+	v0, v2 := builtin.StorageMinerActorCodeID, builtinCode(t, "fil/2/storageminer")
+	tsk := types.NewTipSetKey(testCid(t, "block-0"))
+	info := func(code cid.Cid, head string) actorInfo {
+		return actorInfo{act: types.Actor{Code: code, Head: testCid(t, head)}, tsKey: tsk}
+	}
+
+	v0Tips := ActorTips{tsk: {info(v0, "head-v0")}}
+	actors := map[cid.Cid]ActorTips{
+		v0:                         v0Tips,
+		v2:                         {tsk: {info(v2, "head-v2")}},
+		builtin.AccountActorCodeID: {tsk: {info(builtin.AccountActorCodeID, "head-account")}},
+		testCid(t, "unknown"):      {tsk: {info(testCid(t, "unknown"), "head-unknown")}},
+	}
+
+	// the miners of the version 1 codes route to the miner processor, the states of version 2 are not decoded.
+	require.Equal(t, v0Tips, actorsOfKind(actors, kindStorageMiner))
+	require.Len(t, actorsOfKind(actors, kindAccount)[tsk], 1)
+	require.Nil(t, actorsOfKind(actors, kindMultisig))
+}
+
+func TestMergeActorTips(t *testing.T) {
+	tsk := types.NewTipSetKey(testCid(t, "block-0"))
+	v0 := ActorTips{tsk: {{act: types.Actor{Head: testCid(t, "head-v0")}, tsKey: tsk}}}
+	v2 := ActorTips{tsk: {{act: types.Actor{Head: testCid(t, "head-v2")}, tsKey: tsk}}}
+
+	// the tips merged into a new map are left as they are.
+	merged := mergeActorTips(mergeActorTips(ActorTips{}, v0), v2)
+	var heads []cid.Cid
+	for _, info := range merged[tsk] {
+		heads = append(heads, info.act.Head)
+	}
+	require.Equal(t, []cid.Cid{testCid(t, "head-v0"), testCid(t, "head-v2")}, heads)
+	require.Len(t, v0[tsk], 1)
+}
+
+func TestProcessMinersSkipsNewerActorsVersion(t *testing.T) {
+	ctx := context.Background()
+	tsk := types.NewTipSetKey(testCid(t, "block-0"))
+	v2 := builtinCode(t, "fil/2/storageminer")
+	// the head is not a miner state of specs-actors v0, and the processor has no node to read it from.
+	actors := map[cid.Cid]ActorTips{
+		v2: {tsk: {{act: types.Actor{Code: v2, Head: testCid(t, "head-v2")}, tsKey: tsk}}},
+	}
+
+	// the version 2 miner never reaches the miner processor, so the batch is not failed decoding it.
+	p := &Processor{}
+	changes, err := p.processMiners(ctx, actorsOfKind(actors, kindStorageMiner))
+	require.NoError(t, err)
+	require.Empty(t, changes)
+}
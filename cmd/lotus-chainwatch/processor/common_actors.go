@@ -3,8 +3,18 @@ package processor
 import (
 	"bytes"
 	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/lib/pq"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 
@@ -12,6 +22,7 @@ import (
 	typegen "github.com/whyrusleeping/cbor-gen"
 
 	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
 	"github.com/filecoin-project/specs-actors/actors/builtin"
 	_init "github.com/filecoin-project/specs-actors/actors/builtin/init"
 	"github.com/filecoin-project/specs-actors/actors/util/adt"
@@ -20,13 +31,58 @@ import (
 	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
 )
 
+// Mode selects what the actors table keeps.
+type Mode int
+
+const (
+	// ModeHistory keeps a row for every head an actor had, the default.
+	ModeHistory Mode = iota
+	// ModeLatest keeps a single row per actor, updated to its latest head.
+	ModeLatest
+)
+
 func (p *Processor) setupCommonActors() error {
+	if err := p.migrate(p.migrations()); err != nil {
+		return err
+	}
+
+	if p.PartitionActors {
+		if err := p.partitionActors(); err != nil {
+			return xerrors.Errorf("partition actors: %w", err)
+		}
+	}
+	partitioned, err := p.actorsPartitioned()
+	if err != nil {
+		return err
+	}
+	p.partitions.enabled = partitioned
+
+	if p.Mode != ModeLatest {
+		return nil
+	}
+	if partitioned {
+		return xerrors.Errorf("actors is partitioned, latest mode keeps a row per actor in an unpartitioned table")
+	}
+
 	tx, err := p.db.Begin()
 	if err != nil {
 		return err
 	}
+	// fails if the table already holds the history of an actor.
+	if _, err := tx.Exec(`create unique index if not exists actors_id_uindex on actors (id)`); err != nil {
+		return xerrors.Errorf("create actors id index for latest mode: %w", err)
+	}
+	return tx.Commit()
+}
+
+// commonActorsSchema creates the common actor tables, as they were when schema migrations were introduced. Deployments
+// set up before then have them already, every statement leaves what exists untouched.
+func (p *Processor) commonActorsSchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		return commonActorsSchemaSQLite(tx)
+	}
 
-	if _, err := tx.Exec(`
+	_, err := tx.Exec(`
 create table if not exists id_address_map
 (
 	id text not null,
@@ -48,25 +104,44 @@ create table if not exists actors
 			references id_address_map (id),
 	code text not null,
 	head text not null,
-	nonce int not null,
+	nonce bigint not null,
 	balance text not null,
 	stateroot text
   );
-  
+
+/* nonce was created as a 32 bit int by earlier versions, which high activity accounts outgrow */
+alter table actors alter column nonce type bigint;
+
 create index if not exists actors_id_index
 	on actors (id);
 
+/* makes rewriting the same actor state a no-op so interrupted writes such as the genesis seed can be retried,
+   duplicates left by earlier versions are removed the first time the index is built */
+do $$
+begin
+	if not exists (select 1 from pg_indexes where indexname = 'actors_id_head_stateroot_uindex') then
+		delete from actors a using actors b
+			where a.ctid < b.ctid and a.id = b.id and a.head = b.head and a.stateroot = b.stateroot;
+		create unique index actors_id_head_stateroot_uindex on actors (id, head, stateroot);
+	end if;
+end
+$$;
+
 create index if not exists id_address_map_address_index
 	on id_address_map (address);
 
 create index if not exists id_address_map_id_index
 	on id_address_map (id);
 
-create or replace function actor_tips(epoch bigint)
+/* the return type can't be changed by create or replace, drop the version returning an int nonce */
+drop function if exists actor_tips(bigint);
+
+/* the latest state of every actor changed in [min_epoch, max_epoch) */
+create or replace function actor_tips(min_epoch bigint, max_epoch bigint)
     returns table (id text,
                     code text,
                     head text,
-                    nonce int,
+                    nonce bigint,
                     balance text,
                     stateroot text,
                     height bigint,
@@ -74,10 +149,24 @@ create or replace function actor_tips(epoch bigint)
 $body$
     select distinct on (id) * from actors
         inner join state_heights sh on sh.parentstateroot = stateroot
-        where height < $1
+        where height >= $1 and height < $2
 		order by id, height desc;
 $body$ language sql;
 
+/* kept for queries written against the single epoch version, scans from genesis */
+create or replace function actor_tips(epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce bigint,
+                    balance text,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select * from actor_tips(0, $1);
+$body$ language sql;
+
 create table if not exists actor_states
 (
 	head text not null,
@@ -94,78 +183,397 @@ create index if not exists actor_states_head_index
 create index if not exists actor_states_code_head_index
 	on actor_states (head, code);
 
-`); err != nil {
+/* actor states that could not be stored, as when the state of an unknown actor version failed to decode */
+create table if not exists actor_states_errors
+(
+	head text not null,
+	code text not null,
+	reason text not null,
+	constraint actor_states_errors_pk
+		primary key (head, code)
+);
+
+` + balanceDeltasTable + `;
+`)
+	return err
+}
+
+// actorsTipSetKeySchema adds the key of the tipset an actor head was observed at to actors. Rows written before have
+// no tipset key.
+func (p *Processor) actorsTipSetKeySchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		_, err := tx.Exec(`alter table actors add column tipset_key text`)
 		return err
 	}
 
-	return tx.Commit()
+	_, err := tx.Exec(`
+alter table actors add column if not exists tipset_key text;
+
+/* selects the columns it returns, actors has more of them than the returned table */
+create or replace function actor_tips(min_epoch bigint, max_epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce bigint,
+                    balance text,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select distinct on (a.id) a.id, a.code, a.head, a.nonce, a.balance, a.stateroot, sh.height, sh.parentstateroot
+        from actors a
+        inner join state_heights sh on sh.parentstateroot = a.stateroot
+        where sh.height >= $1 and sh.height < $2
+		order by a.id, sh.height desc;
+$body$ language sql;
+`)
+	return err
 }
 
-func (p *Processor) HandleCommonActorsChanges(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+// actorsBalanceNumericSchema changes actors.balance to numeric, so Postgres rejects a balance which is not an integer
+// and sums them without a cast. A stored balance which does not parse fails the migration. The actor_tips functions
+// return it, as they can't change their return type they are created again. SQLite keeps the text column, its numeric
+// affinity would round the balances above the range of an integer.
+func (p *Processor) actorsBalanceNumericSchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+drop function if exists actor_tips(bigint);
+drop function if exists actor_tips(bigint, bigint);
+
+alter table actors alter column balance type numeric using balance::numeric;
+
+create function actor_tips(min_epoch bigint, max_epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce bigint,
+                    balance numeric,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select distinct on (a.id) a.id, a.code, a.head, a.nonce, a.balance, a.stateroot, sh.height, sh.parentstateroot
+        from actors a
+        inner join state_heights sh on sh.parentstateroot = a.stateroot
+        where sh.height >= $1 and sh.height < $2
+		order by a.id, sh.height desc;
+$body$ language sql;
+
+create function actor_tips(epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce bigint,
+                    balance numeric,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select * from actor_tips(0, $1);
+$body$ language sql;
+`)
+	return err
+}
+
+// actorsIDStaterootIndexSchema indexes actors by id and stateroot for BalanceHistory, which joins the rows of an actor
+// with state_heights for every height.
+func (p *Processor) actorsIDStaterootIndexSchema(tx *sql.Tx) error {
+	_, err := tx.Exec(`create index if not exists actors_id_stateroot_index on actors (id, stateroot)`)
+	return err
+}
+
+// actorsNonceNumericSchema changes actors.nonce to numeric(20,0), which holds every nonce an actor can have. The nonces
+// above the signed range written negative before are given back their value. latest_actors and the actor_tips functions
+// returning the nonce are created again, the view without data until RefreshLatest. SQLite keeps the bigint column and
+// rejects the nonces above its range, converting them to real would round them.
+func (p *Processor) actorsNonceNumericSchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+drop materialized view if exists latest_actors;
+drop function if exists actor_tips(bigint);
+drop function if exists actor_tips(bigint, bigint);
+
+alter table actors alter column nonce type numeric(20, 0)
+	using case when nonce < 0 then nonce::numeric + 18446744073709551616 else nonce::numeric end;
+
+create function actor_tips(min_epoch bigint, max_epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce numeric,
+                    balance numeric,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select distinct on (a.id) a.id, a.code, a.head, a.nonce, a.balance, a.stateroot, sh.height, sh.parentstateroot
+        from actors a
+        inner join state_heights sh on sh.parentstateroot = a.stateroot
+        where sh.height >= $1 and sh.height < $2
+		order by a.id, sh.height desc;
+$body$ language sql;
+
+create function actor_tips(epoch bigint)
+    returns table (id text,
+                    code text,
+                    head text,
+                    nonce numeric,
+                    balance numeric,
+                    stateroot text,
+                    height bigint,
+                    parentstateroot text) as
+$body$
+    select * from actor_tips(0, $1);
+$body$ language sql;
+
+create materialized view latest_actors
+	as select * from actor_tips(9223372036854775807)
+	with no data;
+
+create unique index latest_actors_id_uindex
+	on latest_actors (id);
+`)
+	return err
+}
+
+// HandleCommonActorsChanges stores the heads, states and balance deltas of every actor changed, then moves the
+// checkpoint. The returned summary counts what was handled, along with the rows written when an error is returned.
+// With AtomicRange all of it is committed in a single transaction, or nothing is.
+func (p *Processor) HandleCommonActorsChanges(ctx context.Context, actors map[cid.Cid]ActorTips) (summary ProcessSummary, err error) {
+	start := time.Now()
+	ctx, rows := withStoreRows(ctx)
+	defer func() {
+		summary.Rows = rows.counts()
+		summary.Duration = time.Since(start)
+		if err == nil {
+			p.logger().Infow("Handled common actor changes", "actors", summary.codeCounts(), "rows", summary.Rows,
+				"minEpoch", summary.MinEpoch, "maxEpoch", summary.MaxEpoch, "duration", summary.Duration.String())
+			return
+		}
+		// the phases which committed hold the range while the failed ones do not, until it is processed again.
+		var pce *PartialCommitError
+		if xerrors.As(err, &pce) {
+			p.logger().Errorw("Stored common actor changes partially", "committed", pce.Committed, "failed", pce.failures(),
+				"minEpoch", summary.MinEpoch, "maxEpoch", summary.MaxEpoch, "duration", summary.Duration.String())
+		}
+	}()
+
+	actors, err = p.skipCheckpointed(ctx, actors)
+	if err != nil {
+		return summary, xerrors.Errorf("skip checkpointed tipsets: %w", err)
+	}
+	summary = newProcessSummary(actors)
+
+	if p.AtomicRange {
+		if err := p.atomicRange(ctx, func(ctx context.Context) error {
+			return p.storeCommonActorsInOrder(ctx, actors)
+		}); err != nil {
+			return summary, xerrors.Errorf("store range, nothing was committed: %w", err)
+		}
+	} else if err := p.storeCommonActors(ctx, actors); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
+
+// commonActorsPhases are the phases storing actors once their addresses are stored, but for the burnt funds stored with
+// the checkpoint. The states are not stored with NoState.
+func (p *Processor) commonActorsPhases(ctx context.Context, actors map[cid.Cid]ActorTips) []storePhase {
+	phases := []storePhase{
+		{table: "actors", run: func() error {
+			return p.storeActorHeads(ctx, actors)
+		}},
+	}
+	if !p.NoState {
+		phases = append(phases, storePhase{table: "actor_states", run: func() error {
+			return p.storeActorStates(ctx, actors)
+		}})
+	}
+	return append(phases, storePhase{table: "balance_deltas", run: func() error {
+		return p.storeBalanceDeltas(ctx, actors)
+	}})
+}
+
+// errPhaseSkipped fails the last phase of a batch when it is not run because one of the phases before it failed.
+var errPhaseSkipped = xerrors.New("not stored, a phase before it failed")
+
+// storeCommonActors stores the addresses of actors, then runs the phases concurrently and, once all of them committed,
+// the burnt funds along with the checkpoint. Each commits on its own, a failure is returned as a PartialCommitError.
+func (p *Processor) storeCommonActors(ctx context.Context, actors map[cid.Cid]ActorTips) error {
 	if err := p.storeActorAddresses(ctx, actors); err != nil {
+		return &PartialCommitError{Failed: map[string]error{"id_address_map": err}}
+	}
+
+	phases := append([]storePhase{{table: "id_address_map", done: true}}, p.commonActorsPhases(ctx, actors)...)
+	if err := runStorePhases(phases...); err != nil {
+		var pce *PartialCommitError
+		if xerrors.As(err, &pce) {
+			pce.Failed["burnt_funds"] = errPhaseSkipped
+		}
 		return err
 	}
 
-	grp, _ := errgroup.WithContext(ctx)
+	committed := make([]string, len(phases))
+	for i, phase := range phases {
+		committed[i] = phase.table
+	}
+	if err := p.storeLastPhase(ctx, actors); err != nil {
+		return &PartialCommitError{Committed: committed, Failed: map[string]error{"burnt_funds": err, "processor_checkpoint": err}}
+	}
+	return nil
+}
 
-	grp.Go(func() error {
-		if err := p.storeActorHeads(actors); err != nil {
-			return err
+// storeCommonActorsInOrder stores what storeCommonActors does one phase after the other, for the single transaction
+// of an atomicRange. It stops at the first failure.
+func (p *Processor) storeCommonActorsInOrder(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+	if err := p.storeActorAddresses(ctx, actors); err != nil {
+		return xerrors.Errorf("id_address_map: %w", err)
+	}
+	for _, phase := range p.commonActorsPhases(ctx, actors) {
+		if err := phase.run(); err != nil {
+			return xerrors.Errorf("%s: %w", phase.table, err)
 		}
-		return nil
-	})
+	}
+	return p.storeLastPhase(ctx, actors)
+}
 
-	grp.Go(func() error {
-		if err := p.storeActorStates(actors); err != nil {
-			return err
+// storeLastPhase stores the burnt funds and moves the checkpoint in a single transaction, the last one of a batch, so
+// the checkpoint commits with the last of the batch's data and never covers data that failed to commit. Within an
+// atomicRange both are written in the transaction of the range.
+func (p *Processor) storeLastPhase(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+	store := func(ctx context.Context) error {
+		if err := p.storeBurntFunds(ctx, actors); err != nil {
+			return xerrors.Errorf("burnt_funds: %w", err)
+		}
+		if err := p.storeCheckpoint(ctx, actors); err != nil {
+			return xerrors.Errorf("processor_checkpoint: %w", err)
 		}
 		return nil
-	})
+	}
+	if rangeTx(ctx) != nil {
+		return store(ctx)
+	}
+	return p.atomicRange(ctx, store)
+}
+
+// PartialCommitError is returned when some of the store phases for a batch failed. The phases run in separate
+// transactions so the tables listed in Committed hold the batch's data while the ones in Failed do not.
+type PartialCommitError struct {
+	Committed []string
+	Failed    map[string]error
+}
+
+func (e *PartialCommitError) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for table, err := range e.Failed {
+		failed = append(failed, fmt.Sprintf("%s: %s", table, err))
+	}
+	sort.Strings(failed)
+	return fmt.Sprintf("store failed for [%s], committed [%s]", strings.Join(failed, "; "), strings.Join(e.Committed, ", "))
+}
+
+// failures returns the error of every failed phase by table.
+func (e *PartialCommitError) failures() map[string]string {
+	out := make(map[string]string, len(e.Failed))
+	for table, err := range e.Failed {
+		out[table] = err.Error()
+	}
+	return out
+}
+
+type storePhase struct {
+	table string
+	run   func() error
+	// done marks a phase that already committed before the others were started.
+	done bool
+}
+
+// runStorePhases runs every phase concurrently and waits for all of them, rather than returning on the first failure,
+// so the outcome of each phase can be reported.
+func runStorePhases(phases ...storePhase) error {
+	errs := make([]error, len(phases))
+
+	var wg sync.WaitGroup
+	for i, phase := range phases {
+		if phase.done {
+			continue
+		}
+		i, phase := i, phase
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = phase.run()
+		}()
+	}
+	wg.Wait()
+
+	out := &PartialCommitError{Failed: map[string]error{}}
+	for i, phase := range phases {
+		if errs[i] != nil {
+			out.Failed[phase.table] = errs[i]
+			continue
+		}
+		out.Committed = append(out.Committed, phase.table)
+	}
 
-	return grp.Wait()
+	if len(out.Failed) == 0 {
+		return nil
+	}
+	return out
 }
 
-func (p Processor) storeActorAddresses(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+func (p *Processor) storeActorAddresses(ctx context.Context, actors map[cid.Cid]ActorTips) (err error) {
 	start := time.Now()
+	var addressToID map[address.Address]address.Address
 	defer func() {
-		log.Debugw("Stored Actor Addresses", "duration", time.Since(start).String())
+		err = classifyStoreErr(err)
+		p.recordStore(ctx, "id_address_map", start, len(addressToID), err)
+		p.logger().Debugw("Stored Actor Addresses", "duration", time.Since(start).String())
 	}()
 
-	addressToID := map[address.Address]address.Address{}
-	// HACK until genesis storage is figured out:
-	addressToID[builtin.SystemActorAddr] = builtin.SystemActorAddr
-	addressToID[builtin.InitActorAddr] = builtin.InitActorAddr
-	addressToID[builtin.RewardActorAddr] = builtin.RewardActorAddr
-	addressToID[builtin.CronActorAddr] = builtin.CronActorAddr
-	addressToID[builtin.StoragePowerActorAddr] = builtin.StoragePowerActorAddr
-	addressToID[builtin.StorageMarketActorAddr] = builtin.StorageMarketActorAddr
-	addressToID[builtin.VerifiedRegistryActorAddr] = builtin.VerifiedRegistryActorAddr
-	addressToID[builtin.BurntFundsActorAddr] = builtin.BurntFundsActorAddr
-	initActor, err := p.node.StateGetActor(ctx, builtin.InitActorAddr, types.EmptyTSK)
+	// the singletons and other actors without a robust address are stored once from the genesis state.
+	addressToID, err = p.initAddressMap(ctx, types.EmptyTSK)
 	if err != nil {
 		return err
 	}
+	return p.storeAddressMap(ctx, addressToID)
+}
+
+// initAddressMap returns the robust address to ID address map of the init actor as of the tipset tsk.
+func (p *Processor) initAddressMap(ctx context.Context, tsk types.TipSetKey) (map[address.Address]address.Address, error) {
+	initActor, err := p.node.StateGetActor(ctx, builtin.InitActorAddr, tsk)
+	if err != nil {
+		return nil, err
+	}
 
 	initActorRaw, err := p.node.ChainReadObj(ctx, initActor.Head)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var initActorState _init.State
 	if err := initActorState.UnmarshalCBOR(bytes.NewReader(initActorRaw)); err != nil {
-		return err
+		return nil, xerrors.Errorf("decode init actor state: %w", decodeError(err))
 	}
 	ctxStore := cw_util.NewAPIIpldStore(ctx, p.node)
 	addrMap, err := adt.AsMap(ctxStore, initActorState.AddressMap)
 	if err != nil {
-		return err
+		return nil, err
 	}
+
+	addressToID := map[address.Address]address.Address{}
 	// gross..
 	var actorID typegen.CborInt
 	if err := addrMap.ForEach(&actorID, func(key string) error {
 		longAddr, err := address.NewFromBytes([]byte(key))
 		if err != nil {
-			return err
+			return xerrors.Errorf("decode init actor address map key: %w", decodeError(err))
 		}
 		shortAddr, err := address.NewIDAddress(uint64(actorID))
 		if err != nil {
@@ -174,126 +582,752 @@ func (p Processor) storeActorAddresses(ctx context.Context, actors map[cid.Cid]A
 		addressToID[longAddr] = shortAddr
 		return nil
 	}); err != nil {
-		return err
-	}
-	tx, err := p.db.Begin()
-	if err != nil {
-		return err
+		return nil, err
 	}
+	return addressToID, nil
+}
 
-	if _, err := tx.Exec(`
-create temp table iam (like id_address_map excluding constraints) on commit drop;
-`); err != nil {
-		return xerrors.Errorf("prep temp: %w", err)
-	}
+// storeAddressMap writes addressToID to id_address_map, moving rows whose ID now maps to another address.
+func (p *Processor) storeAddressMap(ctx context.Context, addressToID map[address.Address]address.Address) error {
+	return classifyStoreErr(withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if err := p.putAddressMap(ctx, tx, addressToID); err != nil {
+			return xerrors.Errorf("address put: %w", err)
+		}
 
-	stmt, err := tx.Prepare(`copy iam (id, address) from STDIN `)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	}))
+}
+
+// putAddressMap writes addressToID to id_address_map in tx. An ID already mapped to another address is moved to its
+// address in addressToID by updateAddresses rather than left to the insert, which would skip it on the conflict on
+// id and leave the map stale.
+func (p *Processor) putAddressMap(ctx context.Context, tx *sql.Tx, addressToID map[address.Address]address.Address) error {
+	updates, err := p.addressUpdates(ctx, tx, addressToID)
 	if err != nil {
 		return err
 	}
+	if err := updateAddresses(tx, updates); err != nil {
+		return err
+	}
 
+	mappings := make([]addressMapping, 0, len(addressToID))
+	rows := make([][]interface{}, 0, len(addressToID))
 	for a, i := range addressToID {
 		if i == address.Undef {
 			continue
 		}
-		if _, err := stmt.Exec(
-			i.String(),
-			a.String(),
-		); err != nil {
-			return err
-		}
+		mappings = append(mappings, addressMapping{ID: i, PK: a})
+		rows = append(rows, []interface{}{i.String(), a.String()})
 	}
-	if err := stmt.Close(); err != nil {
+	if err := p.bulkInserter(tx).BulkInsert(ctx, "id_address_map", []string{"id", "address"}, rows); err != nil {
+		var re *RowError
+		if xerrors.As(err, &re) && re.Row >= 0 && re.Row < len(mappings) {
+			m := mappings[re.Row]
+			return xerrors.Errorf("%s (id %s): %w", m.PK, m.ID, err)
+		}
 		return err
 	}
+	return nil
+}
 
-	if _, err := tx.Exec(`insert into id_address_map select * from iam on conflict do nothing `); err != nil {
-		return xerrors.Errorf("actor put: %w", err)
+// addressMapping is a row of id_address_map.
+type addressMapping struct {
+	ID address.Address
+	PK address.Address
+}
+
+// addressUpdate replaces a row of id_address_map. After a reorg the init actor can have assigned an ID to a different
+// robust address than the one recorded from the abandoned fork, and an ID first recorded from a message can have been
+// resolved to another address than the init actor maps it to.
+type addressUpdate struct {
+	Old addressMapping
+	New addressMapping
+}
+
+// addressUpdates returns the rows of id_address_map whose ID is mapped to a different address in addressToID.
+// Addresses still mapped to another ID, as when two IDs swapped addresses, are left alone since moving them would
+// violate the unique address index. Only the rows of the IDs and addresses in addressToID are read.
+func (p *Processor) addressUpdates(ctx context.Context, tx *sql.Tx, addressToID map[address.Address]address.Address) ([]addressUpdate, error) {
+	ids := make([]string, 0, len(addressToID))
+	pks := make([]string, 0, len(addressToID))
+	for pk, id := range addressToID {
+		if id == address.Undef {
+			continue
+		}
+		ids = append(ids, id.String())
+		pks = append(pks, pk.String())
 	}
 
-	return tx.Commit()
+	byID := map[string]string{}
+	stored := map[string]struct{}{}
+	scan := func(rows *sql.Rows) error {
+		defer rows.Close() //nolint:errcheck
+
+		for rows.Next() {
+			var id, pk string
+			if err := rows.Scan(&id, &pk); err != nil {
+				return xerrors.Errorf("scan stored address: %w", err)
+			}
+			byID[id] = pk
+			stored[pk] = struct{}{}
+		}
+		return rows.Err()
+	}
+
+	if p.Backend != BackendSQLite {
+		rows, err := tx.QueryContext(ctx, `select id, address from id_address_map where id = any($1) or address = any($2)`, pq.Array(ids), pq.Array(pks))
+		if err != nil {
+			return nil, xerrors.Errorf("query stored addresses: %w", err)
+		}
+		if err := scan(rows); err != nil {
+			return nil, err
+		}
+	} else {
+		// SQLite has no arrays, the IDs and addresses are bound one parameter each.
+		for _, q := range []struct {
+			column string
+			values []string
+		}{{"id", ids}, {"address", pks}} {
+			for _, b := range batchRanges(len(q.values), sqliteMaxVariables) {
+				args := make([]interface{}, 0, b[1]-b[0])
+				for _, v := range q.values[b[0]:b[1]] {
+					args = append(args, v)
+				}
+				rows, err := tx.QueryContext(ctx, `select id, address from id_address_map where `+q.column+` in (`+sqlitePlaceholders(len(args))+`)`, args...)
+				if err != nil {
+					return nil, xerrors.Errorf("query stored addresses: %w", err)
+				}
+				if err := scan(rows); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var out []addressUpdate
+	for pk, id := range addressToID {
+		if id == address.Undef {
+			continue
+		}
+		old, ok := byID[id.String()]
+		if !ok || old == pk.String() {
+			continue
+		}
+		if _, ok := stored[pk.String()]; ok {
+			continue
+		}
+
+		oldPK, err := address.NewFromString(old)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, addressUpdate{
+			Old: addressMapping{ID: id, PK: oldPK},
+			New: addressMapping{ID: id, PK: pk},
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Old.ID.String() < out[j].Old.ID.String()
+	})
+	return out, nil
+}
+
+// updateAddresses applies updates to id_address_map with a single prepared statement.
+func updateAddresses(tx *sql.Tx, updates []addressUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.Prepare(`update id_address_map set id = $1, address = $2 where id = $3 and address = $4`)
+	if err != nil {
+		return xerrors.Errorf("prepare id_address_map update: %w", err)
+	}
+	defer stmt.Close() //nolint:errcheck
+
+	for _, u := range updates {
+		log.Infow("id address mapping changed", "id", u.Old.ID, "from", u.Old.PK, "to", u.New.PK)
+		if _, err := stmt.Exec(u.New.ID.String(), u.New.PK.String(), u.Old.ID.String(), u.Old.PK.String()); err != nil {
+			return xerrors.Errorf("update id_address_map %s: %w", u.Old.ID, err)
+		}
+	}
+	return stmt.Close()
 }
 
-func (p *Processor) storeActorHeads(actors map[cid.Cid]ActorTips) error {
+func (p *Processor) storeActorHeads(ctx context.Context, actors map[cid.Cid]ActorTips) (err error) {
 	start := time.Now()
+	var stored int
 	defer func() {
-		log.Debugw("Stored Actor Heads", "duration", time.Since(start).String())
+		err = classifyStoreErr(err)
+		p.recordStore(ctx, "actors", start, stored, err)
+		p.logger().Debugw("Stored Actor Heads", "duration", time.Since(start).String())
 	}()
+
+	ids, err := p.resolveIDs(ctx, actors)
+	if err != nil {
+		return xerrors.Errorf("resolve actor ID addresses: %w", err)
+	}
+
+	var heads []actorHeadRow
+	for code, actTips := range actors {
+		for _, actorInfo := range actTips {
+			for _, a := range actorInfo {
+				if missingActor(code, a) {
+					continue
+				}
+				nonce, err := p.dbActorNonce(a.act.Nonce)
+				if err != nil {
+					return xerrors.Errorf("actor %s at %s: %w", a.addr, a.stateroot, decodeError(err))
+				}
+				balance, err := dbBalance(a.act.Balance)
+				if err != nil {
+					return xerrors.Errorf("actor %s at %s: %w", a.addr, a.stateroot, decodeError(err))
+				}
+				heads = append(heads, actorHeadRow{id: ids[a.addr], code: code, info: a, nonce: nonce, balance: balance})
+			}
+		}
+	}
+
+	if p.Mode == ModeLatest {
+		heads = latestHeads(heads)
+	}
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].id.String() < heads[j].id.String()
+	})
+
+	if err := p.ensureActorPartitions(ctx, heads); err != nil {
+		return xerrors.Errorf("create actors partitions: %w", err)
+	}
+
+	// each batch commits on its own, rows of a batch already stored by an earlier one are skipped by the conflict
+	// clause the same way they are within a batch.
+	for _, b := range batchRanges(len(heads), p.BatchSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := uniqueHeads(heads[b[0]:b[1]])
+		if err := withRetry(ctx, func() error {
+			return p.storeActorHeadBatch(ctx, batch)
+		}); err != nil {
+			return err
+		}
+		stored += len(batch)
+	}
+
+	for code, n := range actorCounts(heads) {
+		p.metrics().ActorsProcessed(ctx, code, n)
+	}
+	return nil
+}
+
+// actorCounts returns the number of heads of each actor code.
+func actorCounts(heads []actorHeadRow) map[cid.Cid]int64 {
+	out := map[cid.Cid]int64{}
+	for _, h := range heads {
+		out[h.code]++
+	}
+	return out
+}
+
+// latestHeads keeps the highest head of each actor. An upsert can't update the same row twice in one statement.
+func latestHeads(heads []actorHeadRow) []actorHeadRow {
+	latest := map[address.Address]int{}
+	var out []actorHeadRow
+	for _, h := range heads {
+		i, ok := latest[h.id]
+		if !ok {
+			latest[h.id] = len(out)
+			out = append(out, h)
+			continue
+		}
+		if h.info.height > out[i].info.height {
+			out[i] = h
+		}
+	}
+	return out
+}
+
+// actorHeadKey identifies a row of actors, the columns of the unique index on actors.
+type actorHeadKey struct {
+	id        address.Address
+	head      cid.Cid
+	stateroot cid.Cid
+}
+
+// uniqueHeads drops the heads repeated within batch, such as an actor left unchanged across tipsets sharing a parent
+// state, so they are not encoded and copied only to be skipped by the conflict clause. Only a batch is deduplicated at
+// a time, which keeps the heads remembered bounded by the batch size.
+func uniqueHeads(batch []actorHeadRow) []actorHeadRow {
+	seen := make(map[actorHeadKey]struct{}, len(batch))
+	out := make([]actorHeadRow, 0, len(batch))
+	for _, h := range batch {
+		k := actorHeadKey{id: h.id, head: h.info.act.Head, stateroot: h.info.stateroot}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, h)
+	}
+	return out
+}
+
+// actorHeadRow is a row of actors.
+type actorHeadRow struct {
+	id   address.Address
+	code cid.Cid
+	info actorInfo
+	// nonce is the nonce of info in the encoding of actors.nonce.
+	nonce string
+	// balance is the balance of info in the encoding of actors.balance.
+	balance string
+}
+
+// actorsColumns are the columns of actors written by storeActorHeadBatch.
+var actorsColumns = []string{"id", "code", "head", "nonce", "balance", "stateroot", "tipset_key", "epoch"}
+
+func (p *Processor) storeActorHeadBatch(ctx context.Context, heads []actorHeadRow) error {
 	// Basic
-	tx, err := p.db.Begin()
+	tx, err := p.beginStoreTx(ctx)
 	if err != nil {
 		return err
 	}
-	if _, err := tx.Exec(`
-		create temp table a (like actors excluding constraints) on commit drop;
-	`); err != nil {
-		return xerrors.Errorf("prep temp: %w", err)
+	defer p.rollbackStoreTx(ctx, tx)
+
+	rows := make([][]interface{}, len(heads))
+	for i, h := range heads {
+		rows[i] = []interface{}{h.id.String(), h.code.String(), h.info.act.Head.String(), h.nonce, h.balance, h.info.stateroot.String(), h.info.tsKey.String(), int64(h.info.height)}
 	}
 
-	stmt, err := tx.Prepare(`copy a (id, code, head, nonce, balance, stateroot) from stdin `)
+	bulk := p.bulkInserter(tx)
+	if p.Mode == ModeLatest {
+		// a backfill or an older batch written after a newer one leaves the latest head in place.
+		err = bulk.BulkUpsert(ctx, "actors", actorsColumns, []string{"id"}, "epoch", rows)
+	} else {
+		err = bulk.BulkInsert(ctx, "actors", actorsColumns, rows)
+	}
 	if err != nil {
+		var re *RowError
+		if xerrors.As(err, &re) && re.Row >= 0 && re.Row < len(heads) {
+			h := heads[re.Row]
+			return xerrors.Errorf("actor put %s (id %s, code %s) at %s: %w", h.info.addr, h.id, h.code, h.info.stateroot, err)
+		}
+		return xerrors.Errorf("actor put: %w", err)
+	}
+	if err := p.sinkActorHeads(ctx, heads); err != nil {
 		return err
 	}
 
-	for code, actTips := range actors {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.commitStoreTx(ctx, tx)
+}
+
+// batchRanges splits n rows into [start, end) ranges of at most size rows, a single range if size is not positive.
+func batchRanges(n, size int) [][2]int {
+	if n == 0 {
+		return nil
+	}
+	if size <= 0 || size >= n {
+		return [][2]int{{0, n}}
+	}
+	var out [][2]int
+	for start := 0; start < n; start += size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+		out = append(out, [2]int{start, end})
+	}
+	return out
+}
+
+// resolveIDs maps the address of every actor in actors to its ID address, actors.id must always hold the ID address to
+// satisfy its reference to id_address_map. Robust addresses are resolved in bulk from id_address_map, and any still
+// unknown through the node as of the tipset the actor changed in.
+func (p *Processor) resolveIDs(ctx context.Context, actors map[cid.Cid]ActorTips) (map[address.Address]address.Address, error) {
+	out := map[address.Address]address.Address{}
+	unresolved := map[address.Address]types.TipSetKey{}
+	for _, actTips := range actors {
 		for _, actorInfo := range actTips {
 			for _, a := range actorInfo {
-				if _, err := stmt.Exec(a.addr.String(), code.String(), a.act.Head.String(), a.act.Nonce, a.act.Balance.String(), a.stateroot.String()); err != nil {
-					return err
+				if a.addr.Protocol() == address.ID {
+					out[a.addr] = a.addr
+					continue
 				}
+				unresolved[a.addr] = a.tsKey
 			}
 		}
 	}
+	if len(unresolved) == 0 {
+		return out, nil
+	}
 
-	if err := stmt.Close(); err != nil {
-		return err
+	robust := make([]string, 0, len(unresolved))
+	for a := range unresolved {
+		robust = append(robust, a.String())
 	}
 
-	if _, err := tx.Exec(`insert into actors select * from a on conflict do nothing `); err != nil {
-		return xerrors.Errorf("actor put: %w", err)
+	found, err := p.lookupIDs(ctx, robust)
+	if err != nil {
+		return nil, err
+	}
+	for robustAddr, idAddr := range found {
+		out[robustAddr] = idAddr
+		delete(unresolved, robustAddr)
 	}
 
-	return tx.Commit()
+	viaNode, err := p.lookupIDsOnNode(ctx, unresolved, lookupWorkers)
+	if err != nil {
+		return nil, err
+	}
+	for a, idAddr := range viaNode {
+		out[a] = idAddr
+	}
+	return out, nil
+}
+
+// lookupWorkers is the number of concurrent StateLookupID calls resolving the addresses a batch does not know yet.
+const lookupWorkers = 16
+
+// lookupIDsOnNode resolves every address of addrs through the node as of the tipset it is keyed by, on up to workers
+// concurrent calls. Every lookup is independent so the order they complete in does not matter.
+func (p *Processor) lookupIDsOnNode(ctx context.Context, addrs map[address.Address]types.TipSetKey, workers int) (map[address.Address]address.Address, error) {
+	type lookup struct {
+		addr address.Address
+		tsk  types.TipSetKey
+	}
+
+	var lk sync.Mutex
+	out := make(map[address.Address]address.Address, len(addrs))
+
+	grp, ctx := errgroup.WithContext(ctx)
+	lookups := make(chan lookup)
+	grp.Go(func() error {
+		defer close(lookups)
+		for a, tsk := range addrs {
+			select {
+			case lookups <- lookup{addr: a, tsk: tsk}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+
+	for i := 0; i < workers && i < len(addrs); i++ {
+		grp.Go(func() error {
+			for l := range lookups {
+				idAddr, err := p.stateLookupID(ctx, l.addr, l.tsk)
+				if err != nil {
+					return xerrors.Errorf("lookup ID address of %s: %w", l.addr, err)
+				}
+				lk.Lock()
+				out[l.addr] = idAddr
+				lk.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := grp.Wait(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// lookupIDs returns the ID addresses id_address_map holds for the robust addresses.
+func (p *Processor) lookupIDs(ctx context.Context, robust []string) (map[address.Address]address.Address, error) {
+	out := map[address.Address]address.Address{}
+	scan := func(rows *sql.Rows) error {
+		defer rows.Close() //nolint:errcheck
+
+		for rows.Next() {
+			var id, addr string
+			if err := rows.Scan(&id, &addr); err != nil {
+				return xerrors.Errorf("scan id_address_map: %w", err)
+			}
+			idAddr, err := address.NewFromString(id)
+			if err != nil {
+				return err
+			}
+			robustAddr, err := address.NewFromString(addr)
+			if err != nil {
+				return err
+			}
+			out[robustAddr] = idAddr
+		}
+		return rows.Err()
+	}
+
+	if p.Backend != BackendSQLite {
+		rows, err := p.storeReader(ctx).QueryContext(ctx, `select id, address from id_address_map where address = any($1)`, pq.Array(robust))
+		if err != nil {
+			return nil, xerrors.Errorf("query id_address_map: %w", err)
+		}
+		return out, scan(rows)
+	}
+
+	// SQLite has no arrays, the addresses are bound one parameter each.
+	for _, b := range batchRanges(len(robust), sqliteMaxVariables) {
+		args := make([]interface{}, 0, b[1]-b[0])
+		for _, a := range robust[b[0]:b[1]] {
+			args = append(args, a)
+		}
+		rows, err := p.storeReader(ctx).QueryContext(ctx, `select id, address from id_address_map where address in (`+sqlitePlaceholders(len(args))+`)`, args...)
+		if err != nil {
+			return nil, xerrors.Errorf("query id_address_map: %w", err)
+		}
+		if err := scan(rows); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// dbNonce converts a nonce to the signed 64 bit value stored in a bigint column. Nonces beyond the signed range can't be
+// stored without wrapping negative and are rejected instead.
+func dbNonce(nonce uint64) (int64, error) {
+	if nonce > math.MaxInt64 {
+		return 0, xerrors.Errorf("nonce %d overflows bigint", nonce)
+	}
+	return int64(nonce), nil
+}
+
+// dbActorNonce returns the encoding of nonce written to actors.nonce, its decimal integer. The numeric column of Postgres
+// holds every nonce, the bigint column of a SQLite database rejects the ones beyond the signed range as dbNonce does.
+func (p *Processor) dbActorNonce(nonce uint64) (string, error) {
+	if p.Backend == BackendSQLite {
+		if _, err := dbNonce(nonce); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatUint(nonce, 10), nil
+}
+
+// missingActor reports whether the actor of a change is missing, as when fetching it failed partway, and logs it. The
+// change is skipped by the stores rather than storing a row without a head or failing on its unset balance.
+func missingActor(code cid.Cid, a actorInfo) bool {
+	if a.act.Head.Defined() && a.act.Balance.Int != nil {
+		return false
+	}
+	log.Warnw("Skipping actor change without an actor", "address", a.addr, "code", code, "stateroot", a.stateroot, "tipset", a.tsKey)
+	return true
 }
 
-func (p *Processor) storeActorStates(actors map[cid.Cid]ActorTips) error {
+// dbBalance returns the encoding of balance written to actors.balance, the canonical decimal integer a numeric column
+// reads. Postgres rejects any other, the text column of a SQLite database would store it as is.
+func dbBalance(balance big.Int) (string, error) {
+	return checkBalance(balance.String())
+}
+
+// checkBalance returns s if it is the canonical decimal encoding of a non-negative integer, such as the String of a
+// big.Int which is set.
+func checkBalance(s string) (string, error) {
+	b, err := big.FromString(s)
+	if err != nil {
+		return "", xerrors.Errorf("balance %q is not an integer: %w", s, err)
+	}
+	if b.Sign() < 0 {
+		return "", xerrors.Errorf("balance %s is negative", s)
+	}
+	if b.String() != s {
+		return "", xerrors.Errorf("balance %q is not in canonical form", s)
+	}
+	return s, nil
+}
+
+func (p *Processor) storeActorStates(ctx context.Context, actors map[cid.Cid]ActorTips) (err error) {
 	start := time.Now()
+	rows, skipped := p.stateCache.filter(actors)
 	defer func() {
-		log.Debugw("Stored Actor States", "duration", time.Since(start).String())
+		err = classifyStoreErr(err)
+		p.recordStore(ctx, "actor_states", start, len(rows), err)
+		p.logger().Debugw("Stored Actor States", "duration", time.Since(start).String(), "stored", len(rows), "skipped", skipped, "cache_hit_rate", p.stateCache.hitRate())
 	}()
-	// States
-	tx, err := p.db.Begin()
-	if err != nil {
-		return err
+	p.metrics().CacheLookups(ctx, cacheActorState, skipped, int64(len(rows)))
+
+	if len(rows) == 0 {
+		return nil
 	}
-	if _, err := tx.Exec(`
-		create temp table a (like actor_states excluding constraints) on commit drop;
-	`); err != nil {
-		return xerrors.Errorf("prep temp: %w", err)
+	rows, undecoded := p.undecodedStates(rows)
+	if len(rows) == 0 {
+		return p.storeActorStateErrors(ctx, undecoded)
 	}
 
-	stmt, err := tx.Prepare(`copy a (head, code, state) from stdin `)
-	if err != nil {
+	// rows are checked by a pool of workers while the ones already checked are written, the copy itself runs in a
+	// single transaction at a time. The order rows are written in doesn't matter, conflicts are skipped.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	valid, invalid := checkStates(ctx, rows, runtime.GOMAXPROCS(0))
+
+	size := p.BatchSize
+	if size <= 0 {
+		size = len(rows)
+	}
+	batch := make([]actorStateRow, 0, size)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := withRetry(ctx, func() error {
+			return p.storeActorStateBatch(ctx, batch)
+		}); err != nil {
+			return err
+		}
+		// a dry run stores nothing, the states are written again by the next one.
+		if !p.DryRun {
+			stored := batch
+			afterCommit(ctx, func() {
+				p.stateCache.add(stored)
+			})
+		}
+		batch = make([]actorStateRow, 0, size)
+		return nil
+	}
+
+	for r := range valid {
+		batch = append(batch, r)
+		if len(batch) < size {
+			continue
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
 		return err
 	}
 
-	for code, actTips := range actors {
-		for _, actorInfo := range actTips {
-			for _, a := range actorInfo {
-				if _, err := stmt.Exec(a.act.Head.String(), code.String(), a.state); err != nil {
-					return err
+	// a state that isn't valid JSON would fail the whole batch, it is recorded on its own instead.
+	return p.storeActorStateErrors(ctx, append(<-invalid, undecoded...))
+}
+
+// checkStates checks rows on workers goroutines, sending the ones whose state can be stored to the first channel as
+// they are checked, in no particular order. Once every row is checked, or ctx is done, the first channel is closed and
+// the rows that can't be stored are sent to the second.
+func checkStates(ctx context.Context, rows []actorStateRow, workers int) (<-chan actorStateRow, <-chan []actorStateError) {
+	if workers < 1 {
+		workers = 1
+	}
+	valid := make(chan actorStateRow, workers)
+	invalid := make(chan []actorStateError, 1)
+
+	var (
+		wg      sync.WaitGroup
+		lk      sync.Mutex
+		skipped []actorStateError
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(rows); i += workers {
+				ok, e := checkState(rows[i])
+				if !ok {
+					lk.Lock()
+					skipped = append(skipped, e)
+					lk.Unlock()
+					continue
+				}
+				select {
+				case valid <- rows[i]:
+				case <-ctx.Done():
+					return
 				}
 			}
-		}
+		}(w)
+	}
+
+	go func() {
+		wg.Wait()
+		close(valid)
+		invalid <- skipped
+	}()
+	return valid, invalid
+}
+
+// actorStateError is a row of actor_states_errors.
+type actorStateError struct {
+	actorStateKey
+	reason string
+}
+
+// checkState reports whether the state of r can be stored in the json state column, and why not if it can't.
+func checkState(r actorStateRow) (bool, actorStateError) {
+	var reason string
+	switch {
+	case strings.TrimSpace(r.state) == "":
+		reason = "empty state"
+	case !json.Valid([]byte(r.state)):
+		reason = "state is not valid JSON"
+	default:
+		return true, actorStateError{}
+	}
+	log.Warnw("Skipping actor state that can't be stored", "head", r.head, "code", r.code, "reason", reason)
+	return false, actorStateError{actorStateKey: r.actorStateKey, reason: reason}
+}
+
+func (p *Processor) storeActorStateErrors(ctx context.Context, invalid []actorStateError) error {
+	if len(invalid) == 0 {
+		return nil
 	}
 
-	if err := stmt.Close(); err != nil {
+	rows := make([][]interface{}, len(invalid))
+	for i, e := range invalid {
+		rows[i] = []interface{}{e.head.String(), e.code.String(), e.reason}
+	}
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "actor_states_errors", []string{"head", "code", "reason"}, rows); err != nil {
+			return xerrors.Errorf("actor state errors put: %w", err)
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+func (p *Processor) storeActorStateBatch(ctx context.Context, rows []actorStateRow) error {
+	// States
+	tx, err := p.beginStoreTx(ctx)
+	if err != nil {
 		return err
 	}
+	defer p.rollbackStoreTx(ctx, tx)
 
-	if _, err := tx.Exec(`insert into actor_states select * from a on conflict do nothing `); err != nil {
-		return xerrors.Errorf("actor put: %w", err)
+	states := make([][]interface{}, len(rows))
+	for i, r := range rows {
+		states[i] = []interface{}{r.head.String(), r.code.String(), r.state}
+	}
+	if err := p.bulkInserter(tx).BulkInsert(ctx, "actor_states", []string{"head", "code", "state"}, states); err != nil {
+		var re *RowError
+		if xerrors.As(err, &re) && re.Row >= 0 && re.Row < len(rows) {
+			r := rows[re.Row]
+			return xerrors.Errorf("actor state put %s (code %s): %w", r.head, r.code, err)
+		}
+		return xerrors.Errorf("actor state put: %w", err)
+	}
+	if err := p.sinkActorStates(ctx, rows); err != nil {
+		return err
 	}
 
-	return tx.Commit()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.commitStoreTx(ctx, tx)
 }
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin/cron"
+
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// cronActorInfo is the entries registered with the cron actor at a state root they changed in.
+type cronActorInfo struct {
+	common actorInfo
+
+	entries []cron.Entry
+}
+
+func (p *Processor) setupCron() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/*
+* the callbacks registered with the cron actor, stored at genesis and at every
+* state root the set of them changed in. idx is the order cron calls them in
+*/
+create table if not exists cron_entries
+(
+	state_root text not null,
+	epoch bigint not null,
+	idx bigint not null,
+	receiver text not null,
+	method bigint not null,
+	constraint cron_entries_pk
+		primary key (state_root, idx)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandleCronChanges(ctx context.Context, cronTips ActorTips) error {
+	changes, err := p.processCron(ctx, cronTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process cron actor: %w", err)
+	}
+
+	return p.storeCronEntries(ctx, changes)
+}
+
+// processCron returns the entries of every cron actor change in which they differ from the parent tipset. Most
+// changes leave the entries as they are, only a network upgrade registers new ones.
+func (p *Processor) processCron(ctx context.Context, cronTips ActorTips) ([]cronActorInfo, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Processed Cron Actor", "duration", time.Since(start).String())
+	}()
+
+	pred := state.NewStatePredicates(p.node)
+
+	var out []cronActorInfo
+	for _, crons := range cronTips {
+		for _, ct := range crons {
+			// genesis has no parent to diff against, every entry it holds is new.
+			if ct.parentTsKey == types.EmptyTSK {
+				var st cron.State
+				if err := cw_util.NewAPIIpldStore(ctx, p.node).Get(ctx, ct.act.Head, &st); err != nil {
+					return nil, xerrors.Errorf("read genesis cron state (@ %s): %w", ct.stateroot, err)
+				}
+				out = append(out, cronActorInfo{common: ct, entries: st.Entries})
+				continue
+			}
+
+			entriesDiff := pred.OnCronActorChanged(pred.OnCronEntriesChanged())
+			changed, val, err := entriesDiff(ctx, ct.parentTsKey, ct.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("diff cron entries (@ %s): %w", ct.stateroot, err)
+			}
+			if !changed {
+				continue
+			}
+			changes, ok := val.(*state.CronEntriesChange)
+			if !ok {
+				return nil, xerrors.Errorf("Unknown type returned by Cron Entries predicate: %T", val)
+			}
+			out = append(out, cronActorInfo{common: ct, entries: changes.To})
+		}
+	}
+	return out, nil
+}
+
+func (p *Processor) storeCronEntries(ctx context.Context, crons []cronActorInfo) error {
+	if len(crons) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Cron Entries", "duration", time.Since(start).String())
+	}()
+
+	var rows [][]interface{}
+	for _, c := range crons {
+		for i, e := range c.entries {
+			rows = append(rows, []interface{}{c.common.stateroot.String(), c.common.height, i, e.Receiver.String(), int64(e.MethodNum)})
+		}
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin cron_entries tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		cols := []string{"state_root", "epoch", "idx", "receiver", "method"}
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "cron_entries", cols, rows); err != nil {
+			return xerrors.Errorf("store cron entries: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
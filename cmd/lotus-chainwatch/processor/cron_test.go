@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/cron"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// cronFixture returns a node and the cron actor changes of a genesis holding the built in entries, of a tipset leaving
+// them unchanged and of one registering an extra entry.
+func cronFixture(t *testing.T) (*testNode, []ActorTips, cron.Entry) {
+	node := newTestNode()
+	extra := cron.Entry{Receiver: mock.Address(1000), MethodNum: 5}
+
+	var out []ActorTips
+	parent := types.EmptyTSK
+	for i, entries := range [][]cron.Entry{cron.BuiltInEntries(), cron.BuiltInEntries(), append(cron.BuiltInEntries(), extra)} {
+		tsk := types.NewTipSetKey(testCid(t, fmt.Sprintf("block-%d", i)))
+		act := node.putActor(t, tsk, builtin.CronActorAddr, builtin.CronActorCodeID, cron.ConstructState(entries))
+		out = append(out, actorChange(t, builtin.CronActorAddr, act, abi.ChainEpoch(i), tsk, parent))
+		parent = tsk
+	}
+	return node, out, extra
+}
+
+func TestProcessCron(t *testing.T) {
+	ctx := context.Background()
+	node, tips, extra := cronFixture(t)
+	p := &Processor{node: node}
+
+	// the genesis entries are captured in full.
+	infos, err := p.processCron(ctx, tips[0])
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, cron.BuiltInEntries(), infos[0].entries)
+
+	// unchanged entries are not emitted again.
+	infos, err = p.processCron(ctx, tips[1])
+	require.NoError(t, err)
+	require.Empty(t, infos)
+
+	infos, err = p.processCron(ctx, tips[2])
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, append(cron.BuiltInEntries(), extra), infos[0].entries)
+}
+
+func TestStoreCron(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	node, tips, extra := cronFixture(t)
+
+	p := &Processor{db: db, node: node}
+	require.NoError(t, p.setupCron())
+	_, err := db.Exec(`truncate cron_entries`)
+	require.NoError(t, err)
+
+	for _, ct := range tips {
+		require.NoError(t, p.HandleCronChanges(ctx, ct))
+	}
+
+	builtIn := len(cron.BuiltInEntries())
+	require.Equal(t, 2*builtIn+1, countRows(t, db, `select count(*) from cron_entries`))
+	require.Equal(t, 0, countRows(t, db, `select count(*) from cron_entries where epoch = 1`))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from cron_entries where epoch = 2 and idx = $1 and receiver = $2 and method = $3`,
+		builtIn, extra.Receiver.String(), int64(extra.MethodNum)))
+}
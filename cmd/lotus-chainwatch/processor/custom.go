@@ -0,0 +1,111 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ActorChange is the exported view of an actor state change in a tipset, as handed to custom processors.
+type ActorChange struct {
+	Address   address.Address
+	Actor     types.Actor
+	StateRoot cid.Cid
+	Height    abi.ChainEpoch
+
+	TipSet       types.TipSetKey
+	ParentTipSet types.TipSetKey
+
+	// State is the JSON encoded actor state.
+	State string
+}
+
+func (a actorInfo) change() ActorChange {
+	return ActorChange{
+		Address:      a.addr,
+		Actor:        a.act,
+		StateRoot:    a.stateroot,
+		Height:       a.height,
+		TipSet:       a.tsKey,
+		ParentTipSet: a.parentTsKey,
+		State:        a.state,
+	}
+}
+
+// ActorChangeHandler lets code outside of this package track actors the processor has no built in support for.
+type ActorChangeHandler interface {
+	// Setup creates the tables the handler writes to, it is called once when the processor starts.
+	Setup(db *sql.DB) error
+
+	// HandleActorChanges is called once per processed batch with the changes of every actor having one of the codes
+	// the handler was registered for, grouped by tipset. pred can be used to diff actor state across tipsets.
+	HandleActorChanges(ctx context.Context, pred *state.StatePredicates, db *sql.DB, changes map[types.TipSetKey][]ActorChange) error
+}
+
+type customProcessor struct {
+	name    string
+	codes   []cid.Cid
+	handler ActorChangeHandler
+}
+
+// RegisterProcessor adds a handler that runs alongside the built in processors for actors with the given codes. It
+// must be called before Start.
+func (p *Processor) RegisterProcessor(name string, codes []cid.Cid, handler ActorChangeHandler) {
+	p.custom = append(p.custom, customProcessor{
+		name:    name,
+		codes:   codes,
+		handler: handler,
+	})
+}
+
+func (p *Processor) setupCustomProcessors() error {
+	for _, cp := range p.custom {
+		if err := cp.handler.Setup(p.db); err != nil {
+			return xerrors.Errorf("setup of custom processor %s: %w", cp.name, err)
+		}
+	}
+	return nil
+}
+
+func (p *Processor) HandleCustomChanges(ctx context.Context, actors map[cid.Cid]ActorTips) error {
+	pred := state.NewStatePredicates(p.node)
+
+	grp, ctx := errgroup.WithContext(ctx)
+	for _, cp := range p.custom {
+		cp := cp
+		grp.Go(func() error {
+			return p.handleCustom(ctx, pred, cp, actors)
+		})
+	}
+	return grp.Wait()
+}
+
+// handleCustom passes the changes of the actors cp is registered for to its handler.
+func (p *Processor) handleCustom(ctx context.Context, pred *state.StatePredicates, cp customProcessor, actors map[cid.Cid]ActorTips) error {
+	changes := map[types.TipSetKey][]ActorChange{}
+	for _, code := range cp.codes {
+		for tsKey, infos := range actors[code] {
+			for _, info := range infos {
+				changes[tsKey] = append(changes[tsKey], info.change())
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := cp.handler.HandleActorChanges(ctx, pred, p.db, changes); err != nil {
+		return xerrors.Errorf("custom processor %s: %w", cp.name, err)
+	}
+	return nil
+}
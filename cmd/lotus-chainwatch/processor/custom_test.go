@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+type recordingHandler struct {
+	lk      sync.Mutex
+	setup   bool
+	changes map[types.TipSetKey][]ActorChange
+}
+
+func (r *recordingHandler) Setup(db *sql.DB) error {
+	r.setup = true
+	return nil
+}
+
+func (r *recordingHandler) HandleActorChanges(ctx context.Context, pred *state.StatePredicates, db *sql.DB, changes map[types.TipSetKey][]ActorChange) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.changes = changes
+	return nil
+}
+
+func TestCustomProcessor(t *testing.T) {
+	actors, addrs := syntheticActorTips(t, 3, 2)
+	// a code the custom processor is not registered for must not reach it.
+	actors[builtin.MultisigActorCodeID] = ActorTips{}
+
+	rh := &recordingHandler{}
+	p := &Processor{}
+	p.RegisterProcessor("accounts", []cid.Cid{builtin.AccountActorCodeID}, rh)
+
+	require.NoError(t, p.setupCustomProcessors())
+	require.True(t, rh.setup)
+
+	require.NoError(t, p.HandleCustomChanges(context.Background(), actors))
+	require.Len(t, rh.changes, 3)
+	for tsKey, changes := range rh.changes {
+		require.Len(t, changes, len(addrs))
+		for _, c := range changes {
+			require.Equal(t, tsKey, c.TipSet)
+			require.Equal(t, builtin.AccountActorCodeID, c.Actor.Code)
+		}
+	}
+}
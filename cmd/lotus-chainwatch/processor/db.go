@@ -0,0 +1,168 @@
+package processor
+
+import (
+	"database/sql"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// DefaultMaxOpenConns bounds the connections to Postgres, the processors and the syncer write concurrently.
+	DefaultMaxOpenConns = 1350
+	// DefaultMaxIdleConns is the number of idle connections kept open, the database/sql default.
+	DefaultMaxIdleConns = 2
+)
+
+// sslModes are the sslmode values lib/pq supports.
+var sslModes = map[string]bool{
+	"disable":     true,
+	"require":     true,
+	"verify-ca":   true,
+	"verify-full": true,
+}
+
+type config struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	sslMode         string
+
+	// node and batch are the ones of the Processor built by NewProcessor, OpenDB ignores them.
+	node  Node
+	batch int
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{
+		maxOpenConns: DefaultMaxOpenConns,
+		maxIdleConns: DefaultMaxIdleConns,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// Option configures the connection pool of the database opened by OpenDB and NewProcessor, or the Processor built by
+// NewProcessor.
+type Option func(*config)
+
+// WithMaxOpenConns bounds the connections open at once, 0 for no bound.
+func WithMaxOpenConns(n int) Option {
+	return func(c *config) {
+		c.maxOpenConns = n
+	}
+}
+
+// WithMaxIdleConns sets the number of idle connections kept open, a negative one keeps none.
+func WithMaxIdleConns(n int) Option {
+	return func(c *config) {
+		c.maxIdleConns = n
+	}
+}
+
+// WithConnMaxLifetime closes the connections open for longer than d once they are idle, 0 to keep them.
+func WithConnMaxLifetime(d time.Duration) Option {
+	return func(c *config) {
+		c.connMaxLifetime = d
+	}
+}
+
+// WithSSLMode sets the sslmode of the connections, overriding the one of the DSN. An empty mode keeps the one of the
+// DSN.
+func WithSSLMode(mode string) Option {
+	return func(c *config) {
+		c.sslMode = mode
+	}
+}
+
+// WithNode sets the node the Processor built by NewProcessor reads the chain from.
+func WithNode(node Node) Option {
+	return func(c *config) {
+		c.node = node
+	}
+}
+
+// WithBatch sets the number of blocks the Processor built by NewProcessor processes at a time.
+func WithBatch(n int) Option {
+	return func(c *config) {
+		c.batch = n
+	}
+}
+
+// OpenDB opens the Postgres database of dsn, a URL or key=value connection string, with the connection pool configured
+// by opts. Connections are opened as they are needed, the database is not reached before it is used.
+//
+// A dsn of SQLiteScheme followed by a path opens the SQLite database file at the path instead, BackendOf tells which
+// backend the processor writing to it runs with. opts do not apply to it, it is written through a single connection.
+// The SQLite driver is a cgo package and is only built with the sqlite build tag, without it opening a SQLite database
+// fails.
+func OpenDB(dsn string, opts ...Option) (*sql.DB, error) {
+	if BackendOf(dsn) == BackendSQLite {
+		return openSQLite(strings.TrimPrefix(dsn, SQLiteScheme))
+	}
+
+	cfg := newConfig(opts)
+	dsn, err := dsnWithSSLMode(dsn, cfg.sslMode)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, xerrors.Errorf("open database: %w", err)
+	}
+	db.SetMaxOpenConns(cfg.maxOpenConns)
+	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	return db, nil
+}
+
+// dsnWithSSLMode returns dsn connecting with mode, which replaces any sslmode it has. An empty mode keeps the sslmode
+// of dsn, which is still checked so an unsupported one fails before connecting.
+func dsnWithSSLMode(dsn, mode string) (string, error) {
+	var u *url.URL
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		if u, err = url.Parse(dsn); err != nil {
+			return "", xerrors.Errorf("parse database url: %w", err)
+		}
+	}
+
+	current := dsnParam(dsn, "sslmode")
+	if u != nil {
+		current = u.Query().Get("sslmode")
+	}
+	if mode == "" || mode == current {
+		if current != "" && !sslModes[current] {
+			return "", xerrors.Errorf("unsupported sslmode %q", current)
+		}
+		return dsn, nil
+	}
+	if !sslModes[mode] {
+		return "", xerrors.Errorf("unsupported sslmode %q", mode)
+	}
+
+	if u != nil {
+		q := u.Query()
+		q.Set("sslmode", mode)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+	// a parameter given twice takes its last value.
+	return strings.TrimSpace(dsn + " sslmode=" + mode), nil
+}
+
+// dsnParam returns the value of the parameter key of a key=value connection string, values are not quoted.
+func dsnParam(dsn, key string) string {
+	var val string
+	for _, kv := range strings.Fields(dsn) {
+		if i := strings.IndexByte(kv, '='); i > 0 && kv[:i] == key {
+			val = kv[i+1:]
+		}
+	}
+	return val
+}
@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenDBOptions(t *testing.T) {
+	db, err := OpenDB("postgres://localhost/chainwatch")
+	require.NoError(t, err)
+	require.Equal(t, DefaultMaxOpenConns, db.Stats().MaxOpenConnections)
+	require.NoError(t, db.Close())
+
+	db, err = OpenDB("postgres://localhost/chainwatch", WithMaxOpenConns(10))
+	require.NoError(t, err)
+	require.Equal(t, 10, db.Stats().MaxOpenConnections)
+	require.NoError(t, db.Close())
+
+	_, err = OpenDB("postgres://localhost/chainwatch", WithSSLMode("prefer"))
+	require.Error(t, err)
+}
+
+func TestNewProcessorOptions(t *testing.T) {
+	p, err := NewProcessor("postgres://localhost/chainwatch?sslmode=disable",
+		WithMaxOpenConns(10), WithMaxIdleConns(-1), WithConnMaxLifetime(time.Minute), WithSSLMode("require"), WithBatch(25))
+	require.NoError(t, err)
+	defer p.DB().Close() //nolint:errcheck
+
+	require.Equal(t, BackendPostgres, p.Backend)
+	require.Equal(t, 25, p.batch)
+	require.Equal(t, 10, p.DB().Stats().MaxOpenConnections)
+
+	// an unsupported sslmode fails before the database is reached.
+	_, err = NewProcessor("postgres://localhost/chainwatch", WithSSLMode("prefer"))
+	require.Error(t, err)
+}
+
+func TestOpenDBSQLite(t *testing.T) {
+	dsn := testSQLiteDSN(t)
+	require.Equal(t, BackendSQLite, BackendOf(dsn))
+	require.Equal(t, BackendPostgres, BackendOf("postgres://localhost/chainwatch"))
+
+	// the pool options don't apply to the single connection of SQLite.
+	db, err := OpenDB(dsn, WithMaxOpenConns(10))
+	require.NoError(t, err)
+	defer db.Close() //nolint:errcheck
+	require.Equal(t, 1, db.Stats().MaxOpenConnections)
+	require.NoError(t, db.Ping())
+}
+
+func TestOpenDBPool(t *testing.T) {
+	dsn := os.Getenv(testDBEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDBEnv)
+	}
+	ctx := context.Background()
+
+	db, err := OpenDB(dsn, WithMaxOpenConns(3), WithMaxIdleConns(1), WithConnMaxLifetime(50*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close() //nolint:errcheck
+
+	// the connections released beyond the idle ones kept are closed.
+	var conns []*sql.Conn
+	for i := 0; i < 3; i++ {
+		c, err := db.Conn(ctx)
+		require.NoError(t, err)
+		conns = append(conns, c)
+	}
+	require.Equal(t, 3, db.Stats().OpenConnections)
+	for _, c := range conns {
+		require.NoError(t, c.Close())
+	}
+	require.Equal(t, 1, db.Stats().Idle)
+	require.Equal(t, int64(2), db.Stats().MaxIdleClosed)
+
+	// the idle connection is closed once past its lifetime.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, db.PingContext(ctx))
+	require.NotZero(t, db.Stats().MaxLifetimeClosed)
+}
+
+func TestDSNWithSSLMode(t *testing.T) {
+	for _, tc := range []struct {
+		dsn, mode, want string
+	}{
+		{"postgres://localhost/chainwatch", "", "postgres://localhost/chainwatch"},
+		{"postgres://localhost/chainwatch", "verify-full", "postgres://localhost/chainwatch?sslmode=verify-full"},
+		{"postgres://localhost/chainwatch?sslmode=disable", "require", "postgres://localhost/chainwatch?sslmode=require"},
+		{"postgresql://localhost/chainwatch?sslmode=disable", "", "postgresql://localhost/chainwatch?sslmode=disable"},
+		{"host=localhost dbname=chainwatch", "", "host=localhost dbname=chainwatch"},
+		{"host=localhost dbname=chainwatch", "require", "host=localhost dbname=chainwatch sslmode=require"},
+		{"host=localhost sslmode=disable", "disable", "host=localhost sslmode=disable"},
+		{"host=localhost sslmode=disable", "verify-ca", "host=localhost sslmode=disable sslmode=verify-ca"},
+		{"", "disable", "sslmode=disable"},
+	} {
+		got, err := dsnWithSSLMode(tc.dsn, tc.mode)
+		require.NoError(t, err, tc.dsn)
+		require.Equal(t, tc.want, got, tc.dsn)
+	}
+
+	for _, tc := range []struct {
+		dsn, mode string
+	}{
+		{"postgres://localhost/chainwatch", "prefer"},
+		{"postgres://localhost/chainwatch?sslmode=allow", ""},
+		{"host=localhost sslmode=bogus", ""},
+	} {
+		_, err := dsnWithSSLMode(tc.dsn, tc.mode)
+		require.Error(t, err, tc.dsn)
+	}
+}
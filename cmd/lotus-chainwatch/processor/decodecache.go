@@ -0,0 +1,90 @@
+package processor
+
+import (
+	"context"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DefaultDecodeCacheSize is the default number of decoded actor states kept for reuse.
+const DefaultDecodeCacheSize = 10000
+
+// decodeCache keeps the encoded state decoded for a (head, code). Actor state is content addressed so the state of a
+// head never changes, and an actor that goes epochs without changing keeps being reported with the same head. A nil
+// decodeCache keeps nothing.
+type decodeCache struct {
+	hitCounter
+	cache *lru.ARCCache
+}
+
+func newDecodeCache(size int) (*decodeCache, error) {
+	cache, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return &decodeCache{cache: cache}, nil
+}
+
+func (c *decodeCache) get(k actorStateKey) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	v, ok := c.cache.Get(k)
+	if !ok {
+		c.count(0, 1)
+		return "", false
+	}
+	c.count(1, 0)
+	return v.(string), true
+}
+
+func (c *decodeCache) add(k actorStateKey, state string) {
+	if c == nil {
+		return
+	}
+	c.cache.Add(k, state)
+}
+
+func (c *decodeCache) hitRate() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.rate()
+}
+
+// decodedState returns the encoded state of act, the actor at addr as of the tipset tsk, decoding it only if the same
+// head and code were not decoded recently. The state is decoded by the decoder registered for the code of act if any.
+func (p *Processor) decodedState(ctx context.Context, addr address.Address, tsk types.TipSetKey, act types.Actor) (string, error) {
+	k := actorStateKey{head: act.Head, code: act.Code}
+	if state, ok := p.decodeCache.get(k); ok {
+		p.metrics().CacheLookups(ctx, cacheDecode, 1, 0)
+		return state, nil
+	}
+	p.metrics().CacheLookups(ctx, cacheDecode, 0, 1)
+
+	state, ok, err := p.registeredState(ctx, act.Code, act.Head)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		// the state of a code no decoder is known for is left empty, storeActorStates records it as an error.
+		if !p.canDecodeState(act.Code) {
+			return "", nil
+		}
+
+		ast, err := p.Source.ActorState(ctx, addr, tsk)
+		if err != nil {
+			return "", err
+		}
+		if state, err = p.encodeState(ast.State); err != nil {
+			return "", err
+		}
+	}
+
+	p.decodeCache.add(k, state)
+	return state, nil
+}
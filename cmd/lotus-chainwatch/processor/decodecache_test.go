@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// countingSource counts the actor states read through it.
+type countingSource struct {
+	TipSetSource
+	reads int
+}
+
+func (s *countingSource) ActorState(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	s.reads++
+	return s.TipSetSource.ActorState(ctx, addr, tsk)
+}
+
+// decodeSource returns a source holding the state of a single actor at each of the given tipsets, the actor keeps the
+// same head throughout. The state holds entries fields so decoding it is not free.
+func decodeSource(addr address.Address, tipsets []types.TipSetKey, entries int) *countingSource {
+	state := map[string]interface{}{}
+	for i := 0; i < entries; i++ {
+		state[fmt.Sprintf("Field%d", i)] = map[string]interface{}{"Value": fmt.Sprint(i), "Epoch": i}
+	}
+
+	rec := &RecordedChain{}
+	for _, tsk := range tipsets {
+		rec.States = append(rec.States, RecordedState{
+			Address: addr,
+			TipSet:  tsk,
+			State:   api.ActorState{Balance: types.NewInt(0), State: state},
+		})
+	}
+	return &countingSource{TipSetSource: newRecordedSource(rec)}
+}
+
+func decodeTipSets(n int) []types.TipSetKey {
+	var out []types.TipSetKey
+	var parent *types.TipSet
+	for i := 0; i < n; i++ {
+		ts := mock.TipSet(mock.MkBlock(parent, 1, uint64(i+1)))
+		out = append(out, ts.Key())
+		parent = ts
+	}
+	return out
+}
+
+func TestDecodedStateReusesHead(t *testing.T) {
+	ctx := context.Background()
+	addr := mock.Address(1000)
+	tipsets := decodeTipSets(3)
+	src := decodeSource(addr, tipsets, 4)
+
+	cache, err := newDecodeCache(10)
+	require.NoError(t, err)
+	p := &Processor{Source: src, decodeCache: cache}
+
+	act := types.Actor{Code: builtin.AccountActorCodeID, Head: testCid(t, "head")}
+	var states []string
+	for _, tsk := range tipsets {
+		state, err := p.decodedState(ctx, addr, tsk, act)
+		require.NoError(t, err)
+		states = append(states, state)
+	}
+	require.Equal(t, 1, src.reads)
+	require.Equal(t, states[0], states[1])
+	require.Equal(t, states[0], states[2])
+	require.InDelta(t, 2.0/3.0, cache.hitRate(), 1e-9)
+
+	// the same head under another code is a different state.
+	act.Code = builtin.MultisigActorCodeID
+	_, err = p.decodedState(ctx, addr, tipsets[0], act)
+	require.NoError(t, err)
+	require.Equal(t, 2, src.reads)
+}
+
+func TestNilDecodeCache(t *testing.T) {
+	ctx := context.Background()
+	addr := mock.Address(1000)
+	tipsets := decodeTipSets(2)
+	src := decodeSource(addr, tipsets, 1)
+	p := &Processor{Source: src}
+
+	act := types.Actor{Code: builtin.AccountActorCodeID, Head: testCid(t, "head")}
+	for _, tsk := range tipsets {
+		_, err := p.decodedState(ctx, addr, tsk, act)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, src.reads)
+	require.Zero(t, p.decodeCache.hitRate())
+}
+
+func BenchmarkDecodedState(b *testing.B) {
+	ctx := context.Background()
+	addr := mock.Address(1000)
+	tipsets := decodeTipSets(10)
+	act := types.Actor{Code: builtin.MultisigActorCodeID, Head: testCid(b, "head")}
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			p := &Processor{Source: decodeSource(addr, tipsets, 1000), CanonicalStateJSON: true}
+			if cached {
+				var err error
+				p.decodeCache, err = newDecodeCache(DefaultDecodeCacheSize)
+				require.NoError(b, err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := p.decodedState(ctx, addr, tipsets[i%len(tipsets)], act); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// ExportedActor is a record written by ExportRange, the state of an actor at a height it changed at.
+type ExportedActor struct {
+	ID string `json:"id"`
+	// Address is the robust address of the actor, empty for actors which have none such as the singletons.
+	Address   string         `json:"address,omitempty"`
+	Height    abi.ChainEpoch `json:"height"`
+	StateRoot string         `json:"state_root"`
+	// TipSetKey is empty for the heads stored before the tipset key was recorded.
+	TipSetKey string `json:"tipset_key,omitempty"`
+
+	Code    string `json:"code"`
+	Head    string `json:"head"`
+	Nonce   uint64 `json:"nonce"`
+	Balance string `json:"balance"`
+
+	// State is the decoded state of the actor as stored in actor_states, it is nil if the state was not stored.
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// ExportRange writes every actor state stored at a height in [from, to] to w as JSON Lines, one ExportedActor per
+// line in height order. Rows are written as they are read so the size of the range is not bounded by memory.
+func (p *Processor) ExportRange(ctx context.Context, from, to abi.ChainEpoch, w io.Writer) error {
+	start := time.Now()
+	var exported int
+	defer func() {
+		p.logger().Infow("Exported actors", "from", from, "to", to, "actors", exported, "duration", time.Since(start).String())
+	}()
+
+	rows, err := p.db.QueryContext(ctx, `
+select a.id,
+       (select min(m.address) from id_address_map m where m.id = a.id and m.address <> m.id),
+       sh.height, a.stateroot, a.tipset_key, a.code, a.head, a.nonce, a.balance, s.state
+from actors a
+    inner join state_heights sh on sh.parentstateroot = a.stateroot
+    left join actor_states s on s.head = a.head and s.code = a.code
+where sh.height >= $1 and sh.height <= $2
+order by sh.height, a.id
+`, from, to)
+	if err != nil {
+		return xerrors.Errorf("query actors to export: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for rows.Next() {
+		var (
+			rec                ExportedActor
+			height             int64
+			addr, tsKey, state sql.NullString
+		)
+		if err := rows.Scan(&rec.ID, &addr, &height, &rec.StateRoot, &tsKey, &rec.Code, &rec.Head, &rec.Nonce, &rec.Balance, &state); err != nil {
+			return xerrors.Errorf("scan exported actor: %w", err)
+		}
+		rec.Height = abi.ChainEpoch(height)
+		rec.Address = addr.String
+		rec.TipSetKey = tsKey.String
+		if state.Valid {
+			rec.State = json.RawMessage(state.String)
+		}
+
+		if err := enc.Encode(&rec); err != nil {
+			return xerrors.Errorf("write exported actor %s at %d: %w", rec.ID, height, err)
+		}
+		exported++
+	}
+	if err := rows.Err(); err != nil {
+		return xerrors.Errorf("read actors to export: %w", err)
+	}
+	return bw.Flush()
+}
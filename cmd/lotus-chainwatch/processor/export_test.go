@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestExportRange(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	truncateCommonActors(t, db)
+	p := &Processor{db: db}
+
+	actors, addrs := syntheticActorTips(t, 3, 2)
+	robust, err := address.NewActorAddress([]byte("export"))
+	require.NoError(t, err)
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{robust: addrs[0]}))
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.NoError(t, p.storeActorStates(ctx, actors))
+
+	for i := 0; i < 3; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, p.ExportRange(ctx, 2, 3, &buf))
+
+	var got []ExportedActor
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var rec ExportedActor
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &rec))
+		got = append(got, rec)
+	}
+	require.NoError(t, sc.Err())
+
+	// the first height is left out, the others hold both actors in height order.
+	require.Len(t, got, 4)
+	for i, rec := range got {
+		ts := i/2 + 1
+		require.Equal(t, abi.ChainEpoch(ts+1), rec.Height)
+		require.Equal(t, testCid(t, fmt.Sprintf("stateroot-%d", ts)).String(), rec.StateRoot)
+		require.Equal(t, types.NewTipSetKey(testCid(t, fmt.Sprintf("block-%d", ts))).String(), rec.TipSetKey)
+		require.Equal(t, builtin.AccountActorCodeID.String(), rec.Code)
+		require.Equal(t, uint64(ts), rec.Nonce)
+		require.JSONEq(t, `{"Address":"`+rec.ID+`"}`, string(rec.State))
+	}
+	require.Equal(t, addrs[0].String(), got[0].ID)
+	require.Equal(t, robust.String(), got[0].Address)
+	// an actor with no robust address has none exported.
+	require.Equal(t, addrs[1].String(), got[1].ID)
+	require.Empty(t, got[1].Address)
+
+	buf.Reset()
+	require.NoError(t, p.ExportRange(ctx, 10, 20, &buf))
+	require.Zero(t, buf.Len())
+}
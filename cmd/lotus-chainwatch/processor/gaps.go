@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// EpochRange is the range of epochs [From, To].
+type EpochRange struct {
+	From abi.ChainEpoch
+	To   abi.ChainEpoch
+}
+
+func (r EpochRange) String() string {
+	return fmt.Sprintf("[%d, %d]", r.From, r.To)
+}
+
+// processedHeights selects the heights whose state is stored in actors.
+const processedHeights = `select distinct sh.height from actors a inner join state_heights sh on sh.parentstateroot = a.stateroot`
+
+// FindGaps returns the ranges of heights above genesis with no state stored, lowest first. Null rounds never have a
+// state so they show up as gaps too, backfilling them finds no tipset and stores nothing.
+func (p *Processor) FindGaps(ctx context.Context) ([]EpochRange, error) {
+	return p.findGaps(ctx, processedHeights)
+}
+
+// findGaps returns the gaps in the heights selected by the heights query.
+func (p *Processor) findGaps(ctx context.Context, heights string) ([]EpochRange, error) {
+	// genesis is stored by the genesis seed, 0 is always included so a gap at the bottom is found.
+	rows, err := p.db.QueryContext(ctx, `
+select height + 1, next - 1 from (
+	select height, lead(height) over (order by height) as next
+	from (`+heights+` union select 0) h
+) g
+where next > height + 1
+order by height
+`)
+	if err != nil {
+		return nil, xerrors.Errorf("query gaps: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []EpochRange
+	for rows.Next() {
+		var from, to int64
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, xerrors.Errorf("scan gap: %w", err)
+		}
+		out = append(out, EpochRange{From: abi.ChainEpoch(from), To: abi.ChainEpoch(to)})
+	}
+	return out, rows.Err()
+}
+
+// Backfill stores the state of the common actors over each of ranges, re-fetching the tipsets from the node. Each
+// range runs as a BackfillProcessor of common_actors, so an interrupted backfill resumes where it stopped.
+func (p *Processor) Backfill(ctx context.Context, ranges []EpochRange) error {
+	for _, r := range ranges {
+		ext, err := p.extendGap(ctx, r)
+		if err != nil {
+			return xerrors.Errorf("extend gap %s: %w", r, err)
+		}
+		if ext != r {
+			p.logger().Infow("Gap extended past stored states of reverted tipsets", "gap", r.String(), "backfill", ext.String())
+		}
+
+		if err := p.BackfillProcessor(ctx, "common_actors", ext.From, ext.To); err != nil {
+			return xerrors.Errorf("backfill %s: %w", ext, err)
+		}
+	}
+	return nil
+}
+
+// extendGap widens r past the heights bordering it whose stored state is not the state of the canonical tipset at that
+// height. A gap straddling a reorg is bordered by the state of reverted tipsets, which the gap queries count as stored.
+func (p *Processor) extendGap(ctx context.Context, r EpochRange) (EpochRange, error) {
+	for r.From > 1 {
+		ts, err := p.node.ChainGetTipSetByHeight(ctx, r.From-1, types.EmptyTSK)
+		if err != nil {
+			return r, xerrors.Errorf("get tipset at %d: %w", r.From-1, err)
+		}
+		if ts.Height() == 0 {
+			break
+		}
+		stored, err := p.stateStored(ctx, ts)
+		if err != nil || stored {
+			return r, err
+		}
+		r.From = ts.Height()
+	}
+
+	head, err := p.node.ChainHead(ctx)
+	if err != nil {
+		return r, xerrors.Errorf("get chain head: %w", err)
+	}
+	for r.To < head.Height() {
+		ts, err := p.node.ChainGetTipSetByHeight(ctx, r.To+1, head.Key())
+		if err != nil {
+			return r, xerrors.Errorf("get tipset at %d: %w", r.To+1, err)
+		}
+		// a null round, there is nothing to store at r.To+1.
+		if ts.Height() <= r.To {
+			r.To++
+			continue
+		}
+		stored, err := p.stateStored(ctx, ts)
+		if err != nil || stored {
+			return r, err
+		}
+		r.To = ts.Height()
+	}
+	return r, nil
+}
+
+// stateStored reports whether the state processed for the blocks of ts is stored.
+func (p *Processor) stateStored(ctx context.Context, ts *types.TipSet) (bool, error) {
+	var stored bool
+	if err := p.db.QueryRowContext(ctx, `select exists(select 1 from actors where stateroot = $1)`, ts.ParentState().String()).Scan(&stored); err != nil {
+		return false, xerrors.Errorf("query stored state at %d: %w", ts.Height(), err)
+	}
+	return stored, nil
+}
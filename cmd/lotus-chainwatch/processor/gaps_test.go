@@ -0,0 +1,81 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestFindGaps(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	p := &Processor{db: db}
+
+	// testDB uses a single connection, the temp table is visible to every query of the test.
+	_, err := db.Exec(`create temp table gap_heights (height bigint not null)`)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.Exec(`drop table if exists gap_heights`)
+	})
+
+	for _, tc := range []struct {
+		name    string
+		heights []abi.ChainEpoch
+		gaps    []EpochRange
+	}{
+		{name: "contiguous", heights: []abi.ChainEpoch{0, 1, 2, 3}},
+		{name: "holes", heights: []abi.ChainEpoch{0, 1, 2, 5, 6, 9, 10}, gaps: []EpochRange{{From: 3, To: 4}, {From: 7, To: 8}}},
+		{name: "single height", heights: []abi.ChainEpoch{1, 3}, gaps: []EpochRange{{From: 2, To: 2}}},
+		{name: "missing bottom", heights: []abi.ChainEpoch{4, 5}, gaps: []EpochRange{{From: 1, To: 3}}},
+		{name: "empty"},
+	} {
+		_, err := db.Exec(`truncate gap_heights`)
+		require.NoError(t, err)
+		for _, h := range tc.heights {
+			_, err := db.Exec(`insert into gap_heights (height) values ($1)`, h)
+			require.NoError(t, err)
+		}
+
+		gaps, err := p.findGaps(ctx, `select height from gap_heights`)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.gaps, gaps, tc.name)
+	}
+}
+
+func TestExtendGapAcrossReorg(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	node, _ := backfillChain(t, 6)
+	p := &Processor{db: db, node: node}
+
+	addr := mock.Address(1000)
+	seedAddresses(t, db, []address.Address{addr})
+	store := func(stateroot string) {
+		_, err := db.Exec(`insert into actors (id, code, head, nonce, balance, stateroot) values ($1, $2, $3, 0, '0', $4)`,
+			addr.String(), builtin.AccountActorCodeID.String(), testCid(t, "head-"+stateroot).String(), testCid(t, stateroot).String())
+		require.NoError(t, err)
+	}
+
+	// heights 1, 2 and 6 are stored from the canonical chain, height 3 from a tipset reverted since.
+	for _, h := range []int{1, 2, 6} {
+		store(fmt.Sprintf("stateroot-%d", h))
+	}
+	store("stateroot-3-reverted")
+
+	ext, err := p.extendGap(ctx, EpochRange{From: 4, To: 5})
+	require.NoError(t, err)
+	require.Equal(t, EpochRange{From: 3, To: 5}, ext)
+
+	// a gap bordered by canonical states on both sides is left as is.
+	ext, err = p.extendGap(ctx, EpochRange{From: 3, To: 5})
+	require.NoError(t, err)
+	require.Equal(t, EpochRange{From: 3, To: 5}, ext)
+}
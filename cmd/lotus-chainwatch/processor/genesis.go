@@ -0,0 +1,163 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+const metaGenesisSeeded = "genesis_seeded"
+
+// singletonActors are the builtin actors created at genesis with a fixed ID. They have no robust address so they are
+// not in the init actor address map, and are stored as their own address.
+var singletonActors = []address.Address{
+	builtin.SystemActorAddr,
+	builtin.InitActorAddr,
+	builtin.RewardActorAddr,
+	builtin.CronActorAddr,
+	builtin.StoragePowerActorAddr,
+	builtin.StorageMarketActorAddr,
+	builtin.VerifiedRegistryActorAddr,
+	builtin.BurntFundsActorAddr,
+}
+
+// seedGenesis stores the state of every actor in the genesis tipset, which normal processing never visits since it
+// only walks the changes between a block and its parent. The genesis_seeded flag is set only once the whole seed has
+// committed, a seed interrupted part way is run again from the start on the next startup.
+func (p *Processor) seedGenesis(ctx context.Context) error {
+	// the addresses are stored on every start so databases seeded before genesis addresses were stored get them too.
+	if err := p.seedGenesisAddresses(ctx); err != nil {
+		return xerrors.Errorf("seed genesis addresses: %w", err)
+	}
+
+	_, seeded, err := p.metaValue(metaGenesisSeeded)
+	if err != nil {
+		return err
+	}
+	if seeded {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Seeded Genesis", "duration", time.Since(start).String())
+	}()
+
+	actors, err := p.genesisActors(ctx)
+	if err != nil {
+		return xerrors.Errorf("collect genesis actors: %w", err)
+	}
+
+	steps := []func() error{
+		func() error { return p.storeActorHeads(ctx, actors) },
+	}
+	// the states of the genesis actors are not decoded either, they would all be stored as errors.
+	if !p.NoState {
+		steps = append(steps, func() error { return p.storeActorStates(ctx, actors) })
+	}
+	// genesis multisigs are the ones that vest, they are never seen again unless they send a message.
+	if p.enabled("multisig") {
+		steps = append(steps, func() error { return p.storeMultisigVesting(ctx, actorsOfKind(actors, kindMultisig)) })
+	}
+	// the cron actor rarely changes after genesis, its entries would otherwise not be stored until an upgrade.
+	if p.enabled("cron") {
+		steps = append(steps, func() error { return p.HandleCronChanges(ctx, actorsOfKind(actors, kindCron)) })
+	}
+	// genesis accounts are not seen again until they send or receive funds.
+	if p.enabled("account") {
+		steps = append(steps, func() error { return p.HandleAccountChanges(ctx, actorsOfKind(actors, kindAccount)) })
+	}
+	if p.enabled("actor_events") {
+		steps = append(steps, func() error { return p.storeActorEvents(ctx, genesisActorEvents(actors)) })
+	}
+	return p.runGenesisSeed(steps...)
+}
+
+// runGenesisSeed runs the seed steps in order and marks the seed complete once all of them succeed. Every step must be
+// idempotent as a failed seed is retried in full.
+func (p *Processor) runGenesisSeed(steps ...func() error) error {
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return xerrors.Errorf("seed genesis: %w", err)
+		}
+	}
+	return p.setMeta(metaGenesisSeeded, "true")
+}
+
+// seedGenesisAddresses stores the ID address of every actor in the genesis state. Actors with a robust address, such as
+// genesis accounts and multisigs, are taken from the genesis init actor address map. Those with none, the singletons
+// among them, are stored as their own address since the init actor has no entry for them.
+func (p *Processor) seedGenesisAddresses(ctx context.Context) error {
+	gen := p.genesisTs
+	addressToID, err := p.initAddressMap(ctx, gen.Key())
+	if err != nil {
+		return xerrors.Errorf("load genesis init actor address map: %w", err)
+	}
+
+	robust := map[address.Address]bool{}
+	for _, id := range addressToID {
+		robust[id] = true
+	}
+
+	ids, err := p.node.StateListActors(ctx, gen.Key())
+	if err != nil {
+		return xerrors.Errorf("list genesis actors: %w", err)
+	}
+	for _, id := range append(ids, singletonActors...) {
+		if !robust[id] && id.Protocol() == address.ID {
+			addressToID[id] = id
+		}
+	}
+
+	return p.storeAddressMap(ctx, addressToID)
+}
+
+func (p *Processor) genesisActors(ctx context.Context) (map[cid.Cid]ActorTips, error) {
+	gen := p.genesisTs
+	addrs, err := p.node.StateListActors(ctx, gen.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[cid.Cid]ActorTips{}
+	for _, addr := range addrs {
+		act, err := p.node.StateGetActor(ctx, addr, gen.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("get genesis actor %s: %w", addr, err)
+		}
+
+		var state string
+		if p.decodeStates() {
+			ast, err := p.node.StateReadState(ctx, addr, gen.Key())
+			if err != nil {
+				return nil, xerrors.Errorf("read genesis actor state %s: %w", addr, err)
+			}
+
+			if state, err = p.encodeState(ast.State); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, ok := out[act.Code]; !ok {
+			out[act.Code] = map[types.TipSetKey][]actorInfo{}
+		}
+		out[act.Code][gen.Key()] = append(out[act.Code][gen.Key()], actorInfo{
+			act:         *act,
+			stateroot:   gen.ParentState(),
+			height:      gen.Height(),
+			tsKey:       gen.Key(),
+			parentTsKey: gen.Parents(),
+			addr:        addr,
+			state:       state,
+		})
+	}
+	return out, nil
+}
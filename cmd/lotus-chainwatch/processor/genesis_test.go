@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	typegen "github.com/whyrusleeping/cbor-gen"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	_init "github.com/filecoin-project/specs-actors/actors/builtin/init"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestGenesisSeedResumesAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMeta())
+	_, err := db.Exec(`delete from chainwatch_meta where key = $1`, metaGenesisSeeded)
+	require.NoError(t, err)
+
+	actors, addrs := syntheticActorTips(t, 1, 3)
+	seedAddresses(t, db, addrs)
+
+	// the heads commit but the process dies before the states are written.
+	crash := xerrors.New("killed")
+	err = p.runGenesisSeed(
+		func() error { return p.storeActorHeads(ctx, actors) },
+		func() error { return crash },
+	)
+	require.True(t, xerrors.Is(err, crash))
+
+	_, seeded, err := p.metaValue(metaGenesisSeeded)
+	require.NoError(t, err)
+	require.False(t, seeded)
+
+	// on restart the whole seed runs again.
+	require.NoError(t, p.runGenesisSeed(
+		func() error { return p.storeActorHeads(ctx, actors) },
+		func() error { return p.storeActorStates(ctx, actors) },
+	))
+
+	_, seeded, err = p.metaValue(metaGenesisSeeded)
+	require.NoError(t, err)
+	require.True(t, seeded)
+
+	var heads, states int
+	require.NoError(t, db.QueryRow(`select count(*) from actors`).Scan(&heads))
+	require.NoError(t, db.QueryRow(`select count(*) from actor_states`).Scan(&states))
+	require.Equal(t, len(addrs), heads)
+	require.Equal(t, len(addrs), states)
+}
+
+// newGenesisNode builds a genesis state whose init actor maps each robust address in ids to its ID, and which lists
+// the singleton actors and the IDs.
+func newGenesisNode(t *testing.T, ids map[address.Address]address.Address) *testNode {
+	node := newTestNode()
+	node.listed = append([]address.Address{}, singletonActors...)
+
+	addrMap := adt.MakeEmptyMap(node.store)
+	for robust, id := range ids {
+		actorID, err := address.IDFromAddress(id)
+		require.NoError(t, err)
+		v := typegen.CborInt(actorID)
+		require.NoError(t, addrMap.Put(adt.AddrKey(robust), &v))
+		node.listed = append(node.listed, id)
+	}
+	root, err := addrMap.Root()
+	require.NoError(t, err)
+
+	node.putActor(t, types.EmptyTSK, builtin.InitActorAddr, builtin.InitActorCodeID, _init.ConstructState(root, "testnet"))
+	return node
+}
+
+func TestSeedGenesisAddresses(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	msig, err := address.NewActorAddress([]byte("genesis-msig"))
+	require.NoError(t, err)
+	msigID, err := address.NewIDAddress(101)
+	require.NoError(t, err)
+	// a genesis actor without a robust address, like the pre-seal miners.
+	idOnly, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	node := newGenesisNode(t, map[address.Address]address.Address{msig: msigID})
+	node.listed = append(node.listed, idOnly)
+
+	p := &Processor{db: db, node: node, genesisTs: mock.TipSet(mock.MkBlock(nil, 1, 1))}
+	require.NoError(t, p.seedGenesisAddresses(ctx))
+	// seeding again on the next start is a no-op.
+	require.NoError(t, p.seedGenesisAddresses(ctx))
+
+	var id string
+	require.NoError(t, db.QueryRow(`select id from id_address_map where address = $1`, msig.String()).Scan(&id))
+	require.Equal(t, msigID.String(), id)
+
+	for _, a := range append([]address.Address{idOnly}, singletonActors...) {
+		require.NoError(t, db.QueryRow(`select id from id_address_map where address = $1`, a.String()).Scan(&id))
+		require.Equal(t, a.String(), id)
+	}
+
+	// the ID of the multisig is not also stored as its own address.
+	var n int
+	require.NoError(t, db.QueryRow(`select count(*) from id_address_map where id = $1`, msigID.String()).Scan(&n))
+	require.Equal(t, 1, n)
+}
@@ -0,0 +1,70 @@
+package processor
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// APIHandler serves a read only HTTP API over the processed data, so consumers don't depend on the schema:
+//
+//	GET /actor/{address}?epoch=N  the code, head, nonce and balance of an actor as of epoch N
+//
+// The address is an ID or a robust address.
+func (p *Processor) APIHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/actor/{address}", p.handleActor).Methods(http.MethodGet)
+	return r
+}
+
+// actorResponse is the body of GET /actor/{address}.
+type actorResponse struct {
+	ID      string `json:"id"`
+	Height  int64  `json:"height"`
+	Code    string `json:"code"`
+	Head    string `json:"head"`
+	Nonce   uint64 `json:"nonce"`
+	Balance string `json:"balance"`
+}
+
+func (p *Processor) handleActor(w http.ResponseWriter, r *http.Request) {
+	addr, err := address.NewFromString(mux.Vars(r)["address"])
+	if err != nil {
+		http.Error(w, "malformed address: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	epoch, err := strconv.ParseInt(r.URL.Query().Get("epoch"), 10, 64)
+	if err != nil {
+		http.Error(w, "malformed epoch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	act, err := p.ActorAt(r.Context(), addr, abi.ChainEpoch(epoch))
+	if xerrors.Is(err, ErrActorNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		p.logger().Errorw("Failed to serve actor", "address", addr, "epoch", epoch, "error", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(actorResponse{
+		ID:      act.ID.String(),
+		Height:  int64(act.Height),
+		Code:    act.Code.String(),
+		Head:    act.Head.String(),
+		Nonce:   act.Nonce,
+		Balance: act.Balance.String(),
+	}); err != nil {
+		p.logger().Warnw("Failed to write actor response", "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestAPIActor(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the actor changes in every tipset, the state of tipset i is at height i+1 with nonce i.
+	actors, addrs := syntheticActorTips(t, 3, 1)
+	robust, err := address.NewActorAddress([]byte("robust"))
+	require.NoError(t, err)
+	require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{robust: addrs[0]}))
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	for i := 0; i < 3; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	unknown, err := address.NewActorAddress([]byte("unknown"))
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.APIHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		nonce  uint64
+		height int64
+	}{
+		{path: "/actor/" + addrs[0].String() + "?epoch=2", status: http.StatusOK, nonce: 1, height: 2},
+		{path: "/actor/" + addrs[0].String() + "?epoch=100", status: http.StatusOK, nonce: 2, height: 3},
+		{path: "/actor/" + robust.String() + "?epoch=1", status: http.StatusOK, nonce: 0, height: 1},
+		// nothing is stored for the actor before height 1.
+		{path: "/actor/" + addrs[0].String() + "?epoch=0", status: http.StatusNotFound},
+		{path: "/actor/" + unknown.String() + "?epoch=2", status: http.StatusNotFound},
+		{path: "/actor/not-an-address?epoch=2", status: http.StatusBadRequest},
+		{path: "/actor/" + addrs[0].String() + "?epoch=tomorrow", status: http.StatusBadRequest},
+		{path: "/actor/" + addrs[0].String(), status: http.StatusBadRequest},
+	} {
+		rec := get(tc.path)
+		require.Equal(t, tc.status, rec.Code, "%s: %s", tc.path, rec.Body.String())
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var resp actorResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp), tc.path)
+		require.Equal(t, addrs[0].String(), resp.ID, tc.path)
+		require.Equal(t, builtin.AccountActorCodeID.String(), resp.Code, tc.path)
+		require.Equal(t, testCid(t, fmt.Sprintf("head-%s-%d", addrs[0], tc.nonce)).String(), resp.Head, tc.path)
+		require.Equal(t, tc.nonce, resp.Nonce, tc.path)
+		require.Equal(t, tc.height, resp.Height, tc.path)
+		require.Equal(t, fmt.Sprint(tc.nonce), resp.Balance, tc.path)
+	}
+}
@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"context"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DefaultIDCacheSize is the default number of robust addresses whose ID address is kept to skip looking it up again.
+const DefaultIDCacheSize = 100000
+
+// idCache keeps the ID address the node resolved a robust address to. The init actor never reassigns an ID so the
+// mapping holds at every later tipset, and the same senders and actors are looked up again in tipset after tipset. A
+// nil idCache keeps nothing.
+type idCache struct {
+	hitCounter
+	cache *lru.Cache
+}
+
+func newIDCache(size int) (*idCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &idCache{cache: cache}, nil
+}
+
+func (c *idCache) get(addr address.Address) (address.Address, bool) {
+	if c == nil {
+		return address.Undef, false
+	}
+	v, ok := c.cache.Get(addr)
+	if !ok {
+		c.count(0, 1)
+		return address.Undef, false
+	}
+	c.count(1, 0)
+	return v.(address.Address), true
+}
+
+// add keeps id as the ID address of addr, an undefined id is not a resolution and is not kept.
+func (c *idCache) add(addr, id address.Address) {
+	if c == nil || id == address.Undef {
+		return
+	}
+	c.cache.Add(addr, id)
+}
+
+func (c *idCache) hitRate() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.rate()
+}
+
+// stateLookupID returns the ID address of addr as of the tipset tsk, asking the node only if addr was not resolved
+// recently.
+func (p *Processor) stateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if id, ok := p.idCache.get(addr); ok {
+		p.metrics().CacheLookups(ctx, cacheID, 1, 0)
+		return id, nil
+	}
+	p.metrics().CacheLookups(ctx, cacheID, 0, 1)
+
+	id, err := p.node.StateLookupID(ctx, addr, tsk)
+	if err != nil {
+		return address.Undef, err
+	}
+
+	p.idCache.add(addr, id)
+	return id, nil
+}
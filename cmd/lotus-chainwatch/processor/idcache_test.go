@@ -0,0 +1,84 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// countingLookupNode counts the StateLookupID calls reaching the node.
+type countingLookupNode struct {
+	*lookupNode
+
+	lookups int
+}
+
+func (n *countingLookupNode) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	n.lookups++
+	if id, ok := n.ids[addr]; ok && id == address.Undef {
+		return address.Undef, nil
+	}
+	return n.lookupNode.StateLookupID(ctx, addr, tsk)
+}
+
+func TestStateLookupIDCached(t *testing.T) {
+	ctx := context.Background()
+	addrs, ids := robustLookups(t, 2)
+	node := &countingLookupNode{lookupNode: ids}
+
+	cache, err := newIDCache(10)
+	require.NoError(t, err)
+	p := &Processor{node: node, idCache: cache}
+
+	for robust, tsk := range addrs {
+		id, err := p.stateLookupID(ctx, robust, tsk)
+		require.NoError(t, err)
+		require.Equal(t, ids.ids[robust], id)
+	}
+	require.Equal(t, 2, node.lookups)
+
+	// the second lookup of an address is served from the cache, at any tipset.
+	for robust := range addrs {
+		id, err := p.stateLookupID(ctx, robust, types.EmptyTSK)
+		require.NoError(t, err)
+		require.Equal(t, ids.ids[robust], id)
+	}
+	require.Equal(t, 2, node.lookups)
+	require.Equal(t, 0.5, cache.hitRate())
+
+	// failed and undefined lookups are asked again.
+	unknown, err := address.NewActorAddress([]byte("unknown"))
+	require.NoError(t, err)
+	undef, err := address.NewActorAddress([]byte("undef"))
+	require.NoError(t, err)
+	ids.ids[undef] = address.Undef
+	for i := 0; i < 2; i++ {
+		_, err = p.stateLookupID(ctx, unknown, types.EmptyTSK)
+		require.Error(t, err)
+		id, err := p.stateLookupID(ctx, undef, types.EmptyTSK)
+		require.NoError(t, err)
+		require.Equal(t, address.Undef, id)
+	}
+	require.Equal(t, 6, node.lookups)
+}
+
+func TestNilIDCache(t *testing.T) {
+	ctx := context.Background()
+	addrs, ids := robustLookups(t, 1)
+	node := &countingLookupNode{lookupNode: ids}
+	p := &Processor{node: node}
+
+	for i := 0; i < 2; i++ {
+		for robust, tsk := range addrs {
+			_, err := p.stateLookupID(ctx, robust, tsk)
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, 2, node.lookups)
+	require.Zero(t, p.idCache.hitRate())
+}
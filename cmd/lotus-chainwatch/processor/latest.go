@@ -0,0 +1,57 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// latestActorsSchema creates latest_actors, the tip of every actor as of the head, so the current state of all actors
+// is read without running the actor_tips scan. It is created without data as state_heights may not be populated yet,
+// RefreshLatest fills it. SQLite has no materialized views.
+func (p *Processor) latestActorsSchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+/* every height is below the epoch passed to actor_tips, the newest row of each actor is kept */
+create materialized view if not exists latest_actors
+	as select * from actor_tips(9223372036854775807)
+	with no data;
+
+/* required to refresh the view concurrently */
+create unique index if not exists latest_actors_id_uindex
+	on latest_actors (id);
+`)
+	return err
+}
+
+// RefreshLatest refreshes latest_actors to the actors processed so far. The refresh is concurrent so readers of the
+// view are not blocked, except the first one which populates it.
+func (p *Processor) RefreshLatest(ctx context.Context) error {
+	if p.Backend == BackendSQLite {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Refreshed latest_actors", "duration", time.Since(start).String())
+	}()
+
+	var populated bool
+	if err := p.db.QueryRowContext(ctx, `select relispopulated from pg_class where oid = 'latest_actors'::regclass`).Scan(&populated); err != nil {
+		return xerrors.Errorf("query latest_actors: %w", err)
+	}
+
+	refresh := `refresh materialized view concurrently latest_actors`
+	if !populated {
+		refresh = `refresh materialized view latest_actors`
+	}
+	if _, err := p.db.ExecContext(ctx, refresh); err != nil {
+		return xerrors.Errorf("refresh latest_actors: %w", err)
+	}
+	return nil
+}
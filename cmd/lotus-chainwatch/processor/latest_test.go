@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestRefreshLatest(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the blocks executing each tipset, the state of tipset i is at height i+1.
+	addBlocks := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+				testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+			require.NoError(t, err)
+		}
+		_, err := db.Exec(`refresh materialized view state_heights`)
+		require.NoError(t, err)
+	}
+	latest := func() map[string]string {
+		rows, err := db.Query(`select id, head from latest_actors`)
+		require.NoError(t, err)
+		defer rows.Close() //nolint:errcheck
+
+		out := map[string]string{}
+		for rows.Next() {
+			var id, head string
+			require.NoError(t, rows.Scan(&id, &head))
+			_, dup := out[id]
+			require.False(t, dup, id)
+			out[id] = head
+		}
+		require.NoError(t, rows.Err())
+		return out
+	}
+
+	actors, addrs := syntheticActorTips(t, 3, 2)
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	addBlocks(0, 3)
+
+	require.NoError(t, p.RefreshLatest(ctx))
+	require.Equal(t, map[string]string{
+		addrs[0].String(): testCid(t, fmt.Sprintf("head-%s-2", addrs[0])).String(),
+		addrs[1].String(): testCid(t, fmt.Sprintf("head-%s-2", addrs[1])).String(),
+	}, latest())
+
+	// only the first actor changes in the next tipset, the view is refreshed concurrently now it is populated.
+	next, _ := syntheticActorTips(t, 4, 1)
+	for tsk, infos := range next[builtin.AccountActorCodeID] {
+		if infos[0].stateroot != testCid(t, "stateroot-3") {
+			delete(next[builtin.AccountActorCodeID], tsk)
+		}
+	}
+	require.NoError(t, p.storeActorHeads(ctx, next))
+	addBlocks(3, 4)
+
+	require.NoError(t, p.RefreshLatest(ctx))
+	require.Equal(t, map[string]string{
+		addrs[0].String(): testCid(t, fmt.Sprintf("head-%s-3", addrs[0])).String(),
+		addrs[1].String(): testCid(t, fmt.Sprintf("head-%s-2", addrs[1])).String(),
+	}, latest())
+}
@@ -0,0 +1,23 @@
+package processor
+
+import (
+	"io"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// NewJSONLogger returns a logger for Processor.Log writing the entries at level and above to w, one JSON object per
+// line.
+func NewJSONLogger(w io.Writer, level zapcore.Level) *zap.SugaredLogger {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(w), level)).Sugar().Named("processor")
+}
+
+// logger returns the Log of the processor, or the logger of the processor subsystem if it is not set.
+func (p *Processor) logger() *zap.SugaredLogger {
+	if p.Log == nil {
+		return &log.SugaredLogger
+	}
+	return p.Log
+}
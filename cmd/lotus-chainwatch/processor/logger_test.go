@@ -0,0 +1,42 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProcessorLogger(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zapcore.DebugLevel)
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite, Log: zap.New(core).Sugar()}
+
+	actors, addrs := syntheticActorTips(t, 2, 2)
+	seedAddresses(t, p.db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+
+	stored := logs.FilterMessage("Stored Actor Heads").All()
+	require.Len(t, stored, 1)
+	require.Equal(t, zapcore.DebugLevel, stored[0].Level)
+	require.Contains(t, stored[0].ContextMap(), "duration")
+
+	// a logger at info receives none of the store durations.
+	var buf bytes.Buffer
+	p.Log = NewJSONLogger(&buf, zapcore.InfoLevel)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.Zero(t, buf.Len())
+
+	p.Log = NewJSONLogger(&buf, zapcore.DebugLevel)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes.SplitN(buf.Bytes(), []byte("\n"), 2)[0], &entry))
+	require.Equal(t, "Stored Actor Heads", entry["msg"])
+	require.Equal(t, "debug", entry["level"])
+	require.Equal(t, "processor", entry["logger"])
+}
@@ -8,7 +8,10 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
 	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
 )
 
 func (p *Processor) setupMarket() error {
@@ -70,44 +73,108 @@ create table if not exists market_deal_states
 
 type marketActorInfo struct {
 	common actorInfo
+
+	// the proposals and deal states that changed since the parent tipset, nil if none did.
+	proposals  *state.MarketDealProposalChanges
+	dealStates *state.MarketDealStateChanges
 }
 
 func (p *Processor) HandleMarketChanges(ctx context.Context, marketTips ActorTips) error {
 	marketChanges, err := p.processMarket(ctx, marketTips)
 	if err != nil {
-		log.Fatalw("Failed to process market actors", "error", err)
+		return xerrors.Errorf("Failed to process market actors: %w", err)
 	}
 
 	if err := p.persistMarket(ctx, marketChanges); err != nil {
-		log.Fatalw("Failed to persist market actors", "error", err)
+		return xerrors.Errorf("Failed to persist market actors: %w", err)
 	}
 
 	if err := p.updateMarket(ctx, marketChanges); err != nil {
-		log.Fatalw("Failed to update market actors", "error", err)
+		return xerrors.Errorf("Failed to update market actors: %w", err)
 	}
 	return nil
 }
 
+// processMarket diffs the deal proposals and states of every market change against the parent tipset, so only the
+// deals that changed are written rather than every deal on each tipset.
 func (p *Processor) processMarket(ctx context.Context, marketTips ActorTips) ([]marketActorInfo, error) {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Processed Market", "duration", time.Since(start).String())
+		p.logger().Debugw("Processed Market", "duration", time.Since(start).String())
 	}()
 
+	pred := state.NewStatePredicates(p.node)
+
 	var out []marketActorInfo
 	for _, markets := range marketTips {
 		for _, mt := range markets {
-			// NB: here is where we can extract the market state when we need it.
-			out = append(out, marketActorInfo{common: mt})
+			info := marketActorInfo{common: mt}
+
+			// genesis has no parent to diff against, every deal it holds is new.
+			if mt.parentTsKey == types.EmptyTSK {
+				if err := p.genesisMarketDeals(ctx, &info); err != nil {
+					return nil, err
+				}
+				out = append(out, info)
+				continue
+			}
+
+			propDiff := pred.OnStorageMarketActorChanged(pred.OnDealProposalChanged(pred.OnDealProposalAmtChanged()))
+			changed, val, err := propDiff(ctx, mt.parentTsKey, mt.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("diff market deal proposals (@ %s): %w", mt.stateroot, err)
+			}
+			if changed {
+				changes, ok := val.(*state.MarketDealProposalChanges)
+				if !ok {
+					return nil, xerrors.Errorf("Unknown type returned by Deal Proposal AMT predicate: %T", val)
+				}
+				info.proposals = changes
+			}
+
+			stateDiff := pred.OnStorageMarketActorChanged(pred.OnDealStateChanged(pred.OnDealStateAmtChanged()))
+			changed, val, err = stateDiff(ctx, mt.parentTsKey, mt.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("diff market deal states (@ %s): %w", mt.stateroot, err)
+			}
+			if changed {
+				changes, ok := val.(*state.MarketDealStateChanges)
+				if !ok {
+					return nil, xerrors.Errorf("Unknown type returned by Deal State AMT predicate: %T", val)
+				}
+				info.dealStates = changes
+			}
+
+			out = append(out, info)
 		}
 	}
 	return out, nil
 }
 
+// genesisMarketDeals records every deal of the genesis market as added.
+func (p *Processor) genesisMarketDeals(ctx context.Context, info *marketActorInfo) error {
+	deals, err := p.node.StateMarketDeals(ctx, info.common.tsKey)
+	if err != nil {
+		return xerrors.Errorf("get genesis market deals: %w", err)
+	}
+
+	info.proposals = &state.MarketDealProposalChanges{}
+	info.dealStates = &state.MarketDealStateChanges{}
+	for dealID, ds := range deals {
+		id, err := strconv.ParseUint(dealID, 10, 64)
+		if err != nil {
+			return err
+		}
+		info.proposals.Added = append(info.proposals.Added, state.ProposalIDState{ID: abi.DealID(id), Proposal: ds.Proposal})
+		info.dealStates.Added = append(info.dealStates.Added, state.DealIDState{ID: abi.DealID(id), Deal: ds.State})
+	}
+	return nil
+}
+
 func (p *Processor) persistMarket(ctx context.Context, info []marketActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Market", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Market", "duration", time.Since(start).String())
 	}()
 
 	grp, ctx := errgroup.WithContext(ctx)
@@ -137,10 +204,12 @@ func (p *Processor) updateMarket(ctx context.Context, info []marketActorInfo) er
 	return nil
 }
 
+// storeMarketActorDealStates writes the deal states added or modified by each market change. Deals removed once they
+// expire or are slashed keep their last state.
 func (p *Processor) storeMarketActorDealStates(marketTips []marketActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Market Deal States", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Market Deal States", "duration", time.Since(start).String())
 	}()
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -154,22 +223,21 @@ func (p *Processor) storeMarketActorDealStates(marketTips []marketActorInfo) err
 		return err
 	}
 	for _, mt := range marketTips {
-		dealStates, err := p.node.StateMarketDeals(context.TODO(), mt.common.tsKey)
-		if err != nil {
-			return err
+		if mt.dealStates == nil {
+			continue
 		}
 
-		for dealID, ds := range dealStates {
-			id, err := strconv.ParseUint(dealID, 10, 64)
-			if err != nil {
-				return err
-			}
+		deals := append([]state.DealIDState{}, mt.dealStates.Added...)
+		for _, modified := range mt.dealStates.Modified {
+			deals = append(deals, state.DealIDState{ID: modified.ID, Deal: *modified.To})
+		}
 
+		for _, ds := range deals {
 			if _, err := stmt.Exec(
-				id,
-				ds.State.SectorStartEpoch,
-				ds.State.LastUpdatedEpoch,
-				ds.State.SlashEpoch,
+				uint64(ds.ID),
+				ds.Deal.SectorStartEpoch,
+				ds.Deal.LastUpdatedEpoch,
+				ds.Deal.SlashEpoch,
 				mt.common.stateroot.String(),
 			); err != nil {
 				return err
@@ -188,10 +256,12 @@ func (p *Processor) storeMarketActorDealStates(marketTips []marketActorInfo) err
 	return tx.Commit()
 }
 
+// storeMarketActorDealProposals writes the proposals added by each market change, proposals never change once
+// published.
 func (p *Processor) storeMarketActorDealProposals(ctx context.Context, marketTips []marketActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Market Deal Proposals", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Market Deal Proposals", "duration", time.Since(start).String())
 	}()
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -207,34 +277,27 @@ func (p *Processor) storeMarketActorDealProposals(ctx context.Context, marketTip
 		return err
 	}
 
-	// insert in sorted order (lowest height -> highest height) since dealid is pk of table.
 	for _, mt := range marketTips {
-		dealStates, err := p.node.StateMarketDeals(ctx, mt.common.tsKey)
-		if err != nil {
-			return err
+		if mt.proposals == nil {
+			continue
 		}
 
-		for dealID, ds := range dealStates {
-			id, err := strconv.ParseUint(dealID, 10, 64)
-			if err != nil {
-				return err
-			}
-
+		for _, dp := range mt.proposals.Added {
 			if _, err := stmt.Exec(
-				id,
+				uint64(dp.ID),
 				mt.common.stateroot.String(),
-				ds.Proposal.PieceCID.String(),
-				ds.Proposal.PieceSize,
-				ds.Proposal.PieceSize.Unpadded(),
-				ds.Proposal.VerifiedDeal,
-				ds.Proposal.Client.String(),
-				ds.Proposal.Provider.String(),
-				ds.Proposal.StartEpoch,
-				ds.Proposal.EndEpoch,
+				dp.Proposal.PieceCID.String(),
+				dp.Proposal.PieceSize,
+				dp.Proposal.PieceSize.Unpadded(),
+				dp.Proposal.VerifiedDeal,
+				dp.Proposal.Client.String(),
+				dp.Proposal.Provider.String(),
+				dp.Proposal.StartEpoch,
+				dp.Proposal.EndEpoch,
 				nil, // slashed_epoch
-				ds.Proposal.StoragePricePerEpoch.String(),
-				ds.Proposal.ProviderCollateral.String(),
-				ds.Proposal.ClientCollateral.String(),
+				dp.Proposal.StoragePricePerEpoch.String(),
+				dp.Proposal.ProviderCollateral.String(),
+				dp.Proposal.ClientCollateral.String(),
 			); err != nil {
 				return err
 			}
@@ -252,12 +315,12 @@ func (p *Processor) storeMarketActorDealProposals(ctx context.Context, marketTip
 
 }
 
+// updateMarketActorDealProposals sets the slashed epoch of the proposals whose deal was slashed.
 func (p *Processor) updateMarketActorDealProposals(ctx context.Context, marketTip []marketActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Updated Market Deal Proposals", "duration", time.Since(start).String())
+		p.logger().Debugw("Updated Market Deal Proposals", "duration", time.Since(start).String())
 	}()
-	pred := state.NewStatePredicates(p.node)
 
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -270,21 +333,11 @@ func (p *Processor) updateMarketActorDealProposals(ctx context.Context, marketTi
 	}
 
 	for _, mt := range marketTip {
-		stateDiff := pred.OnStorageMarketActorChanged(pred.OnDealStateChanged(pred.OnDealStateAmtChanged()))
-
-		changed, val, err := stateDiff(ctx, mt.common.parentTsKey, mt.common.tsKey)
-		if err != nil {
-			log.Warnw("error getting market deal state diff", "error", err)
-		}
-		if !changed {
+		if mt.dealStates == nil {
 			continue
 		}
-		changes, ok := val.(*state.MarketDealStateChanges)
-		if !ok {
-			return xerrors.Errorf("Unknown type returned by Deal State AMT predicate: %T", val)
-		}
 
-		for _, modified := range changes.Modified {
+		for _, modified := range mt.dealStates.Modified {
 			if modified.From.SlashEpoch != modified.To.SlashEpoch {
 				if _, err := stmt.Exec(modified.To.SlashEpoch, modified.ID); err != nil {
 					return err
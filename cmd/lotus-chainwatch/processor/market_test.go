@@ -0,0 +1,177 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/market"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func testDealProposal(t *testing.T, start abi.ChainEpoch) market.DealProposal {
+	return market.DealProposal{
+		PieceCID:             testCid(t, "piece"),
+		PieceSize:            2048,
+		Client:               mock.Address(100),
+		Provider:             mock.Address(1000),
+		StartEpoch:           start,
+		EndEpoch:             start + 100,
+		StoragePricePerEpoch: big.NewInt(1),
+		ProviderCollateral:   big.Zero(),
+		ClientCollateral:     big.Zero(),
+	}
+}
+
+// putMarketState stores a market state holding the given proposals and deal states and returns its head.
+func putMarketState(t *testing.T, store adt.Store, props map[abi.DealID]market.DealProposal, deals map[abi.DealID]market.DealState) cid.Cid {
+	propArr := adt.MakeEmptyArray(store)
+	for id, prop := range props {
+		prop := prop
+		require.NoError(t, propArr.Set(uint64(id), &prop))
+	}
+	propRoot, err := propArr.Root()
+	require.NoError(t, err)
+
+	dealArr := adt.MakeEmptyArray(store)
+	for id, deal := range deals {
+		deal := deal
+		require.NoError(t, dealArr.Set(uint64(id), &deal))
+	}
+	dealRoot, err := dealArr.Root()
+	require.NoError(t, err)
+
+	emptyArr, err := adt.MakeEmptyArray(store).Root()
+	require.NoError(t, err)
+	emptyMap, err := adt.MakeEmptyMap(store).Root()
+	require.NoError(t, err)
+
+	st := market.ConstructState(emptyArr, emptyMap, emptyMap)
+	st.Proposals = propRoot
+	st.States = dealRoot
+	head, err := store.Put(store.Context(), st)
+	require.NoError(t, err)
+	return head
+}
+
+// marketFixture returns a node and the market changes of a genesis holding deal 1 and of the tipset after it, in which
+// deal 1 is slashed and deal 2 is published.
+func marketFixture(t *testing.T) (*testNode, ActorTips, ActorTips) {
+	node := newTestNode()
+
+	prop1, prop2 := testDealProposal(t, 10), testDealProposal(t, 20)
+	active := market.DealState{SectorStartEpoch: 5, LastUpdatedEpoch: -1, SlashEpoch: -1}
+	slashed := market.DealState{SectorStartEpoch: 5, LastUpdatedEpoch: 6, SlashEpoch: 6}
+	published := market.DealState{SectorStartEpoch: -1, LastUpdatedEpoch: -1, SlashEpoch: -1}
+
+	genAct := types.Actor{Code: builtin.StorageMarketActorCodeID, Head: putMarketState(t, node.store,
+		map[abi.DealID]market.DealProposal{1: prop1},
+		map[abi.DealID]market.DealState{1: active})}
+	nextAct := types.Actor{Code: builtin.StorageMarketActorCodeID, Head: putMarketState(t, node.store,
+		map[abi.DealID]market.DealProposal{1: prop1, 2: prop2},
+		map[abi.DealID]market.DealState{1: slashed, 2: published})}
+
+	genTsk := types.NewTipSetKey(testCid(t, "genesis"))
+	nextTsk := types.NewTipSetKey(testCid(t, "block-1"))
+	node.setActor(genTsk, builtin.StorageMarketActorAddr, genAct)
+	node.setActor(nextTsk, builtin.StorageMarketActorAddr, nextAct)
+	node.deals = map[string]api.MarketDeal{"1": {Proposal: prop1, State: active}}
+
+	genesis := actorChange(t, builtin.StorageMarketActorAddr, genAct, 0, genTsk, types.EmptyTSK)
+	next := actorChange(t, builtin.StorageMarketActorAddr, nextAct, 1, nextTsk, genTsk)
+	return node, genesis, next
+}
+
+func TestProcessMarketDiffsDeals(t *testing.T) {
+	ctx := context.Background()
+	node, genesis, next := marketFixture(t)
+	p := &Processor{node: node}
+
+	infos, err := p.processMarket(ctx, genesis)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Len(t, infos[0].proposals.Added, 1)
+	require.Equal(t, abi.DealID(1), infos[0].proposals.Added[0].ID)
+	require.Len(t, infos[0].dealStates.Added, 1)
+
+	infos, err = p.processMarket(ctx, next)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	// only the new deal is emitted as a proposal, proposals never change.
+	require.Len(t, infos[0].proposals.Added, 1)
+	require.Equal(t, abi.DealID(2), infos[0].proposals.Added[0].ID)
+	require.Equal(t, abi.ChainEpoch(20), infos[0].proposals.Added[0].Proposal.StartEpoch)
+
+	require.Len(t, infos[0].dealStates.Added, 1)
+	require.Equal(t, abi.DealID(2), infos[0].dealStates.Added[0].ID)
+	require.Len(t, infos[0].dealStates.Modified, 1)
+	require.Equal(t, abi.DealID(1), infos[0].dealStates.Modified[0].ID)
+	require.Equal(t, abi.ChainEpoch(6), infos[0].dealStates.Modified[0].To.SlashEpoch)
+}
+
+func TestStoreMarketDeals(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	node, genesis, next := marketFixture(t)
+
+	p := &Processor{db: db, node: node}
+	require.NoError(t, p.setupMarket())
+	_, err := db.Exec(`truncate market_deal_proposals, market_deal_states`)
+	require.NoError(t, err)
+
+	require.NoError(t, p.HandleMarketChanges(ctx, genesis))
+	require.NoError(t, p.HandleMarketChanges(ctx, next))
+
+	var proposals int
+	require.NoError(t, db.QueryRow(`select count(*) from market_deal_proposals`).Scan(&proposals))
+	require.Equal(t, 2, proposals)
+
+	var slashedEpoch *int64
+	require.NoError(t, db.QueryRow(`select slashed_epoch from market_deal_proposals where deal_id = 1`).Scan(&slashedEpoch))
+	require.NotNil(t, slashedEpoch)
+	require.Equal(t, int64(6), *slashedEpoch)
+	require.NoError(t, db.QueryRow(`select slashed_epoch from market_deal_proposals where deal_id = 2`).Scan(&slashedEpoch))
+	require.Nil(t, slashedEpoch)
+
+	// deal 1 at genesis and once slashed, deal 2 once published.
+	var states int
+	require.NoError(t, db.QueryRow(`select count(*) from market_deal_states`).Scan(&states))
+	require.Equal(t, 3, states)
+}
+
+func TestStoreMarketDealProposalsVerified(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMarket())
+	_, err := db.Exec(`truncate market_deal_proposals`)
+	require.NoError(t, err)
+
+	verified, unverified := testDealProposal(t, 10), testDealProposal(t, 20)
+	verified.VerifiedDeal = true
+	require.NoError(t, p.storeMarketActorDealProposals(ctx, []marketActorInfo{{
+		common: actorInfo{stateroot: testCid(t, "stateroot")},
+		proposals: &state.MarketDealProposalChanges{Added: []state.ProposalIDState{
+			{ID: 1, Proposal: verified},
+			{ID: 2, Proposal: unverified},
+		}},
+	}}))
+
+	for id, expected := range map[abi.DealID]bool{1: true, 2: false} {
+		var isVerified bool
+		require.NoError(t, db.QueryRow(`select is_verified from market_deal_proposals where deal_id = $1`, uint64(id)).Scan(&isVerified))
+		require.Equal(t, expected, isVerified, "deal %d", id)
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 
+	"github.com/filecoin-project/go-address"
 	"github.com/ipfs/go-cid"
 
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/api"
 	"github.com/filecoin-project/lotus/chain/types"
-	"github.com/filecoin-project/lotus/lib/parmap"
 )
 
 func (p *Processor) setupMessages() error {
@@ -82,6 +86,22 @@ create table if not exists receipts
 
 create index if not exists receipts_msg_state_index
 	on receipts (msg, state);
+
+/*
+* per tipset aggregates of the messages executed in it, a height has a row for
+* every tipset seen at it, forks included, null rounds have no row
+*/
+create table if not exists epoch_gas_stats
+(
+	height bigint not null,
+	tipset_key text not null,
+	message_count bigint not null,
+	total_gas_used bigint not null,
+	total_gas_limit bigint not null,
+	avg_gas_price text not null,
+	constraint epoch_gas_stats_pk
+		primary key (height, tipset_key)
+);
 `); err != nil {
 		return err
 	}
@@ -97,8 +117,14 @@ func (p *Processor) HandleMessageChanges(ctx context.Context, blocks map[cid.Cid
 }
 
 func (p *Processor) persistMessagesAndReceipts(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader) error {
-	messages, inclusions := p.fetchMessages(ctx, blocks)
-	receipts := p.fetchParentReceipts(ctx, blocks)
+	messages, inclusions, err := p.fetchMessages(ctx, blocks)
+	if err != nil {
+		return err
+	}
+	receipts, gasStats, err := p.fetchParentReceipts(ctx, blocks)
+	if err != nil {
+		return err
+	}
 
 	grp, _ := errgroup.WithContext(ctx)
 
@@ -114,13 +140,21 @@ func (p *Processor) persistMessagesAndReceipts(ctx context.Context, blocks map[c
 		return p.storeReceipts(receipts)
 	})
 
+	grp.Go(func() error {
+		return p.storeGasStats(gasStats)
+	})
+
+	grp.Go(func() error {
+		return p.storeMessageAddresses(ctx, messages)
+	})
+
 	return grp.Wait()
 }
 
 func (p *Processor) storeReceipts(recs map[mrec]*types.MessageReceipt) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Receipts", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Receipts", "duration", time.Since(start).String())
 	}()
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -161,10 +195,54 @@ create temp table recs (like receipts excluding constraints) on commit drop;
 	return tx.Commit()
 }
 
+func (p *Processor) storeGasStats(stats map[types.TipSetKey]*epochGasStats) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Persisted Epoch Gas Stats", "duration", time.Since(start).String())
+	}()
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+create temp table egs (like epoch_gas_stats excluding constraints) on commit drop;
+`); err != nil {
+		return xerrors.Errorf("prep temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy egs (height, tipset_key, message_count, total_gas_used, total_gas_limit, avg_gas_price) from stdin `)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		if _, err := stmt.Exec(
+			s.height,
+			s.tsKey.String(),
+			s.messageCount,
+			s.totalGasUsed,
+			s.totalGasLimit,
+			s.avgGasPrice().String(),
+		); err != nil {
+			return err
+		}
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`insert into epoch_gas_stats select * from egs on conflict do nothing `); err != nil {
+		return xerrors.Errorf("epoch gas stats put: %w", err)
+	}
+
+	return tx.Commit()
+}
+
 func (p *Processor) storeMsgInclusions(incls map[cid.Cid][]cid.Cid) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Message Inclusions", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Message Inclusions", "duration", time.Since(start).String())
 	}()
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -196,7 +274,7 @@ create temp table mi (like block_messages excluding constraints) on commit drop;
 		return err
 	}
 
-	if _, err := tx.Exec(`insert into block_messages select * from mi on conflict do nothing `); err != nil {
+	if _, err := tx.Exec(`insert into block_messages select * from mi on conflict (block, message) do nothing `); err != nil {
 		return xerrors.Errorf("actor put: %w", err)
 	}
 
@@ -206,7 +284,7 @@ create temp table mi (like block_messages excluding constraints) on commit drop;
 func (p *Processor) storeMessages(msgs map[cid.Cid]*types.Message) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Messages", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Messages", "duration", time.Since(start).String())
 	}()
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -243,22 +321,94 @@ create temp table msgs (like messages excluding constraints) on commit drop;
 		return err
 	}
 
-	if _, err := tx.Exec(`insert into messages select * from msgs on conflict do nothing `); err != nil {
+	// a message shared by several blocks or already stored from an earlier tipset is stored once.
+	if _, err := tx.Exec(`insert into messages select * from msgs on conflict (cid) do nothing `); err != nil {
 		return xerrors.Errorf("actor put: %w", err)
 	}
 
 	return tx.Commit()
 }
 
-func (p *Processor) fetchMessages(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader) (map[cid.Cid]*types.Message, map[cid.Cid][]cid.Cid) {
+// storeMessageAddresses adds the robust senders and recipients of msgs missing from id_address_map, resolved by the
+// node. An account is created by the first transfer to its address rather than through the init actor, so accounts
+// such as BLS accounts paying gas are only ever seen in messages. Addresses the node can't resolve, like the recipient
+// of a transfer that failed, are left out.
+func (p *Processor) storeMessageAddresses(ctx context.Context, msgs map[cid.Cid]*types.Message) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Persisted Message Addresses", "duration", time.Since(start).String())
+	}()
+
+	seen := map[address.Address]struct{}{}
+	var robust []string
+	for _, m := range msgs {
+		for _, a := range []address.Address{m.From, m.To} {
+			if a == address.Undef || a.Protocol() == address.ID {
+				continue
+			}
+			if _, ok := seen[a]; ok {
+				continue
+			}
+			seen[a] = struct{}{}
+			robust = append(robust, a.String())
+		}
+	}
+	if len(robust) == 0 {
+		return nil
+	}
+
+	known, err := p.lookupIDs(ctx, robust)
+	if err != nil {
+		return err
+	}
+
+	addressToID := map[address.Address]address.Address{}
+	for a := range seen {
+		if _, ok := known[a]; ok {
+			continue
+		}
+		id, err := p.stateLookupID(ctx, a, types.EmptyTSK)
+		if err != nil {
+			p.logger().Debugw("Could not resolve message address", "address", a, "error", err)
+			continue
+		}
+		if id == address.Undef {
+			continue
+		}
+		addressToID[a] = id
+	}
+	if len(addressToID) == 0 {
+		return nil
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		// an ID already mapped to another address is moved to the one the node resolved.
+		if err := p.putAddressMap(ctx, tx, addressToID); err != nil {
+			return xerrors.Errorf("message address put: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+func (p *Processor) fetchMessages(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader) (map[cid.Cid]*types.Message, map[cid.Cid][]cid.Cid, error) {
 	var lk sync.Mutex
 	messages := map[cid.Cid]*types.Message{}
 	inclusions := map[cid.Cid][]cid.Cid{} // block -> msgs
 
-	parmap.Par(50, parmap.MapArr(blocks), func(header *types.BlockHeader) {
+	err := parBlocks(50, blocks, func(header *types.BlockHeader) error {
 		msgs, err := p.node.ChainGetBlockMessages(ctx, header.Cid())
 		if err != nil {
-			panic(err)
+			return xerrors.Errorf("get messages of block %s: %w", header.Cid(), err)
 		}
 
 		vmm := make([]*types.Message, 0, len(msgs.Cids))
@@ -271,14 +421,31 @@ func (p *Processor) fetchMessages(ctx context.Context, blocks map[cid.Cid]*types
 		}
 
 		lk.Lock()
-		for _, message := range vmm {
-			messages[message.Cid()] = message
-			inclusions[header.Cid()] = append(inclusions[header.Cid()], message.Cid())
-		}
+		addBlockMessages(messages, inclusions, header.Cid(), vmm)
 		lk.Unlock()
+		return nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return messages, inclusions
+	return messages, inclusions, nil
+}
+
+// addBlockMessages records the messages included in block. A message included by more than one block of a tipset is
+// kept once in messages while inclusions records every block it appears in.
+func addBlockMessages(messages map[cid.Cid]*types.Message, inclusions map[cid.Cid][]cid.Cid, block cid.Cid, msgs []*types.Message) {
+	seen := map[cid.Cid]struct{}{}
+	for _, message := range msgs {
+		mc := message.Cid()
+		if _, ok := seen[mc]; ok {
+			continue
+		}
+		seen[mc] = struct{}{}
+
+		messages[mc] = message
+		inclusions[block] = append(inclusions[block], mc)
+	}
 }
 
 type mrec struct {
@@ -287,20 +454,25 @@ type mrec struct {
 	idx   int
 }
 
-func (p *Processor) fetchParentReceipts(ctx context.Context, toSync map[cid.Cid]*types.BlockHeader) map[mrec]*types.MessageReceipt {
+// fetchParentReceipts fetches the receipts of the messages executed in the parent tipsets of the given blocks, along
+// with the gas aggregates of each parent tipset computed from the same messages and receipts. All blocks of a tipset
+// share the same parents so the aggregates of a parent tipset are only computed once.
+func (p *Processor) fetchParentReceipts(ctx context.Context, toSync map[cid.Cid]*types.BlockHeader) (map[mrec]*types.MessageReceipt, map[types.TipSetKey]*epochGasStats, error) {
 	var lk sync.Mutex
 	out := map[mrec]*types.MessageReceipt{}
+	stats := map[types.TipSetKey]*epochGasStats{}
 
-	parmap.Par(50, parmap.MapArr(toSync), func(header *types.BlockHeader) {
+	err := parBlocks(50, toSync, func(header *types.BlockHeader) error {
 		recs, err := p.node.ChainGetParentReceipts(ctx, header.Cid())
 		if err != nil {
-			panic(err)
+			return xerrors.Errorf("get parent receipts of block %s: %w", header.Cid(), err)
 		}
 		msgs, err := p.node.ChainGetParentMessages(ctx, header.Cid())
 		if err != nil {
-			panic(err)
+			return xerrors.Errorf("get parent messages of block %s: %w", header.Cid(), err)
 		}
 
+		pkey := types.NewTipSetKey(header.Parents...)
 		lk.Lock()
 		for i, r := range recs {
 			out[mrec{
@@ -309,8 +481,65 @@ func (p *Processor) fetchParentReceipts(ctx context.Context, toSync map[cid.Cid]
 				idx:   i,
 			}] = r
 		}
+		_, seen := stats[pkey]
+		if !seen {
+			stats[pkey] = nil
+		}
+		lk.Unlock()
+		if seen {
+			return nil
+		}
+
+		pts, err := p.node.ChainGetTipSet(ctx, pkey)
+		if err != nil {
+			return xerrors.Errorf("get parent tipset of block %s: %w", header.Cid(), err)
+		}
+		s := aggregateGasStats(pts.Height(), msgs, recs)
+		s.tsKey = pkey
+
+		lk.Lock()
+		stats[pkey] = s
 		lk.Unlock()
+		return nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return out, stats, nil
+}
+
+type epochGasStats struct {
+	height abi.ChainEpoch
+	tsKey  types.TipSetKey
+
+	messageCount  int64
+	totalGasUsed  int64
+	totalGasLimit int64
+	totalGasPrice big.Int
+}
 
+func (s *epochGasStats) avgGasPrice() big.Int {
+	if s.messageCount == 0 {
+		return big.Zero()
+	}
+	return big.Div(s.totalGasPrice, big.NewInt(s.messageCount))
+}
+
+// aggregateGasStats sums up the messages executed in the tipset at height, msgs and recs are expected to be in
+// execution order as returned by ChainGetParentMessages and ChainGetParentReceipts.
+func aggregateGasStats(height abi.ChainEpoch, msgs []api.Message, recs []*types.MessageReceipt) *epochGasStats {
+	out := &epochGasStats{
+		height:        height,
+		totalGasPrice: big.Zero(),
+	}
+	for i, m := range msgs {
+		out.messageCount++
+		out.totalGasLimit += m.Message.GasLimit
+		out.totalGasPrice = big.Add(out.totalGasPrice, m.Message.GasPrice)
+		if i < len(recs) {
+			out.totalGasUsed += recs[i].GasUsed
+		}
+	}
 	return out
 }
@@ -0,0 +1,223 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestAggregateGasStats(t *testing.T) {
+	msgs := []api.Message{
+		{Message: &types.Message{GasLimit: 100, GasPrice: big.NewInt(1)}},
+		{Message: &types.Message{GasLimit: 200, GasPrice: big.NewInt(2)}},
+		{Message: &types.Message{GasLimit: 300, GasPrice: big.NewInt(6)}},
+	}
+	recs := []*types.MessageReceipt{
+		{GasUsed: 10},
+		{GasUsed: 20},
+		{GasUsed: 30},
+	}
+
+	stats := aggregateGasStats(abi.ChainEpoch(7), msgs, recs)
+	require.Equal(t, abi.ChainEpoch(7), stats.height)
+	require.Equal(t, int64(3), stats.messageCount)
+	require.Equal(t, int64(60), stats.totalGasUsed)
+	require.Equal(t, int64(600), stats.totalGasLimit)
+	require.Equal(t, big.NewInt(3), stats.avgGasPrice())
+}
+
+func TestAggregateGasStatsEmptyTipSet(t *testing.T) {
+	stats := aggregateGasStats(abi.ChainEpoch(7), nil, nil)
+	require.Equal(t, int64(0), stats.messageCount)
+	require.Equal(t, big.Zero(), stats.avgGasPrice())
+}
+
+// parentMessagesNode serves the messages and receipts executed in each parent tipset, counting the calls made.
+type parentMessagesNode struct {
+	*testNode
+
+	blocks map[cid.Cid]*types.BlockHeader
+	msgs   map[types.TipSetKey][]api.Message
+	recs   map[types.TipSetKey][]*types.MessageReceipt
+
+	lk    sync.Mutex
+	calls map[string]int
+}
+
+func (n *parentMessagesNode) call(name string) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+	n.calls[name]++
+}
+
+func (n *parentMessagesNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	n.call("ChainGetTipSet")
+	return n.testNode.ChainGetTipSet(ctx, tsk)
+}
+
+func (n *parentMessagesNode) ChainGetParentMessages(ctx context.Context, c cid.Cid) ([]api.Message, error) {
+	n.call("ChainGetParentMessages")
+	return n.msgs[types.NewTipSetKey(n.blocks[c].Parents...)], nil
+}
+
+func (n *parentMessagesNode) ChainGetParentReceipts(ctx context.Context, c cid.Cid) ([]*types.MessageReceipt, error) {
+	n.call("ChainGetParentReceipts")
+	return n.recs[types.NewTipSetKey(n.blocks[c].Parents...)], nil
+}
+
+func TestFetchParentReceiptsGasStats(t *testing.T) {
+	ctx := context.Background()
+
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	// two forks at height 1, the first one is built on by two blocks.
+	a := mock.TipSet(mock.MkBlock(gen, 1, 1))
+	b := mock.TipSet(mock.MkBlock(gen, 1, 2))
+	blocks := map[cid.Cid]*types.BlockHeader{}
+	for _, bh := range []*types.BlockHeader{mock.MkBlock(a, 1, 1), mock.MkBlock(a, 1, 2), mock.MkBlock(b, 1, 1)} {
+		blocks[bh.Cid()] = bh
+	}
+
+	msg := func(nonce uint64, limit int64) api.Message {
+		m := &types.Message{From: mock.Address(1000), To: mock.Address(1001), Nonce: nonce, Value: types.NewInt(0), GasPrice: types.NewInt(1), GasLimit: limit}
+		return api.Message{Cid: m.Cid(), Message: m}
+	}
+	node := &parentMessagesNode{
+		testNode: newTestNode(),
+		blocks:   blocks,
+		msgs: map[types.TipSetKey][]api.Message{
+			a.Key(): {msg(0, 100), msg(1, 200)},
+			b.Key(): {msg(2, 300)},
+		},
+		recs: map[types.TipSetKey][]*types.MessageReceipt{
+			a.Key(): {{GasUsed: 10}, {GasUsed: 20}},
+			b.Key(): {{GasUsed: 30}},
+		},
+		calls: map[string]int{},
+	}
+	node.addTipSet(a)
+	node.addTipSet(b)
+	p := &Processor{node: node}
+
+	receipts, stats, err := p.fetchParentReceipts(ctx, blocks)
+	require.NoError(t, err)
+	require.Len(t, receipts, 3)
+
+	// the messages and receipts are fetched once per block, the parent tipsets once each.
+	require.Equal(t, map[string]int{"ChainGetParentMessages": 3, "ChainGetParentReceipts": 3, "ChainGetTipSet": 2}, node.calls)
+
+	// the forks at the same height are aggregated apart.
+	require.Len(t, stats, 2)
+	require.Equal(t, a.Height(), stats[a.Key()].height)
+	require.Equal(t, a.Key(), stats[a.Key()].tsKey)
+	require.Equal(t, int64(2), stats[a.Key()].messageCount)
+	require.Equal(t, int64(30), stats[a.Key()].totalGasUsed)
+	require.Equal(t, int64(300), stats[a.Key()].totalGasLimit)
+	require.Equal(t, b.Height(), stats[b.Key()].height)
+	require.Equal(t, int64(1), stats[b.Key()].messageCount)
+	require.Equal(t, int64(30), stats[b.Key()].totalGasUsed)
+}
+
+func TestAddBlockMessagesDuplicateAcrossBlocks(t *testing.T) {
+	newMsg := func(nonce uint64) *types.Message {
+		return &types.Message{
+			From:     mock.Address(1000),
+			To:       mock.Address(1001),
+			Nonce:    nonce,
+			Value:    types.NewInt(0),
+			GasPrice: types.NewInt(1),
+			GasLimit: 1,
+		}
+	}
+	shared := newMsg(0)
+	only := newMsg(1)
+
+	blockA := testCid(t, "block-a")
+	blockB := testCid(t, "block-b")
+
+	messages := map[cid.Cid]*types.Message{}
+	inclusions := map[cid.Cid][]cid.Cid{}
+	addBlockMessages(messages, inclusions, blockA, []*types.Message{shared, only})
+	addBlockMessages(messages, inclusions, blockB, []*types.Message{shared})
+
+	// one row per message, one inclusion per block the message is in.
+	require.Len(t, messages, 2)
+	require.Equal(t, []cid.Cid{shared.Cid(), only.Cid()}, inclusions[blockA])
+	require.Equal(t, []cid.Cid{shared.Cid()}, inclusions[blockB])
+
+	var sharedInclusions int
+	for _, msgs := range inclusions {
+		for _, m := range msgs {
+			if m == shared.Cid() {
+				sharedInclusions++
+			}
+		}
+	}
+	require.Equal(t, 2, sharedInclusions)
+}
+
+func TestStoreMessageAddresses(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	bls, err := address.NewBLSAddress(make([]byte, 48))
+	require.NoError(t, err)
+	known, err := address.NewSecp256k1Address([]byte("known"))
+	require.NoError(t, err)
+	missing, err := address.NewSecp256k1Address([]byte("never created"))
+	require.NoError(t, err)
+	_, err = db.Exec(`insert into id_address_map (id, address) values ($1, $2)`, mock.Address(1001).String(), known.String())
+	require.NoError(t, err)
+
+	// known is already in id_address_map and missing is unknown to the node, only bls is added.
+	node := &lookupNode{ids: map[address.Address]address.Address{bls: mock.Address(1000)}}
+	p := &Processor{db: db, node: node}
+	msgs := map[cid.Cid]*types.Message{
+		testCid(t, "msg-1"): {From: bls, To: mock.Address(1002)},
+		testCid(t, "msg-2"): {From: known, To: missing},
+	}
+	require.NoError(t, p.storeMessageAddresses(ctx, msgs))
+	// storing the same messages again is a no-op.
+	require.NoError(t, p.storeMessageAddresses(ctx, msgs))
+
+	var id string
+	require.NoError(t, db.QueryRow(`select id from id_address_map where address = $1`, bls.String()).Scan(&id))
+	require.Equal(t, mock.Address(1000).String(), id)
+	require.Equal(t, 2, countRows(t, db, `select count(*) from id_address_map`))
+}
+
+func TestStoreMessageAddressesRemapsID(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		stale, err := address.NewSecp256k1Address([]byte("stale"))
+		require.NoError(t, err)
+		current, err := address.NewSecp256k1Address([]byte("current"))
+		require.NoError(t, err)
+		require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{stale: mock.Address(1000)}))
+
+		// the node resolves a new address to the ID without any reorg having been seen.
+		p.node = &lookupNode{ids: map[address.Address]address.Address{current: mock.Address(1000)}}
+		require.NoError(t, p.storeMessageAddresses(ctx, map[cid.Cid]*types.Message{
+			testCid(t, "msg-1"): {From: current, To: mock.Address(1001)},
+		}))
+
+		id, err := p.IDForRobust(ctx, current)
+		require.NoError(t, err)
+		require.Equal(t, mock.Address(1000), id)
+		_, err = p.IDForRobust(ctx, stale)
+		require.True(t, xerrors.Is(err, ErrActorNotFound))
+		require.Equal(t, 1, countRows(t, p.db, `select count(*) from id_address_map`))
+	})
+}
@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"database/sql"
+
+	"golang.org/x/xerrors"
+)
+
+func (p *Processor) setupMeta() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/* key value store for facts about the chain and the chainwatch database itself */
+create table if not exists chainwatch_meta
+(
+	key text not null
+		constraint chainwatch_meta_pk
+			primary key,
+	value text not null
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// metaValue returns the value stored under key in chainwatch_meta, ok is false if nothing is stored.
+func (p *Processor) metaValue(key string) (value string, ok bool, err error) {
+	err = p.db.QueryRow(`select value from chainwatch_meta where key = $1`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, xerrors.Errorf("query chainwatch_meta %s: %w", key, err)
+	}
+	return value, true, nil
+}
+
+// setMeta stores value under key in chainwatch_meta, replacing any previous value.
+func (p *Processor) setMeta(key, value string) error {
+	if _, err := p.db.Exec(`
+insert into chainwatch_meta (key, value) values ($1, $2)
+on conflict (key) do update set value = excluded.value
+`, key, value); err != nil {
+		return xerrors.Errorf("store chainwatch_meta %s: %w", key, err)
+	}
+	return nil
+}
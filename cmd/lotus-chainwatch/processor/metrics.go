@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// MetricsSink receives the metrics recorded while processing, so they can be sent to whichever backend the operator
+// runs. Call sites only talk to the sink and never to a backend directly.
+type MetricsSink interface {
+	// StoreDuration records how long storing a batch into table took.
+	StoreDuration(ctx context.Context, table string, d time.Duration)
+	// StoreRows records the number of rows written to table.
+	StoreRows(ctx context.Context, table string, n int64)
+	// StoreError records a failed store into table.
+	StoreError(ctx context.Context, table string)
+	// CacheLookups records the hits and misses of one of the processor caches.
+	CacheLookups(ctx context.Context, cache string, hits, misses int64)
+	// ActorsProcessed records n actors with the given code processed.
+	ActorsProcessed(ctx context.Context, code cid.Cid, n int64)
+	// ProcessedEpoch records the highest epoch whose blocks were marked processed.
+	ProcessedEpoch(ctx context.Context, epoch abi.ChainEpoch)
+}
+
+// The caches whose lookups are reported to the MetricsSink.
+const (
+	cacheActorState = "actor_state"
+	cacheDecode     = "decode"
+	cacheID         = "id_address"
+)
+
+// Tags
+var (
+	Table, _ = tag.NewKey("table")
+	Phase, _ = tag.NewKey("phase")
+	Cache, _ = tag.NewKey("cache")
+	Code, _  = tag.NewKey("code")
+)
+
+// Measures
+var (
+	StoreDurationMilliseconds = stats.Float64("chainwatch/store_ms", "Duration of storing a batch into a table in ms", stats.UnitMilliseconds)
+	StoreRows                 = stats.Int64("chainwatch/store_rows", "Rows written to a table", stats.UnitDimensionless)
+	StoreErrors               = stats.Int64("chainwatch/store_errors", "Failed stores into a table", stats.UnitDimensionless)
+	CacheHits                 = stats.Int64("chainwatch/cache_hits", "Lookups answered by a processor cache", stats.UnitDimensionless)
+	CacheMisses               = stats.Int64("chainwatch/cache_misses", "Lookups missed by a processor cache", stats.UnitDimensionless)
+	ActorsProcessed           = stats.Int64("chainwatch/actors_processed", "Actors processed by code", stats.UnitDimensionless)
+	LastProcessedEpoch        = stats.Int64("chainwatch/last_processed_epoch", "Highest epoch marked processed", stats.UnitDimensionless)
+)
+
+var (
+	// store phases are named after the table they write.
+	StoreDurationView = &view.View{
+		Measure:     StoreDurationMilliseconds,
+		Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000),
+		TagKeys:     []tag.Key{Phase},
+	}
+	StoreRowsView = &view.View{
+		Measure:     StoreRows,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Table},
+	}
+	StoreErrorsView = &view.View{
+		Measure:     StoreErrors,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Table},
+	}
+	CacheHitsView = &view.View{
+		Measure:     CacheHits,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Cache},
+	}
+	CacheMissesView = &view.View{
+		Measure:     CacheMisses,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Cache},
+	}
+	ActorsProcessedView = &view.View{
+		Measure:     ActorsProcessed,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Code},
+	}
+	LastProcessedEpochView = &view.View{
+		Measure:     LastProcessedEpoch,
+		Aggregation: view.LastValue(),
+	}
+)
+
+// DefaultViews is the set of views chainwatch exports.
+var DefaultViews = []*view.View{
+	StoreDurationView,
+	StoreRowsView,
+	StoreErrorsView,
+	CacheHitsView,
+	CacheMissesView,
+	ActorsProcessedView,
+	LastProcessedEpochView,
+}
+
+// prometheusSink records into the opencensus measures above, which reach Prometheus through the opencensus exporter
+// once DefaultViews are registered.
+type prometheusSink struct{}
+
+// NewPrometheusSink returns the MetricsSink used by default.
+func NewPrometheusSink() MetricsSink {
+	return prometheusSink{}
+}
+
+func (prometheusSink) StoreDuration(ctx context.Context, table string, d time.Duration) {
+	ctx, _ = tag.New(ctx, tag.Upsert(Phase, table))
+	stats.Record(ctx, StoreDurationMilliseconds.M(float64(d)/float64(time.Millisecond)))
+}
+
+func (prometheusSink) StoreRows(ctx context.Context, table string, n int64) {
+	ctx, _ = tag.New(ctx, tag.Upsert(Table, table))
+	stats.Record(ctx, StoreRows.M(n))
+}
+
+func (prometheusSink) StoreError(ctx context.Context, table string) {
+	ctx, _ = tag.New(ctx, tag.Upsert(Table, table))
+	stats.Record(ctx, StoreErrors.M(1))
+}
+
+func (prometheusSink) CacheLookups(ctx context.Context, cache string, hits, misses int64) {
+	ctx, _ = tag.New(ctx, tag.Upsert(Cache, cache))
+	stats.Record(ctx, CacheHits.M(hits), CacheMisses.M(misses))
+}
+
+func (prometheusSink) ActorsProcessed(ctx context.Context, code cid.Cid, n int64) {
+	ctx, _ = tag.New(ctx, tag.Upsert(Code, code.String()))
+	stats.Record(ctx, ActorsProcessed.M(n))
+}
+
+func (prometheusSink) ProcessedEpoch(ctx context.Context, epoch abi.ChainEpoch) {
+	stats.Record(ctx, LastProcessedEpoch.M(int64(epoch)))
+}
+
+func (p *Processor) metrics() MetricsSink {
+	if p.Metrics == nil {
+		return prometheusSink{}
+	}
+	return p.Metrics
+}
+
+// recordStore reports the outcome of a store into table that began at start and wrote rows rows. The rows are also
+// added to the storeRows of ctx, if any.
+func (p *Processor) recordStore(ctx context.Context, table string, start time.Time, rows int, err error) {
+	m := p.metrics()
+	m.StoreDuration(ctx, table, time.Since(start))
+	if err != nil {
+		m.StoreError(ctx, table)
+		return
+	}
+	m.StoreRows(ctx, table, int64(rows))
+	if s, ok := ctx.Value(storeRowsKey{}).(*storeRows); ok {
+		s.add(table, rows)
+	}
+}
@@ -0,0 +1,87 @@
+package processor
+
+import (
+	"database/sql"
+
+	"golang.org/x/xerrors"
+)
+
+// migration is a change to the schema, applied once per database in version order.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sql.Tx) error
+}
+
+// migrations are the schema migrations of the common actor tables, in version order. Versions are never reused or
+// reordered once released, a change to the schema is a new migration appended here.
+func (p *Processor) migrations() []migration {
+	return []migration{
+		{version: 1, name: "common actor tables", apply: p.commonActorsSchema},
+		{version: 2, name: "actors tipset_key", apply: p.actorsTipSetKeySchema},
+		{version: 3, name: "actors balance numeric", apply: p.actorsBalanceNumericSchema},
+		{version: 4, name: "processor checkpoint", apply: p.checkpointSchema},
+		{version: 5, name: "latest actors view", apply: p.latestActorsSchema},
+		{version: 6, name: "actors id stateroot index", apply: p.actorsIDStaterootIndexSchema},
+		{version: 7, name: "burnt funds", apply: p.burntFundsSchema},
+		{version: 8, name: "actors epoch", apply: p.actorsEpochSchema},
+		{version: 9, name: "actors nonce numeric", apply: p.actorsNonceNumericSchema},
+	}
+}
+
+// schemaMigrationsTable records the migrations applied to the database, it is valid in both backends.
+const schemaMigrationsTable = `
+create table if not exists schema_migrations
+(
+	version bigint not null
+		constraint schema_migrations_pk
+			primary key,
+	name text not null,
+	applied_at timestamp default current_timestamp not null
+)`
+
+// migrate applies the migrations not applied to the database yet, in order and each in a transaction of its own. A
+// migration that fails is rolled back and stops the ones after it.
+func (p *Processor) migrate(migrations []migration) error {
+	if _, err := p.db.Exec(schemaMigrationsTable); err != nil {
+		return xerrors.Errorf("create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		applied, err := p.applyMigration(m)
+		if err != nil {
+			return xerrors.Errorf("schema migration %d (%s): %w", m.version, m.name, err)
+		}
+		if applied {
+			p.logger().Infow("Applied schema migration", "version", m.version, "name", m.name)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies m unless it was already. The version is recorded first, an instance migrating concurrently
+// waits on it and then skips the migration.
+func (p *Processor) applyMigration(m migration) (bool, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.Exec(`insert into schema_migrations (version, name) values ($1, $2) on conflict do nothing`, m.version, m.name)
+	if err != nil {
+		return false, xerrors.Errorf("record migration: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	if err := m.apply(tx); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,108 @@
+package processor
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+// countingMigrations returns migrations creating a table each and the number of times each was applied.
+func countingMigrations(versions ...int) ([]migration, map[int]int) {
+	applied := map[int]int{}
+	var out []migration
+	for _, v := range versions {
+		v := v
+		out = append(out, migration{version: v, name: "test", apply: func(tx *sql.Tx) error {
+			applied[v]++
+			_, err := tx.Exec(fmt.Sprintf(`create table migration_%d (id integer)`, v))
+			return err
+		}})
+	}
+	return out, applied
+}
+
+// schemaVersions returns the versions of the migrations of p followed by versions.
+func schemaVersions(p *Processor, versions ...int) []int {
+	var out []int
+	for _, m := range p.migrations() {
+		out = append(out, m.version)
+	}
+	return append(out, versions...)
+}
+
+func appliedVersions(t *testing.T, db *sql.DB) []int {
+	rows, err := db.Query(`select version from schema_migrations order by version`)
+	require.NoError(t, err)
+	defer rows.Close() //nolint:errcheck
+
+	var out []int
+	for rows.Next() {
+		var v int
+		require.NoError(t, rows.Scan(&v))
+		out = append(out, v)
+	}
+	require.NoError(t, rows.Err())
+	return out
+}
+
+func TestMigrateFresh(t *testing.T) {
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite}
+	require.Equal(t, schemaVersions(p), appliedVersions(t, p.db))
+
+	migrations, applied := countingMigrations(102, 103)
+	require.NoError(t, p.migrate(migrations))
+	require.NoError(t, p.migrate(migrations))
+
+	require.Equal(t, map[int]int{102: 1, 103: 1}, applied)
+	require.Equal(t, schemaVersions(p, 102, 103), appliedVersions(t, p.db))
+	require.Equal(t, 0, countRows(t, p.db, `select count(*) from migration_103`))
+}
+
+func TestMigratePartiallyMigrated(t *testing.T) {
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite}
+
+	migrations, applied := countingMigrations(102, 103, 104)
+	require.NoError(t, p.migrate(migrations[:1]))
+	require.NoError(t, p.migrate(migrations))
+
+	require.Equal(t, map[int]int{102: 1, 103: 1, 104: 1}, applied)
+	require.Equal(t, schemaVersions(p, 102, 103, 104), appliedVersions(t, p.db))
+}
+
+func TestMigrateStopsOnFailure(t *testing.T) {
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite}
+
+	migrations, applied := countingMigrations(102, 104)
+	failing := migration{version: 103, name: "failing", apply: func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`create table migration_failed (id integer)`); err != nil {
+			return err
+		}
+		return xerrors.New("bad migration")
+	}}
+	require.Error(t, p.migrate([]migration{migrations[0], failing, migrations[1]}))
+
+	// the failed migration is rolled back and the ones after it are not applied.
+	require.Equal(t, map[int]int{102: 1}, applied)
+	require.Equal(t, schemaVersions(p, 102), appliedVersions(t, p.db))
+	var n int
+	require.NoError(t, p.db.QueryRow(`select count(*) from sqlite_master where name = 'migration_failed'`).Scan(&n))
+	require.Zero(t, n)
+
+	// once fixed the remaining migrations apply.
+	failing.apply = func(tx *sql.Tx) error { return nil }
+	require.NoError(t, p.migrate([]migration{migrations[0], failing, migrations[1]}))
+	require.Equal(t, schemaVersions(p, 102, 103, 104), appliedVersions(t, p.db))
+}
+
+func TestMigratePostgres(t *testing.T) {
+	// testDB set up the common actor tables through their migrations.
+	p := &Processor{db: testDB(t)}
+	require.Subset(t, appliedVersions(t, p.db), schemaVersions(p))
+
+	// setting up again applies nothing and keeps the tables.
+	require.NoError(t, p.setupCommonActors())
+	require.Equal(t, 0, countRows(t, p.db, `select count(*) from actors`))
+}
@@ -3,6 +3,7 @@ package processor
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 	"sync"
@@ -63,6 +64,52 @@ create table if not exists miner_power
 		primary key (miner_id, state_root)
 );
 
+/*
+* captures the funds a miner has set aside for any given stateroot
+*/
+create table if not exists miner_funds
+(
+	miner_id text not null,
+	state_root text not null,
+	locked_funds text not null,
+	precommit_deposits text not null,
+	constraint miner_funds_pk
+		primary key (miner_id, state_root)
+);
+
+/*
+* the typed columns of the decoded miner state for any given stateroot, see typed_state.go
+*/
+create table if not exists miner_state
+(
+	miner_id text not null,
+	state_root text not null,
+	locked_funds numeric not null,
+	precommit_deposits numeric not null,
+	/* null for actors versions whose miner state has no fee debt */
+	fee_debt numeric,
+	current_deadline bigint not null,
+	/* null for actors versions which lock the initial pledge in locked_funds */
+	initial_pledge numeric,
+	constraint miner_state_pk
+		primary key (miner_id, state_root)
+);
+
+alter table miner_state add column if not exists initial_pledge numeric;
+
+/*
+* the amounts of the locked funds of a miner vesting at each epoch for any given stateroot
+*/
+create table if not exists miner_vesting_funds
+(
+	miner_id text not null,
+	state_root text not null,
+	epoch bigint not null,
+	amount numeric not null,
+	constraint miner_vesting_funds_pk
+		primary key (miner_id, state_root, epoch)
+);
+
 create table if not exists miner_precommits
 (
 	miner_id text not null,
@@ -92,6 +139,17 @@ create table if not exists miner_sectors
 		primary key (miner_id, sector_id)
 );
 
+/* deals a sector was committed with, committed capacity sectors have no rows */
+create table if not exists sector_deals
+(
+	miner_id text not null,
+	sector_id bigint not null,
+	deal_id bigint not null,
+	commit_epoch bigint not null,
+	constraint sector_deals_pk
+		primary key (miner_id, sector_id, deal_id)
+);
+
 /* used to tell when a miners sectors (proven-not-yet-expired) changed if the miner_sectors_cid's are different a new sector was added or removed (terminated/expired) */
 create table if not exists miner_sectors_heads
 (
@@ -127,6 +185,9 @@ create table if not exists miner_sector_events
 		primary key (sector_id, event, miner_id, state_root)
 );
 
+/* the epoch of the tipset whose execution made the event, null for the events stored before it was recorded */
+alter table miner_sector_events add column if not exists epoch bigint;
+
 create materialized view if not exists miner_sectors_view as
 select ms.miner_id, ms.sector_id, mp.precommit_epoch, ms.activation_epoch, ms.expiration_epoch, ms.termination_epoch, ms.deal_weight, ms.verified_deal_weight
 from miner_sectors ms
@@ -159,18 +220,101 @@ type sectorUpdate struct {
 	minerID  address.Address
 }
 
+type sectorDeal struct {
+	minerID     address.Address
+	sectorID    abi.SectorNumber
+	dealID      abi.DealID
+	commitEpoch abi.ChainEpoch
+}
+
+// The sector lifecycle events of miner_sector_events.
+const (
+	sectorPreCommit  = "PRECOMMIT"
+	sectorCommit     = "COMMIT"
+	sectorExtended   = "EXTENDED"
+	sectorExpired    = "EXPIRED"
+	sectorTerminated = "TERMINATED"
+)
+
+// sectorEvent is a row of miner_sector_events.
+type sectorEvent struct {
+	minerID  address.Address
+	sectorID abi.SectorNumber
+	event    string
+	epoch    abi.ChainEpoch
+}
+
+// precommitEvents returns a PRECOMMIT event for every sector the miner pre-committed, at the epoch it did.
+func precommitEvents(minerID address.Address, changes *state.MinerPreCommitChanges) []sectorEvent {
+	out := make([]sectorEvent, 0, len(changes.Added))
+	for _, added := range changes.Added {
+		out = append(out, sectorEvent{minerID: minerID, sectorID: added.Info.SectorNumber, event: sectorPreCommit, epoch: added.PreCommitEpoch})
+	}
+	return out
+}
+
+// sectorChangeEvents returns the events of the sector changes the tipset at epoch made to the miner, one for each of
+// the sectors a batch commits or extends, and the updates to their miner_sectors rows. A sector removed before its
+// expiration was terminated, one removed after it expired.
+func sectorChangeEvents(minerID address.Address, epoch abi.ChainEpoch, changes *state.MinerSectorChanges) ([]sectorEvent, []sectorUpdate) {
+	var events []sectorEvent
+	var updates []sectorUpdate
+	for _, extended := range changes.Extended {
+		events = append(events, sectorEvent{minerID: minerID, sectorID: extended.To.Info.SectorNumber, event: sectorExtended, epoch: epoch})
+		updates = append(updates, sectorUpdate{
+			expirationEpoch: extended.To.Info.Expiration,
+			sectorID:        extended.From.Info.SectorNumber,
+			minerID:         minerID,
+		})
+	}
+
+	for _, removed := range changes.Removed {
+		if removed.Info.Expiration > epoch {
+			events = append(events, sectorEvent{minerID: minerID, sectorID: removed.Info.SectorNumber, event: sectorTerminated, epoch: epoch})
+			updates = append(updates, sectorUpdate{
+				terminationEpoch: epoch,
+				terminated:       true,
+				expirationEpoch:  removed.Info.Expiration,
+				sectorID:         removed.Info.SectorNumber,
+				minerID:          minerID,
+			})
+			continue
+		}
+		events = append(events, sectorEvent{minerID: minerID, sectorID: removed.Info.SectorNumber, event: sectorExpired, epoch: epoch})
+	}
+
+	for _, added := range changes.Added {
+		events = append(events, sectorEvent{minerID: minerID, sectorID: added.Info.SectorNumber, event: sectorCommit, epoch: epoch})
+	}
+	return events, updates
+}
+
+// sectorDeals returns the deals the sector was committed with, it is empty for committed capacity sectors.
+func sectorDeals(minerID address.Address, sector miner.SectorOnChainInfo) []sectorDeal {
+	out := make([]sectorDeal, 0, len(sector.Info.DealIDs))
+	for _, dealID := range sector.Info.DealIDs {
+		out = append(out, sectorDeal{
+			minerID:     minerID,
+			sectorID:    sector.Info.SectorNumber,
+			dealID:      dealID,
+			commitEpoch: sector.ActivationEpoch,
+		})
+	}
+	return out
+}
+
 func (p *Processor) HandleMinerChanges(ctx context.Context, minerTips ActorTips) error {
 	minerChanges, err := p.processMiners(ctx, minerTips)
 	if err != nil {
-		log.Fatalw("Failed to process miner actors", "error", err)
+		return xerrors.Errorf("Failed to process miner actors: %w", err)
 	}
 
 	if err := p.persistMiners(ctx, minerChanges); err != nil {
-		log.Fatalw("Failed to persist miner actors", "error", err)
+		return xerrors.Errorf("Failed to persist miner actors: %w", err)
 	}
 
 	if err := p.updateMiners(ctx, minerChanges); err != nil {
-		log.Fatalw("Failed to update miner actors", "error", err)
+		return xerrors.Errorf("Failed to update miner actors: %w", err)
 	}
 	return nil
 }
@@ -178,7 +322,7 @@ func (p *Processor) HandleMinerChanges(ctx context.Context, minerTips ActorTips)
 func (p *Processor) processMiners(ctx context.Context, minerTips map[types.TipSetKey][]actorInfo) ([]minerActorInfo, error) {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Processed Miners", "duration", time.Since(start).String())
+		p.logger().Debugw("Processed Miners", "duration", time.Since(start).String())
 	}()
 
 	var out []minerActorInfo
@@ -210,7 +354,7 @@ func (p *Processor) processMiners(ctx context.Context, minerTips map[types.TipSe
 			// Get the miner state info
 			astb, err := p.node.ChainReadObj(ctx, act.act.Head)
 			if err != nil {
-				log.Warnw("failed to find miner actor state", "address", act.addr, "error", err)
+				p.logger().Warnw("failed to find miner actor state", "address", act.addr, "error", err)
 				continue
 			}
 			if err := mi.state.UnmarshalCBOR(bytes.NewReader(astb)); err != nil {
@@ -225,7 +369,7 @@ func (p *Processor) processMiners(ctx context.Context, minerTips map[types.TipSe
 func (p *Processor) persistMiners(ctx context.Context, miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Miners", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Miners", "duration", time.Since(start).String())
 	}()
 
 	grp, _ := errgroup.WithContext(ctx)
@@ -244,6 +388,27 @@ func (p *Processor) persistMiners(ctx context.Context, miners []minerActorInfo)
 		return nil
 	})
 
+	grp.Go(func() error {
+		if err := p.storeMinersFunds(miners); err != nil {
+			return err
+		}
+		return nil
+	})
+
+	grp.Go(func() error {
+		if err := p.storeMinersState(ctx, miners); err != nil {
+			return err
+		}
+		return nil
+	})
+
+	grp.Go(func() error {
+		if err := p.storeMinersVestingFunds(ctx, miners); err != nil {
+			return err
+		}
+		return nil
+	})
+
 	grp.Go(func() error {
 		if err := p.storeMinersSectorState(ctx, miners); err != nil {
 			return err
@@ -271,7 +436,7 @@ func (p *Processor) persistMiners(ctx context.Context, miners []minerActorInfo)
 func (p *Processor) storeMinersActorState(miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Miners Actor State", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Miners Actor State", "duration", time.Since(start).String())
 	}()
 
 	tx, err := p.db.Begin()
@@ -293,7 +458,7 @@ func (p *Processor) storeMinersActorState(miners []minerActorInfo) error {
 			peerid, err := peer.IDFromBytes(m.state.Info.PeerId)
 			if err != nil {
 				// this should "never happen", but if it does we should still store info about the miner.
-				log.Warnw("failed to decode peerID", "peerID (bytes)", m.state.Info.PeerId, "miner", m.common.addr, "tipset", m.common.tsKey.String())
+				p.logger().Warnw("failed to decode peerID", "peerID (bytes)", m.state.Info.PeerId, "miner", m.common.addr, "tipset", m.common.tsKey.String())
 			} else {
 				pid = peerid.String()
 			}
@@ -308,7 +473,7 @@ func (p *Processor) storeMinersActorState(miners []minerActorInfo) error {
 			m.state.LockedFunds.String(),
 			m.state.NextDeadlineToProcessFaults,
 		); err != nil {
-			log.Errorw("failed to store miner state", "state", m.state, "info", m.state.Info, "error", err)
+			p.logger().Errorw("failed to store miner state", "state", m.state, "info", m.state.Info, "error", err)
 			return xerrors.Errorf("failed to store miner state: %w", err)
 		}
 
@@ -327,7 +492,7 @@ func (p *Processor) storeMinersActorState(miners []minerActorInfo) error {
 func (p *Processor) storeMinersPower(miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Miners Power", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Miners Power", "duration", time.Since(start).String())
 	}()
 
 	tx, err := p.db.Begin()
@@ -351,7 +516,7 @@ func (p *Processor) storeMinersPower(miners []minerActorInfo) error {
 			m.rawPower.String(),
 			m.qalPower.String(),
 		); err != nil {
-			log.Errorw("failed to store miner power", "miner", m.common.addr, "stateroot", m.common.stateroot, "error", err)
+			p.logger().Errorw("failed to store miner power", "miner", m.common.addr, "stateroot", m.common.stateroot, "error", err)
 		}
 	}
 
@@ -371,10 +536,143 @@ func (p *Processor) storeMinersPower(miners []minerActorInfo) error {
 
 }
 
+func (p *Processor) storeMinersFunds(miners []minerActorInfo) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Miners Funds", "duration", time.Since(start).String())
+	}()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin miner_funds tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table mf (like miner_funds excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep miner_funds temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy mf (miner_id, state_root, locked_funds, precommit_deposits) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp miner_funds: %w", err)
+	}
+
+	for _, m := range miners {
+		if _, err := stmt.Exec(
+			m.common.addr.String(),
+			m.common.stateroot.String(),
+			m.state.LockedFunds.String(),
+			m.state.PreCommitDeposits.String(),
+		); err != nil {
+			return xerrors.Errorf("failed to store miner funds: %w", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared miner_funds: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into miner_funds select * from mf on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert miner_funds from tmp: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit miner_funds tx: %w", err)
+	}
+
+	return nil
+}
+
+// storeMinersState writes the typed miner_state columns of each miner. The miner state of this actors version has no
+// fee debt and locks the initial pledge in the locked funds, both are stored as null.
+func (p *Processor) storeMinersState(ctx context.Context, miners []minerActorInfo) error {
+	cols := []string{"miner_id", "state_root", "locked_funds", "precommit_deposits", "fee_debt", "current_deadline", "initial_pledge"}
+	rows := make([][]interface{}, len(miners))
+	for i, m := range miners {
+		rows[i] = []interface{}{
+			m.common.addr.String(),
+			m.common.stateroot.String(),
+			m.state.LockedFunds.String(),
+			m.state.PreCommitDeposits.String(),
+			nil,
+			uint64(miner.ComputeProvingPeriodDeadline(m.state.ProvingPeriodStart, m.common.height).Index),
+			nil,
+		}
+	}
+	return p.storeTypedState(ctx, "miner_state", cols, rows)
+}
+
+// storeMinersVestingFunds writes the vesting schedule of the locked funds of each miner, the amount vesting at each
+// epoch.
+func (p *Processor) storeMinersVestingFunds(ctx context.Context, miners []minerActorInfo) error {
+	cols := []string{"miner_id", "state_root", "epoch", "amount"}
+	var rows [][]interface{}
+	for _, m := range miners {
+		vesting, err := adt.AsArray(cw_util.NewAPIIpldStore(ctx, p.node), m.state.VestingFunds)
+		if err != nil {
+			return xerrors.Errorf("load vesting funds of miner %s: %w", m.common.addr, err)
+		}
+		var amount abi.TokenAmount
+		if err := vesting.ForEach(&amount, func(epoch int64) error {
+			rows = append(rows, []interface{}{m.common.addr.String(), m.common.stateroot.String(), epoch, amount.String()})
+			return nil
+		}); err != nil {
+			return xerrors.Errorf("read vesting funds of miner %s: %w", m.common.addr, err)
+		}
+	}
+	return p.storeTypedState(ctx, "miner_vesting_funds", cols, rows)
+}
+
+// availableBalance is the part of the actor balance a miner could withdraw, as the node's StateMinerAvailableBalance
+// computes it: the balance less the funds set aside, plus the locked funds which have vested. It is clamped to zero when
+// the set aside funds exceed the balance.
+func availableBalance(balance, lockedFunds, precommitDeposits, initialPledge, feeDebt, vested big.Int) big.Int {
+	avail := big.Sub(big.Sub(big.Sub(big.Sub(balance, lockedFunds), precommitDeposits), initialPledge), feeDebt)
+	avail = big.Add(avail, vested)
+	if avail.LessThan(big.Zero()) {
+		return big.Zero()
+	}
+	return avail
+}
+
+// MinerAvailableBalance returns how much the miner could withdraw at epoch, based on the latest recorded miner funds
+// and actor balance at or before epoch and the locked funds vested before epoch. It returns ErrActorNotFound if no funds
+// of the miner are recorded at or before epoch.
+func (p *Processor) MinerAvailableBalance(ctx context.Context, minerID address.Address, epoch abi.ChainEpoch) (big.Int, error) {
+	var balanceText, lockedText, precommitText, pledgeText, feeDebtText, vestedText string
+	if err := p.db.QueryRowContext(ctx, `
+select a.balance, mf.locked_funds, mf.precommit_deposits, coalesce(ms.initial_pledge, 0), coalesce(ms.fee_debt, 0),
+       (select coalesce(sum(v.amount), 0) from miner_vesting_funds v
+            where v.miner_id = mf.miner_id and v.state_root = mf.state_root and v.epoch < $2)
+from miner_funds mf
+    inner join actors a on a.id = mf.miner_id and a.stateroot = mf.state_root
+    inner join state_heights sh on sh.parentstateroot = mf.state_root
+    left join miner_state ms on ms.miner_id = mf.miner_id and ms.state_root = mf.state_root
+where mf.miner_id = $1 and sh.height <= $2
+order by sh.height desc
+limit 1
+`, minerID.String(), epoch).Scan(&balanceText, &lockedText, &precommitText, &pledgeText, &feeDebtText, &vestedText); err != nil {
+		if err == sql.ErrNoRows {
+			return big.Zero(), xerrors.Errorf("funds of miner %s at %d: %w", minerID, epoch, ErrActorNotFound)
+		}
+		return big.Zero(), xerrors.Errorf("query funds of miner %s at %d: %w", minerID, epoch, err)
+	}
+
+	var amounts []big.Int
+	for _, text := range []string{balanceText, lockedText, precommitText, pledgeText, feeDebtText, vestedText} {
+		amount, err := types.BigFromString(text)
+		if err != nil {
+			return big.Zero(), err
+		}
+		amounts = append(amounts, amount)
+	}
+
+	return availableBalance(amounts[0], amounts[1], amounts[2], amounts[3], amounts[4], amounts[5]), nil
+}
+
 func (p *Processor) storeMinersSectorState(ctx context.Context, miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Miners Sector State", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Miners Sector State", "duration", time.Since(start).String())
 	}()
 
 	tx, err := p.db.Begin()
@@ -391,37 +689,42 @@ func (p *Processor) storeMinersSectorState(ctx context.Context, miners []minerAc
 		return err
 	}
 
-	grp, ctx := errgroup.WithContext(ctx)
-	for _, m := range miners {
-		m := m
+	// sectors are loaded concurrently but written from this goroutine only, a COPY statement can't be used from more
+	// than one goroutine at a time.
+	sectors := make([][]*api.ChainSectorInfo, len(miners))
+	grp, gctx := errgroup.WithContext(ctx)
+	for i, m := range miners {
+		i, m := i, m
 		grp.Go(func() error {
-			sectors, err := p.node.StateMinerSectors(ctx, m.common.addr, nil, true, m.common.tsKey)
+			var err error
+			sectors[i], err = p.node.StateMinerSectors(gctx, m.common.addr, nil, true, m.common.tsKey)
 			if err != nil {
-				log.Debugw("Failed to load sectors", "tipset", m.common.tsKey.String(), "miner", m.common.addr.String(), "error", err)
-			}
-
-			for _, sector := range sectors {
-				if _, err := stmt.Exec(
-					m.common.addr.String(),
-					uint64(sector.ID),
-					int64(sector.Info.ActivationEpoch),
-					int64(sector.Info.Info.Expiration),
-					sector.Info.DealWeight.String(),
-					sector.Info.VerifiedDealWeight.String(),
-					sector.Info.Info.SealedCID.String(),
-					int64(sector.Info.Info.SealRandEpoch),
-				); err != nil {
-					return err
-				}
+				p.logger().Debugw("Failed to load sectors", "tipset", m.common.tsKey.String(), "miner", m.common.addr.String(), "error", err)
 			}
 			return nil
 		})
 	}
-
 	if err := grp.Wait(); err != nil {
 		return err
 	}
 
+	for i, m := range miners {
+		for _, sector := range sectors[i] {
+			if _, err := stmt.Exec(
+				m.common.addr.String(),
+				uint64(sector.ID),
+				int64(sector.Info.ActivationEpoch),
+				int64(sector.Info.Info.Expiration),
+				sector.Info.DealWeight.String(),
+				sector.Info.VerifiedDealWeight.String(),
+				sector.Info.Info.SealedCID.String(),
+				int64(sector.Info.Info.SealRandEpoch),
+			); err != nil {
+				return err
+			}
+		}
+	}
+
 	if err := stmt.Close(); err != nil {
 		return err
 	}
@@ -436,7 +739,7 @@ func (p *Processor) storeMinersSectorState(ctx context.Context, miners []minerAc
 func (p *Processor) storeMinersSectorHeads(miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Stored Miners Sector Heads", "duration", time.Since(start).String())
+		p.logger().Debugw("Stored Miners Sector Heads", "duration", time.Since(start).String())
 	}()
 
 	tx, err := p.db.Begin()
@@ -459,7 +762,7 @@ func (p *Processor) storeMinersSectorHeads(miners []minerActorInfo) error {
 			m.state.Sectors.String(),
 			m.common.stateroot.String(),
 		); err != nil {
-			log.Errorw("failed to store miners sectors head", "state", m.state, "info", m.state.Info, "error", err)
+			p.logger().Errorw("failed to store miners sectors head", "state", m.state, "info", m.state.Info, "error", err)
 			return err
 		}
 
@@ -478,7 +781,7 @@ func (p *Processor) storeMinersSectorHeads(miners []minerActorInfo) error {
 func (p *Processor) storeMinersPreCommitState(ctx context.Context, miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Infow("Stored Miners Precommit State", "duration", time.Since(start).String())
+		p.logger().Infow("Stored Miners Precommit State", "duration", time.Since(start).String())
 	}()
 
 	precommitTx, err := p.db.Begin()
@@ -542,7 +845,7 @@ func (p *Processor) updateMiners(ctx context.Context, miners []minerActorInfo) e
 func (p *Processor) updateMinersPrecommits(ctx context.Context, miners []minerActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Infow("Updated Miner Precommits", "duration", time.Since(start).String())
+		p.logger().Infow("Updated Miner Precommits", "duration", time.Since(start).String())
 	}()
 
 	pred := state.NewStatePredicates(p.node)
@@ -556,7 +859,7 @@ func (p *Processor) updateMinersPrecommits(ctx context.Context, miners []minerAc
 		return xerrors.Errorf("prep temp: %w", err)
 	}
 
-	eventStmt, err := eventTx.Prepare(`copy mse (sector_id, event, miner_id, state_root) from STDIN `)
+	eventStmt, err := eventTx.Prepare(`copy mse (sector_id, event, miner_id, state_root, epoch) from STDIN `)
 	if err != nil {
 		return err
 	}
@@ -568,7 +871,7 @@ func (p *Processor) updateMinersPrecommits(ctx context.Context, miners []minerAc
 			if strings.Contains(err.Error(), "address not found") {
 				continue
 			}
-			log.Errorw("error getting miner precommit diff", "miner", m.common.addr, "error", err)
+			p.logger().Errorw("error getting miner precommit diff", "miner", m.common.addr, "error", err)
 			return err
 		}
 		if !changed {
@@ -576,10 +879,10 @@ func (p *Processor) updateMinersPrecommits(ctx context.Context, miners []minerAc
 		}
 		changes, ok := val.(*state.MinerPreCommitChanges)
 		if !ok {
-			log.Fatal("Developer Error")
+			p.logger().Fatal("Developer Error")
 		}
-		for _, added := range changes.Added {
-			if _, err := eventStmt.Exec(added.Info.SectorNumber, "PRECOMMIT", m.common.addr.String(), m.common.stateroot.String()); err != nil {
+		for _, e := range precommitEvents(m.common.addr, changes) {
+			if _, err := eventStmt.Exec(e.sectorID, e.event, e.minerID.String(), m.common.stateroot.String(), e.epoch); err != nil {
 				return err
 			}
 		}
@@ -597,135 +900,103 @@ func (p *Processor) updateMinersPrecommits(ctx context.Context, miners []minerAc
 }
 
 func (p *Processor) updateMinersSectors(ctx context.Context, miners []minerActorInfo) error {
-	log.Debugw("Updating Miners Sectors", "#miners", len(miners))
+	p.logger().Debugw("Updating Miners Sectors", "#miners", len(miners))
 	start := time.Now()
 	defer func() {
-		log.Debugw("Updated Miners Sectors", "duration", time.Since(start).String())
+		p.logger().Debugw("Updated Miners Sectors", "duration", time.Since(start).String())
 	}()
 
 	pred := state.NewStatePredicates(p.node)
 
-	eventTx, err := p.db.Begin()
-	if err != nil {
-		return err
-	}
-
-	if _, err := eventTx.Exec(`create temp table mse (like miner_sector_events excluding constraints) on commit drop;`); err != nil {
-		return xerrors.Errorf("prep temp: %w", err)
-	}
-
-	eventStmt, err := eventTx.Prepare(`copy mse (sector_id, event, miner_id, state_root) from STDIN `)
-	if err != nil {
-		return err
+	// the events are collected by the miners' goroutines and written once all of them are done.
+	type minerEvent struct {
+		sectorEvent
+		stateroot string
 	}
-
-	var updateWg sync.WaitGroup
-	updateWg.Add(1)
-	sectorUpdatesCh := make(chan sectorUpdate)
+	var lk sync.Mutex
+	var events []minerEvent
 	var sectorUpdates []sectorUpdate
-	go func() {
-		for u := range sectorUpdatesCh {
-			sectorUpdates = append(sectorUpdates, u)
+	var committedDeals []sectorDeal
+	addEvents := func(m minerActorInfo, es []sectorEvent) {
+		for _, e := range es {
+			events = append(events, minerEvent{sectorEvent: e, stateroot: m.common.stateroot.String()})
 		}
-		updateWg.Done()
-	}()
+	}
 
-	minerGrp, ctx := errgroup.WithContext(ctx)
-	complete := 0
+	minerGrp, gctx := errgroup.WithContext(ctx)
 	for _, m := range miners {
 		m := m
+		// special case genesis miners
 		if m.common.tsKey == p.genesisTs.Key() {
 			genSectors, err := p.node.StateMinerSectors(ctx, m.common.addr, nil, true, p.genesisTs.Key())
 			if err != nil {
 				return err
 			}
 			for _, sector := range genSectors {
-				if _, err := eventStmt.Exec(sector.ID, "COMMIT", m.common.addr.String(), m.common.stateroot.String()); err != nil {
-					return err
-				}
+				addEvents(m, []sectorEvent{{minerID: m.common.addr, sectorID: sector.ID, event: sectorCommit, epoch: p.genesisTs.Height()}})
+				committedDeals = append(committedDeals, sectorDeals(m.common.addr, sector.Info)...)
 			}
-			complete++
 			continue
 		}
 		minerGrp.Go(func() error {
-			// special case genesis miners
+			// the sectors are only diffed when the predicate finds the miner's sectors changed.
 			sectorDiffFn := pred.OnMinerActorChange(m.common.addr, pred.OnMinerSectorChange())
-			changed, val, err := sectorDiffFn(ctx, m.common.parentTsKey, m.common.tsKey)
+			changed, val, err := sectorDiffFn(gctx, m.common.parentTsKey, m.common.tsKey)
 			if err != nil {
 				if strings.Contains(err.Error(), "address not found") {
 					return nil
 				}
-				log.Errorw("error getting miner sector diff", "miner", m.common.addr, "error", err)
+				p.logger().Errorw("error getting miner sector diff", "miner", m.common.addr, "error", err)
 				return err
 			}
 			if !changed {
-				complete++
 				return nil
 			}
 			changes, ok := val.(*state.MinerSectorChanges)
 			if !ok {
-				log.Fatalw("Developer Error")
+				p.logger().Fatalw("Developer Error")
 			}
-			log.Debugw("sector changes for miner", "miner", m.common.addr.String(), "Added", len(changes.Added), "Extended", len(changes.Extended), "Removed", len(changes.Removed), "oldState", m.common.parentTsKey, "newState", m.common.tsKey)
-
-			for _, extended := range changes.Extended {
-				if _, err := eventStmt.Exec(extended.To.Info.SectorNumber, "EXTENDED", m.common.addr.String(), m.common.stateroot.String()); err != nil {
-					return err
-				}
-				sectorUpdatesCh <- sectorUpdate{
-					terminationEpoch: 0,
-					terminated:       false,
-					expirationEpoch:  extended.To.Info.Expiration,
-					sectorID:         extended.From.Info.SectorNumber,
-					minerID:          m.common.addr,
-				}
+			p.logger().Debugw("sector changes for miner", "miner", m.common.addr.String(), "Added", len(changes.Added), "Extended", len(changes.Extended), "Removed", len(changes.Removed), "oldState", m.common.parentTsKey, "newState", m.common.tsKey)
 
-				log.Debugw("sector extended", "miner", m.common.addr.String(), "sector", extended.To.Info.SectorNumber, "old", extended.To.Info.Expiration, "new", extended.From.Info.Expiration)
-			}
-			curTs, err := p.node.ChainGetTipSet(ctx, m.common.tsKey)
+			curTs, err := p.node.ChainGetTipSet(gctx, m.common.tsKey)
 			if err != nil {
 				return err
 			}
+			es, updates := sectorChangeEvents(m.common.addr, curTs.Height(), changes)
 
-			for _, removed := range changes.Removed {
-				log.Debugw("removed", "miner", m.common.addr)
-				// decide if they were terminated or extended
-				if removed.Info.Expiration > curTs.Height() {
-					if _, err := eventStmt.Exec(removed.Info.SectorNumber, "TERMINATED", m.common.addr.String(), m.common.stateroot.String()); err != nil {
-						return err
-					}
-					log.Debugw("sector terminated", "miner", m.common.addr.String(), "sector", removed.Info.SectorNumber, "old", "sectorExpiration", removed.Info.Expiration, "terminationEpoch", curTs.Height())
-					sectorUpdatesCh <- sectorUpdate{
-						terminationEpoch: curTs.Height(),
-						terminated:       true,
-						expirationEpoch:  removed.Info.Expiration,
-						sectorID:         removed.Info.SectorNumber,
-						minerID:          m.common.addr,
-					}
-
-				}
-				if _, err := eventStmt.Exec(removed.Info.SectorNumber, "EXPIRED", m.common.addr.String(), m.common.stateroot.String()); err != nil {
-					return err
-				}
-				log.Debugw("sector removed", "miner", m.common.addr.String(), "sector", removed.Info.SectorNumber, "old", "sectorExpiration", removed.Info.Expiration, "currEpoch", curTs.Height())
-			}
-
+			lk.Lock()
+			defer lk.Unlock()
+			addEvents(m, es)
+			sectorUpdates = append(sectorUpdates, updates...)
 			for _, added := range changes.Added {
-				if _, err := eventStmt.Exec(added.Info.SectorNumber, "COMMIT", m.common.addr.String(), m.common.stateroot.String()); err != nil {
-					return err
-				}
+				committedDeals = append(committedDeals, sectorDeals(m.common.addr, added)...)
 			}
-			complete++
-			log.Debugw("Update Done", "complete", complete, "added", len(changes.Added), "removed", len(changes.Removed), "modified", len(changes.Extended))
 			return nil
 		})
 	}
 	if err := minerGrp.Wait(); err != nil {
 		return err
 	}
-	close(sectorUpdatesCh)
-	// wait for the update channel to be drained
-	updateWg.Wait()
+
+	eventTx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := eventTx.Exec(`create temp table mse (like miner_sector_events excluding constraints) on commit drop;`); err != nil {
+		return xerrors.Errorf("prep temp: %w", err)
+	}
+
+	eventStmt, err := eventTx.Prepare(`copy mse (sector_id, event, miner_id, state_root, epoch) from STDIN `)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		if _, err := eventStmt.Exec(e.sectorID, e.event, e.minerID.String(), e.stateroot, e.epoch); err != nil {
+			return err
+		}
+	}
 
 	if err := eventStmt.Close(); err != nil {
 		return err
@@ -739,6 +1010,10 @@ func (p *Processor) updateMinersSectors(ctx context.Context, miners []minerActor
 		return err
 	}
 
+	if err := p.storeSectorDeals(committedDeals); err != nil {
+		return err
+	}
+
 	updateTx, err := p.db.Begin()
 	if err != nil {
 		return err
@@ -768,8 +1043,54 @@ func (p *Processor) updateMinersSectors(ctx context.Context, miners []minerActor
 	return updateTx.Commit()
 }
 
+func (p *Processor) storeSectorDeals(deals []sectorDeal) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Sector Deals", "duration", time.Since(start).String())
+	}()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin sector_deals tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table sd (like sector_deals excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep sector_deals temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy sd (miner_id, sector_id, deal_id, commit_epoch) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp sector_deals: %w", err)
+	}
+
+	for _, d := range deals {
+		if _, err := stmt.Exec(
+			d.minerID.String(),
+			uint64(d.sectorID),
+			uint64(d.dealID),
+			int64(d.commitEpoch),
+		); err != nil {
+			return xerrors.Errorf("failed to store sector deal: %w", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared sector_deals: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into sector_deals select * from sd on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert sector_deals from tmp: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit sector_deals tx: %w", err)
+	}
+
+	return nil
+}
+
 // load the power actor state clam as an adt.Map at the tipset `ts`.
-func getPowerActorClaimsMap(ctx context.Context, api api.FullNode, ts types.TipSetKey) (*adt.Map, error) {
+func getPowerActorClaimsMap(ctx context.Context, api Node, ts types.TipSetKey) (*adt.Map, error) {
 	powerActor, err := api.StateGetActor(ctx, builtin.StoragePowerActorAddr, ts)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,272 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/miner"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestAvailableBalance(t *testing.T) {
+	zero := big.Zero()
+	require.Equal(t, big.NewInt(60), availableBalance(big.NewInt(100), big.NewInt(30), big.NewInt(10), zero, zero, zero))
+	require.Equal(t, big.NewInt(0), availableBalance(big.NewInt(100), big.NewInt(90), big.NewInt(10), zero, zero, zero))
+	require.Equal(t, big.Zero(), availableBalance(big.NewInt(100), big.NewInt(90), big.NewInt(20), zero, zero, zero))
+	require.Equal(t, big.NewInt(45), availableBalance(big.NewInt(100), big.NewInt(30), big.NewInt(10), big.NewInt(20), big.NewInt(5), big.NewInt(10)))
+	require.Equal(t, big.Zero(), availableBalance(big.NewInt(100), big.NewInt(30), big.NewInt(10), zero, big.NewInt(100), big.NewInt(10)))
+}
+
+func TestMinerAvailableBalance(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMiners())
+	_, err := db.Exec(`truncate miner_funds, miner_state, miner_vesting_funds`)
+	require.NoError(t, err)
+
+	minerID, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	seedAddresses(t, db, []address.Address{minerID})
+
+	// the miner holds 100 with 30 locked and 5 deposited at each state, the state at height 10 vests 10 of the locked
+	// funds at 15 and 10 at 20, the one at 30 holds 20 of initial pledge and the one at 40 owes 100 of fee debt.
+	for i, funds := range []struct {
+		height                         int64
+		initialPledge, feeDebt, vested string
+	}{
+		{height: 10, initialPledge: "0", feeDebt: "0", vested: "(15, 10), (20, 10)"},
+		{height: 30, initialPledge: "20", feeDebt: "0"},
+		{height: 40, initialPledge: "0", feeDebt: "100"},
+	} {
+		stateroot := testCid(t, fmt.Sprintf("stateroot-%d", i)).String()
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`, testCid(t, fmt.Sprintf("block-%d", i)).String(), stateroot, funds.height)
+		require.NoError(t, err)
+		_, err = db.Exec(`insert into actors (id, code, head, nonce, balance, stateroot) values ($1, $2, $3, 0, 100, $4)`,
+			minerID.String(), builtin.StorageMinerActorCodeID.String(), testCid(t, fmt.Sprintf("head-%d", i)).String(), stateroot)
+		require.NoError(t, err)
+		_, err = db.Exec(`insert into miner_funds (miner_id, state_root, locked_funds, precommit_deposits) values ($1, $2, '30', '5')`, minerID.String(), stateroot)
+		require.NoError(t, err)
+		_, err = db.Exec(`insert into miner_state (miner_id, state_root, locked_funds, precommit_deposits, fee_debt, current_deadline, initial_pledge) values ($1, $2, 30, 5, $3, 0, $4)`,
+			minerID.String(), stateroot, funds.feeDebt, funds.initialPledge)
+		require.NoError(t, err)
+		if funds.vested != "" {
+			_, err = db.Exec(`insert into miner_vesting_funds (miner_id, state_root, epoch, amount) select $1, $2, v.epoch, v.amount from (values `+funds.vested+`) v (epoch, amount)`,
+				minerID.String(), stateroot)
+			require.NoError(t, err)
+		}
+	}
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	for epoch, expected := range map[abi.ChainEpoch]int64{
+		10: 65,
+		15: 65,
+		16: 75,
+		21: 85,
+		30: 45,
+		40: 0,
+	} {
+		avail, err := p.MinerAvailableBalance(ctx, minerID, epoch)
+		require.NoError(t, err, "%d", epoch)
+		require.Equal(t, big.NewInt(expected), avail, "%d", epoch)
+	}
+
+	_, err = p.MinerAvailableBalance(ctx, minerID, 9)
+	require.True(t, xerrors.Is(err, ErrActorNotFound), "%v", err)
+}
+
+func TestSectorDeals(t *testing.T) {
+	minerID, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	sector := miner.SectorOnChainInfo{
+		Info: miner.SectorPreCommitInfo{
+			SectorNumber: 7,
+			DealIDs:      []abi.DealID{11, 12},
+		},
+		ActivationEpoch: 100,
+	}
+
+	deals := sectorDeals(minerID, sector)
+	require.Equal(t, []sectorDeal{
+		{minerID: minerID, sectorID: 7, dealID: 11, commitEpoch: 100},
+		{minerID: minerID, sectorID: 7, dealID: 12, commitEpoch: 100},
+	}, deals)
+
+	// committed capacity sector
+	sector.Info.DealIDs = nil
+	require.Empty(t, sectorDeals(minerID, sector))
+}
+
+// sectorsNode serves the sectors of each miner.
+type sectorsNode struct {
+	api.FullNode
+
+	sectors map[address.Address][]*api.ChainSectorInfo
+}
+
+func (n *sectorsNode) StateMinerSectors(ctx context.Context, addr address.Address, _ *abi.BitField, _ bool, _ types.TipSetKey) ([]*api.ChainSectorInfo, error) {
+	return n.sectors[addr], nil
+}
+
+func TestStoreMinersSectorState(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMiners())
+	_, err := db.Exec(`truncate miner_sectors`)
+	require.NoError(t, err)
+
+	node := &sectorsNode{sectors: map[address.Address][]*api.ChainSectorInfo{}}
+	var miners []minerActorInfo
+	for i := uint64(0); i < 3; i++ {
+		addr, err := address.NewIDAddress(1000 + i)
+		require.NoError(t, err)
+		miners = append(miners, minerActorInfo{common: actorInfo{addr: addr, tsKey: types.NewTipSetKey(testCid(t, "block"))}})
+
+		for n := abi.SectorNumber(0); n < 2; n++ {
+			node.sectors[addr] = append(node.sectors[addr], &api.ChainSectorInfo{
+				ID: n,
+				Info: miner.SectorOnChainInfo{
+					Info: miner.SectorPreCommitInfo{
+						SectorNumber:  n,
+						SealedCID:     testCid(t, fmt.Sprintf("sealed-%s-%d", addr, n)),
+						SealRandEpoch: 10,
+						Expiration:    1000,
+					},
+					ActivationEpoch:    100,
+					DealWeight:         big.Zero(),
+					VerifiedDealWeight: big.Zero(),
+				},
+			})
+		}
+	}
+	p.node = node
+
+	require.NoError(t, p.storeMinersSectorState(ctx, miners))
+
+	for addr, sectors := range node.sectors {
+		for _, sector := range sectors {
+			var sealed string
+			var activation, expiration int64
+			require.NoError(t, db.QueryRow(`select seal_cid, activation_epoch, expiration_epoch from miner_sectors where miner_id = $1 and sector_id = $2`,
+				addr.String(), uint64(sector.ID)).Scan(&sealed, &activation, &expiration))
+			require.Equal(t, sector.Info.Info.SealedCID.String(), sealed)
+			require.Equal(t, int64(100), activation)
+			require.Equal(t, int64(1000), expiration)
+		}
+	}
+}
+
+func TestStoreMinersState(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMiners())
+	_, err := db.Exec(`truncate miner_state`)
+	require.NoError(t, err)
+
+	// as text 10 sorts before 9.
+	var miners []minerActorInfo
+	for i, funds := range [][2]int64{{9, 10}, {10, 9}} {
+		addr, err := address.NewIDAddress(1000 + uint64(i))
+		require.NoError(t, err)
+		miners = append(miners, minerActorInfo{
+			common: actorInfo{
+				addr:      addr,
+				stateroot: testCid(t, "stateroot"),
+				height:    3*miner.WPoStChallengeWindow + 1,
+			},
+			state: miner.State{
+				LockedFunds:       big.NewInt(funds[0]),
+				PreCommitDeposits: big.NewInt(funds[1]),
+			},
+		})
+	}
+
+	require.NoError(t, p.storeMinersState(ctx, miners))
+
+	rows, err := db.Query(`select miner_id, current_deadline, fee_debt is null from miner_state order by locked_funds`)
+	require.NoError(t, err)
+	defer rows.Close() //nolint:errcheck
+	var ids []string
+	for rows.Next() {
+		var id string
+		var deadline int64
+		var noFeeDebt bool
+		require.NoError(t, rows.Scan(&id, &deadline, &noFeeDebt))
+		require.EqualValues(t, 3, deadline)
+		require.True(t, noFeeDebt)
+		ids = append(ids, id)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []string{miners[0].common.addr.String(), miners[1].common.addr.String()}, ids)
+
+	var id string
+	require.NoError(t, db.QueryRow(`select miner_id from miner_state where locked_funds > precommit_deposits`).Scan(&id))
+	require.Equal(t, miners[1].common.addr.String(), id)
+	require.Equal(t, 2, countRows(t, db, `select count(*) from miner_state where locked_funds + precommit_deposits = 19`))
+}
+
+func TestSectorChangeEvents(t *testing.T) {
+	minerID, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	sector := func(n abi.SectorNumber, expiration abi.ChainEpoch) miner.SectorOnChainInfo {
+		return miner.SectorOnChainInfo{Info: miner.SectorPreCommitInfo{SectorNumber: n, Expiration: expiration}, ActivationEpoch: 100}
+	}
+
+	// a batch commits two sectors, another is extended and two are removed at epoch 100.
+	events, updates := sectorChangeEvents(minerID, 100, &state.MinerSectorChanges{
+		Added:    []miner.SectorOnChainInfo{sector(1, 1000), sector(2, 1000)},
+		Extended: []state.SectorExtensions{{From: sector(3, 500), To: sector(3, 800)}},
+		Removed:  []miner.SectorOnChainInfo{sector(4, 100), sector(5, 300)},
+	})
+	require.ElementsMatch(t, []sectorEvent{
+		{minerID: minerID, sectorID: 1, event: sectorCommit, epoch: 100},
+		{minerID: minerID, sectorID: 2, event: sectorCommit, epoch: 100},
+		{minerID: minerID, sectorID: 3, event: sectorExtended, epoch: 100},
+		{minerID: minerID, sectorID: 4, event: sectorExpired, epoch: 100},
+		{minerID: minerID, sectorID: 5, event: sectorTerminated, epoch: 100},
+	}, events)
+	require.ElementsMatch(t, []sectorUpdate{
+		{expirationEpoch: 800, sectorID: 3, minerID: minerID},
+		{terminationEpoch: 100, terminated: true, expirationEpoch: 300, sectorID: 5, minerID: minerID},
+	}, updates)
+
+	events, updates = sectorChangeEvents(minerID, 100, &state.MinerSectorChanges{})
+	require.Empty(t, events)
+	require.Empty(t, updates)
+}
+
+func TestPrecommitEvents(t *testing.T) {
+	minerID, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+
+	events := precommitEvents(minerID, &state.MinerPreCommitChanges{
+		Added: []miner.SectorPreCommitOnChainInfo{
+			{Info: miner.SectorPreCommitInfo{SectorNumber: 1}, PreCommitEpoch: 90},
+			{Info: miner.SectorPreCommitInfo{SectorNumber: 2}, PreCommitEpoch: 90},
+		},
+	})
+	require.Equal(t, []sectorEvent{
+		{minerID: minerID, sectorID: 1, event: sectorPreCommit, epoch: 90},
+		{minerID: minerID, sectorID: 2, event: sectorPreCommit, epoch: 90},
+	}, events)
+}
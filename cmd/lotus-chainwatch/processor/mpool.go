@@ -48,15 +48,15 @@ func (p *Processor) subMpool(ctx context.Context) {
 			msgs[v.Message.Message.Cid()] = &v.Message.Message
 		}
 
-		log.Debugf("Processing %d mpool updates", len(msgs))
+		p.logger().Debugf("Processing %d mpool updates", len(msgs))
 
 		err := p.storeMessages(msgs)
 		if err != nil {
-			log.Error(err)
+			p.logger().Error(err)
 		}
 
 		if err := p.storeMpoolInclusions(updates); err != nil {
-			log.Error(err)
+			p.logger().Error(err)
 		}
 	}
 }
@@ -0,0 +1,504 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/lib/pq"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// multisigInfo is the state of a multisig at a state root, with the transactions pending in it.
+type multisigInfo struct {
+	common  actorInfo
+	state   multisig.State
+	pending []pendingTxn
+}
+
+type pendingTxn struct {
+	id  int64
+	txn multisig.Transaction
+}
+
+// vestingSchedule is the linear vesting of a multisig's initial balance, fixed when the multisig is constructed.
+type vestingSchedule struct {
+	multisig       address.Address
+	initialBalance big.Int
+	startEpoch     abi.ChainEpoch
+	unlockDuration abi.ChainEpoch
+}
+
+// epochSpan is the range of epochs (parent, height] covered by a tipset, it spans more than one epoch after null rounds.
+type epochSpan struct {
+	parent abi.ChainEpoch
+	height abi.ChainEpoch
+}
+
+// multisigUnlock is the amount of a multisig's balance that vested during an epoch span. These unlocks happen without
+// any message so they never show up as an actor change.
+type multisigUnlock struct {
+	multisig address.Address
+	height   abi.ChainEpoch
+	locked   big.Int
+	unlocked big.Int
+}
+
+func (p *Processor) setupMultisig() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/* the vesting schedule of every multisig with locked funds */
+create table if not exists multisig_vesting
+(
+	multisig_id text not null
+		constraint multisig_vesting_pk
+			primary key,
+	initial_balance text not null,
+	start_epoch bigint not null,
+	unlock_duration bigint not null
+);
+
+/* the signers and vesting parameters of every multisig at each state root it changed in */
+create table if not exists multisig_info
+(
+	multisig_id text not null,
+	state_root text not null,
+	signers text[] not null,
+	threshold bigint not null,
+	unlock_duration bigint not null,
+	start_epoch bigint not null,
+	initial_balance text not null,
+	constraint multisig_info_pk
+		primary key (multisig_id, state_root)
+);
+
+/* the transactions pending in every multisig at each state root it changed in, the proposer is the first approver */
+create table if not exists multisig_transactions
+(
+	multisig_id text not null,
+	state_root text not null,
+	txn_id bigint not null,
+	proposer text not null,
+	to_addr text not null,
+	value text not null,
+	method bigint not null,
+	params bytea,
+	approved text[] not null,
+	constraint multisig_transactions_pk
+		primary key (multisig_id, state_root, txn_id)
+);
+
+/* balance unlocked by vesting in the epochs up to and including height, explicit withdrawals are not included */
+create table if not exists multisig_unlock
+(
+	multisig_id text not null,
+	height bigint not null,
+	locked text not null,
+	unlocked text not null,
+	constraint multisig_unlock_pk
+		primary key (multisig_id, height)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandleMultisigChanges(ctx context.Context, msigTips ActorTips, toProcess map[cid.Cid]*types.BlockHeader) error {
+	if err := p.storeMultisigVesting(ctx, msigTips); err != nil {
+		return err
+	}
+
+	msigs, err := p.processMultisigs(ctx, msigTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process multisigs: %w", err)
+	}
+	if err := p.storeMultisigs(ctx, msigs); err != nil {
+		return err
+	}
+
+	spans, err := p.epochSpans(ctx, toProcess)
+	if err != nil {
+		return xerrors.Errorf("Failed to get epoch spans: %w", err)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	schedules, err := p.vestingSchedules(ctx, spans[0].parent, spans[len(spans)-1].height)
+	if err != nil {
+		return err
+	}
+
+	return p.storeMultisigUnlocks(vestingUnlocks(schedules, spans))
+}
+
+func (p *Processor) processMultisigs(ctx context.Context, msigTips ActorTips) ([]multisigInfo, error) {
+	var out []multisigInfo
+	for _, actors := range msigTips {
+		for _, act := range actors {
+			msigStateRaw, err := p.node.ChainReadObj(ctx, act.act.Head)
+			if err != nil {
+				return nil, xerrors.Errorf("read state obj (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			var msigState multisig.State
+			if err := msigState.UnmarshalCBOR(bytes.NewReader(msigStateRaw)); err != nil {
+				return nil, xerrors.Errorf("unmarshal state (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			pending, err := p.pendingTxns(ctx, msigState.PendingTxns)
+			if err != nil {
+				return nil, xerrors.Errorf("pending transactions of %s (@ %s): %w", act.addr, act.stateroot.String(), err)
+			}
+
+			out = append(out, multisigInfo{common: act, state: msigState, pending: pending})
+		}
+	}
+	return out, nil
+}
+
+// pendingTxns reads the pending transactions HAMT of a multisig, keyed by transaction ID.
+func (p *Processor) pendingTxns(ctx context.Context, root cid.Cid) ([]pendingTxn, error) {
+	txns, err := adt.AsMap(cw_util.NewAPIIpldStore(ctx, p.node), root)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []pendingTxn
+	var txn multisig.Transaction
+	if err := txns.ForEach(&txn, func(key string) error {
+		id, err := adt.ParseIntKey(key)
+		if err != nil {
+			return err
+		}
+		out = append(out, pendingTxn{id: id, txn: txn})
+		// decoding leaves the fields of an empty encoding untouched, don't let the next transaction inherit these.
+		txn = multisig.Transaction{}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *Processor) storeMultisigs(ctx context.Context, msigs []multisigInfo) error {
+	if len(msigs) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Multisigs", "duration", time.Since(start).String())
+	}()
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin multisig tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if _, err := tx.ExecContext(ctx, `
+create temp table mi (like multisig_info excluding constraints) on commit drop;
+create temp table mt (like multisig_transactions excluding constraints) on commit drop;
+`); err != nil {
+			return xerrors.Errorf("prep multisig temp: %w", err)
+		}
+
+		infoStmt, err := tx.Prepare(`copy mi (multisig_id, state_root, signers, threshold, unlock_duration, start_epoch, initial_balance) from STDIN`)
+		if err != nil {
+			return xerrors.Errorf("prepare tmp multisig_info: %w", err)
+		}
+
+		for _, m := range msigs {
+			threshold, err := dbNonce(m.state.NumApprovalsThreshold)
+			if err != nil {
+				return xerrors.Errorf("threshold of %s: %w", m.common.addr, err)
+			}
+			if _, err := infoStmt.ExecContext(ctx,
+				m.common.addr.String(),
+				m.common.stateroot.String(),
+				pq.Array(addressStrings(m.state.Signers)),
+				threshold,
+				m.state.UnlockDuration,
+				m.state.StartEpoch,
+				m.state.InitialBalance.String(),
+			); err != nil {
+				return xerrors.Errorf("store multisig info of %s: %w", m.common.addr, err)
+			}
+		}
+
+		if err := infoStmt.Close(); err != nil {
+			return xerrors.Errorf("close prepared multisig_info: %w", err)
+		}
+
+		txnStmt, err := tx.Prepare(`copy mt (multisig_id, state_root, txn_id, proposer, to_addr, value, method, params, approved) from STDIN`)
+		if err != nil {
+			return xerrors.Errorf("prepare tmp multisig_transactions: %w", err)
+		}
+
+		for _, m := range msigs {
+			for _, pt := range m.pending {
+				// proposing a transaction approves it, so the proposer is always the first approver.
+				var proposer string
+				if len(pt.txn.Approved) > 0 {
+					proposer = pt.txn.Approved[0].String()
+				}
+				if _, err := txnStmt.ExecContext(ctx,
+					m.common.addr.String(),
+					m.common.stateroot.String(),
+					pt.id,
+					proposer,
+					pt.txn.To.String(),
+					pt.txn.Value.String(),
+					int64(pt.txn.Method),
+					pt.txn.Params,
+					pq.Array(addressStrings(pt.txn.Approved)),
+				); err != nil {
+					return xerrors.Errorf("store transaction %d of %s: %w", pt.id, m.common.addr, err)
+				}
+			}
+		}
+
+		if err := txnStmt.Close(); err != nil {
+			return xerrors.Errorf("close prepared multisig_transactions: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `
+insert into multisig_info select * from mi on conflict do nothing;
+insert into multisig_transactions select * from mt on conflict do nothing;
+`); err != nil {
+			return xerrors.Errorf("insert multisig from tmp: %w", err)
+		}
+
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+func addressStrings(addrs []address.Address) []string {
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = a.String()
+	}
+	return out
+}
+
+// epochSpans returns the span of epochs covered by each distinct height in toProcess, in height order.
+func (p *Processor) epochSpans(ctx context.Context, toProcess map[cid.Cid]*types.BlockHeader) ([]epochSpan, error) {
+	byHeight := map[abi.ChainEpoch]*types.BlockHeader{}
+	for _, bh := range toProcess {
+		byHeight[bh.Height] = bh
+	}
+
+	out := make([]epochSpan, 0, len(byHeight))
+	for h, bh := range byHeight {
+		pts, err := p.Source.TipSet(ctx, types.NewTipSetKey(bh.Parents...))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, epochSpan{parent: pts.Height(), height: h})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].height < out[j].height
+	})
+	return out, nil
+}
+
+// storeMultisigVesting records the vesting schedule of the multisigs in msigTips that have one.
+func (p *Processor) storeMultisigVesting(ctx context.Context, msigTips ActorTips) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Multisig Vesting", "duration", time.Since(start).String())
+	}()
+
+	var schedules []vestingSchedule
+	for _, actors := range msigTips {
+		for _, act := range actors {
+			msigStateRaw, err := p.node.ChainReadObj(ctx, act.act.Head)
+			if err != nil {
+				return xerrors.Errorf("read state obj (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			var msigState multisig.State
+			if err := msigState.UnmarshalCBOR(bytes.NewReader(msigStateRaw)); err != nil {
+				return xerrors.Errorf("unmarshal state (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			if msigState.UnlockDuration == 0 {
+				continue
+			}
+			schedules = append(schedules, vestingSchedule{
+				multisig:       act.addr,
+				initialBalance: msigState.InitialBalance,
+				startEpoch:     msigState.StartEpoch,
+				unlockDuration: msigState.UnlockDuration,
+			})
+		}
+	}
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin multisig_vesting tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table mv (like multisig_vesting excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep multisig_vesting temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy mv (multisig_id, initial_balance, start_epoch, unlock_duration) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp multisig_vesting: %w", err)
+	}
+
+	for _, s := range schedules {
+		if _, err := stmt.Exec(s.multisig.String(), s.initialBalance.String(), s.startEpoch, s.unlockDuration); err != nil {
+			p.logger().Errorw("failed to store multisig vesting", "multisig", s.multisig, "error", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared multisig_vesting: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into multisig_vesting select * from mv on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert multisig_vesting from tmp: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// vestingSchedules returns the schedules still unlocking somewhere in the epochs (from, to].
+func (p *Processor) vestingSchedules(ctx context.Context, from, to abi.ChainEpoch) ([]vestingSchedule, error) {
+	rows, err := p.db.QueryContext(ctx, `
+select multisig_id, initial_balance, start_epoch, unlock_duration
+from multisig_vesting
+where start_epoch < $2 and start_epoch + unlock_duration > $1
+`, from, to)
+	if err != nil {
+		return nil, xerrors.Errorf("query multisig vesting: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []vestingSchedule
+	for rows.Next() {
+		var (
+			id, initial     string
+			start, duration int64
+		)
+		if err := rows.Scan(&id, &initial, &start, &duration); err != nil {
+			return nil, xerrors.Errorf("scan multisig vesting: %w", err)
+		}
+
+		s := vestingSchedule{
+			startEpoch:     abi.ChainEpoch(start),
+			unlockDuration: abi.ChainEpoch(duration),
+		}
+		if s.multisig, err = address.NewFromString(id); err != nil {
+			return nil, err
+		}
+		if s.initialBalance, err = types.BigFromString(initial); err != nil {
+			return nil, xerrors.Errorf("parse initial balance of %s: %w", id, err)
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// amountLocked returns the part of the initial balance still locked at height. The balance unlocks in equal parts each
+// epoch after the start epoch, the same way the multisig actor computes it.
+func amountLocked(s vestingSchedule, height abi.ChainEpoch) big.Int {
+	elapsed := height - s.startEpoch
+	if elapsed <= 0 {
+		return s.initialBalance
+	}
+	if elapsed >= s.unlockDuration {
+		return big.Zero()
+	}
+
+	unitLocked := big.Div(s.initialBalance, big.NewInt(int64(s.unlockDuration)))
+	return big.Mul(unitLocked, big.NewInt(int64(s.unlockDuration-elapsed)))
+}
+
+// vestingUnlocks returns an unlock for every schedule whose locked amount decreased over a span.
+func vestingUnlocks(schedules []vestingSchedule, spans []epochSpan) []multisigUnlock {
+	var out []multisigUnlock
+	for _, span := range spans {
+		for _, s := range schedules {
+			before := amountLocked(s, span.parent)
+			after := amountLocked(s, span.height)
+			unlocked := big.Sub(before, after)
+			if unlocked.Sign() <= 0 {
+				continue
+			}
+			out = append(out, multisigUnlock{
+				multisig: s.multisig,
+				height:   span.height,
+				locked:   after,
+				unlocked: unlocked,
+			})
+		}
+	}
+	return out
+}
+
+func (p *Processor) storeMultisigUnlocks(unlocks []multisigUnlock) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Multisig Unlocks", "duration", time.Since(start).String())
+	}()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin multisig_unlock tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table mu (like multisig_unlock excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep multisig_unlock temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy mu (multisig_id, height, locked, unlocked) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp multisig_unlock: %w", err)
+	}
+
+	for _, u := range unlocks {
+		if _, err := stmt.Exec(u.multisig.String(), u.height, u.locked.String(), u.unlocked.String()); err != nil {
+			p.logger().Errorw("failed to store multisig unlock", "multisig", u.multisig, "height", u.height, "error", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared multisig_unlock: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into multisig_unlock select * from mu on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert multisig_unlock from tmp: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,156 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/multisig"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// multisigFixture returns a node holding the state of a 2 of 3 multisig with one transaction pending, proposed by the
+// first signer and approved by no one else, and the actor tips changing it.
+func multisigFixture(t *testing.T) (*testNode, ActorTips, []address.Address) {
+	node := newTestNode()
+
+	signers := []address.Address{mock.Address(100), mock.Address(101), mock.Address(102)}
+	pending := adt.MakeEmptyMap(node.store)
+	require.NoError(t, pending.Put(adt.IntKey(0), &multisig.Transaction{
+		To:       mock.Address(200),
+		Value:    big.NewInt(42),
+		Method:   builtin.MethodSend,
+		Approved: signers[:1],
+	}))
+	pendingRoot, err := pending.Root()
+	require.NoError(t, err)
+
+	tsk := types.NewTipSetKey(testCid(t, "block"))
+	act := node.putActor(t, tsk, mock.Address(1000), builtin.MultisigActorCodeID, &multisig.State{
+		Signers:               signers,
+		NumApprovalsThreshold: 2,
+		NextTxnID:             1,
+		InitialBalance:        big.NewInt(1000),
+		StartEpoch:            10,
+		UnlockDuration:        100,
+		PendingTxns:           pendingRoot,
+	})
+	return node, actorChange(t, mock.Address(1000), act, 0, tsk, types.EmptyTSK), signers
+}
+
+func TestProcessMultisigs(t *testing.T) {
+	node, tips, signers := multisigFixture(t)
+	p := &Processor{node: node}
+
+	msigs, err := p.processMultisigs(context.Background(), tips)
+	require.NoError(t, err)
+	require.Len(t, msigs, 1)
+
+	m := msigs[0]
+	require.Equal(t, signers, m.state.Signers)
+	require.Equal(t, uint64(2), m.state.NumApprovalsThreshold)
+	require.Len(t, m.pending, 1)
+	require.Equal(t, int64(0), m.pending[0].id)
+	require.Equal(t, mock.Address(200), m.pending[0].txn.To)
+	require.Equal(t, big.NewInt(42), m.pending[0].txn.Value)
+	require.Equal(t, signers[:1], m.pending[0].txn.Approved)
+}
+
+func TestStoreMultisigs(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMultisig())
+	_, err := db.Exec(`truncate multisig_info, multisig_transactions`)
+	require.NoError(t, err)
+
+	node, tips, signers := multisigFixture(t)
+	p.node = node
+	msigs, err := p.processMultisigs(ctx, tips)
+	require.NoError(t, err)
+	require.NoError(t, p.storeMultisigs(ctx, msigs))
+	// storing the same state again is a no-op.
+	require.NoError(t, p.storeMultisigs(ctx, msigs))
+
+	var storedSigners []string
+	var threshold, unlockDuration, startEpoch int64
+	var initialBalance string
+	require.NoError(t, db.QueryRow(`select signers, threshold, unlock_duration, start_epoch, initial_balance from multisig_info where multisig_id = $1`,
+		mock.Address(1000).String()).Scan(pq.Array(&storedSigners), &threshold, &unlockDuration, &startEpoch, &initialBalance))
+	require.Equal(t, addressStrings(signers), storedSigners)
+	require.Equal(t, int64(2), threshold)
+	require.Equal(t, int64(100), unlockDuration)
+	require.Equal(t, int64(10), startEpoch)
+	require.Equal(t, "1000", initialBalance)
+
+	var txns int
+	require.NoError(t, db.QueryRow(`select count(*) from multisig_transactions`).Scan(&txns))
+	require.Equal(t, 1, txns)
+
+	var proposer, to, value string
+	var method int64
+	var approved []string
+	require.NoError(t, db.QueryRow(`select proposer, to_addr, value, method, approved from multisig_transactions where multisig_id = $1 and txn_id = 0`,
+		mock.Address(1000).String()).Scan(&proposer, &to, &value, &method, pq.Array(&approved)))
+	require.Equal(t, signers[0].String(), proposer)
+	require.Equal(t, mock.Address(200).String(), to)
+	require.Equal(t, "42", value)
+	require.Equal(t, int64(builtin.MethodSend), method)
+	require.Equal(t, []string{signers[0].String()}, approved)
+}
+
+func TestAmountLocked(t *testing.T) {
+	s := vestingSchedule{
+		multisig:       mock.Address(1000),
+		initialBalance: big.NewInt(100),
+		startEpoch:     10,
+		unlockDuration: 4,
+	}
+
+	for h, locked := range map[abi.ChainEpoch]int64{
+		5:  100,
+		10: 100,
+		11: 75,
+		13: 25,
+		14: 0,
+		20: 0,
+	} {
+		require.Equal(t, big.NewInt(locked), amountLocked(s, h), "height %d", h)
+	}
+}
+
+func TestVestingUnlocksCrossingBoundary(t *testing.T) {
+	s := vestingSchedule{
+		multisig:       mock.Address(1000),
+		initialBalance: big.NewInt(100),
+		startEpoch:     10,
+		unlockDuration: 4,
+	}
+
+	unlocks := vestingUnlocks([]vestingSchedule{s}, []epochSpan{
+		{parent: 8, height: 9},   // before the start, nothing vests
+		{parent: 9, height: 10},  // the start epoch itself, still fully locked
+		{parent: 10, height: 11}, // first unlock
+		{parent: 11, height: 14}, // null rounds, everything else vests in one span
+		{parent: 14, height: 15}, // fully vested
+	})
+
+	require.Len(t, unlocks, 2)
+
+	require.Equal(t, abi.ChainEpoch(11), unlocks[0].height)
+	require.Equal(t, big.NewInt(75), unlocks[0].locked)
+	require.Equal(t, big.NewInt(25), unlocks[0].unlocked)
+
+	require.Equal(t, abi.ChainEpoch(14), unlocks[1].height)
+	require.Equal(t, big.NewInt(0), unlocks[1].locked)
+	require.Equal(t, big.NewInt(75), unlocks[1].unlocked)
+}
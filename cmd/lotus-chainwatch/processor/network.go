@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	_init "github.com/filecoin-project/specs-actors/actors/builtin/init"
+)
+
+const metaNetworkName = "network_name"
+
+// networkNameAt is the network name carried by the init actor state at a given height.
+type networkNameAt struct {
+	height abi.ChainEpoch
+	name   string
+}
+
+// networkNameChange records a height at which the init actor reported a network name different from the one before it.
+type networkNameChange struct {
+	height abi.ChainEpoch
+	from   string
+	to     string
+}
+
+// checkNetworkIdentity guards against writing data for more than one network into the same database. The network name
+// the node is synced to is recorded on first start and must match on every start after that.
+func (p *Processor) checkNetworkIdentity(ctx context.Context) error {
+	nodeName, err := p.node.StateNetworkName(ctx)
+	if err != nil {
+		return xerrors.Errorf("get network name from node: %w", err)
+	}
+
+	stored, ok, err := p.metaValue(metaNetworkName)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		p.networkName = string(nodeName)
+		if p.DryRun {
+			return nil
+		}
+		return p.setMeta(metaNetworkName, string(nodeName))
+	}
+
+	if stored != string(nodeName) {
+		return xerrors.Errorf("database holds data for network %q but the node is synced to %q", stored, nodeName)
+	}
+
+	p.networkName = stored
+	return nil
+}
+
+// HandleInitChanges validates that the network name carried by the init actor is stable. A change means the node is
+// misconfigured or following a different chain than the one in the database, the change is logged but not stored.
+func (p *Processor) HandleInitChanges(ctx context.Context, initTips ActorTips) error {
+	names, err := p.processInitActors(ctx, initTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process init actors: %w", err)
+	}
+
+	for _, c := range networkNameChanges(p.networkName, names) {
+		p.logger().Warnw("init actor network name changed, the node may be misconfigured",
+			"height", c.height, "from", c.from, "to", c.to)
+	}
+
+	return nil
+}
+
+func (p *Processor) processInitActors(ctx context.Context, initTips ActorTips) ([]networkNameAt, error) {
+	var out []networkNameAt
+	for _, actors := range initTips {
+		for _, act := range actors {
+			initStateRaw, err := p.node.ChainReadObj(ctx, act.act.Head)
+			if err != nil {
+				return nil, xerrors.Errorf("read state obj (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			var initActorState _init.State
+			if err := initActorState.UnmarshalCBOR(bytes.NewReader(initStateRaw)); err != nil {
+				return nil, xerrors.Errorf("unmarshal state (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			out = append(out, networkNameAt{height: act.height, name: initActorState.NetworkName})
+		}
+	}
+	return out, nil
+}
+
+// networkNameChanges walks names in height order and returns every point the name differs from the name before it,
+// starting from known. An empty known name is taken from the first state seen.
+func networkNameChanges(known string, names []networkNameAt) []networkNameChange {
+	sorted := make([]networkNameAt, len(names))
+	copy(sorted, names)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].height < sorted[j].height
+	})
+
+	var out []networkNameChange
+	prev := known
+	for _, n := range sorted {
+		if prev != "" && n.name != prev {
+			out = append(out, networkNameChange{height: n.height, from: prev, to: n.name})
+		}
+		prev = n.name
+	}
+	return out
+}
@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkNameChangesStable(t *testing.T) {
+	names := []networkNameAt{
+		{height: 3, name: "testnet"},
+		{height: 1, name: "testnet"},
+		{height: 2, name: "testnet"},
+	}
+
+	require.Empty(t, networkNameChanges("testnet", names))
+	require.Empty(t, networkNameChanges("", names))
+}
+
+func TestNetworkNameChangesDetectsChange(t *testing.T) {
+	names := []networkNameAt{
+		{height: 2, name: "othernet"},
+		{height: 1, name: "testnet"},
+		{height: 3, name: "othernet"},
+	}
+
+	changes := networkNameChanges("testnet", names)
+	require.Equal(t, []networkNameChange{
+		{height: 2, from: "testnet", to: "othernet"},
+	}, changes)
+
+	// a mismatch with the recorded name is reported even if the batch itself is consistent.
+	changes = networkNameChanges("testnet", names[:1])
+	require.Equal(t, []networkNameChange{
+		{height: 2, from: "testnet", to: "othernet"},
+	}, changes)
+}
@@ -0,0 +1,215 @@
+package processor
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/time/rate"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/node/modules/dtypes"
+)
+
+// Node is the part of the lotus full node API the processor reads the chain from, an api.FullNode is one. The methods
+// are the ones of api.FullNode, NewCARNode implements them over an exported chain instead of a live node.
+type Node interface {
+	ChainHead(context.Context) (*types.TipSet, error)
+	ChainGetGenesis(context.Context) (*types.TipSet, error)
+	ChainGetBlock(context.Context, cid.Cid) (*types.BlockHeader, error)
+	ChainGetTipSet(context.Context, types.TipSetKey) (*types.TipSet, error)
+	ChainGetTipSetByHeight(context.Context, abi.ChainEpoch, types.TipSetKey) (*types.TipSet, error)
+	ChainGetBlockMessages(ctx context.Context, blockCid cid.Cid) (*api.BlockMessages, error)
+	ChainGetParentReceipts(ctx context.Context, blockCid cid.Cid) ([]*types.MessageReceipt, error)
+	ChainGetParentMessages(ctx context.Context, blockCid cid.Cid) ([]api.Message, error)
+	// ChainReadObj and ChainHasObj back the ipld stores the actor states are read through.
+	ChainReadObj(context.Context, cid.Cid) ([]byte, error)
+	ChainHasObj(context.Context, cid.Cid) (bool, error)
+
+	// the state methods taking a tipset read the state after executing it.
+	StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error)
+	StateReadState(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*api.ActorState, error)
+	StateLookupID(context.Context, address.Address, types.TipSetKey) (address.Address, error)
+	StateListActors(context.Context, types.TipSetKey) ([]address.Address, error)
+	StateChangedActors(context.Context, cid.Cid, cid.Cid) (map[string]types.Actor, error)
+	StateMarketDeals(context.Context, types.TipSetKey) (map[string]api.MarketDeal, error)
+	StateMinerSectors(context.Context, address.Address, *abi.BitField, bool, types.TipSetKey) ([]*api.ChainSectorInfo, error)
+	StateNetworkName(context.Context) (dtypes.NetworkName, error)
+
+	MpoolSub(context.Context) (<-chan api.MpoolUpdate, error)
+}
+
+var _ Node = api.FullNode(nil)
+
+// DefaultNodeQPS is the default number of calls per second the processor makes to the node.
+const DefaultNodeQPS = 1000
+
+// DefaultNodeBurst is the default number of calls made to the node at once before NodeQPS applies.
+const DefaultNodeBurst = 100
+
+// nodeLimiter returns the limiter every call to the node waits on, made from NodeQPS and NodeBurst the first time a
+// call is made so they can be set after NewProcessor.
+func (p *Processor) nodeLimiter() *rate.Limiter {
+	p.nodeLimitOnce.Do(func() {
+		limit := rate.Inf
+		if p.NodeQPS > 0 {
+			limit = rate.Limit(p.NodeQPS)
+		}
+		burst := p.NodeBurst
+		if burst < 1 {
+			burst = 1
+		}
+		p.nodeLimit = rate.NewLimiter(limit, burst)
+	})
+	return p.nodeLimit
+}
+
+// rateLimitedNode is a Node whose every call first waits on limiter, so a backfill resolving many addresses and
+// states at once does not make the node fall behind the chain or drop its connections.
+type rateLimitedNode struct {
+	node    Node
+	limiter func() *rate.Limiter
+}
+
+var _ Node = (*rateLimitedNode)(nil)
+
+func (n *rateLimitedNode) wait(ctx context.Context) error {
+	return n.limiter().Wait(ctx)
+}
+
+func (n *rateLimitedNode) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainHead(ctx)
+}
+
+func (n *rateLimitedNode) ChainGetGenesis(ctx context.Context) (*types.TipSet, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetGenesis(ctx)
+}
+
+func (n *rateLimitedNode) ChainGetBlock(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetBlock(ctx, c)
+}
+
+func (n *rateLimitedNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetTipSet(ctx, tsk)
+}
+
+func (n *rateLimitedNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetTipSetByHeight(ctx, h, tsk)
+}
+
+func (n *rateLimitedNode) ChainGetBlockMessages(ctx context.Context, blockCid cid.Cid) (*api.BlockMessages, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetBlockMessages(ctx, blockCid)
+}
+
+func (n *rateLimitedNode) ChainGetParentReceipts(ctx context.Context, blockCid cid.Cid) ([]*types.MessageReceipt, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetParentReceipts(ctx, blockCid)
+}
+
+func (n *rateLimitedNode) ChainGetParentMessages(ctx context.Context, blockCid cid.Cid) ([]api.Message, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainGetParentMessages(ctx, blockCid)
+}
+
+func (n *rateLimitedNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.ChainReadObj(ctx, c)
+}
+
+func (n *rateLimitedNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	if err := n.wait(ctx); err != nil {
+		return false, err
+	}
+	return n.node.ChainHasObj(ctx, c)
+}
+
+func (n *rateLimitedNode) StateGetActor(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateGetActor(ctx, actor, tsk)
+}
+
+func (n *rateLimitedNode) StateReadState(ctx context.Context, actor address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateReadState(ctx, actor, tsk)
+}
+
+func (n *rateLimitedNode) StateLookupID(ctx context.Context, addr address.Address, tsk types.TipSetKey) (address.Address, error) {
+	if err := n.wait(ctx); err != nil {
+		return address.Undef, err
+	}
+	return n.node.StateLookupID(ctx, addr, tsk)
+}
+
+func (n *rateLimitedNode) StateListActors(ctx context.Context, tsk types.TipSetKey) ([]address.Address, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateListActors(ctx, tsk)
+}
+
+func (n *rateLimitedNode) StateChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateChangedActors(ctx, old, new)
+}
+
+func (n *rateLimitedNode) StateMarketDeals(ctx context.Context, tsk types.TipSetKey) (map[string]api.MarketDeal, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateMarketDeals(ctx, tsk)
+}
+
+func (n *rateLimitedNode) StateMinerSectors(ctx context.Context, addr address.Address, filter *abi.BitField, filterOut bool, tsk types.TipSetKey) ([]*api.ChainSectorInfo, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.StateMinerSectors(ctx, addr, filter, filterOut, tsk)
+}
+
+func (n *rateLimitedNode) StateNetworkName(ctx context.Context) (dtypes.NetworkName, error) {
+	if err := n.wait(ctx); err != nil {
+		return "", err
+	}
+	return n.node.StateNetworkName(ctx)
+}
+
+// MpoolSub waits once, for the subscription, the updates it delivers are not limited.
+func (n *rateLimitedNode) MpoolSub(ctx context.Context) (<-chan api.MpoolUpdate, error) {
+	if err := n.wait(ctx); err != nil {
+		return nil, err
+	}
+	return n.node.MpoolSub(ctx)
+}
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// countingNode counts the calls made to it, the methods it does not override are not called by the tests.
+type countingNode struct {
+	Node
+	calls int64
+}
+
+func (n *countingNode) ChainHead(context.Context) (*types.TipSet, error) {
+	atomic.AddInt64(&n.calls, 1)
+	return nil, nil
+}
+
+func (n *countingNode) ChainGetTipSet(context.Context, types.TipSetKey) (*types.TipSet, error) {
+	atomic.AddInt64(&n.calls, 1)
+	return nil, nil
+}
+
+func TestNodeRateLimit(t *testing.T) {
+	ctx := context.Background()
+	node := &countingNode{}
+	p := NewProcessorFromDB(nil, node, 0)
+	p.NodeQPS = 50
+	p.NodeBurst = 1
+
+	// past the burst every call waits 1/50s, the calls through the source included.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, err := p.node.ChainHead(ctx)
+		require.NoError(t, err)
+		_, err = p.Source.TipSet(ctx, types.EmptyTSK)
+		require.NoError(t, err)
+	}
+	elapsed := time.Since(start)
+	require.Equal(t, int64(12), atomic.LoadInt64(&node.calls))
+	require.GreaterOrEqual(t, int64(elapsed), int64(200*time.Millisecond), "%s", elapsed)
+	require.Less(t, int64(elapsed), int64(2*time.Second), "%s", elapsed)
+
+	// a call cancelled while waiting does not reach the node.
+	cctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+	defer cancel()
+	_, err := p.node.ChainHead(cctx)
+	require.Error(t, err)
+	require.Equal(t, int64(12), atomic.LoadInt64(&node.calls))
+}
+
+func TestNodeRateLimitDisabled(t *testing.T) {
+	ctx := context.Background()
+	node := &countingNode{}
+	p := NewProcessorFromDB(nil, node, 0)
+	p.NodeQPS = 0
+
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		_, err := p.node.ChainHead(ctx)
+		require.NoError(t, err)
+	}
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, int64(1000), atomic.LoadInt64(&node.calls))
+}
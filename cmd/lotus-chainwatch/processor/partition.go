@@ -0,0 +1,289 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+// actorsPartitionEpochs is the range of epochs a partition of actors holds when PartitionActors is set. It can't
+// change once actors is partitioned, the partitions already created would overlap the ones of another range.
+const actorsPartitionEpochs = 7 * builtin.EpochsInDay
+
+// actorsPartitionLock is the advisory lock the partitions of actors are created under, so processors sharing the
+// database do not race to create the same one.
+const actorsPartitionLock = 0x61637473 // "acts"
+
+// actorsEpochSchema adds the epoch of the state root of a row to actors, the height of the blocks whose parent state
+// root it is, so rows are selected by epoch without joining state_heights and actors can be partitioned by it. Rows
+// written before are given the height of their state root in the syncer's blocks where it is known, the others are
+// left null. SQLite deployments run no syncer in the database, their rows are all left null.
+func (p *Processor) actorsEpochSchema(tx *sql.Tx) error {
+	if p.Backend == BackendSQLite {
+		_, err := tx.Exec(`alter table actors add column epoch bigint`)
+		return err
+	}
+
+	_, err := tx.Exec(`
+alter table actors add column if not exists epoch bigint;
+
+do $$
+begin
+	if to_regclass('blocks') is not null then
+		update actors a set epoch = b.height
+			from (select parentstateroot, min(height) as height from blocks group by parentstateroot) b
+			where b.parentstateroot = a.stateroot and a.epoch is null;
+	end if;
+end
+$$;
+`)
+	return err
+}
+
+// actorPartitions are the partitions of actors known to exist, by the first epoch of their range.
+type actorPartitions struct {
+	// enabled is set when actors is partitioned, the stores then create the partitions they write to.
+	enabled bool
+
+	lk      sync.Mutex
+	created map[int64]struct{}
+}
+
+func (a *actorPartitions) missing(starts []int64) []int64 {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	var out []int64
+	for _, s := range starts {
+		if _, ok := a.created[s]; !ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (a *actorPartitions) add(starts []int64) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.created == nil {
+		a.created = map[int64]struct{}{}
+	}
+	for _, s := range starts {
+		a.created[s] = struct{}{}
+	}
+}
+
+// actorsPartitionStart returns the first epoch of the range of the partition of actors holding epoch.
+func actorsPartitionStart(epoch int64) int64 {
+	return epoch - epoch%actorsPartitionEpochs
+}
+
+// actorsPartitionName returns the name of the partition of actors whose range starts at start.
+func actorsPartitionName(start int64) string {
+	return fmt.Sprintf("actors_p%d", start)
+}
+
+// partitionStarts returns the first epochs of the ranges of the partitions of actors epochs are in, in order.
+func partitionStarts(epochs []int64) []int64 {
+	seen := map[int64]struct{}{}
+	var out []int64
+	for _, e := range epochs {
+		s := actorsPartitionStart(e)
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i] < out[j]
+	})
+	return out
+}
+
+// createActorPartitions creates the partitions of actors starting at starts which do not exist yet.
+func createActorPartitions(tx *sql.Tx, starts []int64) error {
+	if _, err := tx.Exec(`select pg_advisory_xact_lock($1)`, actorsPartitionLock); err != nil {
+		return xerrors.Errorf("lock actors partitions: %w", err)
+	}
+	for _, s := range starts {
+		if _, err := tx.Exec(fmt.Sprintf(`create table if not exists %s partition of actors for values from (%d) to (%d)`,
+			actorsPartitionName(s), s, s+actorsPartitionEpochs)); err != nil {
+			return xerrors.Errorf("create actors partition from %d: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// partitionActors turns actors into a table partitioned by range of epoch, with a partition for every range of
+// actorsPartitionEpochs epochs holding a row. The rows of an unknown epoch are kept in actors_default, the stores
+// create the partition of any other epoch before writing to it. Pruning an old range is then dropping or detaching
+// its partition, and a query bounded by epoch only scans the partitions of its bounds. It is a no-op on a table which
+// is partitioned already.
+//
+// The rows are copied into the partitioned table in a single transaction, which holds actors locked for as long as it
+// takes. Latest mode is not supported: its unique index on id can't be on a table partitioned by another column.
+func (p *Processor) partitionActors() error {
+	if p.Backend == BackendSQLite {
+		return xerrors.Errorf("actors can only be partitioned in Postgres")
+	}
+	if p.Mode == ModeLatest {
+		return xerrors.Errorf("actors can't be partitioned in latest mode")
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(`lock table actors in access exclusive mode`); err != nil {
+		return xerrors.Errorf("lock actors: %w", err)
+	}
+	var kind string
+	if err := tx.QueryRow(`select relkind from pg_class where oid = to_regclass('actors')`).Scan(&kind); err != nil {
+		return xerrors.Errorf("query actors kind: %w", err)
+	}
+	if kind == "p" {
+		return nil
+	}
+
+	if _, err := tx.Exec(`
+/* the names of the indexes are taken again by the ones of the partitioned table */
+drop index if exists actors_id_index;
+drop index if exists actors_id_head_stateroot_uindex;
+drop index if exists actors_id_stateroot_index;
+
+alter table actors rename to actors_unpartitioned;
+
+create table actors
+(
+	id text not null
+		constraint id_address_map_actors_id_fk
+			references id_address_map (id),
+	code text not null,
+	head text not null,
+	nonce numeric(20, 0) not null,
+	balance numeric not null,
+	stateroot text,
+	tipset_key text,
+	epoch bigint
+) partition by range (epoch);
+
+/* the rows whose epoch is not known, written before it was recorded */
+create table actors_default partition of actors default;
+`); err != nil {
+		return xerrors.Errorf("create partitioned actors: %w", err)
+	}
+
+	epochs, err := unpartitionedEpochs(tx)
+	if err != nil {
+		return err
+	}
+	starts := partitionStarts(epochs)
+	if err := createActorPartitions(tx, starts); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+insert into actors (id, code, head, nonce, balance, stateroot, tipset_key, epoch)
+	select id, code, head, nonce, balance, stateroot, tipset_key, epoch from actors_unpartitioned;
+
+drop table actors_unpartitioned;
+
+create index actors_id_index
+	on actors (id);
+
+/* a unique index of a partitioned table includes the partition key, the epoch follows from the state root */
+create unique index actors_id_head_stateroot_uindex
+	on actors (id, head, stateroot, epoch);
+
+create index actors_id_stateroot_index
+	on actors (id, stateroot);
+`); err != nil {
+		return xerrors.Errorf("copy actors into partitions: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	p.partitions.add(starts)
+	p.logger().Infow("Partitioned actors by epoch", "partitions", len(starts), "epochs", actorsPartitionEpochs)
+	return nil
+}
+
+// unpartitionedEpochs returns the epochs of the rows of actors_unpartitioned.
+func unpartitionedEpochs(tx *sql.Tx) ([]int64, error) {
+	rows, err := tx.Query(`select distinct epoch from actors_unpartitioned where epoch is not null`)
+	if err != nil {
+		return nil, xerrors.Errorf("query actors epochs: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []int64
+	for rows.Next() {
+		var epoch int64
+		if err := rows.Scan(&epoch); err != nil {
+			return nil, xerrors.Errorf("scan actors epoch: %w", err)
+		}
+		out = append(out, epoch)
+	}
+	return out, rows.Err()
+}
+
+// actorsPartitioned reports whether actors is a partitioned table.
+func (p *Processor) actorsPartitioned() (bool, error) {
+	if p.Backend == BackendSQLite {
+		return false, nil
+	}
+	var kind string
+	if err := p.db.QueryRow(`select relkind from pg_class where oid = to_regclass('actors')`).Scan(&kind); err != nil {
+		return false, xerrors.Errorf("query actors kind: %w", err)
+	}
+	return kind == "p", nil
+}
+
+// ensureActorPartitions creates the partitions of actors the epochs of heads are in, when actors is partitioned.
+func (p *Processor) ensureActorPartitions(ctx context.Context, heads []actorHeadRow) error {
+	if !p.partitions.enabled {
+		return nil
+	}
+
+	epochs := make([]int64, len(heads))
+	for i, h := range heads {
+		epochs[i] = int64(h.info.height)
+	}
+	starts := p.partitions.missing(partitionStarts(epochs))
+	if len(starts) == 0 {
+		return nil
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return err
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if err := createActorPartitions(tx, starts); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := p.commitStoreTx(ctx, tx); err != nil {
+			return err
+		}
+		// a dry run creates none of them.
+		if !p.DryRun {
+			afterCommit(ctx, func() {
+				p.partitions.add(starts)
+			})
+		}
+		return nil
+	})
+}
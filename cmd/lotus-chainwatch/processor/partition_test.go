@@ -0,0 +1,82 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestActorsPartitionStart(t *testing.T) {
+	require.Equal(t, int64(0), actorsPartitionStart(0))
+	require.Equal(t, int64(0), actorsPartitionStart(actorsPartitionEpochs-1))
+	require.Equal(t, int64(actorsPartitionEpochs), actorsPartitionStart(actorsPartitionEpochs))
+	require.Equal(t, []int64{0, 2 * actorsPartitionEpochs}, partitionStarts([]int64{2*actorsPartitionEpochs + 1, 3, 0}))
+}
+
+func TestPartitionActors(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	// the tables are partitioned in a schema of their own, the other tests share the unpartitioned ones.
+	_, err := db.Exec(`drop schema if exists chainwatch_partitions cascade; create schema chainwatch_partitions; set search_path = chainwatch_partitions`)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.Exec(`set search_path to default; drop schema if exists chainwatch_partitions cascade`)
+	})
+
+	p := &Processor{db: db}
+	require.NoError(t, p.setupCommonActors())
+
+	// a row stored before partitioning with its epoch, and one written without.
+	actors, addrs := syntheticActorTips(t, 1, 2)
+	heightsFromNonces(actors)
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	_, err = db.Exec(`insert into actors (id, code, head, nonce, balance, stateroot) values ($1, $2, $3, 0, 0, $4)`,
+		addrs[0].String(), builtin.AccountActorCodeID.String(), testCid(t, "unknown-head").String(), testCid(t, "unknown-stateroot").String())
+	require.NoError(t, err)
+
+	p = &Processor{db: db, PartitionActors: true}
+	require.NoError(t, p.setupCommonActors())
+	// partitioning again is a no-op.
+	require.NoError(t, p.setupCommonActors())
+
+	// the rows of a later range are written to a partition created for it.
+	later, _ := syntheticActorTips(t, 1, 2)
+	for _, tips := range later {
+		for _, infos := range tips {
+			for i := range infos {
+				infos[i].height = abi.ChainEpoch(actorsPartitionEpochs + 5)
+				infos[i].stateroot = testCid(t, "later-stateroot")
+			}
+		}
+	}
+	require.NoError(t, p.storeActorHeads(ctx, later))
+	require.NoError(t, p.storeActorHeads(ctx, later))
+
+	partitions := map[string]int{}
+	rows, err := db.Query(`select tableoid::regclass::text, count(*) from actors group by 1`)
+	require.NoError(t, err)
+	for rows.Next() {
+		var name string
+		var n int
+		require.NoError(t, rows.Scan(&name, &n))
+		partitions[name] = n
+	}
+	require.NoError(t, rows.Err())
+	require.NoError(t, rows.Close())
+	require.Equal(t, map[string]int{
+		"actors_p0": 2,
+		fmt.Sprintf("actors_p%d", actorsPartitionEpochs): 2,
+		"actors_default": 1,
+	}, partitions)
+
+	// latest mode needs the unpartitioned table.
+	p = &Processor{db: db, Mode: ModeLatest}
+	require.Error(t, p.setupCommonActors())
+}
@@ -0,0 +1,172 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
+)
+
+// paychInfo is the state of a payment channel at a state root.
+type paychInfo struct {
+	common actorInfo
+	state  paych.State
+}
+
+func (p *Processor) setupPaymentChannels() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/* the state of every payment channel at each state root it changed in */
+create table if not exists paych_info
+(
+	paych_id text not null,
+	state_root text not null,
+	from_id text not null,
+	to_id text not null,
+	to_send text not null,
+	settling_at bigint not null,
+	min_settle_height bigint not null,
+	constraint paych_info_pk
+		primary key (paych_id, state_root)
+);
+
+/* the lanes of a payment channel at each state root it changed in */
+create table if not exists paych_lanes
+(
+	paych_id text not null,
+	state_root text not null,
+	lane bigint not null,
+	nonce bigint not null,
+	redeemed text not null,
+	constraint paych_lanes_pk
+		primary key (paych_id, state_root, lane)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandlePaymentChannelChanges(ctx context.Context, paychTips ActorTips) error {
+	channels, err := p.processPaymentChannels(ctx, paychTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process payment channels: %w", err)
+	}
+
+	return p.storePaymentChannels(channels)
+}
+
+func (p *Processor) processPaymentChannels(ctx context.Context, paychTips ActorTips) ([]paychInfo, error) {
+	var out []paychInfo
+	for _, actors := range paychTips {
+		for _, act := range actors {
+			paychStateRaw, err := p.node.ChainReadObj(ctx, act.act.Head)
+			if err != nil {
+				return nil, xerrors.Errorf("read state obj (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			var paychState paych.State
+			if err := paychState.UnmarshalCBOR(bytes.NewReader(paychStateRaw)); err != nil {
+				return nil, xerrors.Errorf("unmarshal state (@ %s): %w", act.stateroot.String(), err)
+			}
+
+			out = append(out, paychInfo{common: act, state: paychState})
+		}
+	}
+	return out, nil
+}
+
+func (p *Processor) storePaymentChannels(channels []paychInfo) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Payment Channels", "duration", time.Since(start).String())
+	}()
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin paych tx: %w", err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(`
+create temp table pi (like paych_info excluding constraints) on commit drop;
+create temp table pl (like paych_lanes excluding constraints) on commit drop;
+`); err != nil {
+		return xerrors.Errorf("prep paych temp: %w", err)
+	}
+
+	infoStmt, err := tx.Prepare(`copy pi (paych_id, state_root, from_id, to_id, to_send, settling_at, min_settle_height) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp paych_info: %w", err)
+	}
+
+	for _, c := range channels {
+		if _, err := infoStmt.Exec(
+			c.common.addr.String(),
+			c.common.stateroot.String(),
+			c.state.From.String(),
+			c.state.To.String(),
+			c.state.ToSend.String(),
+			c.state.SettlingAt,
+			c.state.MinSettleHeight,
+		); err != nil {
+			return xerrors.Errorf("store paych info of %s: %w", c.common.addr, err)
+		}
+	}
+
+	if err := infoStmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared paych_info: %w", err)
+	}
+
+	laneStmt, err := tx.Prepare(`copy pl (paych_id, state_root, lane, nonce, redeemed) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp paych_lanes: %w", err)
+	}
+
+	for _, c := range channels {
+		for _, ls := range c.state.LaneStates {
+			lane, err := dbNonce(ls.ID)
+			if err != nil {
+				return xerrors.Errorf("lane of %s: %w", c.common.addr, err)
+			}
+			nonce, err := dbNonce(ls.Nonce)
+			if err != nil {
+				return xerrors.Errorf("lane %d of %s: %w", ls.ID, c.common.addr, err)
+			}
+			if _, err := laneStmt.Exec(
+				c.common.addr.String(),
+				c.common.stateroot.String(),
+				lane,
+				nonce,
+				ls.Redeemed.String(),
+			); err != nil {
+				return xerrors.Errorf("store lane %d of %s: %w", ls.ID, c.common.addr, err)
+			}
+		}
+	}
+
+	if err := laneStmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared paych_lanes: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+insert into paych_info select * from pi on conflict do nothing;
+insert into paych_lanes select * from pl on conflict do nothing;
+`); err != nil {
+		return xerrors.Errorf("insert paych from tmp: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,89 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/paych"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// paychFixture returns a node holding the state of one payment channel with two lanes, and the actor tips changing it.
+func paychFixture(t *testing.T) (*testNode, ActorTips) {
+	node := newTestNode()
+	tsk := types.NewTipSetKey(testCid(t, "block"))
+	act := node.putActor(t, tsk, mock.Address(1000), builtin.PaymentChannelActorCodeID, &paych.State{
+		From:            mock.Address(100),
+		To:              mock.Address(101),
+		ToSend:          big.NewInt(10),
+		SettlingAt:      0,
+		MinSettleHeight: 50,
+		LaneStates: []*paych.LaneState{
+			{ID: 0, Redeemed: big.NewInt(3), Nonce: 1},
+			{ID: 1, Redeemed: big.NewInt(7), Nonce: 4},
+		},
+	})
+	return node, actorChange(t, mock.Address(1000), act, 0, tsk, types.EmptyTSK)
+}
+
+func TestProcessPaymentChannels(t *testing.T) {
+	node, tips := paychFixture(t)
+	p := &Processor{node: node}
+
+	channels, err := p.processPaymentChannels(context.Background(), tips)
+	require.NoError(t, err)
+	require.Len(t, channels, 1)
+
+	c := channels[0]
+	require.Equal(t, mock.Address(1000), c.common.addr)
+	require.Equal(t, mock.Address(100), c.state.From)
+	require.Equal(t, mock.Address(101), c.state.To)
+	require.Len(t, c.state.LaneStates, 2)
+	require.Equal(t, big.NewInt(7), c.state.LaneStates[1].Redeemed)
+	require.Equal(t, uint64(4), c.state.LaneStates[1].Nonce)
+}
+
+func TestStorePaymentChannels(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupPaymentChannels())
+	_, err := db.Exec(`truncate paych_info, paych_lanes`)
+	require.NoError(t, err)
+
+	node, tips := paychFixture(t)
+	p.node = node
+	require.NoError(t, p.HandlePaymentChannelChanges(ctx, tips))
+	// storing the same state again is a no-op.
+	require.NoError(t, p.HandlePaymentChannelChanges(ctx, tips))
+
+	var from, to string
+	var minSettle int64
+	require.NoError(t, db.QueryRow(`select from_id, to_id, min_settle_height from paych_info where paych_id = $1`, mock.Address(1000).String()).Scan(&from, &to, &minSettle))
+	require.Equal(t, mock.Address(100).String(), from)
+	require.Equal(t, mock.Address(101).String(), to)
+	require.Equal(t, int64(50), minSettle)
+
+	rows, err := db.Query(`select lane, nonce, redeemed from paych_lanes where paych_id = $1 order by lane`, mock.Address(1000).String())
+	require.NoError(t, err)
+	defer rows.Close() //nolint:errcheck
+
+	type lane struct {
+		lane, nonce int64
+		redeemed    string
+	}
+	var lanes []lane
+	for rows.Next() {
+		var l lane
+		require.NoError(t, rows.Scan(&l.lane, &l.nonce, &l.redeemed))
+		lanes = append(lanes, l)
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, []lane{{0, 1, "3"}, {1, 4, "7"}}, lanes)
+}
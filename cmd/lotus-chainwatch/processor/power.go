@@ -0,0 +1,283 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/power"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+type powerActorInfo struct {
+	common actorInfo
+
+	totalRawBytes         big.Int
+	totalQualityAdjBytes  big.Int
+	totalPledgeCollateral big.Int
+	minerCount            int64
+
+	// the cron event queue in this state and in the state before the power actor changed.
+	cronQueue     cid.Cid
+	prevCronQueue cid.Cid
+}
+
+func (p *Processor) setupPower() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/* captures the network wide power totals of the power actor for any given stateroot */
+create table if not exists network_power
+(
+	state_root text not null
+		constraint network_power_pk
+			primary key,
+	total_raw_bytes_power text not null,
+	total_qa_bytes_power text not null,
+	total_pledge_collateral text not null,
+	miner_count bigint not null
+);
+
+/* cron callbacks scheduled by miners with the power actor, dequeued_at is set once the event leaves the queue */
+create table if not exists power_cron_queue
+(
+	miner_id text not null,
+	epoch bigint not null,
+	enqueued_at bigint not null,
+	dequeued_at bigint,
+	constraint power_cron_queue_pk
+		primary key (miner_id, epoch)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandlePowerChanges(ctx context.Context, powerTips ActorTips) error {
+	powerChanges, err := p.processPowerActors(ctx, powerTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process power actors: %w", err)
+	}
+
+	if err := p.persistPowerActors(ctx, powerChanges); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *Processor) processPowerActors(ctx context.Context, powerTips ActorTips) ([]powerActorInfo, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Processed Power Actors", "duration", time.Since(start).String())
+	}()
+
+	var out []powerActorInfo
+	for _, actors := range powerTips {
+		for _, act := range actors {
+			var pw powerActorInfo
+			pw.common = act
+
+			powerStateRaw, err := p.node.ChainReadObj(ctx, act.act.Head)
+			if err != nil {
+				return nil, xerrors.Errorf("read state obj (@ %s): %w", pw.common.stateroot.String(), err)
+			}
+
+			var powerActorState power.State
+			if err := powerActorState.UnmarshalCBOR(bytes.NewReader(powerStateRaw)); err != nil {
+				return nil, xerrors.Errorf("unmarshal state (@ %s): %w", pw.common.stateroot.String(), err)
+			}
+
+			pw.totalRawBytes = powerActorState.TotalRawBytePower
+			pw.totalQualityAdjBytes = powerActorState.TotalQualityAdjPower
+			pw.totalPledgeCollateral = powerActorState.TotalPledgeCollateral
+			pw.minerCount = powerActorState.MinerCount
+			pw.cronQueue = powerActorState.CronEventQueue
+
+			prevPowerActor, err := p.node.StateGetActor(ctx, builtin.StoragePowerActorAddr, act.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("get previous power actor (@ %s): %w", act.tsKey, err)
+			}
+			prevPowerStateRaw, err := p.node.ChainReadObj(ctx, prevPowerActor.Head)
+			if err != nil {
+				return nil, xerrors.Errorf("read previous state obj (@ %s): %w", act.tsKey, err)
+			}
+			var prevPowerActorState power.State
+			if err := prevPowerActorState.UnmarshalCBOR(bytes.NewReader(prevPowerStateRaw)); err != nil {
+				return nil, xerrors.Errorf("unmarshal previous state (@ %s): %w", act.tsKey, err)
+			}
+			pw.prevCronQueue = prevPowerActorState.CronEventQueue
+
+			out = append(out, pw)
+		}
+	}
+	return out, nil
+}
+
+func (p *Processor) persistPowerActors(ctx context.Context, powers []powerActorInfo) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Persisted Power Actors", "duration", time.Since(start).String())
+	}()
+
+	if err := p.storeNetworkPower(powers); err != nil {
+		return err
+	}
+
+	return p.updateCronQueue(ctx, powers)
+}
+
+func (p *Processor) storeNetworkPower(powers []powerActorInfo) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin network_power tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table np (like network_power excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep network_power temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy np (state_root, total_raw_bytes_power, total_qa_bytes_power, total_pledge_collateral, miner_count) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp network_power: %w", err)
+	}
+
+	for _, ps := range powers {
+		if _, err := stmt.Exec(
+			ps.common.stateroot.String(),
+			ps.totalRawBytes.String(),
+			ps.totalQualityAdjBytes.String(),
+			ps.totalPledgeCollateral.String(),
+			ps.minerCount,
+		); err != nil {
+			p.logger().Errorw("failed to store network power", "state_root", ps.common.stateroot, "error", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared network_power: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into network_power select * from np on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert network_power from tmp: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit network_power tx: %w", err)
+	}
+
+	return nil
+}
+
+// PowerGrowthPoint is the change of the network power at a height compared to the previous recorded height.
+type PowerGrowthPoint struct {
+	Height abi.ChainEpoch
+
+	RawBytesDelta       big.Int
+	QualityAdjDelta     big.Int
+	RawBytesDailyRate   big.Int
+	QualityAdjDailyRate big.Int
+}
+
+type powerAt struct {
+	height     abi.ChainEpoch
+	rawBytes   big.Int
+	qualityAdj big.Int
+}
+
+// dailyRate extrapolates the change between from and to to a day worth of epochs.
+func dailyRate(from, to abi.ChainEpoch, delta big.Int) big.Int {
+	if to <= from {
+		return big.Zero()
+	}
+	return big.Div(big.Mul(delta, big.NewInt(builtin.EpochsInDay)), big.NewInt(int64(to-from)))
+}
+
+// powerGrowth computes the per height deltas of the (height ordered) power points and a rate smoothed over the
+// trailing day. The first point has nothing to be compared with, such as the genesis bootstrap from zero power, so
+// its deltas and rates are zero.
+func powerGrowth(points []powerAt) []PowerGrowthPoint {
+	out := make([]PowerGrowthPoint, 0, len(points))
+	windowStart := 0
+	for i, cur := range points {
+		gp := PowerGrowthPoint{
+			Height:              cur.height,
+			RawBytesDelta:       big.Zero(),
+			QualityAdjDelta:     big.Zero(),
+			RawBytesDailyRate:   big.Zero(),
+			QualityAdjDailyRate: big.Zero(),
+		}
+		if i > 0 {
+			prev := points[i-1]
+			gp.RawBytesDelta = big.Sub(cur.rawBytes, prev.rawBytes)
+			gp.QualityAdjDelta = big.Sub(cur.qualityAdj, prev.qualityAdj)
+
+			for cur.height-points[windowStart].height > builtin.EpochsInDay {
+				windowStart++
+			}
+			first := points[windowStart]
+			gp.RawBytesDailyRate = dailyRate(first.height, cur.height, big.Sub(cur.rawBytes, first.rawBytes))
+			gp.QualityAdjDailyRate = dailyRate(first.height, cur.height, big.Sub(cur.qualityAdj, first.qualityAdj))
+		}
+		out = append(out, gp)
+	}
+	return out
+}
+
+// PowerGrowth returns the change in network raw byte and quality adjusted power for every height in [from, to] where
+// the power actor changed, along with the growth rate smoothed over the trailing day. A day of history before from is
+// loaded so the rate is smoothed from the first returned height on.
+func (p *Processor) PowerGrowth(ctx context.Context, from, to abi.ChainEpoch) ([]PowerGrowthPoint, error) {
+	rows, err := p.db.QueryContext(ctx, `
+select sh.height, np.total_raw_bytes_power, np.total_qa_bytes_power
+from network_power np
+    inner join state_heights sh on sh.parentstateroot = np.state_root
+where sh.height >= $1 and sh.height <= $2
+order by sh.height
+`, from-builtin.EpochsInDay, to)
+	if err != nil {
+		return nil, xerrors.Errorf("query network power: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var points []powerAt
+	for rows.Next() {
+		var height int64
+		var rawText, qaText string
+		if err := rows.Scan(&height, &rawText, &qaText); err != nil {
+			return nil, xerrors.Errorf("scan network power: %w", err)
+		}
+		pa := powerAt{height: abi.ChainEpoch(height)}
+		if pa.rawBytes, err = types.BigFromString(rawText); err != nil {
+			return nil, err
+		}
+		if pa.qualityAdj, err = types.BigFromString(qaText); err != nil {
+			return nil, err
+		}
+		points = append(points, pa)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var out []PowerGrowthPoint
+	for _, gp := range powerGrowth(points) {
+		if gp.Height >= from {
+			out = append(out, gp)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,160 @@
+package processor
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	typegen "github.com/whyrusleeping/cbor-gen"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin/power"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// cronEntry is a cron callback a miner has scheduled with the power actor.
+type cronEntry struct {
+	miner address.Address
+	epoch abi.ChainEpoch
+}
+
+// loadCronQueue reads the power actor's cron event queue, a multimap of epoch to the events scheduled at that epoch.
+func (p *Processor) loadCronQueue(ctx context.Context, root cid.Cid) ([]cronEntry, error) {
+	store := cw_util.NewAPIIpldStore(ctx, p.node)
+	epochs, err := adt.AsMap(store, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []cronEntry
+	var eventsRoot typegen.CborCid
+	if err := epochs.ForEach(&eventsRoot, func(key string) error {
+		epoch, err := adt.ParseIntKey(key)
+		if err != nil {
+			return err
+		}
+
+		events, err := adt.AsArray(store, cid.Cid(eventsRoot))
+		if err != nil {
+			return err
+		}
+
+		var ev power.CronEvent
+		return events.ForEach(&ev, func(i int64) error {
+			out = append(out, cronEntry{miner: ev.MinerAddr, epoch: abi.ChainEpoch(epoch)})
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// cronQueueDiff returns the entries that were enqueued and dequeued going from prev to cur.
+func cronQueueDiff(prev, cur []cronEntry) (enqueued, dequeued []cronEntry) {
+	inPrev := map[cronEntry]struct{}{}
+	for _, e := range prev {
+		inPrev[e] = struct{}{}
+	}
+	inCur := map[cronEntry]struct{}{}
+	for _, e := range cur {
+		inCur[e] = struct{}{}
+		if _, ok := inPrev[e]; !ok {
+			enqueued = append(enqueued, e)
+		}
+	}
+	for e := range inPrev {
+		if _, ok := inCur[e]; !ok {
+			dequeued = append(dequeued, e)
+		}
+	}
+	return enqueued, dequeued
+}
+
+// updateCronQueue records the cron events enqueued and dequeued by every power actor change, in height order.
+func (p *Processor) updateCronQueue(ctx context.Context, powers []powerActorInfo) error {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Updated Power Cron Queue", "duration", time.Since(start).String())
+	}()
+
+	sorted := make([]powerActorInfo, len(powers))
+	copy(sorted, powers)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].common.height < sorted[j].common.height
+	})
+
+	for _, pw := range sorted {
+		if pw.cronQueue == pw.prevCronQueue {
+			continue
+		}
+
+		cur, err := p.loadCronQueue(ctx, pw.cronQueue)
+		if err != nil {
+			return xerrors.Errorf("load cron queue (@ %s): %w", pw.common.stateroot, err)
+		}
+		prev, err := p.loadCronQueue(ctx, pw.prevCronQueue)
+		if err != nil {
+			return xerrors.Errorf("load previous cron queue (@ %s): %w", pw.common.stateroot, err)
+		}
+
+		enqueued, dequeued := cronQueueDiff(prev, cur)
+		if err := p.storeCronQueueChanges(pw.common.height, enqueued, dequeued); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Processor) storeCronQueueChanges(height abi.ChainEpoch, enqueued, dequeued []cronEntry) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin power_cron_queue tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table pcq (like power_cron_queue excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep power_cron_queue temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy pcq (miner_id, epoch, enqueued_at) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp power_cron_queue: %w", err)
+	}
+
+	for _, e := range enqueued {
+		if _, err := stmt.Exec(e.miner.String(), e.epoch, height); err != nil {
+			p.logger().Errorw("failed to store cron event", "miner", e.miner, "epoch", e.epoch, "error", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared power_cron_queue: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into power_cron_queue select * from pcq on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert power_cron_queue from tmp: %w", err)
+	}
+
+	dequeueStmt, err := tx.Prepare(`update power_cron_queue set dequeued_at = $1 where miner_id = $2 and epoch = $3 and dequeued_at is null`)
+	if err != nil {
+		return xerrors.Errorf("prepare power_cron_queue dequeue: %w", err)
+	}
+
+	for _, e := range dequeued {
+		if _, err := dequeueStmt.Exec(height, e.miner.String(), e.epoch); err != nil {
+			p.logger().Errorw("failed to dequeue cron event", "miner", e.miner, "epoch", e.epoch, "error", err)
+		}
+	}
+
+	if err := dequeueStmt.Close(); err != nil {
+		return xerrors.Errorf("close power_cron_queue dequeue: %w", err)
+	}
+
+	return tx.Commit()
+}
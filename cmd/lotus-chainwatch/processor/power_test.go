@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestPowerGrowth(t *testing.T) {
+	points := []powerAt{
+		// genesis bootstrap, nothing to compare with
+		{height: 0, rawBytes: big.NewInt(0), qualityAdj: big.NewInt(0)},
+		{height: 10, rawBytes: big.NewInt(100), qualityAdj: big.NewInt(200)},
+		{height: 20, rawBytes: big.NewInt(150), qualityAdj: big.NewInt(200)},
+		{height: 20 + builtin.EpochsInDay, rawBytes: big.NewInt(250), qualityAdj: big.NewInt(100)},
+	}
+
+	growth := powerGrowth(points)
+	require.Len(t, growth, 4)
+
+	require.Equal(t, big.Zero(), growth[0].RawBytesDelta)
+	require.Equal(t, big.Zero(), growth[0].RawBytesDailyRate)
+
+	require.Equal(t, big.NewInt(100), growth[1].RawBytesDelta)
+	require.Equal(t, big.NewInt(200), growth[1].QualityAdjDelta)
+	require.Equal(t, big.NewInt(100*builtin.EpochsInDay/10), growth[1].RawBytesDailyRate)
+
+	require.Equal(t, big.NewInt(50), growth[2].RawBytesDelta)
+	require.Equal(t, big.NewInt(0), growth[2].QualityAdjDelta)
+
+	// the window only reaches back a day, to height 20
+	require.Equal(t, big.NewInt(100), growth[3].RawBytesDelta)
+	require.Equal(t, big.NewInt(-100), growth[3].QualityAdjDelta)
+	require.Equal(t, big.NewInt(100), growth[3].RawBytesDailyRate)
+	require.Equal(t, big.NewInt(-100), growth[3].QualityAdjDailyRate)
+}
+
+func TestCronQueueDiff(t *testing.T) {
+	minerA := mock.Address(1000)
+	minerB := mock.Address(1001)
+
+	prev := []cronEntry{
+		{miner: minerA, epoch: 100},
+		{miner: minerB, epoch: 120},
+	}
+	// minerA's deadline cron ran and it enqueued the next one, minerB is unchanged.
+	cur := []cronEntry{
+		{miner: minerB, epoch: 120},
+		{miner: minerA, epoch: 160},
+	}
+
+	enqueued, dequeued := cronQueueDiff(prev, cur)
+	require.Equal(t, []cronEntry{{miner: minerA, epoch: 160}}, enqueued)
+	require.Equal(t, []cronEntry{{miner: minerA, epoch: 100}}, dequeued)
+
+	enqueued, dequeued = cronQueueDiff(nil, prev)
+	require.ElementsMatch(t, prev, enqueued)
+	require.Empty(t, dequeued)
+}
@@ -3,11 +3,13 @@ package processor
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"sort"
 	"sync"
 	"time"
 
+	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/go-address"
@@ -15,26 +17,168 @@ import (
 	logging "github.com/ipfs/go-log/v2"
 
 	"github.com/filecoin-project/specs-actors/actors/abi"
-	"github.com/filecoin-project/specs-actors/actors/builtin"
 
-	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/events/state"
 	"github.com/filecoin-project/lotus/chain/types"
 	"github.com/filecoin-project/lotus/lib/parmap"
 )
 
+// log is the processor subsystem logger, the helpers run without a Processor log to it.
 var log = logging.Logger("processor")
 
+// WriterVersion identifies the processor logic that wrote a block's data, it is recorded on blocks_synced when a block
+// is marked processed. Bump it whenever a decoding or storage change makes previously written rows stale.
+//
+// 2: actors.id holds the ID address of an actor changed under its robust address.
+// 3: actors.balance is stored as a numeric, balances which are not non-negative integers are rejected.
+// 4: miner sector events record their epoch, terminated sectors are no longer marked expired.
+const WriterVersion = 4
+
 type Processor struct {
 	db *sql.DB
 
-	node api.FullNode
+	// Backend is the database db connects to, BackendPostgres unless set.
+	Backend Backend
+
+	node Node
+
+	// NodeQPS is the most calls per second made to the node, the calls beyond it wait. 0 leaves the calls unlimited.
+	NodeQPS float64
+	// NodeBurst is the number of calls made to the node at once before NodeQPS applies.
+	NodeBurst     int
+	nodeLimitOnce sync.Once
+	nodeLimit     *rate.Limiter
+
+	// Source provides the blocks, tipsets and changed actor states walked while processing, it defaults to the node.
+	Source TipSetSource
 
 	genesisTs *types.TipSet
 
 	// number of blocks processed at a time
 	batch int
+
+	// PollInterval is how long the processor waits before checking for new blocks once it has caught up.
+	PollInterval time.Duration
+
+	// BatchHeights limits the number of distinct heights processed per cycle, 0 means only the block batch size
+	// applies. Setting it to 1 processes one tipset at a time.
+	BatchHeights int
+
+	// HeadLag is the number of epochs a block must be below the highest block synced to be processed. The blocks nearer
+	// the head are the ones most likely to be reorged, they are held back until the chain has grown past them. 0
+	// processes blocks up to the head.
+	HeadLag int
+
+	// BatchSize is the most rows written to a table in one transaction by the common actor store methods, larger
+	// writes are split into several transactions. 0 writes everything at once.
+	BatchSize int
+
+	// StateCacheSize is the number of recently stored actor states remembered so unchanged states are not rewritten,
+	// 0 disables the cache.
+	StateCacheSize int
+	stateCache     *stateCache
+
+	// DecodeCacheSize is the number of decoded actor states kept by head and code so a head seen again is not decoded
+	// again, 0 disables the cache.
+	DecodeCacheSize int
+	decodeCache     *decodeCache
+
+	// IDCacheSize is the number of robust addresses whose ID address is kept so the node is not asked to resolve them
+	// again, 0 disables the cache.
+	IDCacheSize int
+	idCache     *idCache
+
+	// Metrics receives the store and cache metrics, NewPrometheusSink by default.
+	Metrics MetricsSink
+
+	// Log receives the logs of the processor, such as the duration of every store, in place of the processor
+	// subsystem logger. Its level is its own, independent of the level set for the other subsystems.
+	Log *zap.SugaredLogger
+
+	// Mode selects whether the actors table keeps every head of an actor or only its latest one, ModeHistory unless set.
+	Mode Mode
+
+	// CanonicalStateJSON stores actor states in canonical JSON so identical states are byte identical and can be
+	// compared or hashed directly in the database.
+	CanonicalStateJSON bool
+
+	// StateRetention is the number of epochs of actor states kept by the periodic prune of actor_states, states only
+	// referenced by older actors rows are deleted. 0 keeps every state and disables the prune.
+	StateRetention int
+	// PruneInterval is how often actor_states is pruned when StateRetention is set.
+	PruneInterval time.Duration
+
+	// Processors names the built in processors that run, all of them if empty. The tables of a processor that does
+	// not run are not created. Registered custom processors always run.
+	Processors []string
+
+	// DryRun rolls back every store transaction instead of committing it, logging the rows written to each table, so
+	// what a change would write can be checked against a live database. Only the processors whose writes all go
+	// through store transactions run, and the loop stops after a single batch since none is marked processed.
+	DryRun bool
+
+	// StatementTimeout bounds every statement of a store transaction, so a transaction stuck behind the locks of
+	// another fails with a StatementTimeoutError instead of hanging. 0 leaves the server's statement_timeout.
+	StatementTimeout time.Duration
+
+	// AtomicRange stores everything HandleCommonActorsChanges writes for a range in a single transaction, so a failure
+	// leaves none of the range stored rather than the tables whose phase succeeded. The phases then run one after the
+	// other instead of concurrently.
+	AtomicRange bool
+
+	// NoState skips storing actor_states, the largest of the common actor tables, and decoding the states of the
+	// actors changed unless a custom processor is handed them. Only the heads of the actors are stored, the queries
+	// reading states find none. The table is still created by the schema migrations, it is left empty.
+	NoState bool
+
+	// PartitionActors partitions actors by range of epoch on start if it is not, so old ranges are pruned by dropping
+	// their partition and queries bounded by epoch scan only the partitions of their bounds. Postgres and history mode
+	// only, the rows are copied into the partitions in a single transaction.
+	PartitionActors bool
+	partitions      actorPartitions
+
+	// BackfillWorkers is the number of chunks a backfill processes concurrently.
+	BackfillWorkers int
+	// BackfillHeights is the number of heights in a backfill chunk, backfillHeights if not set.
+	BackfillHeights int
+	// ShutdownGrace is how long chunks in flight when Close is called are given to commit before being cancelled.
+	ShutdownGrace time.Duration
+	// marks keeps how far each backfill got, in chainwatch_meta unless set.
+	marks watermarks
+
+	closeInit sync.Once
+	closeOnce sync.Once
+	closing   chan struct{}
+
+	custom        []customProcessor
+	sinks         []registeredSink
+	stateDecoders map[cid.Cid]StateDecoder
+
+	// resumeLk guards resume, the processing loop clears it while backfill workers handling common actor changes read it.
+	resumeLk sync.Mutex
+	// resume is the checkpoint read on start, the tipsets it covers are skipped by the common actors processor until the
+	// processing loop committed its first batch.
+	resume *checkpoint
+
+	// lastTs is the latest tipset observed by the processing loop, reorgs are detected against it.
+	lastTs *types.TipSet
+
+	// networkName is the name of the network this database holds data for, set by the network identity check on start.
+	networkName string
 }
 
+// DefaultPollInterval is the default wait between checks for unprocessed blocks when caught up.
+const DefaultPollInterval = 10 * time.Second
+
+// DefaultHeadLag is the default number of epochs below the head a block is processed at.
+const DefaultHeadLag = 5
+
+// DefaultBatchSize is the default number of rows written per transaction by the common actor store methods.
+const DefaultBatchSize = 5000
+
+// DefaultStatementTimeout is the default bound on each statement of a store transaction.
+const DefaultStatementTimeout = 5 * time.Minute
+
 type ActorTips map[types.TipSetKey][]actorInfo
 
 type actorInfo struct {
@@ -50,128 +194,270 @@ type actorInfo struct {
 	state string
 }
 
-func NewProcessor(db *sql.DB, node api.FullNode, batch int) *Processor {
-	return &Processor{
-		db:    db,
-		node:  node,
-		batch: batch,
+// NewProcessor opens the database of dsn with the connection pool configured by opts, as OpenDB does, and returns a
+// Processor writing to it with the backend of dsn. It reads the chain from the node set by WithNode. The database is
+// not reached before it is used, and closing it is left to the caller through DB.
+func NewProcessor(dsn string, opts ...Option) (*Processor, error) {
+	db, err := OpenDB(dsn, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := newConfig(opts)
+	p := NewProcessorFromDB(db, cfg.node, cfg.batch)
+	p.Backend = BackendOf(dsn)
+	return p, nil
+}
+
+// NewProcessorFromDB returns a Processor writing to db, opened by the caller, which is shared with the syncer when
+// both run in the same process.
+func NewProcessorFromDB(db *sql.DB, node Node, batch int) *Processor {
+	p := &Processor{
+		db:              db,
+		batch:           batch,
+		NodeQPS:         DefaultNodeQPS,
+		NodeBurst:       DefaultNodeBurst,
+		PollInterval:    DefaultPollInterval,
+		HeadLag:         DefaultHeadLag,
+		BatchSize:       DefaultBatchSize,
+		StateCacheSize:  DefaultStateCacheSize,
+		DecodeCacheSize: DefaultDecodeCacheSize,
+		IDCacheSize:     DefaultIDCacheSize,
+		Metrics:         NewPrometheusSink(),
+		PruneInterval:   DefaultPruneInterval,
+		BackfillWorkers: DefaultBackfillWorkers,
+		ShutdownGrace:   DefaultShutdownGrace,
+
+		StatementTimeout: DefaultStatementTimeout,
 	}
+	p.node = &rateLimitedNode{node: node, limiter: p.nodeLimiter}
+	p.Source = NewNodeSource(p.node)
+	return p
+}
+
+// DB returns the database p writes to.
+func (p *Processor) DB() *sql.DB {
+	return p.db
 }
 
 func (p *Processor) setupSchemas() error {
-	if err := p.setupMarket(); err != nil {
+	if err := p.checkProcessors(); err != nil {
 		return err
 	}
 
-	if err := p.setupMiners(); err != nil {
-		return err
+	for _, s := range []struct {
+		// processor is the built in processor writing the tables, empty for the tables every processor needs.
+		processor string
+		setup     func() error
+		// loop is set for the tables only the processing loop reads or writes, which runs on Postgres alone.
+		loop bool
+	}{
+		{"", p.setupProcessed, true},
+		{"", p.setupMeta},
+		{"market", p.setupMarket},
+		{"miner", p.setupMiners},
+		{"reward", p.setupRewards},
+		{"power", p.setupPower},
+		{"account", p.setupAccounts},
+		{"multisig", p.setupMultisig},
+		{"paych", p.setupPaymentChannels},
+		{"verifreg", p.setupVerifiedRegistry},
+		{"cron", p.setupCron},
+		{"system", p.setupSystem},
+		{"actor_events", p.setupActorEvents},
+		{"", p.setupReorgs, true},
+		{"messages", p.setupMessages},
+		// the other processors resolve addresses through id_address_map, so the common actor tables always exist.
+		{"", p.setupCommonActors},
+		{"", p.setupCustomProcessors},
+	} {
+		if s.processor != "" && !p.enabled(s.processor) {
+			continue
+		}
+		if s.loop && p.Backend == BackendSQLite {
+			continue
+		}
+		if err := s.setup(); err != nil {
+			return err
+		}
 	}
 
-	if err := p.setupRewards(); err != nil {
+	return nil
+}
+
+func (p *Processor) setupProcessed() error {
+	tx, err := p.db.Begin()
+	if err != nil {
 		return err
 	}
 
-	if err := p.setupMessages(); err != nil {
+	if _, err := tx.Exec(`
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+`); err != nil {
 		return err
 	}
 
-	if err := p.setupCommonActors(); err != nil {
-		return err
+	return tx.Commit()
+}
+
+// Setup creates the tables of the processors and seeds the genesis state, everything Start does before processing.
+// Backfilling a database no processor was started on, a SQLite one in particular, needs it first.
+func (p *Processor) Setup(ctx context.Context) error {
+	if err := p.setupSchemas(); err != nil {
+		return xerrors.Errorf("setup processor: %w", err)
+	}
+	if err := p.checkNetworkIdentity(ctx); err != nil {
+		return xerrors.Errorf("check network identity: %w", err)
 	}
 
+	var err error
+	if p.genesisTs, err = p.node.ChainGetGenesis(ctx); err != nil {
+		return xerrors.Errorf("get genesis tipset: %w", err)
+	}
+	if p.DryRun {
+		return nil
+	}
+	if err := p.seedGenesis(ctx); err != nil {
+		return xerrors.Errorf("seed genesis state: %w", err)
+	}
 	return nil
 }
 
 func (p *Processor) Start(ctx context.Context) {
-	log.Debug("Starting Processor")
+	p.logger().Debug("Starting Processor")
+
+	// the loop processes the blocks the syncer stores, and the syncer only writes to Postgres.
+	if p.Backend == BackendSQLite {
+		p.logger().Fatalw("Failed to setup processor", "error", "the processing loop needs a Postgres database, SQLite databases are only written by backfills")
+	}
 
 	if err := p.setupSchemas(); err != nil {
-		log.Fatalw("Failed to setup processor", "error", err)
+		p.logger().Fatalw("Failed to setup processor", "error", err)
+	}
+
+	if p.StateCacheSize > 0 {
+		var err error
+		if p.stateCache, err = newStateCache(p.StateCacheSize); err != nil {
+			p.logger().Fatalw("Failed to create actor state cache", "error", err)
+		}
+	}
+
+	if p.DecodeCacheSize > 0 {
+		var err error
+		if p.decodeCache, err = newDecodeCache(p.DecodeCacheSize); err != nil {
+			p.logger().Fatalw("Failed to create actor decode cache", "error", err)
+		}
+	}
+
+	if p.IDCacheSize > 0 {
+		var err error
+		if p.idCache, err = newIDCache(p.IDCacheSize); err != nil {
+			p.logger().Fatalw("Failed to create ID address cache", "error", err)
+		}
+	}
+
+	if err := p.checkNetworkIdentity(ctx); err != nil {
+		p.logger().Fatalw("Failed network identity check", "error", err)
 	}
 
 	var err error
 	p.genesisTs, err = p.node.ChainGetGenesis(ctx)
 	if err != nil {
-		log.Fatalw("Failed to get genesis state from lotus", "error", err.Error())
+		p.logger().Fatalw("Failed to get genesis state from lotus", "error", err.Error())
 	}
 
-	go p.subMpool(ctx)
+	if p.DryRun {
+		p.logger().Warnw("Dry run, nothing is written to the database", "processors", processorNames(p.processors()))
+	} else {
+		if err := p.seedGenesis(ctx); err != nil {
+			p.logger().Fatalw("Failed to seed genesis state", "error", err)
+		}
+
+		if err := p.loadCheckpoint(); err != nil {
+			p.logger().Fatalw("Failed to load processor checkpoint", "error", err)
+		}
+
+		go p.subMpool(ctx)
+
+		if p.StateRetention > 0 {
+			go p.pruneLoop(ctx, p.StateRetention, p.PruneInterval)
+		}
+	}
 
 	// main processor loop
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
-				log.Debugw("Stopping Processor...")
+				p.logger().Debugw("Stopping Processor...")
 				return
 			default:
-				toProcess, err := p.unprocessedBlocks(ctx, p.batch)
+				toProcess, err := p.nextBatch(ctx)
+				if ctx.Err() != nil {
+					continue
+				}
 				if err != nil {
-					log.Fatalw("Failed to get unprocessed blocks", "error", err)
+					p.logger().Fatalw("Failed to get unprocessed blocks", "error", err)
 				}
 
-				if len(toProcess) == 0 {
-					log.Debugw("No unprocessed blocks. Wait then try again...")
-					time.Sleep(time.Second * 10)
-					continue
+				if !p.DryRun {
+					if err := p.observeTipSets(ctx, toProcess); err != nil {
+						p.logger().Errorw("Failed to check for reorgs", "error", err)
+					}
 				}
 
 				// TODO special case genesis state handling here to avoid all the special cases that will be needed for it else where
 				// before doing "normal" processing.
 
-				actorChanges, err := p.collectActorChanges(ctx, toProcess)
+				// the node being unavailable keeps the batch unprocessed, it is
+				// handled again once the node is back.
+				var actorChanges map[cid.Cid]ActorTips
+				err = withNodeRetry(ctx, func() error {
+					var err error
+					actorChanges, err = p.collectActorChanges(ctx, toProcess)
+					return err
+				})
+				if ctx.Err() != nil {
+					continue
+				}
 				if err != nil {
-					log.Fatalw("Failed to collect actor changes", "error", err)
+					p.logger().Fatalw("Failed to collect actor changes", "error", err)
 				}
 
-				grp, ctx := errgroup.WithContext(ctx)
-
-				grp.Go(func() error {
-					if err := p.HandleMarketChanges(ctx, actorChanges[builtin.StorageMarketActorCodeID]); err != nil {
-						return xerrors.Errorf("Failed to handle market changes: %w", err)
+				if err := withNodeRetry(ctx, func() error {
+					grp, ctx := errgroup.WithContext(ctx)
+
+					for _, np := range p.processors() {
+						np := np
+						grp.Go(func() error {
+							if err := np.run(ctx, actorChanges, toProcess); err != nil {
+								return xerrors.Errorf("Failed to handle %s changes: %w", np.name, err)
+							}
+							return nil
+						})
 					}
-					return nil
-				})
-
-				grp.Go(func() error {
-					if err := p.HandleMinerChanges(ctx, actorChanges[builtin.StorageMinerActorCodeID]); err != nil {
-						return xerrors.Errorf("Failed to handle miner changes: %w", err)
-					}
-					return nil
-				})
-
-				grp.Go(func() error {
-					if err := p.HandleRewardChanges(ctx, actorChanges[builtin.RewardActorCodeID]); err != nil {
-						return xerrors.Errorf("Failed to handle reward changes: %w", err)
-					}
-					return nil
-				})
-
-				grp.Go(func() error {
-					if err := p.HandleMessageChanges(ctx, toProcess); err != nil {
-						return xerrors.Errorf("Failed to handle message changes: %w", err)
-					}
-					return nil
-				})
-
-				grp.Go(func() error {
-					if err := p.HandleCommonActorsChanges(ctx, actorChanges); err != nil {
-						return xerrors.Errorf("Failed to handle common actor changes: %w", err)
-					}
-					return nil
-				})
-
-				if err := grp.Wait(); err != nil {
-					log.Errorw("Failed to handle actor changes...retrying", "error", err)
+					return grp.Wait()
+				}); err != nil {
+					p.logger().Errorw("Failed to handle actor changes...retrying", "error", err)
 					continue
 				}
 
+				if p.DryRun {
+					p.logger().Infow("Dry run batch done, stopping", "blocks", len(toProcess))
+					return
+				}
+
 				if err := p.markBlocksProcessed(ctx, toProcess); err != nil {
-					log.Fatalw("Failed to mark blocks as processed", "error", err)
+					p.logger().Fatalw("Failed to mark blocks as processed", "error", err)
 				}
+				p.clearResume()
 
 				if err := p.refreshViews(); err != nil {
-					log.Errorw("Failed to refresh views", "error", err)
+					p.logger().Errorw("Failed to refresh views", "error", err)
+				} else if err := p.RefreshLatest(ctx); err != nil {
+					// latest_actors reads state_heights, it is only refreshed after it.
+					p.logger().Errorw("Failed to refresh latest actors", "error", err)
 				}
 			}
 		}
@@ -179,13 +465,175 @@ func (p *Processor) Start(ctx context.Context) {
 
 }
 
+// nextBatch returns the next batch of unprocessed blocks. When lagging behind the next batch is returned right away, it
+// only waits PollInterval between looks once caught up, until ctx is done.
+func (p *Processor) nextBatch(ctx context.Context) (map[cid.Cid]*types.BlockHeader, error) {
+	for {
+		toProcess, err := p.unprocessedBlocks(ctx, p.batch, p.BatchHeights, p.HeadLag)
+		if err != nil || len(toProcess) > 0 {
+			return toProcess, err
+		}
+
+		p.logger().Debugw("No unprocessed blocks. Wait then try again...", "interval", p.PollInterval.String())
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(p.PollInterval):
+		}
+	}
+}
+
+// processorFunc handles a batch of blocks and the actor changes collected from them.
+type processorFunc func(ctx context.Context, actors map[cid.Cid]ActorTips, blocks map[cid.Cid]*types.BlockHeader) error
+
+type namedProcessor struct {
+	name string
+	run  processorFunc
+	// dryRun is set on processors writing only through store transactions, which a DryRun rolls back.
+	dryRun bool
+	// stream handles the records of the actor changes as they are collected, set on processors a backfill feeds a
+	// stream rather than the changes of a whole chunk at once.
+	stream func(ctx context.Context, records <-chan ActorRecord) error
+}
+
+func processorNames(procs []namedProcessor) []string {
+	out := make([]string, 0, len(procs))
+	for _, np := range procs {
+		out = append(out, np.name)
+	}
+	return out
+}
+
+// processors returns the enabled built in processors followed by the registered custom ones. Every processor writes
+// only its own tables so any of them can be run on its own. A DryRun leaves out the ones that would write anyway.
+func (p *Processor) processors() []namedProcessor {
+	var out []namedProcessor
+	for _, np := range p.builtinProcessors() {
+		if p.enabled(np.name) && (np.dryRun || !p.DryRun) {
+			out = append(out, np)
+		}
+	}
+	// custom handlers write through connections of their own.
+	if p.DryRun {
+		return out
+	}
+
+	for _, cp := range p.custom {
+		cp := cp
+		out = append(out, namedProcessor{name: cp.name, run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.handleCustom(ctx, state.NewStatePredicates(p.node), cp, actors)
+		}})
+	}
+	return out
+}
+
+// processorAliases are the other names Processors accepts for a built in processor.
+var processorAliases = map[string]string{
+	"common": "common_actors",
+}
+
+// processorName returns the built in processor name is an alias of, or name.
+func processorName(name string) string {
+	if n, ok := processorAliases[name]; ok {
+		return n
+	}
+	return name
+}
+
+// enabled reports whether the built in processor name runs. On SQLite only the sqliteProcessors run unless Processors
+// is set.
+func (p *Processor) enabled(name string) bool {
+	if len(p.Processors) == 0 {
+		if p.Backend == BackendSQLite {
+			_, ok := sqliteProcessors[name]
+			return ok
+		}
+		return true
+	}
+	for _, n := range p.Processors {
+		if processorName(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProcessors fails if Processors names a processor that is not built in, or one whose tables don't exist in the
+// SQLite database of a processor on BackendSQLite.
+func (p *Processor) checkProcessors() error {
+	known := map[string]struct{}{}
+	for _, np := range p.builtinProcessors() {
+		known[np.name] = struct{}{}
+	}
+	for _, name := range p.Processors {
+		name = processorName(name)
+		if _, ok := known[name]; !ok {
+			return xerrors.Errorf("unknown processor %q", name)
+		}
+		if _, ok := sqliteProcessors[name]; !ok && p.Backend == BackendSQLite {
+			return xerrors.Errorf("processor %q needs a Postgres database", name)
+		}
+	}
+	return nil
+}
+
+func (p *Processor) builtinProcessors() []namedProcessor {
+	return []namedProcessor{
+		{name: "market", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleMarketChanges(ctx, actorsOfKind(actors, kindStorageMarket))
+		}},
+		{name: "miner", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleMinerChanges(ctx, actorsOfKind(actors, kindStorageMiner))
+		}},
+		{name: "reward", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleRewardChanges(ctx, actorsOfKind(actors, kindReward))
+		}},
+		{name: "power", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandlePowerChanges(ctx, actorsOfKind(actors, kindStoragePower))
+		}},
+		{name: "init", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleInitChanges(ctx, actorsOfKind(actors, kindInit))
+		}},
+		{name: "account", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleAccountChanges(ctx, actorsOfKind(actors, kindAccount))
+		}, dryRun: true},
+		{name: "multisig", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, blocks map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleMultisigChanges(ctx, actorsOfKind(actors, kindMultisig), blocks)
+		}},
+		{name: "paych", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandlePaymentChannelChanges(ctx, actorsOfKind(actors, kindPaymentChannel))
+		}},
+		{name: "verifreg", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleVerifiedRegistryChanges(ctx, actorsOfKind(actors, kindVerifiedRegistry))
+		}, dryRun: true},
+		{name: "cron", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleCronChanges(ctx, actorsOfKind(actors, kindCron))
+		}, dryRun: true},
+		{name: "system", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleSystemChanges(ctx, actorsOfKind(actors, kindSystem))
+		}, dryRun: true},
+		{name: "messages", run: func(ctx context.Context, _ map[cid.Cid]ActorTips, blocks map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleMessageChanges(ctx, blocks)
+		}},
+		{name: "actor_events", run: func(ctx context.Context, _ map[cid.Cid]ActorTips, blocks map[cid.Cid]*types.BlockHeader) error {
+			return p.HandleActorEvents(ctx, blocks)
+		}, dryRun: true},
+		{name: "common_actors", run: func(ctx context.Context, actors map[cid.Cid]ActorTips, _ map[cid.Cid]*types.BlockHeader) error {
+			_, err := p.HandleCommonActorsChanges(ctx, actors)
+			return err
+		}, dryRun: true, stream: p.HandleActorStream},
+	}
+}
+
 func (p *Processor) refreshViews() error {
 	if _, err := p.db.Exec(`refresh materialized view state_heights`); err != nil {
 		return err
 	}
 
-	if _, err := p.db.Exec(`refresh materialized view miner_sectors_view`); err != nil {
-		return err
+	if p.enabled("miner") {
+		if _, err := p.db.Exec(`refresh materialized view miner_sectors_view`); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -194,35 +642,33 @@ func (p *Processor) refreshViews() error {
 func (p *Processor) collectActorChanges(ctx context.Context, toProcess map[cid.Cid]*types.BlockHeader) (map[cid.Cid]ActorTips, error) {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Collected Actor Changes", "duration", time.Since(start).String())
+		p.logger().Debugw("Collected Actor Changes", "duration", time.Since(start).String())
 	}()
 	// ActorCode - > tipset->[]actorInfo
 	out := map[cid.Cid]ActorTips{}
 	var outMu sync.Mutex
 
-	// map of addresses to changed actors
-	var changes map[string]types.Actor
 	actorsSeen := map[cid.Cid]struct{}{}
 
 	// collect all actor state that has changes between block headers
 	paDone := 0
-	parmap.Par(50, parmap.MapArr(toProcess), func(bh *types.BlockHeader) {
+	err := parBlocks(50, toProcess, func(bh *types.BlockHeader) error {
 		paDone++
 		if paDone%100 == 0 {
-			log.Debugw("Collecting actor changes", "done", paDone, "percent", (paDone*100)/len(toProcess))
+			p.logger().Debugw("Collecting actor changes", "done", paDone, "percent", (paDone*100)/len(toProcess))
 		}
 
-		pts, err := p.node.ChainGetTipSet(ctx, types.NewTipSetKey(bh.Parents...))
+		pts, err := p.Source.TipSet(ctx, types.NewTipSetKey(bh.Parents...))
 		if err != nil {
-			panic(err)
+			return xerrors.Errorf("get parent tipset of %s: %w", bh.Cid(), err)
 		}
 
 		// collect all actors that had state changes between the blockheader parent-state and its grandparent-state.
 		// TODO: changes will contain deleted actors, this causes needless processing further down the pipeline, consider
 		// a separate strategy for deleted actors
-		changes, err = p.node.StateChangedActors(ctx, pts.ParentState(), bh.ParentStateRoot)
+		changes, err := p.Source.ChangedActors(ctx, pts.ParentState(), bh.ParentStateRoot)
 		if err != nil {
-			panic(err)
+			return xerrors.Errorf("get actors changed at %s: %w", bh.ParentStateRoot, err)
 		}
 
 		// record the state of all actors that have changed
@@ -232,19 +678,17 @@ func (p *Processor) collectActorChanges(ctx context.Context, toProcess map[cid.C
 
 			addr, err := address.NewFromString(a)
 			if err != nil {
-				panic(err)
-			}
-
-			ast, err := p.node.StateReadState(ctx, addr, pts.Key())
-			if err != nil {
-				panic(err)
+				return err
 			}
 
 			// TODO look here for an empty state, maybe thats a sign the actor was deleted?
 
-			state, err := json.Marshal(ast.State)
-			if err != nil {
-				panic(err)
+			var state string
+			if p.decodeStates() {
+				state, err = p.decodedState(ctx, addr, pts.Key(), act)
+				if err != nil {
+					return xerrors.Errorf("decode state of %s (@ %s): %w", addr, pts.Key(), err)
+				}
 			}
 
 			outMu.Lock()
@@ -260,32 +704,72 @@ func (p *Processor) collectActorChanges(ctx context.Context, toProcess map[cid.C
 					tsKey:       pts.Key(),
 					parentTsKey: pts.Parents(),
 					addr:        addr,
-					state:       string(state),
+					state:       state,
 				})
 			}
 			actorsSeen[act.Head] = struct{}{}
 			outMu.Unlock()
 		}
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	warnUnknownCodes(out)
 	return out, nil
 }
 
-func (p *Processor) unprocessedBlocks(ctx context.Context, batch int) (map[cid.Cid]*types.BlockHeader, error) {
+// decodeStates reports whether the states of the actors changed are decoded, as run for every change of an actor.
+func (p *Processor) decodeStates() bool {
+	return !p.NoState || len(p.custom) > 0
+}
+
+// parBlocks runs f over blocks on n goroutines and returns the first error it fails with. The blocks not started yet
+// once f failed are skipped.
+func parBlocks(n int, blocks map[cid.Cid]*types.BlockHeader, f func(bh *types.BlockHeader) error) error {
+	var lk sync.Mutex
+	var first error
+	parmap.Par(n, parmap.MapArr(blocks), func(bh *types.BlockHeader) {
+		lk.Lock()
+		failed := first != nil
+		lk.Unlock()
+		if failed {
+			return
+		}
+
+		if err := f(bh); err != nil {
+			lk.Lock()
+			if first == nil {
+				first = err
+			}
+			lk.Unlock()
+		}
+	})
+	return first
+}
+
+// unprocessedBlocks returns up to batch unprocessed blocks spanning at most heights distinct heights (0 for no limit),
+// lowest heights first so blocks are always processed in chain order. The blocks less than lag epochs below the highest
+// block are left unprocessed. Blocks the syncer marked reverted are neither returned nor counted as the highest.
+func (p *Processor) unprocessedBlocks(ctx context.Context, batch int, heights int, lag int) (map[cid.Cid]*types.BlockHeader, error) {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Gathered Blocks to process", "duration", time.Since(start).String())
+		p.logger().Debugw("Gathered Blocks to process", "duration", time.Since(start).String())
 	}()
 	rows, err := p.db.Query(`
 with toProcess as (
-    select blocks.cid, blocks.height, rank() over (order by height) as rnk
+    select blocks.cid, blocks.height, rank() over (order by height) as rnk, dense_rank() over (order by height) as hrnk
     from blocks
         left join blocks_synced bs on blocks.cid = bs.cid
-    where bs.processed_at is null and blocks.height > 0
+    where bs.processed_at is null and bs.reverted_at is null and blocks.height > 0
+        and blocks.height <= (
+            select max(b.height) from blocks b left join blocks_synced r on b.cid = r.cid where r.reverted_at is null
+        ) - $3
 )
 select cid
 from toProcess
-where rnk <= $1
-`, batch)
+where rnk <= $1 and ($2 = 0 or hrnk <= $2)
+`, batch, heights, lag)
 	if err != nil {
 		return nil, xerrors.Errorf("Failed to query for unprocessed blocks: %w", err)
 	}
@@ -304,7 +788,7 @@ where rnk <= $1
 		if err != nil {
 			return nil, xerrors.Errorf("Failed to parse unprocessed blocks: %w", err)
 		}
-		bh, err := p.node.ChainGetBlock(ctx, ci)
+		bh, err := p.Source.Block(ctx, ci)
 		if err != nil {
 			// this is a pretty serious issue.
 			return nil, xerrors.Errorf("Failed to get block header %s: %w", ci.String(), err)
@@ -317,28 +801,83 @@ where rnk <= $1
 func (p *Processor) markBlocksProcessed(ctx context.Context, processed map[cid.Cid]*types.BlockHeader) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Marked blocks as Processed", "duration", time.Since(start).String())
+		p.logger().Debugw("Marked blocks as Processed", "duration", time.Since(start).String())
 	}()
-	tx, err := p.db.Begin()
-	if err != nil {
+
+	// update in a consistent order so concurrent writers acquire the row locks in the same order.
+	cids := make([]string, 0, len(processed))
+	var height abi.ChainEpoch
+	for c, bh := range processed {
+		cids = append(cids, c.String())
+		if bh.Height > height {
+			height = bh.Height
+		}
+	}
+	sort.Strings(cids)
+
+	if err := withRetry(ctx, func() error {
+		tx, err := p.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+
+		processedAt := time.Now().Unix()
+		stmt, err := tx.Prepare(`update blocks_synced set processed_at=$1, writer_version=$2 where cid=$3`)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range cids {
+			if _, err := stmt.Exec(processedAt, WriterVersion, c); err != nil {
+				return err
+			}
+		}
+
+		if err := stmt.Close(); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}); err != nil {
 		return err
 	}
 
-	processedAt := time.Now().Unix()
-	stmt, err := tx.Prepare(`update blocks_synced set processed_at=$1 where cid=$2`)
+	p.metrics().ProcessedEpoch(ctx, height)
+	return nil
+}
+
+// Redecode flags the processed blocks whose data was written by a processor older than version, the ones StaleBlocks
+// returns, for the processing loop to process again by clearing their processed marker. The checkpoint of the common
+// actors processor is removed along, a restart would skip the flagged tipsets it covers. It returns the number of
+// blocks flagged.
+func (p *Processor) Redecode(ctx context.Context, version int) (int64, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer tx.Rollback() //nolint:errcheck
 
-	for c := range processed {
-		if _, err := stmt.Exec(processedAt, c.String()); err != nil {
-			return err
+	res, err := tx.ExecContext(ctx, `
+update blocks_synced set processed_at = null
+where processed_at is not null and (writer_version is null or writer_version < $1)
+`, version)
+	if err != nil {
+		return 0, xerrors.Errorf("flag stale blocks: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		if _, err := tx.ExecContext(ctx, `delete from processor_checkpoint where processor = $1`, commonActorsCheckpoint); err != nil {
+			return 0, xerrors.Errorf("remove processor checkpoint: %w", err)
 		}
 	}
-
-	if err := stmt.Close(); err != nil {
-		return err
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
 
-	return tx.Commit()
+	p.logger().Infow("Flagged stale blocks for reprocessing", "blocks", n, "version", version)
+	return n, nil
 }
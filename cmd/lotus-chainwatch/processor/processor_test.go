@@ -0,0 +1,290 @@
+package processor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestEnabledProcessors(t *testing.T) {
+	p := &Processor{}
+	require.Len(t, processorNames(p.processors()), len(p.builtinProcessors()))
+
+	p.Processors = []string{"common_actors", "miner"}
+	p.RegisterProcessor("accounts", nil, &recordingHandler{})
+	// custom processors run whichever built in ones are enabled.
+	require.Equal(t, []string{"miner", "common_actors", "accounts"}, processorNames(p.processors()))
+
+	// common is the common_actors processor.
+	p.Processors = []string{"common", "miner"}
+	require.NoError(t, p.checkProcessors())
+	require.Equal(t, []string{"miner", "common_actors", "accounts"}, processorNames(p.processors()))
+
+	p.Processors = []string{"commons"}
+	require.Error(t, p.checkProcessors())
+}
+
+func TestSQLiteProcessors(t *testing.T) {
+	p := &Processor{Backend: BackendSQLite}
+	require.Equal(t, []string{"common_actors"}, processorNames(p.processors()))
+
+	p.Processors = []string{"common_actors", "miner"}
+	require.Error(t, p.checkProcessors())
+	p.Processors = []string{"common_actors"}
+	require.NoError(t, p.checkProcessors())
+}
+
+func TestSetupSchemasEnabledProcessors(t *testing.T) {
+	db := testDB(t)
+
+	// the schemas are created from scratch, away from the tables the other tests left behind.
+	_, err := db.Exec(`
+drop schema if exists processors_test cascade;
+create schema processors_test;
+set search_path = processors_test;
+create table blocks_synced (cid text not null primary key, processed_at bigint);
+`)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.Exec(`drop schema processors_test cascade; set search_path to default`)
+	})
+
+	p := &Processor{db: db, Processors: []string{"common_actors"}}
+	require.NoError(t, p.setupSchemas())
+	require.Equal(t, []string{"common_actors"}, processorNames(p.processors()))
+
+	exists := func(table string) bool {
+		var reg *string
+		require.NoError(t, db.QueryRow(`select to_regclass($1)::text`, "processors_test."+table).Scan(&reg))
+		return reg != nil
+	}
+	require.True(t, exists("actors"))
+	require.True(t, exists("id_address_map"))
+	for _, table := range []string{"miner_info", "miner_sectors", "miner_sectors_view", "market_deal_proposals", "messages"} {
+		require.False(t, exists(table), table)
+	}
+}
+
+func TestUnprocessedBlocksHeadLag(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+
+	rec := &RecordedChain{}
+	p := &Processor{db: db, HeadLag: 2}
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	// sync grows the chain by n tipsets the way the syncer stores them.
+	sync := func(n int) {
+		for i := 0; i < n; i++ {
+			ts = mock.TipSet(mock.MkBlock(ts, 1, 1))
+			rec.TipSets = append(rec.TipSets, ts)
+			_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+				ts.Cids()[0].String(), ts.ParentState().String(), ts.Height())
+			require.NoError(t, err)
+			_, err = db.Exec(`insert into blocks_synced (cid) values ($1)`, ts.Cids()[0].String())
+			require.NoError(t, err)
+		}
+		p.Source = newRecordedSource(rec)
+	}
+
+	processed := map[cid.Cid]int{}
+	process := func() []int {
+		blocks, err := p.unprocessedBlocks(ctx, 100, 0, p.HeadLag)
+		require.NoError(t, err)
+		var heights []int
+		for c, bh := range blocks {
+			processed[c]++
+			heights = append(heights, int(bh.Height))
+		}
+		require.NoError(t, p.markBlocksProcessed(ctx, blocks))
+		return heights
+	}
+
+	// the two heights below the head are held back.
+	sync(5)
+	require.ElementsMatch(t, []int{1, 2, 3}, process())
+	require.Empty(t, process())
+
+	// they are processed once the chain has grown past them.
+	sync(2)
+	require.ElementsMatch(t, []int{4, 5}, process())
+	require.Empty(t, process())
+
+	for _, ts := range rec.TipSets {
+		if ts.Height() <= 5 {
+			require.Equal(t, 1, processed[ts.Cids()[0]], ts.Height())
+		} else {
+			require.Zero(t, processed[ts.Cids()[0]], ts.Height())
+		}
+	}
+
+	// without a lag every block is processed.
+	p.HeadLag = 0
+	require.ElementsMatch(t, []int{6, 7}, process())
+}
+
+func TestUnprocessedBlocksReverted(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+
+	rec := &RecordedChain{}
+	store := func(ts *types.TipSet, revertedAt interface{}) {
+		rec.TipSets = append(rec.TipSets, ts)
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			ts.Cids()[0].String(), ts.ParentState().String(), ts.Height())
+		require.NoError(t, err)
+		_, err = db.Exec(`insert into blocks_synced (cid, reverted_at) values ($1, $2)`, ts.Cids()[0].String(), revertedAt)
+		require.NoError(t, err)
+	}
+
+	// the canonical chain reaches height 5, a fork off height 3 reaching height 7 was reverted while catching up.
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	var fork *types.TipSet
+	for i := 0; i < 5; i++ {
+		ts = mock.TipSet(mock.MkBlock(ts, 1, 1))
+		store(ts, nil)
+		if ts.Height() == 3 {
+			fork = ts
+		}
+	}
+	reverted := map[cid.Cid]bool{}
+	for i := 0; i < 4; i++ {
+		fork = mock.TipSet(mock.MkBlock(fork, 1, 2))
+		store(fork, 1)
+		reverted[fork.Cids()[0]] = true
+	}
+
+	p := &Processor{db: db, Source: newRecordedSource(rec)}
+	blocks, err := p.unprocessedBlocks(ctx, 100, 0, 1)
+	require.NoError(t, err)
+
+	// the reverted blocks are left out, and the lag is counted from the canonical head.
+	var heights []int
+	for c, bh := range blocks {
+		heights = append(heights, int(bh.Height))
+		require.False(t, reverted[c], bh.Height)
+	}
+	require.ElementsMatch(t, []int{1, 2, 3, 4}, heights)
+}
+
+func TestNextBatchBacklog(t *testing.T) {
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+
+	// a backlog of three batches of two tipsets.
+	rec := &RecordedChain{}
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	for i := 0; i < 6; i++ {
+		ts = mock.TipSet(mock.MkBlock(ts, 1, 1))
+		rec.TipSets = append(rec.TipSets, ts)
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			ts.Cids()[0].String(), ts.ParentState().String(), ts.Height())
+		require.NoError(t, err)
+		_, err = db.Exec(`insert into blocks_synced (cid) values ($1)`, ts.Cids()[0].String())
+		require.NoError(t, err)
+	}
+	p := &Processor{db: db, batch: 2, PollInterval: time.Hour, Source: newRecordedSource(rec)}
+
+	// every batch of the backlog is returned without waiting the poll interval, which would time the context out.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		blocks, err := p.nextBatch(ctx)
+		require.NoError(t, err)
+		require.Len(t, blocks, 2)
+		require.NoError(t, p.markBlocksProcessed(ctx, blocks))
+	}
+
+	// once caught up it waits.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = p.nextBatch(ctx)
+	require.True(t, xerrors.Is(err, context.DeadlineExceeded), "%v", err)
+}
+
+func TestMarkBlocksProcessedWriterVersion(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+
+	blk := mock.MkBlock(nil, 1, 1)
+	_, err = db.Exec(`insert into blocks_synced (cid) values ($1)`, blk.Cid().String())
+	require.NoError(t, err)
+
+	p := &Processor{db: db}
+	require.NoError(t, p.markBlocksProcessed(ctx, map[cid.Cid]*types.BlockHeader{blk.Cid(): blk}))
+
+	var version int
+	require.NoError(t, db.QueryRow(`select writer_version from blocks_synced where cid = $1 and processed_at is not null`, blk.Cid().String()).Scan(&version))
+	require.Equal(t, WriterVersion, version)
+}
+
+func TestRedecode(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+alter table blocks_synced add column if not exists reverted_at int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+	p := &Processor{db: db}
+
+	insert := func(name string, processedAt, version interface{}) {
+		_, err := db.Exec(`insert into blocks_synced (cid, processed_at, writer_version) values ($1, $2, $3)`, testCid(t, name).String(), processedAt, version)
+		require.NoError(t, err)
+	}
+	insert("unversioned", 1, nil)
+	insert("older", 1, 2)
+	insert("current", 1, 3)
+	_, err = db.Exec(`insert into processor_checkpoint (processor, epoch, tipset_key, updated_at) values ($1, 10, '{}', 0)`, commonActorsCheckpoint)
+	require.NoError(t, err)
+
+	// only the blocks written below the version are flagged, and the checkpoint no longer skips them.
+	n, err := p.Redecode(ctx, 3)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, n)
+	require.Equal(t, 2, countRows(t, db, `select count(*) from blocks_synced where processed_at is null`))
+	require.Equal(t, 1, countRows(t, db, `select count(*) from blocks_synced where cid = $1 and processed_at is not null`, testCid(t, "current").String()))
+	require.Zero(t, countRows(t, db, `select count(*) from processor_checkpoint`))
+
+	stale, err := p.StaleBlocks(ctx, 3)
+	require.NoError(t, err)
+	require.Empty(t, stale)
+}
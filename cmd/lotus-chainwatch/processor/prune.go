@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultPruneInterval is the default wait between two prunes of actor_states when a retention is set.
+const DefaultPruneInterval = time.Hour
+
+// PruneActorStates deletes the actor states no actors row of the last keepEpochs epochs references. Actors rows whose
+// height is not known yet, stored since state_heights was last refreshed, are retained too. In latest mode every actors
+// row is the current head of its actor, so only states no row references at all are deleted.
+func (p *Processor) PruneActorStates(ctx context.Context, keepEpochs int) error {
+	if keepEpochs < 0 {
+		return xerrors.Errorf("negative retention %d", keepEpochs)
+	}
+
+	start := time.Now()
+
+	var current int64
+	if err := p.db.QueryRowContext(ctx, `select coalesce(max(height), 0) from state_heights`).Scan(&current); err != nil {
+		return xerrors.Errorf("query current epoch: %w", err)
+	}
+	cutoff := current - int64(keepEpochs)
+
+	query := `
+delete from actor_states s
+where not exists (
+	select 1 from actors a
+		left join state_heights sh on sh.parentstateroot = a.stateroot
+	where a.head = s.head and (sh.height is null or sh.height >= $1)
+)`
+	args := []interface{}{cutoff}
+	if p.Mode == ModeLatest {
+		query = `delete from actor_states s where not exists (select 1 from actors a where a.head = s.head)`
+		args = nil
+	}
+
+	var pruned int64
+	if err := withRetry(ctx, func() error {
+		res, err := p.db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		pruned, err = res.RowsAffected()
+		return err
+	}); err != nil {
+		return xerrors.Errorf("prune actor_states: %w", err)
+	}
+
+	// the cache would skip storing a pruned state seen again.
+	p.stateCache.purge()
+
+	p.logger().Infow("Pruned actor states", "pruned", pruned, "cutoff", cutoff, "duration", time.Since(start).String())
+	return nil
+}
+
+// pruneLoop prunes actor_states every interval until ctx is done.
+func (p *Processor) pruneLoop(ctx context.Context, keepEpochs int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.PruneActorStates(ctx, keepEpochs); err != nil {
+				p.logger().Errorw("Failed to prune actor states", "error", err)
+			}
+		}
+	}
+}
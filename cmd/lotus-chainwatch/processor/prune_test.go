@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestPruneActorStates(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	addr := mock.Address(1000)
+	seedAddresses(t, db, []address.Address{addr})
+
+	// the state at height h is stateroot-h, up to height 10.
+	for h := 1; h <= 10; h++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("block-%d", h)).String(), testCid(t, fmt.Sprintf("stateroot-%d", h)).String(), h)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	head := func(name string) string {
+		return testCid(t, "head-"+name).String()
+	}
+	storeHead := func(name, stateroot string) {
+		_, err := db.Exec(`insert into actors (id, code, head, nonce, balance, stateroot) values ($1, $2, $3, 0, '0', $4)`,
+			addr.String(), builtin.AccountActorCodeID.String(), head(name), testCid(t, stateroot).String())
+		require.NoError(t, err)
+	}
+
+	storeHead("recent", "stateroot-8")
+	storeHead("old", "stateroot-2")
+	storeHead("old-and-recent", "stateroot-2")
+	storeHead("old-and-recent", "stateroot-9")
+	// stored after state_heights was last refreshed, its height is not known yet.
+	storeHead("unrefreshed", "stateroot-11")
+
+	for _, name := range []string{"recent", "old", "old-and-recent", "unrefreshed", "unreferenced"} {
+		_, err := db.Exec(`insert into actor_states (head, code, state) values ($1, $2, '{}')`, head(name), builtin.AccountActorCodeID.String())
+		require.NoError(t, err)
+	}
+
+	require.Error(t, p.PruneActorStates(ctx, -1))
+	require.NoError(t, p.PruneActorStates(ctx, 5))
+
+	rows, err := db.Query(`select head from actor_states`)
+	require.NoError(t, err)
+	defer rows.Close() //nolint:errcheck
+
+	kept := map[string]bool{}
+	for rows.Next() {
+		var h string
+		require.NoError(t, rows.Scan(&h))
+		kept[h] = true
+	}
+	require.NoError(t, rows.Err())
+	require.Equal(t, map[string]bool{
+		head("recent"):         true,
+		head("old-and-recent"): true,
+		head("unrefreshed"):    true,
+	}, kept)
+}
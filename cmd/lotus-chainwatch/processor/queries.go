@@ -0,0 +1,528 @@
+package processor
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DecodedStateAt is the state of an actor at a height it changed.
+type DecodedStateAt struct {
+	Height    abi.ChainEpoch
+	StateRoot cid.Cid
+
+	Code    cid.Cid
+	Head    cid.Cid
+	Nonce   uint64
+	Balance big.Int
+
+	// State is the decoded state of the actor, decoded by the decoder registered for Code if any and as stored in
+	// actor_states otherwise. It is nil if the state was not stored and no decoder is registered for Code.
+	State json.RawMessage
+}
+
+// ErrActorNotFound is returned when the database holds no state of an actor.
+var ErrActorNotFound = xerrors.New("actor not found")
+
+// lookupID returns the ID address of addr by consulting id_address_map, ID addresses are returned unchanged.
+func (p *Processor) lookupID(ctx context.Context, addr address.Address) (address.Address, error) {
+	if addr.Protocol() == address.ID {
+		return addr, nil
+	}
+
+	var id string
+	if err := p.db.QueryRowContext(ctx, `select id from id_address_map where address = $1`, addr.String()).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return address.Undef, xerrors.Errorf("no ID address known for %s: %w", addr, ErrActorNotFound)
+		}
+		return address.Undef, xerrors.Errorf("lookup ID address for %s: %w", addr, err)
+	}
+	return address.NewFromString(id)
+}
+
+// IDForRobust returns the ID address the robust address addr is mapped to in id_address_map, ID addresses are returned
+// unchanged. It returns ErrActorNotFound if addr was not assigned an ID by any processed state.
+func (p *Processor) IDForRobust(ctx context.Context, addr address.Address) (address.Address, error) {
+	return p.lookupID(ctx, addr)
+}
+
+// RobustForID returns the robust addresses the ID address id is mapped to in id_address_map, the inverse of
+// IDForRobust. It returns ErrActorNotFound if id is not mapped, and no addresses for a singleton actor, which is only
+// mapped to its ID.
+//
+// The mapping is 1:1: id_address_map has a unique index on both of its columns, and when a reorg has the init actor
+// assign an ID to another robust address than the abandoned fork did, storeAddressMap moves the row to the canonical
+// address rather than adding one. The robust address of the fork then no longer resolves, so at most one address is
+// returned. A slice is returned so callers do not depend on this should the map ever record the addresses of forks.
+func (p *Processor) RobustForID(ctx context.Context, id address.Address) ([]address.Address, error) {
+	if id.Protocol() != address.ID {
+		return nil, xerrors.Errorf("%s is not an ID address", id)
+	}
+
+	rows, err := p.db.QueryContext(ctx, `select address from id_address_map where id = $1 order by address`, id.String())
+	if err != nil {
+		return nil, xerrors.Errorf("lookup robust addresses for %s: %w", id, err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var (
+		out   []address.Address
+		found bool
+	)
+	for rows.Next() {
+		found = true
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, xerrors.Errorf("scan robust address for %s: %w", id, err)
+		}
+		a, err := address.NewFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		if a.Protocol() == address.ID {
+			continue
+		}
+		out = append(out, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, xerrors.Errorf("no robust address known for %s: %w", id, ErrActorNotFound)
+	}
+	return out, nil
+}
+
+// ActorAtEpoch is the state of an actor as of an epoch.
+type ActorAtEpoch struct {
+	ID address.Address
+	// Height is the height the state was stored at, the latest one at or before the epoch.
+	Height abi.ChainEpoch
+
+	Code    cid.Cid
+	Head    cid.Cid
+	Nonce   uint64
+	Balance big.Int
+}
+
+// ActorAt returns the state of the actor as of epoch, the latest state stored for it at or before epoch the way
+// actor_tips picks the state of every actor. It returns ErrActorNotFound if there is none.
+func (p *Processor) ActorAt(ctx context.Context, addr address.Address, epoch abi.ChainEpoch) (*ActorAtEpoch, error) {
+	id, err := p.lookupID(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		height                 int64
+		code, head, balanceStr string
+		nonce                  uint64
+	)
+	if err := p.db.QueryRowContext(ctx, `
+select sh.height, a.code, a.head, a.nonce, a.balance
+from actors a
+    inner join state_heights sh on sh.parentstateroot = a.stateroot
+where a.id = $1 and sh.height <= $2
+order by sh.height desc
+limit 1
+`, id.String(), epoch).Scan(&height, &code, &head, &nonce, &balanceStr); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, xerrors.Errorf("%s at %d: %w", addr, epoch, ErrActorNotFound)
+		}
+		return nil, xerrors.Errorf("query actor %s at %d: %w", addr, epoch, err)
+	}
+
+	out := &ActorAtEpoch{ID: id, Height: abi.ChainEpoch(height), Nonce: nonce}
+	if out.Code, err = cid.Parse(code); err != nil {
+		return nil, err
+	}
+	if out.Head, err = cid.Parse(head); err != nil {
+		return nil, err
+	}
+	if out.Balance, err = types.BigFromString(balanceStr); err != nil {
+		return nil, xerrors.Errorf("parse balance of %s at %d: %w", id, height, err)
+	}
+	return out, nil
+}
+
+// ActorTimeline returns the state of the actor at every height in [from, to] where it changed, in chronological
+// order. Every entry carries the code the actor had at that height and its state decoded with the decoder registered
+// for that code, or as stored when none is, so an actor whose code changes mid-range is decoded by the decoder of each
+// of its codes.
+func (p *Processor) ActorTimeline(ctx context.Context, addr address.Address, from, to abi.ChainEpoch) ([]DecodedStateAt, error) {
+	id, err := p.lookupID(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+select sh.height, a.stateroot, a.code, a.head, a.nonce, a.balance, s.state
+from actors a
+    inner join state_heights sh on sh.parentstateroot = a.stateroot
+    left join actor_states s on s.head = a.head and s.code = a.code
+where a.id = $1 and sh.height >= $2 and sh.height <= $3
+order by sh.height
+`, id.String(), from, to)
+	if err != nil {
+		return nil, xerrors.Errorf("query actor timeline: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []DecodedStateAt
+	for rows.Next() {
+		var (
+			height                             int64
+			stateroot, code, head, balanceText string
+			nonce                              uint64
+			state                              sql.NullString
+		)
+		if err := rows.Scan(&height, &stateroot, &code, &head, &nonce, &balanceText, &state); err != nil {
+			return nil, xerrors.Errorf("scan actor timeline: %w", err)
+		}
+
+		ds := DecodedStateAt{
+			Height: abi.ChainEpoch(height),
+			Nonce:  nonce,
+		}
+		if ds.StateRoot, err = cid.Parse(stateroot); err != nil {
+			return nil, err
+		}
+		if ds.Code, err = cid.Parse(code); err != nil {
+			return nil, err
+		}
+		if ds.Head, err = cid.Parse(head); err != nil {
+			return nil, err
+		}
+		if ds.Balance, err = types.BigFromString(balanceText); err != nil {
+			return nil, xerrors.Errorf("parse balance of %s at %d: %w", id, height, err)
+		}
+		if state.Valid {
+			ds.State = json.RawMessage(state.String)
+		}
+		out = append(out, ds)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, ds := range out {
+		k := actorStateKey{head: ds.Head, code: ds.Code}
+		state, ok := p.decodeCache.get(k)
+		if !ok {
+			if state, ok, err = p.registeredState(ctx, ds.Code, ds.Head); err != nil {
+				return nil, xerrors.Errorf("decode state of %s at %d: %w", id, ds.Height, err)
+			}
+			if !ok {
+				continue
+			}
+			p.decodeCache.add(k, state)
+		}
+		out[i].State = json.RawMessage(state)
+	}
+	return out, nil
+}
+
+// BalancePoint is the balance of an actor as of an epoch.
+type BalancePoint struct {
+	Epoch   abi.ChainEpoch
+	Balance big.Int
+}
+
+// BalanceHistory returns the balance of the actor as of every height in [from, to] with a state, in chronological
+// order. The balance at a height is the one of the latest state stored for the actor at or before it, the heights
+// before the first state stored for it are omitted.
+func (p *Processor) BalanceHistory(ctx context.Context, addr address.Address, from, to abi.ChainEpoch) ([]BalancePoint, error) {
+	id, err := p.lookupID(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+select h.height, b.balance
+from (select distinct height from state_heights where height >= $2 and height <= $3) h
+    cross join lateral (
+        select a.balance
+        from actors a
+            inner join state_heights sh on sh.parentstateroot = a.stateroot
+        where a.id = $1 and sh.height <= h.height
+        order by sh.height desc
+        limit 1
+    ) b
+order by h.height
+`, id.String(), from, to)
+	if err != nil {
+		return nil, xerrors.Errorf("query balance history: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []BalancePoint
+	for rows.Next() {
+		var height int64
+		var balanceText string
+		if err := rows.Scan(&height, &balanceText); err != nil {
+			return nil, xerrors.Errorf("scan balance history: %w", err)
+		}
+		bp := BalancePoint{Epoch: abi.ChainEpoch(height)}
+		if bp.Balance, err = types.BigFromString(balanceText); err != nil {
+			return nil, xerrors.Errorf("parse balance of %s at %d: %w", id, height, err)
+		}
+		out = append(out, bp)
+	}
+	return out, rows.Err()
+}
+
+// StaleBlocks returns the processed blocks whose data was written by a processor older than version, including
+// blocks processed before writer versions were recorded. These are the candidates for targeted reprocessing after a
+// decoder fix, Redecode flags them for it.
+func (p *Processor) StaleBlocks(ctx context.Context, version int) ([]cid.Cid, error) {
+	rows, err := p.db.QueryContext(ctx, `
+select cid from blocks_synced
+where processed_at is not null and (writer_version is null or writer_version < $1)
+`, version)
+	if err != nil {
+		return nil, xerrors.Errorf("query stale blocks: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []cid.Cid
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return nil, xerrors.Errorf("scan stale blocks: %w", err)
+		}
+		ci, err := cid.Parse(c)
+		if err != nil {
+			return nil, xerrors.Errorf("parse stale block cid: %w", err)
+		}
+		out = append(out, ci)
+	}
+	return out, rows.Err()
+}
+
+// ActorTip is the latest recorded state of an actor as of a tipset.
+type ActorTip struct {
+	Address   address.Address
+	Code      cid.Cid
+	Head      cid.Cid
+	Nonce     uint64
+	Balance   big.Int
+	StateRoot cid.Cid
+	Height    abi.ChainEpoch
+
+	// Changed is true when the actor's state changed in the tipset, false when the row was carried forward from an
+	// earlier height because only changed actors are stored.
+	Changed bool
+}
+
+// TipSetActors returns every actor known as of the tipset tsk, identified by its parent state root. Only changed actors
+// are stored, so each actor is represented by its most recent row at or below the tipset's height and Changed marks
+// the ones that changed in the tipset itself.
+func (p *Processor) TipSetActors(ctx context.Context, tsk types.TipSetKey) ([]ActorTip, error) {
+	if tsk.IsEmpty() {
+		return nil, xerrors.Errorf("empty tipset key")
+	}
+
+	var (
+		parentStateRoot string
+		height          int64
+	)
+	if err := p.db.QueryRowContext(ctx, `select parentstateroot, height from blocks where cid = $1`,
+		tsk.Cids()[0].String()).Scan(&parentStateRoot, &height); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, xerrors.Errorf("tipset %s not found", tsk)
+		}
+		return nil, xerrors.Errorf("lookup tipset %s: %w", tsk, err)
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+select distinct on (a.id) a.id, a.code, a.head, a.nonce, a.balance, a.stateroot, sh.height
+from actors a
+    inner join state_heights sh on sh.parentstateroot = a.stateroot
+where sh.height <= $1
+order by a.id, sh.height desc
+`, height)
+	if err != nil {
+		return nil, xerrors.Errorf("query tipset actors: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []ActorTip
+	for rows.Next() {
+		var (
+			id, code, head, balanceText, stateroot string
+			nonce                                  uint64
+			h                                      int64
+		)
+		if err := rows.Scan(&id, &code, &head, &nonce, &balanceText, &stateroot, &h); err != nil {
+			return nil, xerrors.Errorf("scan tipset actors: %w", err)
+		}
+
+		at := ActorTip{
+			Nonce:   nonce,
+			Height:  abi.ChainEpoch(h),
+			Changed: stateroot == parentStateRoot,
+		}
+		if at.Address, err = address.NewFromString(id); err != nil {
+			return nil, err
+		}
+		if at.Code, err = cid.Parse(code); err != nil {
+			return nil, err
+		}
+		if at.Head, err = cid.Parse(head); err != nil {
+			return nil, err
+		}
+		if at.StateRoot, err = cid.Parse(stateroot); err != nil {
+			return nil, err
+		}
+		if at.Balance, err = types.BigFromString(balanceText); err != nil {
+			return nil, xerrors.Errorf("parse balance of %s: %w", id, err)
+		}
+		out = append(out, at)
+	}
+	return out, rows.Err()
+}
+
+// DealStatus is the state of a deal as of the latest processed height.
+type DealStatus string
+
+const (
+	// DealPending deals have been published but their sector has not been proven yet.
+	DealPending DealStatus = "pending"
+	// DealActive deals are in a proven sector and have not reached their end epoch.
+	DealActive DealStatus = "active"
+	// DealExpired deals have passed their end epoch.
+	DealExpired DealStatus = "expired"
+	// DealSlashed deals were terminated early, usually because their sector was.
+	DealSlashed DealStatus = "slashed"
+)
+
+// DealSummary describes a deal stored in a sector.
+type DealSummary struct {
+	DealID          abi.DealID
+	PieceCID        cid.Cid
+	PaddedPieceSize abi.PaddedPieceSize
+	Client          address.Address
+	Provider        address.Address
+	StartEpoch      abi.ChainEpoch
+	EndEpoch        abi.ChainEpoch
+
+	// SectorStartEpoch and SlashEpoch are -1 until the market actor records them.
+	SectorStartEpoch abi.ChainEpoch
+	SlashEpoch       abi.ChainEpoch
+
+	Status DealStatus
+}
+
+// dealStatus derives the status of a deal at height from its latest market state.
+func dealStatus(sectorStart, slash, end, height abi.ChainEpoch) DealStatus {
+	switch {
+	case slash > -1:
+		return DealSlashed
+	case end <= height:
+		return DealExpired
+	case sectorStart > -1:
+		return DealActive
+	default:
+		return DealPending
+	}
+}
+
+// SectorDeals returns the deals a sector was committed with along with their latest known status, the inverse of the
+// deals to sector association recorded at commit time.
+func (p *Processor) SectorDeals(ctx context.Context, minerID address.Address, sectorID abi.SectorNumber) ([]DealSummary, error) {
+	var height int64
+	if err := p.db.QueryRowContext(ctx, `select coalesce(max(height), 0) from state_heights`).Scan(&height); err != nil {
+		return nil, xerrors.Errorf("query processed height: %w", err)
+	}
+
+	rows, err := p.db.QueryContext(ctx, `
+select sd.deal_id, mdp.piece_cid, mdp.padded_piece_size, mdp.client_id, mdp.provider_id, mdp.start_epoch, mdp.end_epoch,
+       coalesce(ds.sector_start_epoch, -1), coalesce(ds.slash_epoch, -1)
+from sector_deals sd
+    inner join market_deal_proposals mdp on mdp.deal_id = sd.deal_id
+    left join lateral (
+        select mds.sector_start_epoch, mds.slash_epoch
+        from market_deal_states mds
+        where mds.deal_id = sd.deal_id
+        order by mds.last_update_epoch desc
+        limit 1
+    ) ds on true
+where sd.miner_id = $1 and sd.sector_id = $2
+order by sd.deal_id
+`, minerID.String(), uint64(sectorID))
+	if err != nil {
+		return nil, xerrors.Errorf("query sector deals: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var out []DealSummary
+	for rows.Next() {
+		var (
+			dealID, paddedSize                    uint64
+			pieceCid, client, provider            string
+			startEpoch, endEpoch, sectorStart, sl int64
+		)
+		if err := rows.Scan(&dealID, &pieceCid, &paddedSize, &client, &provider, &startEpoch, &endEpoch, &sectorStart, &sl); err != nil {
+			return nil, xerrors.Errorf("scan sector deals: %w", err)
+		}
+
+		ds := DealSummary{
+			DealID:           abi.DealID(dealID),
+			PaddedPieceSize:  abi.PaddedPieceSize(paddedSize),
+			StartEpoch:       abi.ChainEpoch(startEpoch),
+			EndEpoch:         abi.ChainEpoch(endEpoch),
+			SectorStartEpoch: abi.ChainEpoch(sectorStart),
+			SlashEpoch:       abi.ChainEpoch(sl),
+		}
+		if ds.PieceCID, err = cid.Parse(pieceCid); err != nil {
+			return nil, err
+		}
+		if ds.Client, err = address.NewFromString(client); err != nil {
+			return nil, err
+		}
+		if ds.Provider, err = address.NewFromString(provider); err != nil {
+			return nil, err
+		}
+		ds.Status = dealStatus(ds.SectorStartEpoch, ds.SlashEpoch, ds.EndEpoch, abi.ChainEpoch(height))
+		out = append(out, ds)
+	}
+	return out, rows.Err()
+}
+
+// StateHash returns the sha256 of the canonical JSON encoding of the actor's latest recorded state at or before epoch.
+// The hash is stable however the state was serialized when stored, so it can be used to detect changes.
+func (p *Processor) StateHash(ctx context.Context, addr address.Address, epoch abi.ChainEpoch) ([sha256.Size]byte, error) {
+	id, err := p.lookupID(ctx, addr)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+
+	var state string
+	if err := p.db.QueryRowContext(ctx, `
+select s.state
+from actors a
+    inner join state_heights sh on sh.parentstateroot = a.stateroot
+    inner join actor_states s on s.head = a.head and s.code = a.code
+where a.id = $1 and sh.height <= $2
+order by sh.height desc
+limit 1
+`, id.String(), epoch).Scan(&state); err != nil {
+		if err == sql.ErrNoRows {
+			return [sha256.Size]byte{}, xerrors.Errorf("no state recorded for %s at or before %d", addr, epoch)
+		}
+		return [sha256.Size]byte{}, xerrors.Errorf("query state of %s at %d: %w", addr, epoch, err)
+	}
+
+	return hashState([]byte(state))
+}
@@ -0,0 +1,431 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// setupTestBlocks creates the subset of the syncer's blocks schema the queries depend on.
+func setupTestBlocks(tb testing.TB, db *sql.DB) {
+	_, err := db.Exec(`
+create table if not exists blocks
+(
+	cid text not null primary key,
+	parentstateroot text not null,
+	height bigint not null
+);
+
+create materialized view if not exists state_heights
+    as select distinct height, parentstateroot from blocks;
+
+truncate blocks;
+`)
+	require.NoError(tb, err)
+}
+
+func TestTipSetActors(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the second actor only changes in the first tipset, so later tipsets have no row for it.
+	actors, addrs := syntheticActorTips(t, 3, 2)
+	tips := actors[builtin.AccountActorCodeID]
+	for tsk, infos := range tips {
+		var kept []actorInfo
+		for _, info := range infos {
+			if info.addr == addrs[1] && info.stateroot != testCid(t, "stateroot-0") {
+				continue
+			}
+			kept = append(kept, info)
+		}
+		tips[tsk] = kept
+	}
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+
+	var last types.TipSetKey
+	for i := 0; i < 3; i++ {
+		blk := testCid(t, fmt.Sprintf("child-%d", i))
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			blk.String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+		last = types.NewTipSetKey(blk)
+	}
+	_, err := db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	got, err := p.TipSetActors(ctx, last)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	byAddr := map[string]ActorTip{}
+	for _, at := range got {
+		byAddr[at.Address.String()] = at
+	}
+
+	changed := byAddr[addrs[0].String()]
+	require.True(t, changed.Changed)
+	require.Equal(t, abi.ChainEpoch(3), changed.Height)
+	require.Equal(t, testCid(t, "stateroot-2"), changed.StateRoot)
+	require.Equal(t, uint64(2), changed.Nonce)
+
+	carried := byAddr[addrs[1].String()]
+	require.False(t, carried.Changed)
+	require.Equal(t, abi.ChainEpoch(1), carried.Height)
+	require.Equal(t, testCid(t, "stateroot-0"), carried.StateRoot)
+
+	_, err = p.TipSetActors(ctx, types.NewTipSetKey(testCid(t, "unknown")))
+	require.Error(t, err)
+}
+
+func TestDealStatus(t *testing.T) {
+	require.Equal(t, DealPending, dealStatus(-1, -1, 100, 10))
+	require.Equal(t, DealActive, dealStatus(5, -1, 100, 10))
+	require.Equal(t, DealExpired, dealStatus(5, -1, 100, 100))
+	require.Equal(t, DealSlashed, dealStatus(5, 8, 100, 10))
+}
+
+func TestSectorDeals(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupMarket())
+	require.NoError(t, p.setupMiners())
+	_, err := db.Exec(`truncate market_deal_proposals, market_deal_states, sector_deals`)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, 50)`,
+		testCid(t, "block").String(), testCid(t, "stateroot").String())
+	require.NoError(t, err)
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	miner := mock.Address(1000)
+	client := mock.Address(2000)
+	for _, d := range []struct {
+		id          uint64
+		end         int64
+		sectorStart int64
+		slash       int64
+	}{
+		{id: 1, end: 100, sectorStart: 10, slash: -1},
+		{id: 2, end: 200, sectorStart: 10, slash: 40},
+	} {
+		_, err := db.Exec(`
+insert into market_deal_proposals (deal_id, state_root, piece_cid, padded_piece_size, unpadded_piece_size, is_verified,
+    client_id, provider_id, start_epoch, end_epoch, storage_price_per_epoch, provider_collateral, client_collateral)
+values ($1, $2, $3, 2048, 2032, false, $4, $5, 10, $6, '0', '0', '0')`,
+			d.id, testCid(t, "stateroot").String(), testCid(t, fmt.Sprintf("piece-%d", d.id)).String(),
+			client.String(), miner.String(), d.end)
+		require.NoError(t, err)
+
+		_, err = db.Exec(`
+insert into market_deal_states (deal_id, sector_start_epoch, last_update_epoch, slash_epoch, state_root)
+values ($1, $2, $3, $4, $5)`, d.id, d.sectorStart, 40, d.slash, testCid(t, "stateroot").String())
+		require.NoError(t, err)
+
+		_, err = db.Exec(`insert into sector_deals (miner_id, sector_id, deal_id, commit_epoch) values ($1, 7, $2, 10)`,
+			miner.String(), d.id)
+		require.NoError(t, err)
+	}
+
+	// a deal in another sector is not returned.
+	_, err = db.Exec(`insert into sector_deals (miner_id, sector_id, deal_id, commit_epoch) values ($1, 8, 3, 10)`, miner.String())
+	require.NoError(t, err)
+
+	deals, err := p.SectorDeals(ctx, miner, 7)
+	require.NoError(t, err)
+	require.Len(t, deals, 2)
+
+	require.Equal(t, abi.DealID(1), deals[0].DealID)
+	require.Equal(t, testCid(t, "piece-1"), deals[0].PieceCID)
+	require.Equal(t, client, deals[0].Client)
+	require.Equal(t, miner, deals[0].Provider)
+	require.Equal(t, DealActive, deals[0].Status)
+
+	require.Equal(t, abi.DealID(2), deals[1].DealID)
+	require.Equal(t, abi.ChainEpoch(40), deals[1].SlashEpoch)
+	require.Equal(t, DealSlashed, deals[1].Status)
+}
+
+func TestActorTipsRange(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	var defs int
+	require.NoError(t, db.QueryRow(`select count(*) from pg_proc where proname = 'actor_tips'`).Scan(&defs))
+	require.Equal(t, 2, defs)
+
+	// the state of tipset i is stored at height i+1 with nonce i.
+	actors, addrs := syntheticActorTips(t, 4, 2)
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	for i := 0; i < 4; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	tips := func(query string, args ...interface{}) map[string][2]int64 {
+		rows, err := db.Query(query, args...)
+		require.NoError(t, err)
+		defer rows.Close() //nolint:errcheck
+
+		out := map[string][2]int64{}
+		for rows.Next() {
+			var id string
+			var nonce, height int64
+			require.NoError(t, rows.Scan(&id, &nonce, &height))
+			out[id] = [2]int64{nonce, height}
+		}
+		require.NoError(t, rows.Err())
+		return out
+	}
+
+	want := func(nonce, height int64) map[string][2]int64 {
+		out := map[string][2]int64{}
+		for _, addr := range addrs {
+			out[addr.String()] = [2]int64{nonce, height}
+		}
+		return out
+	}
+
+	require.Equal(t, want(2, 3), tips(`select id, nonce, height from actor_tips($1, $2)`, 2, 4))
+	require.Equal(t, want(1, 2), tips(`select id, nonce, height from actor_tips($1, $2)`, 2, 3))
+	require.Empty(t, tips(`select id, nonce, height from actor_tips($1, $2)`, 5, 10))
+	// the single epoch version is bounded by genesis.
+	require.Equal(t, want(2, 3), tips(`select id, nonce, height from actor_tips($1)`, 4))
+}
+
+func TestBalanceHistory(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the state of tipset i is stored at height i+1 with a balance of i. The first actor does not change in tipset 1,
+	// the second one is only created in tipset 2.
+	actors, addrs := syntheticActorTips(t, 4, 2)
+	for tsk, infos := range actors[builtin.AccountActorCodeID] {
+		var keep []actorInfo
+		for _, info := range infos {
+			if (info.addr == addrs[0] && info.act.Nonce == 1) || (info.addr == addrs[1] && info.act.Nonce < 2) {
+				continue
+			}
+			keep = append(keep, info)
+		}
+		actors[builtin.AccountActorCodeID][tsk] = keep
+	}
+	seedAddresses(t, db, addrs[:1])
+	robust, err := address.NewActorAddress([]byte("robust"))
+	require.NoError(t, err)
+	require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{robust: addrs[1]}))
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	for i := 0; i < 4; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err = db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	points := func(history []BalancePoint) []string {
+		var out []string
+		for _, bp := range history {
+			out = append(out, fmt.Sprintf("%d:%s", bp.Epoch, bp.Balance))
+		}
+		return out
+	}
+
+	// the balance is carried over the height the first actor did not change at.
+	history, err := p.BalanceHistory(ctx, addrs[0], 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1:0", "2:0", "3:2", "4:3"}, points(history))
+
+	// the heights before the second actor was created are omitted, it is resolved from its robust address.
+	history, err = p.BalanceHistory(ctx, robust, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"3:2"}, points(history))
+
+	history, err = p.BalanceHistory(ctx, addrs[0], 5, 10)
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	unknown, err := address.NewActorAddress([]byte("unknown"))
+	require.NoError(t, err)
+	_, err = p.BalanceHistory(ctx, unknown, 0, 10)
+	require.True(t, xerrors.Is(err, ErrActorNotFound))
+}
+
+func TestActorTimeline(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the state of tipset i is stored at height i+1, the actor is a multisig from tipset 2 on.
+	accounts, addrs := syntheticActorTips(t, 4, 1)
+	actors := map[cid.Cid]ActorTips{builtin.AccountActorCodeID: {}, builtin.MultisigActorCodeID: {}}
+	for tsk, infos := range accounts[builtin.AccountActorCodeID] {
+		for _, info := range infos {
+			code := builtin.AccountActorCodeID
+			if info.act.Nonce >= 2 {
+				code = builtin.MultisigActorCodeID
+				info.state = fmt.Sprintf(`{"NumApprovalsThreshold":%d}`, info.act.Nonce)
+			}
+			info.act.Code = code
+			actors[code][tsk] = append(actors[code][tsk], info)
+		}
+	}
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.NoError(t, p.storeActorStates(ctx, actors))
+	for i := 0; i < 4; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	// the multisig states are decoded by the decoder registered for its code, the account states are read as stored.
+	p.RegisterStateDecoder(builtin.MultisigActorCodeID, func(ctx context.Context, head cid.Cid) (json.RawMessage, error) {
+		return json.RawMessage(`{"Head":"` + head.String() + `"}`), nil
+	})
+
+	// every entry carries the code the actor had at its height, and the state decoded by the decoder of that code.
+	timeline, err := p.ActorTimeline(ctx, addrs[0], 2, 4)
+	require.NoError(t, err)
+	require.Len(t, timeline, 3)
+	for i, ds := range timeline {
+		h := abi.ChainEpoch(i + 2)
+		require.Equal(t, h, ds.Height)
+		require.Equal(t, testCid(t, fmt.Sprintf("stateroot-%d", h-1)), ds.StateRoot)
+		require.EqualValues(t, h-1, ds.Nonce)
+		require.Equal(t, fmt.Sprint(h-1), ds.Balance.String())
+	}
+	require.Equal(t, builtin.AccountActorCodeID, timeline[0].Code)
+	require.JSONEq(t, `{"Address":"`+addrs[0].String()+`"}`, string(timeline[0].State))
+	for _, ds := range timeline[1:] {
+		require.Equal(t, builtin.MultisigActorCodeID, ds.Code)
+		require.JSONEq(t, `{"Head":"`+ds.Head.String()+`"}`, string(ds.State))
+	}
+
+	// a decoder failing fails the timeline.
+	p.RegisterStateDecoder(builtin.MultisigActorCodeID, func(ctx context.Context, head cid.Cid) (json.RawMessage, error) {
+		return nil, xerrors.New("decode failed")
+	})
+	_, err = p.ActorTimeline(ctx, addrs[0], 2, 4)
+	require.Error(t, err)
+
+	timeline, err = p.ActorTimeline(ctx, addrs[0], 5, 10)
+	require.NoError(t, err)
+	require.Empty(t, timeline)
+}
+
+func TestRobustForID(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		id, err := address.NewIDAddress(1000)
+		require.NoError(t, err)
+		forked, err := address.NewActorAddress([]byte("forked"))
+		require.NoError(t, err)
+		canonical, err := address.NewActorAddress([]byte("canonical"))
+		require.NoError(t, err)
+		require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{
+			forked:                id,
+			builtin.InitActorAddr: builtin.InitActorAddr,
+		}))
+
+		robust, err := p.RobustForID(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, []address.Address{forked}, robust)
+		got, err := p.IDForRobust(ctx, forked)
+		require.NoError(t, err)
+		require.Equal(t, id, got)
+
+		got, err = p.IDForRobust(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, id, got)
+
+		// the init actor is only mapped to itself.
+		robust, err = p.RobustForID(ctx, builtin.InitActorAddr)
+		require.NoError(t, err)
+		require.Empty(t, robust)
+
+		// after the reorg the ID resolves to the canonical address only, the fork's no longer resolves.
+		require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{
+			canonical:             id,
+			builtin.InitActorAddr: builtin.InitActorAddr,
+		}))
+		robust, err = p.RobustForID(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, []address.Address{canonical}, robust)
+		got, err = p.IDForRobust(ctx, canonical)
+		require.NoError(t, err)
+		require.Equal(t, id, got)
+		_, err = p.IDForRobust(ctx, forked)
+		require.True(t, xerrors.Is(err, ErrActorNotFound))
+
+		unknown, err := address.NewIDAddress(2000)
+		require.NoError(t, err)
+		_, err = p.RobustForID(ctx, unknown)
+		require.True(t, xerrors.Is(err, ErrActorNotFound))
+		_, err = p.RobustForID(ctx, canonical)
+		require.Error(t, err)
+	})
+}
+
+func TestStaleBlocks(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	_, err := db.Exec(`
+create table if not exists blocks_synced (cid text not null primary key, processed_at bigint);
+alter table blocks_synced add column if not exists writer_version int;
+truncate blocks_synced;
+`)
+	require.NoError(t, err)
+	p := &Processor{db: db}
+
+	insert := func(name string, processedAt, version interface{}) {
+		_, err := db.Exec(`insert into blocks_synced (cid, processed_at, writer_version) values ($1, $2, $3)`, testCid(t, name).String(), processedAt, version)
+		require.NoError(t, err)
+	}
+	insert("unprocessed", nil, nil)
+	insert("unversioned", 1, nil)
+	insert("older", 1, 2)
+	insert("current", 1, 3)
+	insert("newer", 1, 4)
+
+	// the blocks written before versions were recorded are stale, the unprocessed ones are left to the loop.
+	stale, err := p.StaleBlocks(ctx, 3)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cid.Cid{testCid(t, "unversioned"), testCid(t, "older")}, stale)
+
+	stale, err = p.StaleBlocks(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []cid.Cid{testCid(t, "unversioned")}, stale)
+}
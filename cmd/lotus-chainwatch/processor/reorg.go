@@ -0,0 +1,136 @@
+package processor
+
+import (
+	"context"
+	"sort"
+
+	"golang.org/x/xerrors"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func (p *Processor) setupReorgs() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/* every reorg observed by the processor, depth is the number of epochs between the old tipset and the common ancestor */
+create table if not exists reorgs
+(
+	old_tipset text not null,
+	new_tipset text not null,
+	common_ancestor_epoch bigint not null,
+	depth bigint not null,
+	detected_at timestamptz default now() not null,
+	constraint reorgs_pk
+		primary key (old_tipset, new_tipset)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// observeTipSets follows the parent tipsets of the blocks in toProcess, in height order, and records a reorg whenever
+// one does not descend from the tipset observed before it.
+func (p *Processor) observeTipSets(ctx context.Context, toProcess map[cid.Cid]*types.BlockHeader) error {
+	keys := map[types.TipSetKey]struct{}{}
+	for _, bh := range toProcess {
+		keys[types.NewTipSetKey(bh.Parents...)] = struct{}{}
+	}
+
+	tipsets := make([]*types.TipSet, 0, len(keys))
+	for tsk := range keys {
+		ts, err := p.Source.TipSet(ctx, tsk)
+		if err != nil {
+			return xerrors.Errorf("get tipset %s: %w", tsk, err)
+		}
+		tipsets = append(tipsets, ts)
+	}
+	sort.Slice(tipsets, func(i, j int) bool {
+		return tipsets[i].Height() < tipsets[j].Height()
+	})
+
+	for _, ts := range tipsets {
+		last := p.lastTs
+		if last == nil || ts.Parents() == last.Key() {
+			p.lastTs = ts
+			continue
+		}
+		if ts.Key() == last.Key() {
+			continue
+		}
+
+		if _, err := p.recordReorg(ctx, last.Key(), ts.Key()); err != nil {
+			return err
+		}
+		if ts.Height() >= last.Height() {
+			p.lastTs = ts
+		}
+	}
+	return nil
+}
+
+// recordReorg records a reorg from the tipset old to the tipset new in the reorgs table, unless one descends from the
+// other. It returns whether a reorg was recorded.
+func (p *Processor) recordReorg(ctx context.Context, old, new types.TipSetKey) (bool, error) {
+	oldTs, err := p.Source.TipSet(ctx, old)
+	if err != nil {
+		return false, xerrors.Errorf("get old tipset %s: %w", old, err)
+	}
+	newTs, err := p.Source.TipSet(ctx, new)
+	if err != nil {
+		return false, xerrors.Errorf("get new tipset %s: %w", new, err)
+	}
+
+	ancestor, err := p.commonAncestor(ctx, oldTs, newTs)
+	if err != nil {
+		return false, err
+	}
+	// new extends old, or is a tipset below old seen again when a batch is retried.
+	if ancestor.Equals(oldTs) || ancestor.Equals(newTs) {
+		return false, nil
+	}
+
+	depth := oldTs.Height() - ancestor.Height()
+	p.logger().Warnw("Reorg observed", "old", old, "new", new, "ancestor", ancestor.Height(), "depth", depth)
+
+	if _, err := p.db.ExecContext(ctx, `
+insert into reorgs (old_tipset, new_tipset, common_ancestor_epoch, depth)
+values ($1, $2, $3, $4)
+on conflict do nothing
+`, old.String(), new.String(), ancestor.Height(), depth); err != nil {
+		return false, xerrors.Errorf("store reorg: %w", err)
+	}
+
+	if p.enabled("actor_events") {
+		if err := p.revertActorEvents(ctx, oldTs, ancestor); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// commonAncestor walks a and b back until they meet.
+func (p *Processor) commonAncestor(ctx context.Context, a, b *types.TipSet) (*types.TipSet, error) {
+	for !a.Equals(b) {
+		var err error
+		if a.Height() >= b.Height() {
+			if a.Height() == 0 {
+				return nil, xerrors.Errorf("tipsets %s and %s have no common ancestor", a.Key(), b.Key())
+			}
+			a, err = p.Source.TipSet(ctx, a.Parents())
+		} else {
+			b, err = p.Source.TipSet(ctx, b.Parents())
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("walk back to common ancestor: %w", err)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,76 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// forkedChain returns a chain of old tipsets above gen and one of new tipsets forking off at gen.
+func forkedChain(gen *types.TipSet, old, new int) ([]*types.TipSet, []*types.TipSet) {
+	walk := func(n int, nonce uint64) []*types.TipSet {
+		var out []*types.TipSet
+		ts := gen
+		for i := 0; i < n; i++ {
+			ts = mock.TipSet(mock.MkBlock(ts, 1, nonce))
+			out = append(out, ts)
+		}
+		return out
+	}
+	return walk(old, 1), walk(new, 2)
+}
+
+// childOf returns a block to process whose parent is ts.
+func childOf(ts *types.TipSet) map[cid.Cid]*types.BlockHeader {
+	bh := mock.MkBlock(ts, 1, 3)
+	return map[cid.Cid]*types.BlockHeader{bh.Cid(): bh}
+}
+
+func TestRecordReorgDepth(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	oldChain, newChain := forkedChain(gen, 3, 4)
+
+	rec := &RecordedChain{TipSets: append([]*types.TipSet{gen}, append(oldChain, newChain...)...)}
+	p := &Processor{db: db, Source: newRecordedSource(rec)}
+	require.NoError(t, p.setupReorgs())
+	_, err := db.Exec(`truncate reorgs`)
+	require.NoError(t, err)
+
+	// the old chain is processed up to its head, nothing reorgs.
+	for _, ts := range oldChain {
+		require.NoError(t, p.observeTipSets(ctx, childOf(ts)))
+	}
+	// a batch retried after a failure shows a tipset below the last one again.
+	require.NoError(t, p.observeTipSets(ctx, childOf(oldChain[1])))
+
+	var n int
+	require.NoError(t, db.QueryRow(`select count(*) from reorgs`).Scan(&n))
+	require.Equal(t, 0, n)
+
+	// the node switches to the heavier chain, the three old tipsets above genesis are reverted.
+	require.NoError(t, p.observeTipSets(ctx, childOf(newChain[3])))
+
+	var oldTs, newTs string
+	var ancestor, depth int64
+	require.NoError(t, db.QueryRow(`select old_tipset, new_tipset, common_ancestor_epoch, depth from reorgs`).Scan(&oldTs, &newTs, &ancestor, &depth))
+	require.Equal(t, oldChain[2].Key().String(), oldTs)
+	require.Equal(t, newChain[3].Key().String(), newTs)
+	require.Equal(t, int64(gen.Height()), ancestor)
+	require.Equal(t, int64(3), depth)
+	require.Equal(t, newChain[3].Key(), p.lastTs.Key())
+
+	// recording the same reorg again is a no-op.
+	recorded, err := p.recordReorg(ctx, oldChain[2].Key(), newChain[3].Key())
+	require.NoError(t, err)
+	require.True(t, recorded)
+	require.NoError(t, db.QueryRow(`select count(*) from reorgs`).Scan(&n))
+	require.Equal(t, 1, n)
+}
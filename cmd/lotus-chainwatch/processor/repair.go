@@ -0,0 +1,80 @@
+package processor
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// RepairAddressMap adds the IDs of actors missing from id_address_map to it. id_address_map is only written from the
+// init actor and the messages processed, so an actor stored by a run which failed to store its addresses, or into a
+// SQLite database which does not enforce the foreign key of actors, can reference an ID the map lacks.
+//
+// The robust address of every missing ID is resolved from the address map of the init actor at the head of the node.
+// An ID the init actor has no robust address for, a singleton or an actor created from an ID address, is mapped to
+// itself the way the genesis actors are.
+func (p *Processor) RepairAddressMap(ctx context.Context) error {
+	missing, err := p.unmappedActorIDs(ctx)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		p.logger().Infow("No actor is missing from id_address_map")
+		return nil
+	}
+
+	addressToID, err := p.initAddressMap(ctx, types.EmptyTSK)
+	if err != nil {
+		return xerrors.Errorf("read init actor address map: %w", err)
+	}
+
+	repaired := make(map[address.Address]address.Address, len(missing))
+	var resolved int
+	for robust, id := range addressToID {
+		if _, ok := missing[id]; ok {
+			repaired[robust] = id
+			delete(missing, id)
+			resolved++
+		}
+	}
+	for id := range missing {
+		repaired[id] = id
+	}
+
+	if err := p.storeAddressMap(ctx, repaired); err != nil {
+		return xerrors.Errorf("store repaired addresses: %w", err)
+	}
+	p.logger().Infow("Repaired id_address_map", "added", len(repaired), "resolved", resolved, "unresolved", len(missing))
+	return nil
+}
+
+// unmappedActorIDs returns the IDs of actors no row of id_address_map maps an address to.
+func (p *Processor) unmappedActorIDs(ctx context.Context) (map[address.Address]struct{}, error) {
+	rows, err := p.db.QueryContext(ctx, `
+select distinct a.id
+from actors a
+where not exists (select 1 from id_address_map m where m.id = a.id)
+`)
+	if err != nil {
+		return nil, xerrors.Errorf("query unmapped actor IDs: %w", err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	out := map[address.Address]struct{}{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, xerrors.Errorf("scan unmapped actor ID: %w", err)
+		}
+		id, err := address.NewFromString(s)
+		if err != nil {
+			return nil, xerrors.Errorf("parse actor ID %q: %w", s, err)
+		}
+		out[id] = struct{}{}
+	}
+	return out, rows.Err()
+}
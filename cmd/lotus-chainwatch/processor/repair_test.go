@@ -0,0 +1,47 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestRepairAddressMap(t *testing.T) {
+	ctx := context.Background()
+	f := newCARFixture(t)
+	node, err := NewCARNode(bytes.NewReader(f.car))
+	require.NoError(t, err)
+
+	// SQLite does not enforce the foreign key of actors, so rows can reference IDs missing from the map.
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite, node: node}
+	seedAddresses(t, p.db, []address.Address{f.account})
+
+	singleton, err := address.NewIDAddress(99)
+	require.NoError(t, err)
+	for _, id := range []address.Address{f.account, f.created, singleton} {
+		_, err := p.db.Exec(`insert into actors (id, code, head, nonce, balance, stateroot, tipset_key, epoch) values ($1, $2, $3, 0, '0', $4, '', 1)`,
+			id.String(), builtin.AccountActorCodeID.String(), testCid(t, "head-"+id.String()).String(), testCid(t, "stateroot").String())
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, p.RepairAddressMap(ctx))
+
+	// the created actor is mapped to its robust address, the ID unknown to the init actor to itself.
+	id, err := p.IDForRobust(ctx, f.robust)
+	require.NoError(t, err)
+	require.Equal(t, f.created, id)
+	require.Equal(t, 1, countRows(t, p.db, `select count(*) from id_address_map where id = $1 and address = $1`, singleton.String()))
+	require.Equal(t, 1, countRows(t, p.db, `select count(*) from id_address_map where id = $1`, f.account.String()))
+	require.Zero(t, countRows(t, p.db, `select count(*) from actors a where not exists (select 1 from id_address_map m where m.id = a.id)`))
+
+	// once repaired there is nothing left to add.
+	before := countRows(t, p.db, `select count(*) from id_address_map`)
+	require.NoError(t, p.RepairAddressMap(ctx))
+	require.Equal(t, before, countRows(t, p.db, `select count(*) from id_address_map`))
+}
@@ -0,0 +1,321 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// pqDeadlockDetected is the SQLSTATE Postgres reports on the transaction it aborts to break a deadlock.
+	pqDeadlockDetected = "40P01"
+	// pqSerializationFailure is the SQLSTATE of a transaction aborted because of a concurrent update.
+	pqSerializationFailure = "40001"
+	// pqQueryCanceled is the SQLSTATE of a statement cancelled by statement_timeout, or by an administrator.
+	pqQueryCanceled = "57014"
+
+	maxRetries      = 5
+	maxRetryBackoff = 5 * time.Second
+	// maxNodeBackoff caps the wait between attempts to reach a node that is unavailable.
+	maxNodeBackoff = 30 * time.Second
+)
+
+// retryBackoff is the wait before the first retry, it doubles with every attempt up to maxRetryBackoff.
+var retryBackoff = 100 * time.Millisecond
+
+// transientClasses are the SQLSTATE classes and codes of failures that go away on their own, such as the server
+// restarting or failing over. Classes match any code starting with them.
+var transientClasses = []pq.ErrorCode{
+	"08", // connection_exception
+	pqSerializationFailure,
+	"57P01", // admin_shutdown
+	"57P02", // crash_shutdown
+	"57P03", // cannot_connect_now
+}
+
+// isDeadlock reports whether err is Postgres aborting the transaction to break a deadlock with a concurrent one. The
+// other transaction goes on once this one rolled back, so it is transient.
+func isDeadlock(err error) bool {
+	var pqErr *pq.Error
+	return xerrors.As(err, &pqErr) && pqErr.Code == pqDeadlockDetected
+}
+
+// isTransient reports whether err is a failure worth retrying: a dropped connection or a transaction Postgres aborted
+// because of a concurrent one. Constraint violations and any other statement error are not.
+func isTransient(err error) bool {
+	if xerrors.Is(err, context.Canceled) || xerrors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if isDeadlock(err) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if xerrors.As(err, &pqErr) {
+		for _, c := range transientClasses {
+			if pqErr.Code == c || (len(c) == 2 && pqErr.Code.Class() == pq.ErrorClass(c)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if xerrors.Is(err, driver.ErrBadConn) || xerrors.Is(err, io.EOF) || xerrors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return xerrors.As(err, &netErr)
+}
+
+// The classes of failure of the stores of the common actor tables, which wrap the errors they return with one of them
+// so callers tell with xerrors.Is whether to retry a batch or to alert.
+var (
+	// ErrTransientDB is a failure of the database that goes away on its own, as reported by isTransient. It is only
+	// returned once withRetry gave up.
+	ErrTransientDB = xerrors.New("transient database failure")
+	// ErrConstraint is a row the database rejected for violating a constraint of its table, retrying fails again.
+	ErrConstraint = xerrors.New("constraint violation")
+	// ErrDecode is an actor or actor state that could not be decoded or encoded for the database.
+	ErrDecode = xerrors.New("decode failure")
+)
+
+// classError is an error of a class of failure, it is the class and unwraps to the error.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classError) Unwrap() error {
+	return e.err
+}
+
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
+// decodeError wraps err as an ErrDecode.
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classError{class: ErrDecode, err: err}
+}
+
+// isConstraintViolation reports whether err is the database rejecting a row for one of the constraints of its table:
+// an integrity_constraint_violation of Postgres, or the constraint failures SQLite reports as plain messages.
+func isConstraintViolation(err error) bool {
+	var pqErr *pq.Error
+	if xerrors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "23"
+	}
+	return strings.Contains(err.Error(), "constraint failed")
+}
+
+// classifyStoreErr wraps the error of a store with its class of failure, errors already of a class and of none are
+// returned as they are.
+func classifyStoreErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, class := range []error{ErrTransientDB, ErrConstraint, ErrDecode} {
+		if xerrors.Is(err, class) {
+			return err
+		}
+	}
+	switch {
+	case isTransient(err):
+		return &classError{class: ErrTransientDB, err: err}
+	case isConstraintViolation(err):
+		return &classError{class: ErrConstraint, err: err}
+	default:
+		return err
+	}
+}
+
+// withRetry runs fn and runs it again, after an exponential randomized backoff, if it failed with a transient error. A
+// deadlock is retried once, after a short randomized backoff, the transaction it deadlocked with is done by then and a
+// second one is returned. It gives up after maxRetries retries or once ctx is done. fn must run (and roll back on
+// failure) a whole transaction so it is safe to repeat, within atomicRange fn is only run once.
+func withRetry(ctx context.Context, fn func() error) error {
+	// a failed statement aborts the transaction of a range, only atomicRange can run it again.
+	if rangeTx(ctx) != nil {
+		return fn()
+	}
+
+	backoff := retryBackoff
+	deadlocked := false
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !isTransient(err) || attempt > maxRetries {
+			return timeoutError(ctx, err)
+		}
+
+		if isDeadlock(err) {
+			if deadlocked {
+				return err
+			}
+			deadlocked = true
+			wait := retryBackoff/2 + time.Duration(rand.Int63n(int64(retryBackoff))) //nolint:gosec
+			log.Warnw("Transaction deadlocked, retrying", "attempt", attempt, "backoff", wait.String(), "error", err)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff))) //nolint:gosec
+		log.Warnw("Transaction failed with a transient error, retrying", "attempt", attempt, "backoff", wait.String(), "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// transientNodeMessages are the messages of the transport failures the RPC client passes on as plain strings.
+var transientNodeMessages = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"websocket: close",
+	"unexpected EOF",
+}
+
+// isTransientNodeErr reports whether err is a failure to reach the node, such as the node restarting or the connection
+// to it dropping, rather than the node failing the call itself.
+func isTransientNodeErr(err error) bool {
+	if err == nil || xerrors.Is(err, context.Canceled) || xerrors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	for _, target := range []error{syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE, io.EOF, io.ErrUnexpectedEOF} {
+		if xerrors.Is(err, target) {
+			return true
+		}
+	}
+	var netErr net.Error
+	if xerrors.As(err, &netErr) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, m := range transientNodeMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return strings.HasSuffix(msg, io.EOF.Error())
+}
+
+// withNodeRetry runs fn and runs it again, after an exponential randomized backoff, for as long as it fails because the
+// node is unavailable. Any other error is returned right away, as is the last one once ctx is done. fn must be safe to
+// repeat: the batch it handles is left unprocessed until it succeeds.
+func withNodeRetry(ctx context.Context, fn func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || ctx.Err() != nil || !isTransientNodeErr(err) {
+			return err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff))) //nolint:gosec
+		log.Warnw("Lotus node unavailable, retrying the batch", "attempt", attempt, "backoff", wait.String(), "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > maxNodeBackoff {
+			backoff = maxNodeBackoff
+		}
+	}
+}
+
+// StatementTimeoutError is returned by a store whose transaction was rolled back because one of its statements ran
+// longer than the StatementTimeout.
+type StatementTimeoutError struct {
+	Err error
+}
+
+func (e *StatementTimeoutError) Error() string {
+	return fmt.Sprintf("statement timed out: %s", e.Err)
+}
+
+func (e *StatementTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// timeoutError returns err as a StatementTimeoutError if a statement was cancelled by the server. A statement
+// cancelled because ctx is done is reported with the same code, err is returned as it is then.
+func timeoutError(ctx context.Context, err error) error {
+	var pqErr *pq.Error
+	if xerrors.As(err, &pqErr) && pqErr.Code == pqQueryCanceled && ctx.Err() == nil {
+		return &StatementTimeoutError{Err: err}
+	}
+	return err
+}
+
+// beginStoreTx begins a store transaction with its statements bounded by the StatementTimeout. Within atomicRange it
+// returns the transaction of the range instead, committed and rolled back with it.
+func (p *Processor) beginStoreTx(ctx context.Context) (*sql.Tx, error) {
+	if r := rangeTx(ctx); r != nil {
+		return r.tx, nil
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.StatementTimeout <= 0 || p.Backend == BackendSQLite {
+		return tx, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`set local statement_timeout = %d`, p.StatementTimeout.Milliseconds())); err != nil {
+		_ = tx.Rollback()
+		return nil, xerrors.Errorf("set statement timeout: %w", err)
+	}
+	return tx, nil
+}
+
+// commitStoreTx commits a store transaction, or rolls it back in a DryRun. The transaction of a range is left to
+// atomicRange.
+func (p *Processor) commitStoreTx(ctx context.Context, tx *sql.Tx) error {
+	if r := rangeTx(ctx); r != nil && r.tx == tx {
+		return nil
+	}
+	if p.DryRun {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+// rollbackStoreTx rolls back a store transaction that was not committed, the transaction of a range is left to
+// atomicRange.
+func (p *Processor) rollbackStoreTx(ctx context.Context, tx *sql.Tx) {
+	if r := rangeTx(ctx); r != nil && r.tx == tx {
+		return
+	}
+	_ = tx.Rollback()
+}
@@ -0,0 +1,520 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// fastRetries shortens the retry backoff for the duration of the test.
+func fastRetries(t *testing.T) {
+	backoff := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() {
+		retryBackoff = backoff
+	})
+}
+
+func TestWithDeadlockRetry(t *testing.T) {
+	fastRetries(t)
+	ctx := context.Background()
+	db := testDB(t)
+	// each transaction runs on a connection of its own.
+	db.SetMaxOpenConns(2)
+	addrs := []address.Address{mock.Address(1000), mock.Address(1001)}
+	seedAddresses(t, db, addrs)
+
+	var (
+		ready     sync.WaitGroup
+		lk        sync.Mutex
+		deadlocks int
+	)
+	ready.Add(2)
+	// lockBoth locks the row of first then the one of second. Their first attempts both hold the row of first before
+	// locking the other, in the opposite order of each other, so Postgres aborts one of them.
+	lockBoth := func(first, second address.Address) func() error {
+		attempt := 0
+		return func() error {
+			attempt++
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback() //nolint:errcheck
+
+			if _, err := tx.Exec(`update id_address_map set address = address where id = $1`, first.String()); err != nil {
+				return err
+			}
+			if attempt == 1 {
+				ready.Done()
+				ready.Wait()
+			}
+			if _, err := tx.Exec(`update id_address_map set address = address where id = $1`, second.String()); err != nil {
+				if isDeadlock(err) {
+					lk.Lock()
+					deadlocks++
+					lk.Unlock()
+				}
+				return err
+			}
+			return tx.Commit()
+		}
+	}
+
+	var grp errgroup.Group
+	grp.Go(func() error { return withRetry(ctx, lockBoth(addrs[0], addrs[1])) })
+	grp.Go(func() error { return withRetry(ctx, lockBoth(addrs[1], addrs[0])) })
+	require.NoError(t, grp.Wait())
+	require.Equal(t, 1, deadlocks)
+}
+
+func TestWithDeadlockRetryOtherErrors(t *testing.T) {
+	attempts := 0
+	// unique_violation is not retried.
+	err := withRetry(context.Background(), func() error {
+		attempts++
+		return &pq.Error{Code: "23505"}
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+}
+
+func TestWithDeadlockRetryGivesUp(t *testing.T) {
+	fastRetries(t)
+	attempts := 0
+	err := withRetry(context.Background(), func() error {
+		attempts++
+		return &pq.Error{Code: pqDeadlockDetected}
+	})
+	require.True(t, isDeadlock(err))
+	// a deadlock is only retried once.
+	require.Equal(t, 2, attempts)
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"connection failure", &pq.Error{Code: "08006"}, true},
+		{"connection does not exist", xerrors.Errorf("begin: %w", &pq.Error{Code: "08003"}), true},
+		{"serialization failure", &pq.Error{Code: pqSerializationFailure}, true},
+		{"deadlock", &pq.Error{Code: pqDeadlockDetected}, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, true},
+		{"bad connection", driver.ErrBadConn, true},
+		{"connection reset", xerrors.Errorf("copy: %w", io.ErrUnexpectedEOF), true},
+		{"unique violation", &pq.Error{Code: "23505"}, false},
+		{"query canceled", &pq.Error{Code: "57014"}, false},
+		{"context canceled", xerrors.Errorf("begin: %w", context.Canceled), false},
+		{"other", xerrors.New("boom"), false},
+	} {
+		require.Equal(t, tc.transient, isTransient(tc.err), tc.name)
+	}
+}
+
+func TestWithRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := withRetry(ctx, func() error {
+		attempts++
+		cancel()
+		return &pq.Error{Code: "08006"}
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+}
+
+// flakyDB is a database/sql driver failing to begin its first failures transactions with err. Statements succeed
+// unless execErr returns an error for their arguments, and queries return no rows. onExec, if set, is called with the
+// number of statements run so far.
+type flakyDB struct {
+	lk        sync.Mutex
+	failures  int
+	err       error
+	begins    int
+	commits   int
+	rollbacks int
+	execs     int
+	prepared  []string
+	onExec    func(n int)
+	execErr   func(args []driver.Value) error
+}
+
+func (f *flakyDB) Connect(context.Context) (driver.Conn, error) { return flakyConn{db: f}, nil }
+func (f *flakyDB) Driver() driver.Driver                        { return nil }
+
+type flakyConn struct {
+	db *flakyDB
+}
+
+func (c flakyConn) Close() error { return nil }
+
+func (c flakyConn) Prepare(query string) (driver.Stmt, error) {
+	c.db.lk.Lock()
+	defer c.db.lk.Unlock()
+	c.db.prepared = append(c.db.prepared, query)
+	return flakyStmt{db: c.db}, nil
+}
+
+func (c flakyConn) Begin() (driver.Tx, error) {
+	c.db.lk.Lock()
+	defer c.db.lk.Unlock()
+	c.db.begins++
+	if c.db.begins <= c.db.failures {
+		return nil, c.db.err
+	}
+	return flakyTx{db: c.db}, nil
+}
+
+type flakyTx struct {
+	db *flakyDB
+}
+
+func (t flakyTx) Commit() error {
+	t.db.lk.Lock()
+	defer t.db.lk.Unlock()
+	t.db.commits++
+	return nil
+}
+
+func (t flakyTx) Rollback() error {
+	t.db.lk.Lock()
+	defer t.db.lk.Unlock()
+	t.db.rollbacks++
+	return nil
+}
+
+type flakyStmt struct {
+	db *flakyDB
+}
+
+func (flakyStmt) Close() error                              { return nil }
+func (flakyStmt) NumInput() int                             { return -1 }
+func (flakyStmt) Query([]driver.Value) (driver.Rows, error) { return flakyRows{}, nil }
+
+func (s flakyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.lk.Lock()
+	s.db.execs++
+	n, onExec, execErr := s.db.execs, s.db.onExec, s.db.execErr
+	s.db.lk.Unlock()
+	if onExec != nil {
+		onExec(n)
+	}
+	if execErr != nil {
+		if err := execErr(args); err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type flakyRows struct{}
+
+func (flakyRows) Columns() []string         { return []string{"id", "old_address", "address"} }
+func (flakyRows) Close() error              { return nil }
+func (flakyRows) Next([]driver.Value) error { return io.EOF }
+
+// retryStores returns the store methods wrapped in withRetry, keyed by table, storing a single account actor.
+func retryStores(ctx context.Context, t *testing.T) map[string]func(p *Processor) error {
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	actors := map[cid.Cid]ActorTips{
+		builtin.AccountActorCodeID: {
+			types.EmptyTSK: {{
+				act:       types.Actor{Code: builtin.AccountActorCodeID, Head: testCid(t, "head"), Balance: types.NewInt(0)},
+				addr:      addr,
+				stateroot: testCid(t, "stateroot"),
+				state:     `{}`,
+			}},
+		},
+	}
+
+	return map[string]func(p *Processor) error{
+		"id_address_map": func(p *Processor) error {
+			return p.storeAddressMap(ctx, map[address.Address]address.Address{addr: addr})
+		},
+		"actors": func(p *Processor) error {
+			return p.storeActorHeads(ctx, actors)
+		},
+		"actor_states": func(p *Processor) error {
+			return p.storeActorStates(ctx, actors)
+		},
+	}
+}
+
+func TestStoreRetriesTransientFailures(t *testing.T) {
+	fastRetries(t)
+
+	for table, store := range retryStores(context.Background(), t) {
+		fake := &flakyDB{failures: 2, err: &pq.Error{Code: "08006"}}
+		p := &Processor{db: sql.OpenDB(fake)}
+		require.NoError(t, store(p), table)
+		require.Equal(t, 3, fake.begins, table)
+		require.Equal(t, 1, fake.commits, table)
+
+		// a constraint violation is returned right away.
+		fake = &flakyDB{failures: 2, err: &pq.Error{Code: "23505"}}
+		p = &Processor{db: sql.OpenDB(fake)}
+		require.Error(t, store(p), table)
+		require.Equal(t, 1, fake.begins, table)
+		require.Equal(t, 0, fake.commits, table)
+	}
+}
+
+func TestStoreStopsOnCancel(t *testing.T) {
+	for _, table := range []string{"id_address_map", "actors", "actor_states"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		// the temp table is created by the first statement, cancel while copying the row.
+		fake := &flakyDB{onExec: func(n int) {
+			if n == 2 {
+				cancel()
+			}
+		}}
+		p := &Processor{db: sql.OpenDB(fake)}
+		err := retryStores(ctx, t)[table](p)
+		cancel()
+
+		require.True(t, xerrors.Is(err, context.Canceled), "%s: %v", table, err)
+		require.Equal(t, 1, fake.begins, table)
+		require.Equal(t, 0, fake.commits, table)
+	}
+}
+
+func TestStoreStatementTimeout(t *testing.T) {
+	for table, store := range retryStores(context.Background(), t) {
+		// the statement copying the row runs out of time.
+		fake := &flakyDB{execErr: func(args []driver.Value) error {
+			if len(args) > 0 {
+				return &pq.Error{Code: pqQueryCanceled, Message: "canceling statement due to statement timeout"}
+			}
+			return nil
+		}}
+		p := &Processor{db: sql.OpenDB(fake), StatementTimeout: time.Minute}
+		err := store(p)
+
+		var timeout *StatementTimeoutError
+		require.True(t, xerrors.As(err, &timeout), "%s: %v", table, err)
+		require.Equal(t, "set local statement_timeout = 60000", fake.prepared[0], table)
+		// a timeout is not retried.
+		require.Equal(t, 1, fake.begins, table)
+		require.Equal(t, 1, fake.rollbacks, table)
+		require.Equal(t, 0, fake.commits, table)
+	}
+}
+
+func TestTimeoutErrorCancelled(t *testing.T) {
+	canceled := &pq.Error{Code: pqQueryCanceled, Message: "canceling statement due to user request"}
+
+	var timeout *StatementTimeoutError
+	require.True(t, xerrors.As(timeoutError(context.Background(), canceled), &timeout))
+
+	// the statement was cancelled along with its context, not by the statement timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := timeoutError(ctx, canceled)
+	require.False(t, xerrors.As(err, &timeout))
+	require.Equal(t, canceled, err)
+}
+
+// connRefused is the error a dial to a node that is not listening fails with.
+var connRefused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+func TestIsTransientNodeErr(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"connection refused", xerrors.Errorf("get tipset: %w", connRefused), true},
+		{"connection reset", syscall.ECONNRESET, true},
+		{"eof", xerrors.Errorf("get block: %w", io.EOF), true},
+		{"rpc connection refused", xerrors.New("RPC client error: sendRequest failed: dial tcp 127.0.0.1:1234: connect: connection refused"), true},
+		{"rpc websocket closed", xerrors.New("handler: websocket: close 1006 (abnormal closure): unexpected EOF"), true},
+		{"rpc eof", xerrors.New("RPC client error: sendRequest failed: EOF"), true},
+		{"unknown block", xerrors.New("blockstore: block not found"), false},
+		{"canceled", xerrors.Errorf("get tipset: %w", context.Canceled), false},
+		{"nil", nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.transient, isTransientNodeErr(tc.err))
+		})
+	}
+}
+
+// flakySource fails the first failures tipset reads with err, the node being unavailable until then.
+type flakySource struct {
+	TipSetSource
+	failures int
+	err      error
+
+	lk    sync.Mutex
+	reads int
+}
+
+func (s *flakySource) TipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	s.lk.Lock()
+	s.reads++
+	fail := s.reads <= s.failures
+	s.lk.Unlock()
+	if fail {
+		return nil, s.err
+	}
+	return s.TipSetSource.TipSet(ctx, tsk)
+}
+
+// flakyNodeFixture returns a processor reading a single block, changing a single account actor, from a source failing
+// the first failures reads with err.
+func flakyNodeFixture(t *testing.T, failures int, err error) (*Processor, *flakySource, map[cid.Cid]*types.BlockHeader) {
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	child := mock.MkBlock(gen, 1, 1)
+	child.ParentStateRoot = testCid(t, "stateroot-1")
+	addr := mock.Address(1000)
+
+	src := &flakySource{
+		TipSetSource: newRecordedSource(&RecordedChain{
+			TipSets: []*types.TipSet{gen},
+			Changes: []RecordedChanges{{
+				Old:    gen.ParentState(),
+				New:    child.ParentStateRoot,
+				Actors: map[string]types.Actor{addr.String(): {Code: builtin.AccountActorCodeID, Head: testCid(t, "head"), Balance: types.NewInt(1)}},
+			}},
+			States: []RecordedState{{
+				Address: addr,
+				TipSet:  gen.Key(),
+				State:   api.ActorState{Balance: types.NewInt(1), State: map[string]interface{}{"Address": addr.String()}},
+			}},
+		}),
+		failures: failures,
+		err:      err,
+	}
+	return &Processor{Source: src}, src, map[cid.Cid]*types.BlockHeader{child.Cid(): child}
+}
+
+func TestCollectActorChangesWaitsForNode(t *testing.T) {
+	fastRetries(t)
+	ctx := context.Background()
+	p, src, blocks := flakyNodeFixture(t, 3, xerrors.Errorf("RPC client error: %w", connRefused))
+
+	var changes map[cid.Cid]ActorTips
+	require.NoError(t, withNodeRetry(ctx, func() error {
+		var err error
+		changes, err = p.collectActorChanges(ctx, blocks)
+		return err
+	}))
+	require.Equal(t, 4, src.reads)
+	require.Len(t, changes[builtin.AccountActorCodeID], 1)
+}
+
+func TestCollectActorChangesNodeLogicError(t *testing.T) {
+	fastRetries(t)
+	ctx := context.Background()
+	p, src, blocks := flakyNodeFixture(t, 1, xerrors.New("tipset not found"))
+
+	err := withNodeRetry(ctx, func() error {
+		_, err := p.collectActorChanges(ctx, blocks)
+		return err
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tipset not found")
+	require.Equal(t, 1, src.reads)
+}
+
+func TestWithNodeRetryStopsOnCancel(t *testing.T) {
+	fastRetries(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := withNodeRetry(ctx, func() error {
+		attempts++
+		if attempts == 3 {
+			cancel()
+		}
+		return connRefused
+	})
+	require.Error(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+func TestClassifyStoreErr(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		err   error
+		class error
+	}{
+		{"connection failure", &pq.Error{Code: "08006"}, ErrTransientDB},
+		{"bad connection", xerrors.Errorf("begin: %w", driver.ErrBadConn), ErrTransientDB},
+		{"unique violation", &pq.Error{Code: "23505"}, ErrConstraint},
+		{"foreign key violation", xerrors.Errorf("actor put: %w", &pq.Error{Code: "23503"}), ErrConstraint},
+		{"sqlite constraint", xerrors.New("UNIQUE constraint failed: actors.id"), ErrConstraint},
+		{"decode", xerrors.Errorf("actor: %w", decodeError(xerrors.New("nonce overflows bigint"))), ErrDecode},
+		{"other", xerrors.New("boom"), nil},
+	} {
+		err := classifyStoreErr(tc.err)
+		for _, class := range []error{ErrTransientDB, ErrConstraint, ErrDecode} {
+			require.Equal(t, class == tc.class, xerrors.Is(err, class), "%s is %s", tc.name, class)
+		}
+		// the error is still the one the store failed with.
+		require.Equal(t, tc.err.Error(), err.Error(), tc.name)
+		require.True(t, xerrors.Is(err, tc.err), tc.name)
+	}
+	require.NoError(t, classifyStoreErr(nil))
+}
+
+func TestStoreErrorClasses(t *testing.T) {
+	fastRetries(t)
+
+	for table, store := range retryStores(context.Background(), t) {
+		// the database is still unavailable once the retries are used up.
+		fake := &flakyDB{failures: maxRetries + 1, err: &pq.Error{Code: "08006"}}
+		err := store(&Processor{db: sql.OpenDB(fake)})
+		require.True(t, xerrors.Is(err, ErrTransientDB), "%s: %v", table, err)
+
+		fake = &flakyDB{execErr: func(args []driver.Value) error {
+			if len(args) > 0 {
+				return &pq.Error{Code: "23505"}
+			}
+			return nil
+		}}
+		err = store(&Processor{db: sql.OpenDB(fake)})
+		require.True(t, xerrors.Is(err, ErrConstraint), "%s: %v", table, err)
+		require.False(t, xerrors.Is(err, ErrTransientDB), "%s: %v", table, err)
+	}
+
+	// a balance that can't be stored is a decode failure, no transaction is begun for it.
+	addr, err := address.NewIDAddress(1000)
+	require.NoError(t, err)
+	fake := &flakyDB{}
+	p := &Processor{db: sql.OpenDB(fake)}
+	err = p.storeActorHeads(context.Background(), map[cid.Cid]ActorTips{
+		builtin.AccountActorCodeID: {
+			types.EmptyTSK: {{
+				act:       types.Actor{Code: builtin.AccountActorCodeID, Head: testCid(t, "head"), Balance: types.BigSub(types.NewInt(0), types.NewInt(1))},
+				addr:      addr,
+				stateroot: testCid(t, "stateroot"),
+			}},
+		},
+	})
+	require.True(t, xerrors.Is(err, ErrDecode), "%v", err)
+	require.Zero(t, fake.begins)
+}
@@ -9,6 +9,8 @@ import (
 	"golang.org/x/xerrors"
 
 	"github.com/filecoin-project/lotus/build"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/specs-actors/actors/abi"
 	"github.com/filecoin-project/specs-actors/actors/abi/big"
 	"github.com/filecoin-project/specs-actors/actors/builtin"
 	"github.com/filecoin-project/specs-actors/actors/builtin/reward"
@@ -22,6 +24,19 @@ type rewardActorInfo struct {
 
 	// base reward in attofil for each block found during this epoch
 	baseBlockReward big.Int
+
+	// reward minted so far by the simple (exponential decay) and baseline minting functions
+	simpleSupply   big.Int
+	baselineSupply big.Int
+	// reward minted by each function since the parent tipset
+	simpleMinted   big.Int
+	baselineMinted big.Int
+
+	// the baseline and realized power accumulated over time, in byte-epochs
+	cumsumBaseline big.Int
+	cumsumRealized big.Int
+	// epoch at which the baseline function is evaluated, it only advances when the network meets the baseline
+	effectiveNetworkTime abi.ChainEpoch
 }
 
 func (p *Processor) setupRewards() error {
@@ -52,6 +67,47 @@ create table if not exists chain_power
 	baseline_power text not null
 );
 
+/*
+* splits the storage power reward minted as of a stateroot between the simple
+* and baseline minting functions, *_minted is the amount minted by each since
+* the parent state
+*/
+create table if not exists reward_supply
+(
+	state_root text not null
+		constraint reward_supply_pk
+			primary key,
+	simple_supply numeric not null,
+	baseline_supply numeric not null,
+	total_minted numeric not null,
+	simple_minted numeric not null,
+	baseline_minted numeric not null
+);
+
+/*
+* the reward actor state at each epoch, epoch is the height of the blocks with
+* the state root as their parent state. effective_baseline_power is not part of
+* the reward state of the current actors version and is left null
+*/
+create table if not exists reward_state
+(
+	state_root text not null,
+	epoch bigint not null,
+	cumsum_baseline numeric not null,
+	cumsum_realized numeric not null,
+	effective_network_time bigint not null,
+	effective_baseline_power numeric,
+	this_epoch_reward numeric not null,
+	this_epoch_baseline_power numeric not null,
+	total_mined numeric not null,
+	constraint reward_state_pk
+		primary key (state_root, epoch)
+);
+
+/* the first state stored for an epoch is kept, a state from another fork at the same epoch is ignored */
+create unique index if not exists reward_state_epoch_uindex
+	on reward_state (epoch);
+
 create materialized view if not exists top_miners_by_base_reward as
 	with total_rewards_by_miner as (
 		select
@@ -80,7 +136,7 @@ create index if not exists top_miners_by_base_reward_miner_index
 func (p *Processor) HandleRewardChanges(ctx context.Context, rewardTips ActorTips) error {
 	rewardChanges, err := p.processRewardActors(ctx, rewardTips)
 	if err != nil {
-		log.Fatalw("Failed to process reward actors", "error", err)
+		return xerrors.Errorf("Failed to process reward actors: %w", err)
 	}
 
 	if err := p.persistRewardActors(ctx, rewardChanges); err != nil {
@@ -93,7 +149,7 @@ func (p *Processor) HandleRewardChanges(ctx context.Context, rewardTips ActorTip
 func (p *Processor) processRewardActors(ctx context.Context, rewardTips ActorTips) ([]rewardActorInfo, error) {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Processed Reward Actors", "duration", time.Since(start).String())
+		p.logger().Debugw("Processed Reward Actors", "duration", time.Since(start).String())
 	}()
 
 	var out []rewardActorInfo
@@ -103,33 +159,61 @@ func (p *Processor) processRewardActors(ctx context.Context, rewardTips ActorTip
 			rw.common = act
 
 			// get reward actor states at each tipset once for all updates
-			rewardActor, err := p.node.StateGetActor(ctx, builtin.RewardActorAddr, tipset)
-			if err != nil {
-				return nil, xerrors.Errorf("get reward state (@ %s): %w", rw.common.stateroot.String(), err)
-			}
-
-			rewardStateRaw, err := p.node.ChainReadObj(ctx, rewardActor.Head)
+			rewardActorState, err := p.rewardState(ctx, tipset)
 			if err != nil {
-				return nil, xerrors.Errorf("read state obj (@ %s): %w", rw.common.stateroot.String(), err)
+				return nil, xerrors.Errorf("reward state (@ %s): %w", rw.common.stateroot.String(), err)
 			}
 
-			var rewardActorState reward.State
-			if err := rewardActorState.UnmarshalCBOR(bytes.NewReader(rewardStateRaw)); err != nil {
-				return nil, xerrors.Errorf("unmarshal state (@ %s): %w", rw.common.stateroot.String(), err)
+			// the genesis state has no parent, everything in it was minted at genesis.
+			prevState := &reward.State{SimpleSupply: big.Zero(), BaselineSupply: big.Zero()}
+			if act.parentTsKey != types.EmptyTSK {
+				if prevState, err = p.rewardState(ctx, act.parentTsKey); err != nil {
+					return nil, xerrors.Errorf("parent reward state (@ %s): %w", rw.common.stateroot.String(), err)
+				}
 			}
 
 			rw.baseBlockReward = rewardActorState.LastPerEpochReward
 			rw.baselinePower = rewardActorState.BaselinePower
+			rw.simpleSupply = rewardActorState.SimpleSupply
+			rw.baselineSupply = rewardActorState.BaselineSupply
+			rw.simpleMinted, rw.baselineMinted = supplyMinted(prevState, rewardActorState)
+			rw.cumsumBaseline = rewardActorState.CumsumBaseline
+			rw.cumsumRealized = rewardActorState.CumsumRealized
+			rw.effectiveNetworkTime = rewardActorState.EffectiveNetworkTime
 			out = append(out, rw)
 		}
 	}
 	return out, nil
 }
 
+func (p *Processor) rewardState(ctx context.Context, tsk types.TipSetKey) (*reward.State, error) {
+	rewardActor, err := p.node.StateGetActor(ctx, builtin.RewardActorAddr, tsk)
+	if err != nil {
+		return nil, xerrors.Errorf("get reward actor: %w", err)
+	}
+
+	rewardStateRaw, err := p.node.ChainReadObj(ctx, rewardActor.Head)
+	if err != nil {
+		return nil, xerrors.Errorf("read state obj: %w", err)
+	}
+
+	var rewardActorState reward.State
+	if err := rewardActorState.UnmarshalCBOR(bytes.NewReader(rewardStateRaw)); err != nil {
+		return nil, xerrors.Errorf("unmarshal state: %w", err)
+	}
+	return &rewardActorState, nil
+}
+
+// supplyMinted returns the amounts minted by the simple and baseline minting functions between two consecutive reward
+// states.
+func supplyMinted(prev, cur *reward.State) (simple, baseline big.Int) {
+	return big.Sub(cur.SimpleSupply, prev.SimpleSupply), big.Sub(cur.BaselineSupply, prev.BaselineSupply)
+}
+
 func (p *Processor) persistRewardActors(ctx context.Context, rewards []rewardActorInfo) error {
 	start := time.Now()
 	defer func() {
-		log.Debugw("Persisted Reward Actors", "duration", time.Since(start).String())
+		p.logger().Debugw("Persisted Reward Actors", "duration", time.Since(start).String())
 	}()
 
 	grp, ctx := errgroup.WithContext(ctx)
@@ -148,6 +232,17 @@ func (p *Processor) persistRewardActors(ctx context.Context, rewards []rewardAct
 		return nil
 	})
 
+	grp.Go(func() error {
+		if err := p.storeRewardSupply(rewards); err != nil {
+			return err
+		}
+		return nil
+	})
+
+	grp.Go(func() error {
+		return p.storeRewardState(ctx, rewards)
+	})
+
 	return grp.Wait()
 }
 
@@ -171,7 +266,7 @@ func (p *Processor) storeChainPower(rewards []rewardActorInfo) error {
 			rewardState.common.stateroot.String(),
 			rewardState.baselinePower.String(),
 		); err != nil {
-			log.Errorw("failed to store chain power", "state_root", rewardState.common.stateroot, "error", err)
+			p.logger().Errorw("failed to store chain power", "state_root", rewardState.common.stateroot, "error", err)
 		}
 	}
 
@@ -211,7 +306,7 @@ func (p *Processor) storeBaseBlockReward(rewards []rewardActorInfo) error {
 			rewardState.common.stateroot.String(),
 			baseBlockReward.String(),
 		); err != nil {
-			log.Errorw("failed to store base block reward", "state_root", rewardState.common.stateroot, "error", err)
+			p.logger().Errorw("failed to store base block reward", "state_root", rewardState.common.stateroot, "error", err)
 		}
 	}
 
@@ -229,3 +324,100 @@ func (p *Processor) storeBaseBlockReward(rewards []rewardActorInfo) error {
 
 	return nil
 }
+
+func (p *Processor) storeRewardSupply(rewards []rewardActorInfo) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return xerrors.Errorf("begin reward_supply tx: %w", err)
+	}
+
+	if _, err := tx.Exec(`create temp table rs (like reward_supply excluding constraints) on commit drop`); err != nil {
+		return xerrors.Errorf("prep reward_supply temp: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`copy rs (state_root, simple_supply, baseline_supply, total_minted, simple_minted, baseline_minted) from STDIN`)
+	if err != nil {
+		return xerrors.Errorf("prepare tmp reward_supply: %w", err)
+	}
+
+	for _, rewardState := range rewards {
+		if _, err := stmt.Exec(
+			rewardState.common.stateroot.String(),
+			rewardState.simpleSupply.String(),
+			rewardState.baselineSupply.String(),
+			big.Add(rewardState.simpleSupply, rewardState.baselineSupply).String(),
+			rewardState.simpleMinted.String(),
+			rewardState.baselineMinted.String(),
+		); err != nil {
+			p.logger().Errorw("failed to store reward supply", "state_root", rewardState.common.stateroot, "error", err)
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		return xerrors.Errorf("close prepared reward_supply: %w", err)
+	}
+
+	if _, err := tx.Exec(`insert into reward_supply select * from rs on conflict do nothing`); err != nil {
+		return xerrors.Errorf("insert reward_supply from tmp: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return xerrors.Errorf("commit reward_supply tx: %w", err)
+	}
+
+	return nil
+}
+
+// storeRewardState stores one reward_state row per epoch. The epoch of a state root is the height of the blocks it is
+// the parent state of, the height state_heights joins it to in actor_tips, which the actor changes already carry.
+func (p *Processor) storeRewardState(ctx context.Context, rewards []rewardActorInfo) error {
+	if len(rewards) == 0 {
+		return nil
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin reward_state tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		if _, err := tx.ExecContext(ctx, `create temp table rst (like reward_state excluding constraints) on commit drop`); err != nil {
+			return xerrors.Errorf("prep reward_state temp: %w", err)
+		}
+
+		stmt, err := tx.Prepare(`copy rst (state_root, epoch, cumsum_baseline, cumsum_realized, effective_network_time, this_epoch_reward, this_epoch_baseline_power, total_mined) from STDIN`)
+		if err != nil {
+			return xerrors.Errorf("prepare tmp reward_state: %w", err)
+		}
+
+		for _, rewardState := range rewards {
+			if _, err := stmt.ExecContext(ctx,
+				rewardState.common.stateroot.String(),
+				rewardState.common.height,
+				rewardState.cumsumBaseline.String(),
+				rewardState.cumsumRealized.String(),
+				rewardState.effectiveNetworkTime,
+				rewardState.baseBlockReward.String(),
+				rewardState.baselinePower.String(),
+				big.Add(rewardState.simpleSupply, rewardState.baselineSupply).String(),
+			); err != nil {
+				return xerrors.Errorf("store reward state (@ %s): %w", rewardState.common.stateroot, err)
+			}
+		}
+
+		if err := stmt.Close(); err != nil {
+			return xerrors.Errorf("close prepared reward_state: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `insert into reward_state select * from rst on conflict (epoch) do nothing`); err != nil {
+			return xerrors.Errorf("insert reward_state from tmp: %w", err)
+		}
+
+		return p.commitStoreTx(ctx, tx)
+	})
+}
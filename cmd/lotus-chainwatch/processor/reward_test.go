@@ -0,0 +1,131 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/reward"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// rewardFixture returns a node holding a known reward state at the tipset after genesis, and its actor tips.
+func rewardFixture(t *testing.T) (*testNode, ActorTips) {
+	st := reward.State{
+		BaselinePower:        big.NewInt(1 << 40),
+		RealizedPower:        big.NewInt(1 << 39),
+		CumsumBaseline:       big.NewInt(5000),
+		CumsumRealized:       big.NewInt(3000),
+		EffectiveNetworkTime: 7,
+		SimpleSupply:         big.NewInt(900),
+		BaselineSupply:       big.NewInt(100),
+		LastPerEpochReward:   big.NewInt(25),
+	}
+
+	genesis := reward.State{
+		BaselinePower:      big.Zero(),
+		RealizedPower:      big.Zero(),
+		CumsumBaseline:     big.Zero(),
+		CumsumRealized:     big.Zero(),
+		SimpleSupply:       big.Zero(),
+		BaselineSupply:     big.Zero(),
+		LastPerEpochReward: big.Zero(),
+	}
+
+	tsk, genTsk := types.NewTipSetKey(testCid(t, "block-10")), types.NewTipSetKey(testCid(t, "genesis"))
+	node := newTestNode()
+	node.putActor(t, genTsk, builtin.RewardActorAddr, builtin.RewardActorCodeID, &genesis)
+	act := node.putActor(t, tsk, builtin.RewardActorAddr, builtin.RewardActorCodeID, &st)
+
+	tips := actorChange(t, builtin.RewardActorAddr, act, 10, tsk, genTsk)
+	return node, tips
+}
+
+func TestProcessRewardState(t *testing.T) {
+	node, tips := rewardFixture(t)
+	p := &Processor{node: node}
+
+	rewards, err := p.processRewardActors(context.Background(), tips)
+	require.NoError(t, err)
+	require.Len(t, rewards, 1)
+
+	rw := rewards[0]
+	require.Equal(t, big.NewInt(5000), rw.cumsumBaseline)
+	require.Equal(t, big.NewInt(3000), rw.cumsumRealized)
+	require.EqualValues(t, 7, rw.effectiveNetworkTime)
+	require.Equal(t, big.NewInt(25), rw.baseBlockReward)
+	require.Equal(t, big.NewInt(1<<40), rw.baselinePower)
+	require.Equal(t, big.NewInt(900), rw.simpleMinted)
+	require.Equal(t, big.NewInt(100), rw.baselineMinted)
+}
+
+func TestStoreRewardState(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	p := &Processor{db: db}
+	require.NoError(t, p.setupRewards())
+	_, err := db.Exec(`truncate reward_state`)
+	require.NoError(t, err)
+
+	node, tips := rewardFixture(t)
+	p.node = node
+	rewards, err := p.processRewardActors(ctx, tips)
+	require.NoError(t, err)
+	require.NoError(t, p.storeRewardState(ctx, rewards))
+
+	// the state of another fork at the same epoch is ignored.
+	forked := rewards[0]
+	forked.common.stateroot = testCid(t, "stateroot-10-fork")
+	forked.cumsumBaseline = big.NewInt(1)
+	require.NoError(t, p.storeRewardState(ctx, []rewardActorInfo{forked}))
+
+	var (
+		stateRoot                                      string
+		cumsumBaseline, cumsumRealized                 string
+		effectiveNetworkTime                           int64
+		effectiveBaselinePower                         *string
+		thisEpochReward, thisEpochBaseline, totalMined string
+	)
+	require.NoError(t, db.QueryRow(`
+select state_root, cumsum_baseline, cumsum_realized, effective_network_time, effective_baseline_power,
+	this_epoch_reward, this_epoch_baseline_power, total_mined
+from reward_state where epoch = 10`).Scan(&stateRoot, &cumsumBaseline, &cumsumRealized, &effectiveNetworkTime,
+		&effectiveBaselinePower, &thisEpochReward, &thisEpochBaseline, &totalMined))
+
+	require.Equal(t, testCid(t, "stateroot-10").String(), stateRoot)
+	require.Equal(t, "5000", cumsumBaseline)
+	require.Equal(t, "3000", cumsumRealized)
+	require.Equal(t, int64(7), effectiveNetworkTime)
+	require.Nil(t, effectiveBaselinePower)
+	require.Equal(t, "25", thisEpochReward)
+	require.Equal(t, big.NewInt(1<<40).String(), thisEpochBaseline)
+	require.Equal(t, "1000", totalMined)
+
+	var n int
+	require.NoError(t, db.QueryRow(`select count(*) from reward_state`).Scan(&n))
+	require.Equal(t, 1, n)
+}
+
+func TestSupplyMinted(t *testing.T) {
+	prev := &reward.State{
+		SimpleSupply:   big.NewInt(1000),
+		BaselineSupply: big.NewInt(200),
+	}
+	cur := &reward.State{
+		SimpleSupply:   big.NewInt(1090),
+		BaselineSupply: big.NewInt(215),
+	}
+
+	simple, baseline := supplyMinted(prev, cur)
+	require.Equal(t, big.NewInt(90), simple)
+	require.Equal(t, big.NewInt(15), baseline)
+
+	// nothing minted between two identical states.
+	simple, baseline = supplyMinted(cur, cur)
+	require.True(t, simple.IsZero())
+	require.True(t, baseline.IsZero())
+}
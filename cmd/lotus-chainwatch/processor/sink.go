@@ -0,0 +1,124 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ActorHead is a row of actors as handed to an ActorSink.
+type ActorHead struct {
+	ID      address.Address
+	Address address.Address
+
+	Code    cid.Cid
+	Head    cid.Cid
+	Nonce   uint64
+	Balance big.Int
+
+	StateRoot cid.Cid
+	Height    abi.ChainEpoch
+	TipSet    types.TipSetKey
+}
+
+// ActorState is a row of actor_states as handed to an ActorSink.
+type ActorState struct {
+	Head cid.Cid
+	Code cid.Cid
+	// State is the decoded state of the actor, in the JSON stored in actor_states.
+	State json.RawMessage
+}
+
+// ActorSink receives the actor heads and states the common actors processor stores, so another system can be fed the
+// same stream of actor changes the database is.
+//
+// The sinks are called in the store transaction of every batch once the database accepted its rows, before it is
+// committed. A batch whose transaction is retried or fails to commit after that is delivered again when it is
+// written again, a sink sees every row at least once and should ignore the ones it already has. No sink is called in
+// a dry run.
+type ActorSink interface {
+	OnActorHead(ctx context.Context, head ActorHead) error
+	OnActorState(ctx context.Context, state ActorState) error
+}
+
+type registeredSink struct {
+	name  string
+	sink  ActorSink
+	fatal bool
+}
+
+// RegisterSink adds a sink the stored actor heads and states are sent to alongside the database. If fatal is set an
+// error of the sink fails the batch, which is rolled back and handled again by the next run. Otherwise the error is
+// logged, the rest of the batch is not sent to the sink and the batch is stored regardless. It must be called before
+// Start.
+func (p *Processor) RegisterSink(name string, sink ActorSink, fatal bool) {
+	p.sinks = append(p.sinks, registeredSink{name: name, sink: sink, fatal: fatal})
+}
+
+// sinkError returns the error a sink failing with err fails its batch with, nil for a best effort sink.
+func (p *Processor) sinkError(s registeredSink, err error) error {
+	if s.fatal {
+		return xerrors.Errorf("actor sink %s: %w", s.name, err)
+	}
+	p.logger().Warnw("Actor sink failed, the batch is stored without it", "sink", s.name, "error", err)
+	return nil
+}
+
+// sinkActorHeads sends heads to the sinks, stopping at the first error of a fatal one.
+func (p *Processor) sinkActorHeads(ctx context.Context, heads []actorHeadRow) error {
+	if len(p.sinks) == 0 || p.DryRun {
+		return nil
+	}
+	for _, s := range p.sinks {
+		for _, h := range heads {
+			if err := s.sink.OnActorHead(ctx, h.record()); err != nil {
+				if err := p.sinkError(s, err); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// sinkActorStates sends rows to the sinks, stopping at the first error of a fatal one.
+func (p *Processor) sinkActorStates(ctx context.Context, rows []actorStateRow) error {
+	if len(p.sinks) == 0 || p.DryRun {
+		return nil
+	}
+	for _, s := range p.sinks {
+		for _, r := range rows {
+			if err := s.sink.OnActorState(ctx, ActorState{Head: r.head, Code: r.code, State: json.RawMessage(r.state)}); err != nil {
+				if err := p.sinkError(s, err); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (h actorHeadRow) record() ActorHead {
+	return ActorHead{
+		ID:        h.id,
+		Address:   h.info.addr,
+		Code:      h.code,
+		Head:      h.info.act.Head,
+		Nonce:     h.info.act.Nonce,
+		Balance:   h.info.act.Balance,
+		StateRoot: h.info.stateroot,
+		Height:    h.info.height,
+		TipSet:    h.info.tsKey,
+	}
+}
@@ -0,0 +1,123 @@
+package processor
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/xerrors"
+)
+
+// recordingSink keeps the records sent to it, failing every call with err if it is set.
+type recordingSink struct {
+	lk     sync.Mutex
+	heads  []ActorHead
+	states []ActorState
+	err    error
+}
+
+func (s *recordingSink) OnActorHead(_ context.Context, h ActorHead) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.heads = append(s.heads, h)
+	return nil
+}
+
+func (s *recordingSink) OnActorState(_ context.Context, st ActorState) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.states = append(s.states, st)
+	return nil
+}
+
+func TestActorSinkRecordsStoredRows(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		sink := &recordingSink{}
+		p.RegisterSink("recording", sink, true)
+
+		actors, addrs := syntheticActorTips(t, 2, 3)
+		seedAddresses(t, p.db, addrs)
+		require.NoError(t, p.storeActorHeads(ctx, actors))
+		require.NoError(t, p.storeActorStates(ctx, actors))
+
+		// the sink is sent the rows the database holds, no more and no less.
+		rows, err := p.db.Query(`select id, head, stateroot, nonce from actors order by id, stateroot`)
+		require.NoError(t, err)
+		var stored []string
+		for rows.Next() {
+			var id, head, stateroot string
+			var nonce int64
+			require.NoError(t, rows.Scan(&id, &head, &stateroot, &nonce))
+			stored = append(stored, id+" "+head+" "+stateroot)
+		}
+		require.NoError(t, rows.Err())
+		require.NoError(t, rows.Close())
+
+		var sent []string
+		for _, h := range sink.heads {
+			sent = append(sent, h.ID.String()+" "+h.Head.String()+" "+h.StateRoot.String())
+			require.Equal(t, h.ID, h.Address)
+		}
+		sort.Strings(stored)
+		sort.Strings(sent)
+		require.Len(t, stored, 6)
+		require.Equal(t, stored, sent)
+
+		require.Len(t, sink.states, countRows(t, p.db, `select count(*) from actor_states`))
+		for _, st := range sink.states {
+			var state string
+			require.NoError(t, p.db.QueryRow(`select state from actor_states where head = $1 and code = $2`, st.Head.String(), st.Code.String()).Scan(&state))
+			require.JSONEq(t, state, string(st.State))
+		}
+	})
+}
+
+func TestActorSinkErrors(t *testing.T) {
+	ctx := context.Background()
+	failure := xerrors.New("broker unavailable")
+
+	// a fatal sink rolls the batch back.
+	p := &Processor{db: testSQLiteDB(t), Backend: BackendSQLite}
+	p.RegisterSink("fatal", &recordingSink{err: failure}, true)
+	actors, addrs := syntheticActorTips(t, 1, 2)
+	seedAddresses(t, p.db, addrs)
+	err := p.storeActorHeads(ctx, actors)
+	require.True(t, xerrors.Is(err, failure), "%v", err)
+	require.Contains(t, err.Error(), "actor sink fatal")
+	require.Zero(t, countRows(t, p.db, `select count(*) from actors`))
+
+	// a best effort sink is logged and the batch stored, the other sinks still receive it.
+	core, logs := observer.New(zapcore.DebugLevel)
+	p = &Processor{db: testSQLiteDB(t), Backend: BackendSQLite, Log: zap.New(core).Sugar()}
+	other := &recordingSink{}
+	p.RegisterSink("best-effort", &recordingSink{err: failure}, false)
+	p.RegisterSink("other", other, true)
+	seedAddresses(t, p.db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.Equal(t, 2, countRows(t, p.db, `select count(*) from actors`))
+	require.Len(t, other.heads, 2)
+
+	failed := logs.FilterMessage("Actor sink failed, the batch is stored without it").All()
+	require.Len(t, failed, 1)
+	require.Equal(t, "best-effort", failed[0].ContextMap()["sink"])
+
+	// a dry run sends nothing.
+	dry := &recordingSink{}
+	p = &Processor{db: testSQLiteDB(t), Backend: BackendSQLite, DryRun: true}
+	p.RegisterSink("dry", dry, true)
+	seedAddresses(t, p.db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	require.Empty(t, dry.heads)
+}
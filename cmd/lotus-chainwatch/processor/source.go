@@ -0,0 +1,261 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// TipSetSource provides the chain data the processing loop walks: block headers, tipsets and the actor states that
+// changed between them. The node backed source reads from a live lotus node, the file backed source replays a recorded
+// chain segment so processing can be run deterministically and offline.
+type TipSetSource interface {
+	// Block returns the block header with the given cid.
+	Block(ctx context.Context, c cid.Cid) (*types.BlockHeader, error)
+	// TipSet returns the tipset with the given key.
+	TipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error)
+	// ChangedActors returns the actors whose state differs between the old and new state roots, keyed by address.
+	ChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error)
+	// ActorState returns the decoded state of the actor at addr as of the tipset tsk.
+	ActorState(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.ActorState, error)
+}
+
+type nodeSource struct {
+	node Node
+}
+
+// NewNodeSource returns a TipSetSource reading from a lotus node.
+func NewNodeSource(node Node) TipSetSource {
+	return &nodeSource{node: node}
+}
+
+func (s *nodeSource) Block(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	return s.node.ChainGetBlock(ctx, c)
+}
+
+func (s *nodeSource) TipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	return s.node.ChainGetTipSet(ctx, tsk)
+}
+
+func (s *nodeSource) ChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error) {
+	return s.node.StateChangedActors(ctx, old, new)
+}
+
+func (s *nodeSource) ActorState(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	return s.node.StateReadState(ctx, addr, tsk)
+}
+
+// RecordedChain is the on disk format of a file backed TipSetSource.
+type RecordedChain struct {
+	Blocks  []*types.BlockHeader
+	TipSets []*types.TipSet
+	Changes []RecordedChanges
+	States  []RecordedState
+}
+
+// RecordedChanges are the actors that changed between two state roots.
+type RecordedChanges struct {
+	Old    cid.Cid
+	New    cid.Cid
+	Actors map[string]types.Actor
+}
+
+// RecordedState is the decoded state of an actor as of a tipset.
+type RecordedState struct {
+	Address address.Address
+	TipSet  types.TipSetKey
+	State   api.ActorState
+}
+
+type fileSource struct {
+	blocks  map[cid.Cid]*types.BlockHeader
+	tipsets map[types.TipSetKey]*types.TipSet
+	changes map[[2]cid.Cid]map[string]types.Actor
+	states  map[string]*api.ActorState
+}
+
+// NewFileSource loads a recorded chain segment written with RecordingSource.Save.
+func NewFileSource(path string) (TipSetSource, error) {
+	return loadRecordedChain(path)
+}
+
+func loadRecordedChain(path string) (*fileSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("open tipset file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var rec RecordedChain
+	if err := json.NewDecoder(f).Decode(&rec); err != nil {
+		return nil, xerrors.Errorf("decode tipset file %s: %w", path, err)
+	}
+	return newRecordedSource(&rec), nil
+}
+
+func newRecordedSource(rec *RecordedChain) *fileSource {
+	s := &fileSource{
+		blocks:  map[cid.Cid]*types.BlockHeader{},
+		tipsets: map[types.TipSetKey]*types.TipSet{},
+		changes: map[[2]cid.Cid]map[string]types.Actor{},
+		states:  map[string]*api.ActorState{},
+	}
+	for _, bh := range rec.Blocks {
+		s.blocks[bh.Cid()] = bh
+	}
+	for _, ts := range rec.TipSets {
+		s.tipsets[ts.Key()] = ts
+		for _, bh := range ts.Blocks() {
+			s.blocks[bh.Cid()] = bh
+		}
+	}
+	for _, c := range rec.Changes {
+		s.changes[[2]cid.Cid{c.Old, c.New}] = c.Actors
+	}
+	for i := range rec.States {
+		st := rec.States[i]
+		s.states[stateKey(st.Address, st.TipSet)] = &st.State
+	}
+	return s
+}
+
+// replayBlocks returns the recorded blocks whose parent tipset is recorded, the ones whose changes can be collected.
+func (s *fileSource) replayBlocks() map[cid.Cid]*types.BlockHeader {
+	out := map[cid.Cid]*types.BlockHeader{}
+	for c, bh := range s.blocks {
+		if _, ok := s.tipsets[types.NewTipSetKey(bh.Parents...)]; ok {
+			out[c] = bh
+		}
+	}
+	return out
+}
+
+// Replay stores the common actor changes of the chain segment recorded at path, written with RecordingSource.Save, as
+// the processor stored them when it was recorded. The blocks, tipsets and states are read from the recording in place
+// of the Source of the processor, every recorded block whose parent tipset is recorded too is replayed. The node is
+// only called to resolve the addresses of the init actors changed, the network identity is not checked and the genesis
+// state not seeded as Start does.
+func (p *Processor) Replay(ctx context.Context, path string) error {
+	src, err := loadRecordedChain(path)
+	if err != nil {
+		return err
+	}
+	if err := p.setupCommonActors(); err != nil {
+		return xerrors.Errorf("setup common actor tables: %w", err)
+	}
+
+	p.Source = src
+	blocks := src.replayBlocks()
+	p.logger().Infow("Replaying recorded chain segment", "path", path, "blocks", len(blocks))
+	return p.streamActorChanges(ctx, blocks, p.HandleActorStream)
+}
+
+func stateKey(addr address.Address, tsk types.TipSetKey) string {
+	return addr.String() + "@" + tsk.String()
+}
+
+func (s *fileSource) Block(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	bh, ok := s.blocks[c]
+	if !ok {
+		return nil, xerrors.Errorf("block %s not in recorded chain", c)
+	}
+	return bh, nil
+}
+
+func (s *fileSource) TipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, ok := s.tipsets[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not in recorded chain", tsk)
+	}
+	return ts, nil
+}
+
+func (s *fileSource) ChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error) {
+	changes, ok := s.changes[[2]cid.Cid{old, new}]
+	if !ok {
+		return nil, xerrors.Errorf("changes between %s and %s not in recorded chain", old, new)
+	}
+	return changes, nil
+}
+
+func (s *fileSource) ActorState(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	st, ok := s.states[stateKey(addr, tsk)]
+	if !ok {
+		return nil, xerrors.Errorf("state of %s at %s not in recorded chain", addr, tsk)
+	}
+	return st, nil
+}
+
+// RecordingSource wraps another TipSetSource and keeps everything read through it, so a chain segment processed from a
+// live node can be written out and replayed later with NewFileSource.
+type RecordingSource struct {
+	src TipSetSource
+
+	lk  sync.Mutex
+	rec RecordedChain
+}
+
+func NewRecordingSource(src TipSetSource) *RecordingSource {
+	return &RecordingSource{src: src}
+}
+
+func (r *RecordingSource) Block(ctx context.Context, c cid.Cid) (*types.BlockHeader, error) {
+	bh, err := r.src.Block(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	r.lk.Lock()
+	r.rec.Blocks = append(r.rec.Blocks, bh)
+	r.lk.Unlock()
+	return bh, nil
+}
+
+func (r *RecordingSource) TipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, err := r.src.TipSet(ctx, tsk)
+	if err != nil {
+		return nil, err
+	}
+	r.lk.Lock()
+	r.rec.TipSets = append(r.rec.TipSets, ts)
+	r.lk.Unlock()
+	return ts, nil
+}
+
+func (r *RecordingSource) ChangedActors(ctx context.Context, old, new cid.Cid) (map[string]types.Actor, error) {
+	changes, err := r.src.ChangedActors(ctx, old, new)
+	if err != nil {
+		return nil, err
+	}
+	r.lk.Lock()
+	r.rec.Changes = append(r.rec.Changes, RecordedChanges{Old: old, New: new, Actors: changes})
+	r.lk.Unlock()
+	return changes, nil
+}
+
+func (r *RecordingSource) ActorState(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*api.ActorState, error) {
+	st, err := r.src.ActorState(ctx, addr, tsk)
+	if err != nil {
+		return nil, err
+	}
+	r.lk.Lock()
+	r.rec.States = append(r.rec.States, RecordedState{Address: addr, TipSet: tsk, State: *st})
+	r.lk.Unlock()
+	return st, nil
+}
+
+// Save writes everything recorded so far in the format read by NewFileSource.
+func (r *RecordingSource) Save(w io.Writer) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return json.NewEncoder(w).Encode(&r.rec)
+}
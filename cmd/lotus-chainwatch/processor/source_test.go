@@ -0,0 +1,134 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// recordedChainFile writes a two tipset chain segment in which two account actors change, and returns the path of the
+// file along with the block to process.
+func recordedChainFile(t *testing.T) (string, *types.BlockHeader, []address.Address) {
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	child := mock.MkBlock(gen, 1, 1)
+	child.ParentStateRoot = testCid(t, "stateroot-1")
+
+	rec := RecordedChain{
+		Blocks:  []*types.BlockHeader{child},
+		TipSets: []*types.TipSet{gen},
+		Changes: []RecordedChanges{{
+			Old:    gen.ParentState(),
+			New:    child.ParentStateRoot,
+			Actors: map[string]types.Actor{},
+		}},
+	}
+
+	var addrs []address.Address
+	for i := uint64(0); i < 2; i++ {
+		addr, err := address.NewIDAddress(1000 + i)
+		require.NoError(t, err)
+		addrs = append(addrs, addr)
+
+		rec.Changes[0].Actors[addr.String()] = types.Actor{
+			Code:    builtin.AccountActorCodeID,
+			Head:    testCid(t, "head-"+addr.String()),
+			Nonce:   i,
+			Balance: types.NewInt(i),
+		}
+		rec.States = append(rec.States, RecordedState{
+			Address: addr,
+			TipSet:  gen.Key(),
+			State: api.ActorState{
+				Balance: types.NewInt(i),
+				State:   map[string]interface{}{"Address": addr.String()},
+			},
+		})
+	}
+
+	f, err := ioutil.TempFile("", "chainwatch-tipsets-*.json")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.Remove(f.Name())
+	})
+	require.NoError(t, json.NewEncoder(f).Encode(&rec))
+	require.NoError(t, f.Close())
+
+	return f.Name(), child, addrs
+}
+
+func TestFileSourceCollectsActorChanges(t *testing.T) {
+	ctx := context.Background()
+	path, child, addrs := recordedChainFile(t)
+
+	src, err := NewFileSource(path)
+	require.NoError(t, err)
+
+	bh, err := src.Block(ctx, child.Cid())
+	require.NoError(t, err)
+	require.Equal(t, child.Cid(), bh.Cid())
+
+	p := &Processor{Source: src}
+	changes, err := p.collectActorChanges(ctx, map[cid.Cid]*types.BlockHeader{child.Cid(): child})
+	require.NoError(t, err)
+
+	tips := changes[builtin.AccountActorCodeID]
+	require.Len(t, tips, 1)
+	for tsk, actors := range tips {
+		require.Equal(t, types.NewTipSetKey(child.Parents...), tsk)
+		require.Len(t, actors, len(addrs))
+		for _, a := range actors {
+			require.Equal(t, child.ParentStateRoot, a.stateroot)
+			require.Contains(t, addrs, a.addr)
+			require.JSONEq(t, `{"Address":"`+a.addr.String()+`"}`, a.state)
+		}
+	}
+}
+
+func TestFileSourceCommonActorsPipeline(t *testing.T) {
+	ctx := context.Background()
+	path, child, addrs := recordedChainFile(t)
+
+	src, err := NewFileSource(path)
+	require.NoError(t, err)
+
+	// record the changes collected from the file so it can be checked that a recording replays the same chain segment.
+	recording := NewRecordingSource(src)
+	collector := &Processor{Source: recording}
+	bh, err := recording.Block(ctx, child.Cid())
+	require.NoError(t, err)
+	changes, err := collector.collectActorChanges(ctx, map[cid.Cid]*types.BlockHeader{bh.Cid(): bh})
+	require.NoError(t, err)
+	require.Len(t, changes[builtin.AccountActorCodeID][types.NewTipSetKey(child.Parents...)], len(addrs))
+
+	f, err := ioutil.TempFile("", "chainwatch-replay-*.json")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.Remove(f.Name())
+	})
+	require.NoError(t, recording.Save(f))
+	require.NoError(t, f.Close())
+
+	for _, file := range []string{path, f.Name()} {
+		testBackends(t, func(t *testing.T, p *Processor) {
+			// the replay runs the common actor pipeline without a node, no init actor changed.
+			seedAddresses(t, p.db, addrs)
+			require.NoError(t, p.Replay(ctx, file))
+
+			require.Equal(t, len(addrs), countRows(t, p.db, `select count(*) from actors where stateroot = $1`, child.ParentStateRoot.String()))
+			require.Equal(t, len(addrs), countRows(t, p.db, `select count(*) from actor_states`))
+		})
+	}
+}
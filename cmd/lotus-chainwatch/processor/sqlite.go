@@ -0,0 +1,122 @@
+package processor
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// SQLiteScheme prefixes the DSN of a SQLite database, the path of the database file follows it.
+const SQLiteScheme = "sqlite://"
+
+// BackendOf returns the backend of the database dsn names: BackendSQLite for a SQLiteScheme DSN, BackendPostgres for
+// any other.
+func BackendOf(dsn string) Backend {
+	if strings.HasPrefix(dsn, SQLiteScheme) {
+		return BackendSQLite
+	}
+	return BackendPostgres
+}
+
+// sqliteProcessors are the built in processors whose tables exist in SQLite. The tables of the others are created with
+// Postgres only statements, and the processing loop reads the blocks the syncer stores in Postgres.
+var sqliteProcessors = map[string]struct{}{
+	"common_actors": {},
+}
+
+// errNoSQLite is returned opening a SQLite database from a binary built without the sqlite build tag.
+var errNoSQLite = xerrors.New("chainwatch was built without SQLite support, rebuild it with -tags sqlite")
+
+// sqliteMaxVariables is the number of parameters SQLite binds to a statement at most in its default build.
+const sqliteMaxVariables = 999
+
+// sqliteInserter inserts rows with multi row inserts, as many rows per statement as SQLite binds parameters for.
+type sqliteInserter struct {
+	tx *sql.Tx
+}
+
+func (s *sqliteInserter) BulkInsert(ctx context.Context, table string, cols []string, rows [][]interface{}) error {
+	return s.insert(ctx, table, cols, rows, "do nothing")
+}
+
+func (s *sqliteInserter) BulkUpsert(ctx context.Context, table string, cols, key []string, newer string, rows [][]interface{}) error {
+	return s.insert(ctx, table, cols, rows, upsertConflict(table, cols, key, newer))
+}
+
+func (s *sqliteInserter) insert(ctx context.Context, table string, cols []string, rows [][]interface{}, conflict string) error {
+	row := "(" + sqlitePlaceholders(len(cols)) + ")"
+	for _, b := range batchRanges(len(rows), sqliteMaxVariables/len(cols)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		values := make([]string, 0, b[1]-b[0])
+		args := make([]interface{}, 0, (b[1]-b[0])*len(cols))
+		for _, r := range rows[b[0]:b[1]] {
+			values = append(values, row)
+			args = append(args, r...)
+		}
+
+		if _, err := s.tx.ExecContext(ctx, `insert into `+table+` (`+strings.Join(cols, ", ")+`) values `+strings.Join(values, ", ")+` on conflict `+conflict, args...); err != nil {
+			return xerrors.Errorf("insert %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// sqlitePlaceholders returns n comma separated parameters.
+func sqlitePlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// commonActorsSchemaSQLite creates the common actor tables in SQLite, without the functions and column fixes of the
+// Postgres schema.
+func commonActorsSchemaSQLite(tx *sql.Tx) error {
+	for _, stmt := range []string{
+		`create table if not exists id_address_map
+(
+	id text not null,
+	address text not null,
+	constraint id_address_map_pk
+		primary key (id, address)
+)`,
+		`create unique index if not exists id_address_map_id_uindex on id_address_map (id)`,
+		`create unique index if not exists id_address_map_address_uindex on id_address_map (address)`,
+		`create table if not exists actors
+(
+	id text not null
+		constraint id_address_map_actors_id_fk
+			references id_address_map (id),
+	code text not null,
+	head text not null,
+	nonce bigint not null,
+	balance text not null,
+	stateroot text
+)`,
+		`create index if not exists actors_id_index on actors (id)`,
+		`create unique index if not exists actors_id_head_stateroot_uindex on actors (id, head, stateroot)`,
+		`create table if not exists actor_states
+(
+	head text not null,
+	code text not null,
+	state text not null
+)`,
+		`create unique index if not exists actor_states_head_code_uindex on actor_states (head, code)`,
+		`create table if not exists actor_states_errors
+(
+	head text not null,
+	code text not null,
+	reason text not null,
+	constraint actor_states_errors_pk
+		primary key (head, code)
+)`,
+		balanceDeltasTable,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// +build sqlite
+
+package processor
+
+import (
+	"database/sql"
+
+	// the driver of BackendSQLite, opened by OpenDB for a sqlite:// DSN. It is a cgo package, which is why the SQLite
+	// backend is only built with the sqlite build tag.
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/xerrors"
+)
+
+// openSQLite opens the SQLite database file at path. A single connection is kept open, SQLite runs one writer at a
+// time and every connection to an in memory database opens a database of its own.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, xerrors.Errorf("open sqlite database: %w", err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
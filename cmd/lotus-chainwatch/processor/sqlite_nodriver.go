@@ -0,0 +1,12 @@
+// +build !sqlite
+
+package processor
+
+import (
+	"database/sql"
+)
+
+// openSQLite fails, the SQLite driver is only built with the sqlite build tag.
+func openSQLite(string) (*sql.DB, error) {
+	return nil, errNoSQLite
+}
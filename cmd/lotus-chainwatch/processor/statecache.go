@@ -0,0 +1,118 @@
+package processor
+
+import (
+	"sync/atomic"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-cid"
+)
+
+// DefaultStateCacheSize is the default number of recently stored actor states remembered to skip rewriting them.
+const DefaultStateCacheSize = 100000
+
+type actorStateKey struct {
+	head cid.Cid
+	code cid.Cid
+}
+
+type actorStateRow struct {
+	actorStateKey
+	state string
+}
+
+// stateCache remembers the actor states stored most recently. actor_states is keyed on (head, code) and an unchanged
+// head is reinserted by every tipset, skipping those rows saves the round trip and the conflict resolution in the
+// unique index. A nil stateCache remembers nothing.
+type stateCache struct {
+	hitCounter
+	cache *lru.ARCCache
+}
+
+// hitCounter counts cache lookups.
+type hitCounter struct {
+	hits   int64
+	misses int64
+}
+
+func (h *hitCounter) count(hits, misses int64) {
+	atomic.AddInt64(&h.hits, hits)
+	atomic.AddInt64(&h.misses, misses)
+}
+
+// rate is the fraction of lookups that were hits.
+func (h *hitCounter) rate() float64 {
+	hits := atomic.LoadInt64(&h.hits)
+	total := hits + atomic.LoadInt64(&h.misses)
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+func newStateCache(size int) (*stateCache, error) {
+	cache, err := lru.NewARC(size)
+	if err != nil {
+		return nil, err
+	}
+	return &stateCache{cache: cache}, nil
+}
+
+// filter returns the states in actors not stored recently, each (head, code) at most once, and the number of states
+// skipped because they were.
+func (c *stateCache) filter(actors map[cid.Cid]ActorTips) ([]actorStateRow, int64) {
+	var out []actorStateRow
+	batch := map[actorStateKey]struct{}{}
+	var hits, misses int64
+	for code, actTips := range actors {
+		for _, actorInfo := range actTips {
+			for _, a := range actorInfo {
+				if missingActor(code, a) {
+					continue
+				}
+				k := actorStateKey{head: a.act.Head, code: code}
+				if _, ok := batch[k]; ok {
+					continue
+				}
+				batch[k] = struct{}{}
+
+				if c != nil && c.cache.Contains(k) {
+					hits++
+					continue
+				}
+				misses++
+				out = append(out, actorStateRow{actorStateKey: k, state: a.state})
+			}
+		}
+	}
+
+	if c != nil {
+		c.count(hits, misses)
+	}
+	return out, hits
+}
+
+// add remembers rows once they are committed.
+func (c *stateCache) add(rows []actorStateRow) {
+	if c == nil {
+		return
+	}
+	for _, r := range rows {
+		c.cache.Add(r.actorStateKey, struct{}{})
+	}
+}
+
+// purge forgets every state, for when stored states are deleted.
+func (c *stateCache) purge() {
+	if c == nil {
+		return
+	}
+	c.cache.Purge()
+}
+
+// hitRate is the fraction of states looked up that were skipped since the cache was created.
+func (c *stateCache) hitRate() float64 {
+	if c == nil {
+		return 0
+	}
+	return c.rate()
+}
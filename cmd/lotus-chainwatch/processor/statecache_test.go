@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateCacheSkipsRecentlyStored(t *testing.T) {
+	c, err := newStateCache(100)
+	require.NoError(t, err)
+
+	// every actor keeps the same head across tipsets, only the first occurrence is stored.
+	actors, addrs := syntheticActorTips(t, 3, 2)
+	for _, tips := range actors {
+		for tsk, infos := range tips {
+			for i := range infos {
+				infos[i].act.Head = testCid(t, "head-"+infos[i].addr.String())
+			}
+			tips[tsk] = infos
+		}
+	}
+
+	rows, skipped := c.filter(actors)
+	require.Len(t, rows, len(addrs))
+	require.Zero(t, skipped)
+	c.add(rows)
+
+	rows, skipped = c.filter(actors)
+	require.Empty(t, rows)
+	require.Equal(t, int64(len(addrs)), skipped)
+	require.Equal(t, 0.5, c.hitRate())
+}
+
+func TestStateCacheBounded(t *testing.T) {
+	c, err := newStateCache(2)
+	require.NoError(t, err)
+
+	actors, _ := syntheticActorTips(t, 1, 4)
+	rows, _ := c.filter(actors)
+	require.Len(t, rows, 4)
+	c.add(rows)
+
+	// only the two most recent states are remembered.
+	rows, skipped := c.filter(actors)
+	require.Len(t, rows, 2)
+	require.Equal(t, int64(2), skipped)
+}
+
+func TestNilStateCache(t *testing.T) {
+	var c *stateCache
+
+	actors, _ := syntheticActorTips(t, 2, 2)
+	rows, skipped := c.filter(actors)
+	require.Len(t, rows, 4)
+	require.Zero(t, skipped)
+	c.add(rows)
+	require.Zero(t, c.hitRate())
+}
@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ipfs/go-cid"
+)
+
+// StateDecoder decodes the state object head of an actor to the JSON stored in actor_states.
+type StateDecoder func(ctx context.Context, head cid.Cid) (json.RawMessage, error)
+
+// RegisterStateDecoder decodes the states of the actors of code with decode, so the state of an actor the node can't
+// decode, or one decoded differently than the node does, is stored without changing how the changes are collected.
+// The states of the builtin actors are read from the Source of the processor unless a decoder is registered for their
+// code, the states of any other code are not decoded and recorded in actor_states_errors. It must be called before
+// Start.
+func (p *Processor) RegisterStateDecoder(code cid.Cid, decode StateDecoder) {
+	if p.stateDecoders == nil {
+		p.stateDecoders = map[cid.Cid]StateDecoder{}
+	}
+	p.stateDecoders[code] = decode
+}
+
+// canDecodeState reports whether the states of the actors of code are decoded.
+func (p *Processor) canDecodeState(code cid.Cid) bool {
+	if _, ok := p.stateDecoders[code]; ok {
+		return true
+	}
+	_, ok := codeKind(code)
+	return ok
+}
+
+// registeredState returns the state of head decoded by the decoder registered for code, in the JSON encoding of the
+// processor. ok is false if no decoder is registered for code. A decoded state which is not valid JSON is returned as
+// it is, it is recorded in actor_states_errors when stored.
+func (p *Processor) registeredState(ctx context.Context, code, head cid.Cid) (state string, ok bool, err error) {
+	decode, ok := p.stateDecoders[code]
+	if !ok {
+		return "", false, nil
+	}
+	raw, err := decode(ctx, head)
+	if err != nil {
+		return "", true, err
+	}
+	if p.CanonicalStateJSON && json.Valid(raw) {
+		if raw, err = canonicalJSON(raw); err != nil {
+			return "", true, err
+		}
+	}
+	return string(raw), true, nil
+}
+
+// undecodedStates splits the rows of the codes whose states are not decoded off rows, as errors of actor_states_errors.
+func (p *Processor) undecodedStates(rows []actorStateRow) ([]actorStateRow, []actorStateError) {
+	var undecoded []actorStateError
+	out := rows[:0:0]
+	for _, r := range rows {
+		if p.canDecodeState(r.code) {
+			out = append(out, r)
+			continue
+		}
+		undecoded = append(undecoded, actorStateError{actorStateKey: r.actorStateKey, reason: "no state decoder for code"})
+	}
+	return out, undecoded
+}
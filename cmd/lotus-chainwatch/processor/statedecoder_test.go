@@ -0,0 +1,66 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestRegisteredStateDecoder(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		custom, unknown := testCid(t, "custom-code"), testCid(t, "unknown-code")
+
+		var decoded []cid.Cid
+		p.RegisterStateDecoder(custom, func(ctx context.Context, head cid.Cid) (json.RawMessage, error) {
+			decoded = append(decoded, head)
+			return json.RawMessage(`{"Head":"` + head.String() + `"}`), nil
+		})
+
+		addr, err := address.NewIDAddress(1000)
+		require.NoError(t, err)
+		actors := map[cid.Cid]ActorTips{}
+		for _, code := range []cid.Cid{custom, unknown} {
+			act := types.Actor{Code: code, Head: testCid(t, "head-"+code.String()), Balance: types.NewInt(0)}
+			state, err := p.decodedState(ctx, addr, types.EmptyTSK, act)
+			require.NoError(t, err)
+			actors[code] = ActorTips{types.EmptyTSK: {{act: act, addr: addr, stateroot: testCid(t, "stateroot"), state: state}}}
+		}
+		require.Equal(t, []cid.Cid{testCid(t, "head-"+custom.String())}, decoded)
+
+		require.NoError(t, p.storeActorStates(ctx, actors))
+
+		// the state of the registered code is stored as its decoder returned it.
+		var state string
+		require.NoError(t, p.db.QueryRow(`select state from actor_states where code = $1`, custom.String()).Scan(&state))
+		require.JSONEq(t, `{"Head":"`+testCid(t, "head-"+custom.String()).String()+`"}`, state)
+
+		// the one of the unregistered code is recorded as an error.
+		require.Zero(t, countRows(t, p.db, `select count(*) from actor_states where code = $1`, unknown.String()))
+		var reason string
+		require.NoError(t, p.db.QueryRow(`select reason from actor_states_errors where code = $1`, unknown.String()).Scan(&reason))
+		require.Equal(t, "no state decoder for code", reason)
+	})
+}
+
+func TestRegisteredStateDecoderOverridesBuiltin(t *testing.T) {
+	ctx := context.Background()
+	p := &Processor{}
+	p.RegisterStateDecoder(builtin.AccountActorCodeID, func(ctx context.Context, head cid.Cid) (json.RawMessage, error) {
+		return json.RawMessage(`{"Custom":true}`), nil
+	})
+
+	// the source is not read for a code with a decoder.
+	state, err := p.decodedState(ctx, address.Undef, types.EmptyTSK, types.Actor{Code: builtin.AccountActorCodeID, Head: testCid(t, "head")})
+	require.NoError(t, err)
+	require.Equal(t, `{"Custom":true}`, state)
+}
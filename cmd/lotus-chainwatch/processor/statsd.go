@@ -0,0 +1,72 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// DefaultStatsdPrefix is prepended to the name of every metric sent to StatsD.
+const DefaultStatsdPrefix = "chainwatch"
+
+// StatsdSink sends metrics to a StatsD compatible daemon, such as the Datadog agent, over UDP. Sends are fire and
+// forget so a missing daemon never slows processing down.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsdSink returns a MetricsSink sending to the StatsD daemon listening at addr.
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, xerrors.Errorf("dial statsd at %s: %w", addr, err)
+	}
+	return &StatsdSink{conn: conn, prefix: strings.TrimSuffix(prefix, ".")}, nil
+}
+
+func (s *StatsdSink) StoreDuration(ctx context.Context, table string, d time.Duration) {
+	s.send("store.duration."+table, fmt.Sprintf("%d|ms", d.Milliseconds()))
+}
+
+func (s *StatsdSink) StoreRows(ctx context.Context, table string, n int64) {
+	s.send("store.rows."+table, fmt.Sprintf("%d|c", n))
+}
+
+func (s *StatsdSink) StoreError(ctx context.Context, table string) {
+	s.send("store.errors."+table, "1|c")
+}
+
+func (s *StatsdSink) CacheLookups(ctx context.Context, cache string, hits, misses int64) {
+	s.send("cache.hits."+cache, fmt.Sprintf("%d|c", hits))
+	s.send("cache.misses."+cache, fmt.Sprintf("%d|c", misses))
+}
+
+func (s *StatsdSink) ActorsProcessed(ctx context.Context, code cid.Cid, n int64) {
+	s.send("actors.processed."+code.String(), fmt.Sprintf("%d|c", n))
+}
+
+func (s *StatsdSink) ProcessedEpoch(ctx context.Context, epoch abi.ChainEpoch) {
+	s.send("processed_epoch", fmt.Sprintf("%d|g", epoch))
+}
+
+func (s *StatsdSink) send(name, value string) {
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	if _, err := s.conn.Write([]byte(name + ":" + value)); err != nil {
+		log.Debugw("failed to send metric to statsd", "metric", name, "error", err)
+	}
+}
+
+// Close closes the connection to the StatsD daemon.
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
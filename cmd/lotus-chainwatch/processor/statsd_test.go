@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestStatsdSinkMetricNames(t *testing.T) {
+	ctx := context.Background()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+
+	sink, err := NewStatsdSink(conn.LocalAddr().String(), "cw.")
+	require.NoError(t, err)
+	defer sink.Close() //nolint:errcheck
+
+	p := &Processor{Metrics: sink}
+	start := time.Now()
+	p.recordStore(ctx, "actors", start, 3, nil)
+	p.recordStore(ctx, "actor_states", start, 0, xerrors.New("boom"))
+	p.metrics().CacheLookups(ctx, cacheDecode, 2, 1)
+	p.metrics().ActorsProcessed(ctx, builtin.AccountActorCodeID, 4)
+	p.metrics().ProcessedEpoch(ctx, 42)
+
+	var packets, got []string
+	buf := make([]byte, 512)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+
+		// name:value|type, durations vary so only the name and type are compared.
+		packet := string(buf[:n])
+		packets = append(packets, packet)
+		got = append(got, packet[:strings.Index(packet, ":")]+"|"+packet[strings.LastIndex(packet, "|")+1:])
+	}
+
+	require.Contains(t, packets, "cw.store.rows.actors:3|c")
+	require.Contains(t, packets, "cw.actors.processed."+builtin.AccountActorCodeID.String()+":4|c")
+	require.Contains(t, packets, "cw.processed_epoch:42|g")
+	require.Equal(t, []string{
+		"cw.store.duration.actors|ms",
+		"cw.store.rows.actors|c",
+		"cw.store.duration.actor_states|ms",
+		"cw.store.errors.actor_states|c",
+		"cw.cache.hits.decode|c",
+		"cw.cache.misses.decode|c",
+		"cw.actors.processed." + builtin.AccountActorCodeID.String() + "|c",
+		"cw.processed_epoch|g",
+	}, got)
+}
@@ -0,0 +1,147 @@
+package processor
+
+import (
+	"context"
+	"sort"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ActorRecord is the change of one actor, with the code it is handled as, fed to HandleActorStream.
+type ActorRecord struct {
+	Code cid.Cid
+	info actorInfo
+}
+
+// NewActorRecord returns the record of the actor at addr changing to act in the parent state of bh, whose parent
+// tipset is parent. state is the JSON of the decoded state of act stored in actor_states, empty if it is not decoded.
+func NewActorRecord(addr address.Address, act types.Actor, bh *types.BlockHeader, parent *types.TipSet, state string) ActorRecord {
+	return ActorRecord{Code: act.Code, info: actorInfo{
+		act:         act,
+		stateroot:   bh.ParentStateRoot,
+		height:      bh.Height,
+		tsKey:       parent.Key(),
+		parentTsKey: parent.Parents(),
+		addr:        addr,
+		state:       state,
+	}}
+}
+
+// StreamActorChanges sends the changes of the actors in the parent states of blocks to records in the order
+// HandleActorStream reads them, the records of a tipset together and the tipsets in ascending height. records is
+// closed once every change is sent, or the changes failed to be collected.
+func (p *Processor) StreamActorChanges(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader, records chan<- ActorRecord) error {
+	defer close(records)
+
+	actors, err := p.collectActorChanges(ctx, blocks)
+	if err != nil {
+		return xerrors.Errorf("collect actor changes: %w", err)
+	}
+	for _, r := range actorRecords(actors) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case records <- r:
+		}
+	}
+	return nil
+}
+
+// streamActorChanges hands the changes of the actors in the parent states of blocks to handle as they are sent by
+// StreamActorChanges.
+func (p *Processor) streamActorChanges(ctx context.Context, blocks map[cid.Cid]*types.BlockHeader, handle func(context.Context, <-chan ActorRecord) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	records := make(chan ActorRecord)
+	collected := make(chan error, 1)
+	go func() {
+		collected <- p.StreamActorChanges(ctx, blocks, records)
+	}()
+	if err := handle(ctx, records); err != nil {
+		// stop the changes still being sent, nothing reads them anymore.
+		cancel()
+		<-collected
+		return err
+	}
+	return <-collected
+}
+
+// actorRecords returns the changes of actors as records, the ones of each tipset together in ascending height.
+func actorRecords(actors map[cid.Cid]ActorTips) []ActorRecord {
+	var out []ActorRecord
+	for code, tips := range actors {
+		for _, infos := range tips {
+			for _, info := range infos {
+				out = append(out, ActorRecord{Code: code, info: info})
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].info.height != out[j].info.height {
+			return out[i].info.height < out[j].info.height
+		}
+		return out[i].info.tsKey.String() < out[j].info.tsKey.String()
+	})
+	return out
+}
+
+// HandleActorStream stores the actor changes read from records until it is closed, as HandleCommonActorsChanges does
+// for a map of them. The records are handled in batches of about BatchSize, DefaultBatchSize if it is not set, so only
+// one batch is held at a time however wide the range the records come from.
+//
+// The records of a tipset must be fed together and the tipsets in ascending height: a batch is only cut between two
+// tipsets so the checkpoint it moves never covers a tipset partly stored, and the balance deltas of a batch are
+// computed from the balances the batches before it stored.
+func (p *Processor) HandleActorStream(ctx context.Context, records <-chan ActorRecord) error {
+	size := p.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+
+	batch := map[cid.Cid]ActorTips{}
+	var (
+		n    int
+		last types.TipSetKey
+	)
+	flush := func() error {
+		if n == 0 {
+			return nil
+		}
+		if _, err := p.HandleCommonActorsChanges(ctx, batch); err != nil {
+			return xerrors.Errorf("handle batch of %d actor changes: %w", n, err)
+		}
+		batch = map[cid.Cid]ActorTips{}
+		n = 0
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-records:
+			if !ok {
+				return flush()
+			}
+			if n >= size && r.info.tsKey != last {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+
+			tips, ok := batch[r.Code]
+			if !ok {
+				tips = ActorTips{}
+				batch[r.Code] = tips
+			}
+			tips[r.info.tsKey] = append(tips[r.info.tsKey], r.info)
+			n++
+			last = r.info.tsKey
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// dumpRows returns every row of query as one string each.
+func dumpRows(t *testing.T, db *sql.DB, query string) []string {
+	rows, err := db.Query(query)
+	require.NoError(t, err)
+	defer rows.Close() //nolint:errcheck
+
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	var out []string
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		require.NoError(t, rows.Scan(ptrs...))
+		for i, v := range vals {
+			if b, ok := v.([]byte); ok {
+				vals[i] = string(b)
+			}
+		}
+		out = append(out, fmt.Sprint(vals...))
+	}
+	require.NoError(t, rows.Err())
+	return out
+}
+
+func TestHandleActorStream(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+		f := newCARFixture(t)
+
+		node, err := NewCARNode(bytes.NewReader(f.car))
+		require.NoError(t, err)
+		p.node = node
+		p.Source = NewNodeSource(node)
+		seedAddresses(t, p.db, []address.Address{builtin.InitActorAddr, f.account})
+
+		actors, err := p.collectActorChanges(ctx, f.blocks)
+		require.NoError(t, err)
+
+		tables := []string{
+			`select id, code, head, nonce, balance, stateroot from actors order by id, stateroot`,
+			`select head, code, state from actor_states order by head, code`,
+			`select id, epoch, delta, new_balance from balance_deltas order by id, epoch`,
+		}
+		dump := func() [][]string {
+			var out [][]string
+			for _, q := range tables {
+				out = append(out, dumpRows(t, p.db, q))
+			}
+			return out
+		}
+
+		_, err = p.HandleCommonActorsChanges(ctx, actors)
+		require.NoError(t, err)
+		want := dump()
+		require.NotEmpty(t, want[0])
+
+		for _, table := range []string{"actors", "actor_states", "balance_deltas", "processor_checkpoint"} {
+			_, err := p.db.Exec(`delete from ` + table)
+			require.NoError(t, err)
+		}
+
+		// a batch of one record cuts a batch at every tipset.
+		p.BatchSize = 1
+		records := make(chan ActorRecord)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- p.StreamActorChanges(ctx, f.blocks, records)
+		}()
+		require.NoError(t, p.HandleActorStream(ctx, records))
+		require.NoError(t, <-errc)
+		require.Equal(t, want, dump())
+	})
+}
+
+func TestNewActorRecord(t *testing.T) {
+	ctx := context.Background()
+	f := newCARFixture(t)
+	node, err := NewCARNode(bytes.NewReader(f.car))
+	require.NoError(t, err)
+	p := &Processor{node: node, Source: NewNodeSource(node), NoState: true}
+
+	actors, err := p.collectActorChanges(ctx, f.blocks)
+	require.NoError(t, err)
+
+	// a record built from the block and its parent tipset is the one collected.
+	for _, bh := range f.blocks {
+		parent, err := node.ChainGetTipSet(ctx, types.NewTipSetKey(bh.Parents...))
+		require.NoError(t, err)
+		act, err := node.StateGetActor(ctx, f.account, parent.Key())
+		require.NoError(t, err)
+
+		r := NewActorRecord(f.account, *act, bh, parent, "")
+		require.Contains(t, actorInfos(actors[builtin.AccountActorCodeID]), r.info)
+		require.Equal(t, builtin.AccountActorCodeID, r.Code)
+	}
+}
+
+// actorInfos returns every change of tips.
+func actorInfos(tips ActorTips) []actorInfo {
+	var out []actorInfo
+	for _, infos := range tips {
+		out = append(out, infos...)
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package processor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+)
+
+// ProcessSummary is what HandleCommonActorsChanges did with a batch.
+type ProcessSummary struct {
+	// Actors is the number of actor changes handled for each actor code.
+	Actors map[cid.Cid]int
+	// Rows is the number of rows written to each table, as reported to the MetricsSink.
+	Rows map[string]int
+	// Duration is how long handling the batch took.
+	Duration time.Duration
+	// MinEpoch and MaxEpoch bound the epochs of the changes handled, both are 0 when there were none.
+	MinEpoch abi.ChainEpoch
+	MaxEpoch abi.ChainEpoch
+}
+
+// newProcessSummary returns the summary of the actor changes in actors, without any row written yet.
+func newProcessSummary(actors map[cid.Cid]ActorTips) ProcessSummary {
+	s := ProcessSummary{Actors: map[cid.Cid]int{}, Rows: map[string]int{}}
+	first := true
+	for code, tips := range actors {
+		for _, infos := range tips {
+			for _, info := range infos {
+				s.Actors[code]++
+				if first || info.height < s.MinEpoch {
+					s.MinEpoch = info.height
+				}
+				if first || info.height > s.MaxEpoch {
+					s.MaxEpoch = info.height
+				}
+				first = false
+			}
+		}
+	}
+	return s
+}
+
+// codeCounts returns the actor counts of s keyed by the string of their code, for logging.
+func (s ProcessSummary) codeCounts() map[string]int {
+	out := make(map[string]int, len(s.Actors))
+	for code, n := range s.Actors {
+		out[code.String()] = n
+	}
+	return out
+}
+
+type storeRowsKey struct{}
+
+// storeRows adds up the rows recordStore reports for each table under a context returned by withStoreRows. The store
+// phases of a batch report concurrently.
+type storeRows struct {
+	lk   sync.Mutex
+	rows map[string]int
+}
+
+// withStoreRows returns a context under which the rows of every store are added up in the returned storeRows.
+func withStoreRows(ctx context.Context) (context.Context, *storeRows) {
+	s := &storeRows{rows: map[string]int{}}
+	return context.WithValue(ctx, storeRowsKey{}, s), s
+}
+
+func (s *storeRows) add(table string, n int) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.rows[table] += n
+}
+
+// counts returns a copy of the rows added up for each table.
+func (s *storeRows) counts() map[string]int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	out := make(map[string]int, len(s.rows))
+	for table, n := range s.rows {
+		out[table] = n
+	}
+	return out
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+)
+
+func TestHandleCommonActorsChangesSummary(t *testing.T) {
+	testBackends(t, func(t *testing.T, p *Processor) {
+		ctx := context.Background()
+
+		actors, addrs := syntheticActorTips(t, 3, 2)
+		miner, err := address.NewIDAddress(2000)
+		require.NoError(t, err)
+		seedAddresses(t, p.db, append(addrs, miner))
+
+		// the third tipset changes a miner along with the accounts, each tipset is at a height of its own.
+		miners := ActorTips{}
+		for tsk, infos := range actors[builtin.AccountActorCodeID] {
+			height := abi.ChainEpoch(infos[0].act.Nonce + 10)
+			for i := range infos {
+				infos[i].height = height
+			}
+			if height == 12 {
+				info := infos[0]
+				info.addr = miner
+				info.act.Code = builtin.StorageMinerActorCodeID
+				info.act.Head = testCid(t, "head-miner")
+				info.state = `{}`
+				miners[tsk] = []actorInfo{info}
+			}
+		}
+		actors[builtin.StorageMinerActorCodeID] = miners
+
+		summary, err := p.HandleCommonActorsChanges(ctx, actors)
+		require.NoError(t, err)
+		require.Equal(t, map[cid.Cid]int{builtin.AccountActorCodeID: 6, builtin.StorageMinerActorCodeID: 1}, summary.Actors)
+		require.Equal(t, abi.ChainEpoch(10), summary.MinEpoch)
+		require.Equal(t, abi.ChainEpoch(12), summary.MaxEpoch)
+		require.Equal(t, 7, summary.Rows["actors"])
+		require.Equal(t, 7, summary.Rows["actor_states"])
+		require.Equal(t, 7, countRows(t, p.db, `select count(*) from actors`))
+		require.NotZero(t, summary.Duration)
+
+		summary, err = p.HandleCommonActorsChanges(ctx, map[cid.Cid]ActorTips{})
+		require.NoError(t, err)
+		require.Empty(t, summary.Actors)
+		require.Zero(t, summary.MinEpoch)
+		require.Zero(t, summary.MaxEpoch)
+	})
+}
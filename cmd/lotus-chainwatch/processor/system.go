@@ -0,0 +1,138 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// The system actor of the actors versions up to maxActorsVersion has an empty state, it holds no bundle CID of the
+// builtin actors. Their code CIDs are what changes at a network upgrade to another actors version, so the code CID of
+// the system actor stands in for the bundle: it is recorded as builtin_actors_cid of system_state.
+
+func (p *Processor) setupSystem() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/*
+* the builtin actors the chain runs, stored at genesis and at every state root
+* the code of the system actor changed in
+*/
+create table if not exists system_state
+(
+	state_root text not null
+		constraint system_state_pk
+			primary key,
+	epoch bigint not null,
+	builtin_actors_cid text not null
+);
+
+/*
+* the first epoch each builtin actors CID was seen at, the network upgrades
+*/
+create or replace view builtin_actors_upgrades as
+	select builtin_actors_cid, min(epoch) as first_epoch
+	from system_state
+	group by builtin_actors_cid;
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// systemActorInfo is the builtin actors CID of a system actor change in which it differs from the parent tipset.
+type systemActorInfo struct {
+	common actorInfo
+
+	builtinActors cid.Cid
+}
+
+func (p *Processor) HandleSystemChanges(ctx context.Context, systemTips ActorTips) error {
+	changes, err := p.processSystem(ctx, systemTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process system actor: %w", err)
+	}
+
+	return p.storeSystemState(ctx, changes)
+}
+
+// processSystem returns the system actor changes in which the builtin actors CID differs from the one of the parent
+// tipset, the genesis state included.
+func (p *Processor) processSystem(ctx context.Context, systemTips ActorTips) ([]systemActorInfo, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Processed System Actor", "duration", time.Since(start).String())
+	}()
+
+	var out []systemActorInfo
+	for _, systems := range systemTips {
+		for _, st := range systems {
+			changed, err := p.builtinActorsChanged(ctx, st)
+			if err != nil {
+				return nil, xerrors.Errorf("diff builtin actors (@ %s): %w", st.stateroot, err)
+			}
+			if !changed {
+				continue
+			}
+			out = append(out, systemActorInfo{common: st, builtinActors: st.act.Code})
+		}
+	}
+	return out, nil
+}
+
+// builtinActorsChanged is the predicate processSystem writes a change with: whether the code of the system actor in
+// the change differs from its code in the parent tipset. Genesis has no parent, its builtin actors are always new.
+func (p *Processor) builtinActorsChanged(ctx context.Context, st actorInfo) (bool, error) {
+	if st.parentTsKey == types.EmptyTSK {
+		return true, nil
+	}
+	parent, err := p.node.StateGetActor(ctx, builtin.SystemActorAddr, st.parentTsKey)
+	if err != nil {
+		return false, err
+	}
+	return parent.Code != st.act.Code, nil
+}
+
+func (p *Processor) storeSystemState(ctx context.Context, systems []systemActorInfo) error {
+	if len(systems) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored System State", "duration", time.Since(start).String())
+	}()
+
+	rows := make([][]interface{}, 0, len(systems))
+	for _, s := range systems {
+		rows = append(rows, []interface{}{s.common.stateroot.String(), int64(s.common.height), s.builtinActors.String()})
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin system_state tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		cols := []string{"state_root", "epoch", "builtin_actors_cid"}
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "system_state", cols, rows); err != nil {
+			return xerrors.Errorf("store system state: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
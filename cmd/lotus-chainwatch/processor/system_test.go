@@ -0,0 +1,44 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+func TestStoreSystemState(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	// the system actor is of actors version 1 before the first epoch and is upgraded to version 2 at the second.
+	node := newTestNode()
+	parent := types.NewTipSetKey(testCid(t, "block-0"))
+	node.setActor(parent, builtin.SystemActorAddr, types.Actor{Code: builtin.SystemActorCodeID})
+	upgraded := builtinCode(t, "fil/2/system")
+
+	p := &Processor{db: db, node: node}
+	require.NoError(t, p.setupSystem())
+	_, err := db.Exec(`truncate system_state`)
+	require.NoError(t, err)
+
+	for i, code := range []cid.Cid{builtin.SystemActorCodeID, upgraded} {
+		tsk := types.NewTipSetKey(testCid(t, fmt.Sprintf("block-%d", i+1)))
+		act := types.Actor{Code: code}
+		node.setActor(tsk, builtin.SystemActorAddr, act)
+		require.NoError(t, p.HandleSystemChanges(ctx, actorChange(t, builtin.SystemActorAddr, act, abi.ChainEpoch(i+1), tsk, parent)))
+		parent = tsk
+	}
+
+	require.Equal(t, 1, countRows(t, db, `select count(*) from system_state`))
+	var epoch int64
+	require.NoError(t, db.QueryRow(`select first_epoch from builtin_actors_upgrades where builtin_actors_cid = $1`, upgraded.String()).Scan(&epoch))
+	require.Equal(t, int64(2), epoch)
+}
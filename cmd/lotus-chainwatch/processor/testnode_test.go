@@ -0,0 +1,148 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	ds_sync "github.com/ipfs/go-datastore/sync"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// testNode is the node the processor tests read the chain from. It serves the objects of an in memory blockstore, which
+// the tests put their states in through store, along with the tipsets and actors set on it. The other methods of the
+// node are not implemented.
+type testNode struct {
+	api.FullNode
+
+	bs    bstore.Blockstore
+	store adt.Store
+
+	tipsets  map[types.TipSetKey]*types.TipSet
+	byHeight map[abi.ChainEpoch]*types.TipSet
+	// actors are the actors in the state after executing each tipset, the ones set at EmptyTSK are in every state.
+	actors map[types.TipSetKey]map[address.Address]*types.Actor
+	// listed are the actors StateListActors returns.
+	listed []address.Address
+	// deals are the deals StateMarketDeals returns.
+	deals map[string]api.MarketDeal
+}
+
+func newTestNode() *testNode {
+	bs := bstore.NewBlockstore(ds_sync.MutexWrap(ds.NewMapDatastore()))
+	return &testNode{
+		bs:       bs,
+		store:    adt.WrapStore(context.Background(), cbornode.NewCborStore(bs)),
+		tipsets:  map[types.TipSetKey]*types.TipSet{},
+		byHeight: map[abi.ChainEpoch]*types.TipSet{},
+		actors:   map[types.TipSetKey]map[address.Address]*types.Actor{},
+	}
+}
+
+// put stores v in the blockstore of n and returns its cid.
+func (n *testNode) put(t testing.TB, v interface{}) cid.Cid {
+	c, err := n.store.Put(n.store.Context(), v)
+	require.NoError(t, err)
+	return c
+}
+
+// addTipSet adds ts to the tipsets of n, the one added last at a height is the one at that height.
+func (n *testNode) addTipSet(ts *types.TipSet) {
+	n.tipsets[ts.Key()] = ts
+	n.byHeight[ts.Height()] = ts
+}
+
+// setActor sets addr to act in the state after executing the tipset tsk.
+func (n *testNode) setActor(tsk types.TipSetKey, addr address.Address, act types.Actor) {
+	if n.actors[tsk] == nil {
+		n.actors[tsk] = map[address.Address]*types.Actor{}
+	}
+	n.actors[tsk][addr] = &act
+}
+
+// putActor stores state as the head of an actor of code and sets it at addr after executing the tipset tsk.
+func (n *testNode) putActor(t testing.TB, tsk types.TipSetKey, addr address.Address, code cid.Cid, state interface{}) types.Actor {
+	act := types.Actor{Code: code, Head: n.put(t, state), Balance: types.NewInt(0)}
+	n.setActor(tsk, addr, act)
+	return act
+}
+
+func (n *testNode) ChainReadObj(ctx context.Context, c cid.Cid) ([]byte, error) {
+	blk, err := n.bs.Get(c)
+	if err != nil {
+		return nil, err
+	}
+	return blk.RawData(), nil
+}
+
+func (n *testNode) ChainHasObj(ctx context.Context, c cid.Cid) (bool, error) {
+	return n.bs.Has(c)
+}
+
+func (n *testNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, ok := n.tipsets[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+func (n *testNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, _ types.TipSetKey) (*types.TipSet, error) {
+	ts, ok := n.byHeight[h]
+	if !ok {
+		return nil, xerrors.Errorf("no tipset at %d", h)
+	}
+	return ts, nil
+}
+
+func (n *testNode) ChainHead(ctx context.Context) (*types.TipSet, error) {
+	var head *types.TipSet
+	for _, ts := range n.byHeight {
+		if head == nil || ts.Height() > head.Height() {
+			head = ts
+		}
+	}
+	return head, nil
+}
+
+func (n *testNode) StateGetActor(ctx context.Context, addr address.Address, tsk types.TipSetKey) (*types.Actor, error) {
+	if act, ok := n.actors[tsk][addr]; ok {
+		return act, nil
+	}
+	if act, ok := n.actors[types.EmptyTSK][addr]; ok {
+		return act, nil
+	}
+	return nil, types.ErrActorNotFound
+}
+
+func (n *testNode) StateListActors(ctx context.Context, _ types.TipSetKey) ([]address.Address, error) {
+	return n.listed, nil
+}
+
+func (n *testNode) StateMarketDeals(ctx context.Context, _ types.TipSetKey) (map[string]api.MarketDeal, error) {
+	return n.deals, nil
+}
+
+// actorChange returns the tips of addr changing to act in the tipset tsk at height, whose parent is parent.
+func actorChange(t testing.TB, addr address.Address, act types.Actor, height abi.ChainEpoch, tsk, parent types.TipSetKey) ActorTips {
+	return ActorTips{tsk: {{
+		act:         act,
+		addr:        addr,
+		stateroot:   testCid(t, fmt.Sprintf("stateroot-%d", height)),
+		height:      height,
+		tsKey:       tsk,
+		parentTsKey: parent,
+	}}}
+}
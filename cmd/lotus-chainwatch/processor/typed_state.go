@@ -0,0 +1,56 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Typed state tables hold the fields of a decoded actor state as columns, so they can be filtered, ordered and
+// aggregated in SQL rather than extracted from the JSON of actor_states. miner_state is the first of them, one for
+// another actor follows the same pattern:
+//
+//   - the table is keyed by (<actor>_id, state_root), the actor's ID address and the state root the state was read at,
+//     the key of actors and the other per actor tables.
+//   - token amounts are numeric and epochs, counts and indexes bigint, text is only used for addresses and CIDs. A
+//     field missing from the state of some actors versions is a nullable column, written as nil for those versions.
+//   - the store maps each decoded state to one row of the columns and writes the rows with storeTypedState.
+//
+// Rows are only ever inserted, the state of an actor at a state root does not change.
+
+// storeTypedState writes rows of cols to the typed state table, batched by the processor's BatchSize.
+func (p *Processor) storeTypedState(ctx context.Context, table string, cols []string, rows [][]interface{}) (err error) {
+	start := time.Now()
+	var stored int
+	defer func() {
+		p.recordStore(ctx, table, start, stored, err)
+		p.logger().Debugw("Stored Typed State", "table", table, "duration", time.Since(start).String())
+	}()
+
+	for _, b := range batchRanges(len(rows), p.BatchSize) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := rows[b[0]:b[1]]
+		if err := withRetry(ctx, func() error {
+			tx, err := p.beginStoreTx(ctx)
+			if err != nil {
+				return err
+			}
+			defer p.rollbackStoreTx(ctx, tx)
+
+			if err := p.bulkInserter(tx).BulkInsert(ctx, table, cols, batch); err != nil {
+				return xerrors.Errorf("%s put: %w", table, err)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return p.commitStoreTx(ctx, tx)
+		}); err != nil {
+			return err
+		}
+		stored += len(batch)
+	}
+	return nil
+}
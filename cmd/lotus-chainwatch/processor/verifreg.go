@@ -0,0 +1,274 @@
+package processor
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/events/state"
+	"github.com/filecoin-project/lotus/chain/types"
+	cw_util "github.com/filecoin-project/lotus/cmd/lotus-chainwatch/util"
+)
+
+// verifiedRegistryInfo is the datacap of the verifiers and verified clients that changed in a verified registry
+// change, nil if none did.
+type verifiedRegistryInfo struct {
+	common actorInfo
+
+	verifiers *state.DataCapChanges
+	clients   *state.DataCapChanges
+}
+
+func (p *Processor) setupVerifiedRegistry() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`
+/*
+* the datacap of a verifier as of each epoch it changed at, a removed verifier
+* has a datacap of 0. address is the ID address of the verifier when known
+*/
+create table if not exists verified_registry_verifiers
+(
+	address text not null,
+	datacap numeric not null,
+	epoch bigint not null,
+	constraint verified_registry_verifiers_pk
+		primary key (address, epoch)
+);
+
+/*
+* the datacap of a verified client as of each epoch it changed at, a client
+* is removed once it has used all of it. address is the ID address of the
+* client when known
+*/
+create table if not exists verified_registry_clients
+(
+	address text not null,
+	datacap numeric not null,
+	epoch bigint not null,
+	constraint verified_registry_clients_pk
+		primary key (address, epoch)
+);
+`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *Processor) HandleVerifiedRegistryChanges(ctx context.Context, verifregTips ActorTips) error {
+	changes, err := p.processVerifiedRegistry(ctx, verifregTips)
+	if err != nil {
+		return xerrors.Errorf("Failed to process verified registry: %w", err)
+	}
+
+	return p.storeVerifiedRegistry(ctx, changes)
+}
+
+// processVerifiedRegistry diffs the verifiers and verified clients of every verified registry change against the
+// parent tipset, so only the datacap that changed is written.
+func (p *Processor) processVerifiedRegistry(ctx context.Context, verifregTips ActorTips) ([]verifiedRegistryInfo, error) {
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Processed Verified Registry", "duration", time.Since(start).String())
+	}()
+
+	pred := state.NewStatePredicates(p.node)
+
+	var out []verifiedRegistryInfo
+	for _, registries := range verifregTips {
+		for _, vt := range registries {
+			info := verifiedRegistryInfo{common: vt}
+
+			// genesis has no parent to diff against, every verifier and client it holds is new.
+			if vt.parentTsKey == types.EmptyTSK {
+				if err := p.genesisVerifiedRegistry(ctx, &info); err != nil {
+					return nil, xerrors.Errorf("read genesis verified registry (@ %s): %w", vt.stateroot, err)
+				}
+				out = append(out, info)
+				continue
+			}
+
+			verifiersDiff := pred.OnVerifiedRegistryActorChanged(pred.OnVerifiersChanged())
+			changed, val, err := verifiersDiff(ctx, vt.parentTsKey, vt.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("diff verifiers (@ %s): %w", vt.stateroot, err)
+			}
+			if changed {
+				changes, ok := val.(*state.DataCapChanges)
+				if !ok {
+					return nil, xerrors.Errorf("Unknown type returned by Verifiers HAMT predicate: %T", val)
+				}
+				info.verifiers = changes
+			}
+
+			clientsDiff := pred.OnVerifiedRegistryActorChanged(pred.OnVerifiedClientsChanged())
+			changed, val, err = clientsDiff(ctx, vt.parentTsKey, vt.tsKey)
+			if err != nil {
+				return nil, xerrors.Errorf("diff verified clients (@ %s): %w", vt.stateroot, err)
+			}
+			if changed {
+				changes, ok := val.(*state.DataCapChanges)
+				if !ok {
+					return nil, xerrors.Errorf("Unknown type returned by Verified Clients HAMT predicate: %T", val)
+				}
+				info.clients = changes
+			}
+
+			out = append(out, info)
+		}
+	}
+	return out, nil
+}
+
+// genesisVerifiedRegistry records every verifier and client of the genesis verified registry as added.
+func (p *Processor) genesisVerifiedRegistry(ctx context.Context, info *verifiedRegistryInfo) error {
+	store := cw_util.NewAPIIpldStore(ctx, p.node)
+
+	var st verifreg.State
+	if err := store.Get(ctx, info.common.act.Head, &st); err != nil {
+		return err
+	}
+
+	var err error
+	if info.verifiers, err = dataCaps(store, st.Verifiers); err != nil {
+		return xerrors.Errorf("read verifiers: %w", err)
+	}
+	if info.clients, err = dataCaps(store, st.VerifiedClients); err != nil {
+		return xerrors.Errorf("read verified clients: %w", err)
+	}
+	return nil
+}
+
+// dataCaps reads a HAMT of datacap keyed by address as added datacap.
+func dataCaps(store adt.Store, root cid.Cid) (*state.DataCapChanges, error) {
+	m, err := adt.AsMap(store, root)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &state.DataCapChanges{}
+	var dc verifreg.DataCap
+	if err := m.ForEach(&dc, func(key string) error {
+		addr, err := address.NewFromBytes([]byte(key))
+		if err != nil {
+			return err
+		}
+		out.Added = append(out.Added, state.AddressDataCap{Address: addr, DataCap: dc})
+		dc = verifreg.DataCap{}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *Processor) storeVerifiedRegistry(ctx context.Context, registries []verifiedRegistryInfo) error {
+	if len(registries) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		p.logger().Debugw("Stored Verified Registry", "duration", time.Since(start).String())
+	}()
+
+	var robust []string
+	for _, r := range registries {
+		for _, changes := range []*state.DataCapChanges{r.verifiers, r.clients} {
+			for _, a := range dataCapAddresses(changes) {
+				if a.Protocol() != address.ID {
+					robust = append(robust, a.String())
+				}
+			}
+		}
+	}
+	ids, err := p.lookupIDs(ctx, robust)
+	if err != nil {
+		return xerrors.Errorf("resolve verified registry addresses: %w", err)
+	}
+
+	var verifiers, clients [][]interface{}
+	for _, r := range registries {
+		verifiers = append(verifiers, dataCapRows(r.verifiers, ids, r.common)...)
+		clients = append(clients, dataCapRows(r.clients, ids, r.common)...)
+	}
+
+	return withRetry(ctx, func() error {
+		tx, err := p.beginStoreTx(ctx)
+		if err != nil {
+			return xerrors.Errorf("begin verified registry tx: %w", err)
+		}
+		defer p.rollbackStoreTx(ctx, tx)
+
+		cols := []string{"address", "datacap", "epoch"}
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "verified_registry_verifiers", cols, verifiers); err != nil {
+			return xerrors.Errorf("store verifiers: %w", err)
+		}
+		if err := p.bulkInserter(tx).BulkInsert(ctx, "verified_registry_clients", cols, clients); err != nil {
+			return xerrors.Errorf("store verified clients: %w", err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return p.commitStoreTx(ctx, tx)
+	})
+}
+
+// dataCapAddresses returns the addresses whose datacap changed.
+func dataCapAddresses(changes *state.DataCapChanges) []address.Address {
+	if changes == nil {
+		return nil
+	}
+
+	var out []address.Address
+	for _, a := range changes.Added {
+		out = append(out, a.Address)
+	}
+	for _, m := range changes.Modified {
+		out = append(out, m.Address)
+	}
+	for _, r := range changes.Removed {
+		out = append(out, r.Address)
+	}
+	return out
+}
+
+// dataCapRows returns the rows of the datacap changed at the height of common, with the addresses resolved through ids
+// where they are known. A removed address is left with no datacap.
+func dataCapRows(changes *state.DataCapChanges, ids map[address.Address]address.Address, common actorInfo) [][]interface{} {
+	if changes == nil {
+		return nil
+	}
+
+	row := func(a address.Address, dc big.Int) []interface{} {
+		if id, ok := ids[a]; ok {
+			a = id
+		}
+		return []interface{}{a.String(), dc.String(), common.height}
+	}
+
+	var out [][]interface{}
+	for _, a := range changes.Added {
+		out = append(out, row(a.Address, a.DataCap))
+	}
+	for _, m := range changes.Modified {
+		out = append(out, row(m.Address, m.To))
+	}
+	for _, r := range changes.Removed {
+		out = append(out, row(r.Address, big.Zero()))
+	}
+	return out
+}
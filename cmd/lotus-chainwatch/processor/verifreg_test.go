@@ -0,0 +1,129 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+	"github.com/filecoin-project/specs-actors/actors/builtin/verifreg"
+	"github.com/filecoin-project/specs-actors/actors/util/adt"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// putDataCaps stores a HAMT of datacap keyed by address and returns its root.
+func putDataCaps(t *testing.T, store adt.Store, caps map[address.Address]int64) cid.Cid {
+	m := adt.MakeEmptyMap(store)
+	for a, n := range caps {
+		dc := verifreg.DataCap(big.NewInt(n))
+		require.NoError(t, m.Put(adt.AddrKey(a), &dc))
+	}
+	root, err := m.Root()
+	require.NoError(t, err)
+	return root
+}
+
+// verifregFixture returns a node and the verified registry changes of a genesis holding one verifier with 100 bytes of
+// datacap, and of the tipset after it, in which the verifier grants 10 bytes to a client known by its robust address.
+func verifregFixture(t *testing.T) (*testNode, ActorTips, ActorTips, address.Address, address.Address) {
+	node := newTestNode()
+
+	verifier := mock.Address(100)
+	client, err := address.NewSecp256k1Address([]byte("verified client"))
+	require.NoError(t, err)
+
+	emptyMap, err := adt.MakeEmptyMap(node.store).Root()
+	require.NoError(t, err)
+
+	genState := verifreg.ConstructState(emptyMap, mock.Address(80))
+	genState.Verifiers = putDataCaps(t, node.store, map[address.Address]int64{verifier: 100})
+	nextState := verifreg.ConstructState(emptyMap, mock.Address(80))
+	nextState.Verifiers = putDataCaps(t, node.store, map[address.Address]int64{verifier: 90})
+	nextState.VerifiedClients = putDataCaps(t, node.store, map[address.Address]int64{client: 10})
+
+	genTsk := types.NewTipSetKey(testCid(t, "genesis"))
+	nextTsk := types.NewTipSetKey(testCid(t, "block-1"))
+	genAct := node.putActor(t, genTsk, builtin.VerifiedRegistryActorAddr, builtin.VerifiedRegistryActorCodeID, genState)
+	nextAct := node.putActor(t, nextTsk, builtin.VerifiedRegistryActorAddr, builtin.VerifiedRegistryActorCodeID, nextState)
+
+	genesis := actorChange(t, builtin.VerifiedRegistryActorAddr, genAct, 0, genTsk, types.EmptyTSK)
+	next := actorChange(t, builtin.VerifiedRegistryActorAddr, nextAct, 1, nextTsk, genTsk)
+	return node, genesis, next, verifier, client
+}
+
+func TestProcessVerifiedRegistry(t *testing.T) {
+	ctx := context.Background()
+	node, genesis, next, verifier, client := verifregFixture(t)
+	p := &Processor{node: node}
+
+	infos, err := p.processVerifiedRegistry(ctx, genesis)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Len(t, infos[0].verifiers.Added, 1)
+	require.Equal(t, verifier, infos[0].verifiers.Added[0].Address)
+	require.Empty(t, infos[0].clients.Added)
+
+	infos, err = p.processVerifiedRegistry(ctx, next)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	// only the datacap that changed is emitted.
+	require.Empty(t, infos[0].verifiers.Added)
+	require.Len(t, infos[0].verifiers.Modified, 1)
+	require.Equal(t, big.NewInt(100), infos[0].verifiers.Modified[0].From)
+	require.Equal(t, big.NewInt(90), infos[0].verifiers.Modified[0].To)
+
+	require.Len(t, infos[0].clients.Added, 1)
+	require.Equal(t, client, infos[0].clients.Added[0].Address)
+	require.Equal(t, big.NewInt(10), infos[0].clients.Added[0].DataCap)
+}
+
+func TestStoreVerifiedRegistry(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	node, genesis, next, verifier, client := verifregFixture(t)
+
+	p := &Processor{db: db, node: node}
+	require.NoError(t, p.setupVerifiedRegistry())
+	_, err := db.Exec(`truncate verified_registry_verifiers, verified_registry_clients`)
+	require.NoError(t, err)
+
+	clientID := mock.Address(1000)
+	require.NoError(t, p.storeAddressMap(ctx, map[address.Address]address.Address{client: clientID}))
+
+	require.NoError(t, p.HandleVerifiedRegistryChanges(ctx, genesis))
+	require.NoError(t, p.HandleVerifiedRegistryChanges(ctx, next))
+
+	type dataCap struct {
+		address string
+		datacap string
+		epoch   int64
+	}
+	query := func(table string) []dataCap {
+		rows, err := db.Query(`select address, datacap, epoch from ` + table + ` order by epoch`)
+		require.NoError(t, err)
+		defer rows.Close() //nolint:errcheck
+
+		var out []dataCap
+		for rows.Next() {
+			var dc dataCap
+			require.NoError(t, rows.Scan(&dc.address, &dc.datacap, &dc.epoch))
+			out = append(out, dc)
+		}
+		require.NoError(t, rows.Err())
+		return out
+	}
+
+	require.Equal(t, []dataCap{
+		{verifier.String(), "100", 0},
+		{verifier.String(), "90", 1},
+	}, query("verified_registry_verifiers"))
+	// the client is stored by its ID address.
+	require.Equal(t, []dataCap{{clientID.String(), "10", 1}}, query("verified_registry_clients"))
+}
@@ -0,0 +1,136 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+	"github.com/filecoin-project/specs-actors/actors/abi/big"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// ActorMismatch is an actor whose stored state as of an epoch differs from the one the node has.
+type ActorMismatch struct {
+	ID address.Address
+	// Height is the height of the stored row, the latest one of the actor at or before the verified epoch.
+	Height abi.ChainEpoch
+
+	// Fields are the fields that differ: head, nonce or balance, or missing if the node has no such actor.
+	Fields []string
+
+	StoredHead    cid.Cid
+	StoredNonce   uint64
+	StoredBalance big.Int
+	// Chain is the actor as the node has it, nil if it is missing.
+	Chain *types.Actor
+}
+
+func (m ActorMismatch) String() string {
+	if m.Chain == nil {
+		return fmt.Sprintf("%s (stored at %d): missing on chain", m.ID, m.Height)
+	}
+	return fmt.Sprintf("%s (stored at %d): head %s/%s nonce %d/%d balance %s/%s", m.ID, m.Height,
+		m.StoredHead, m.Chain.Head, m.StoredNonce, m.Chain.Nonce, m.StoredBalance, m.Chain.Balance)
+}
+
+// VerifyReport is the outcome of VerifyActors.
+type VerifyReport struct {
+	Epoch      abi.ChainEpoch
+	Matched    int
+	Mismatches []ActorMismatch
+}
+
+// VerifyActors compares the state of the actors stored as of epoch, the rows actor_tips picks, with the state the node
+// has in the parent state of the tipset at epoch. A row reorged out but not replaced or a change in a skipped tipset
+// shows up as a mismatch. sample limits the check to that many actors picked at random, 0 checks every actor.
+func (p *Processor) VerifyActors(ctx context.Context, epoch abi.ChainEpoch, sample int) (*VerifyReport, error) {
+	ts, err := p.node.ChainGetTipSetByHeight(ctx, epoch, types.EmptyTSK)
+	if err != nil {
+		return nil, xerrors.Errorf("get tipset at %d: %w", epoch, err)
+	}
+	if ts.Height() != epoch {
+		return nil, xerrors.Errorf("no tipset at %d, it is a null round", epoch)
+	}
+
+	// actor_tips excludes its upper bound.
+	query := `select id, head, nonce, balance, height from actor_tips($1)`
+	args := []interface{}{epoch + 1}
+	if sample > 0 {
+		query += ` order by random() limit $2`
+		args = append(args, sample)
+	}
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, xerrors.Errorf("query actors at %d: %w", epoch, err)
+	}
+	defer rows.Close() //nolint:errcheck
+
+	var stored []ActorMismatch
+	for rows.Next() {
+		var (
+			id, head, balanceText string
+			nonce                 uint64
+			height                int64
+		)
+		if err := rows.Scan(&id, &head, &nonce, &balanceText, &height); err != nil {
+			return nil, xerrors.Errorf("scan actors at %d: %w", epoch, err)
+		}
+
+		s := ActorMismatch{StoredNonce: nonce, Height: abi.ChainEpoch(height)}
+		if s.ID, err = address.NewFromString(id); err != nil {
+			return nil, err
+		}
+		if s.StoredHead, err = cid.Parse(head); err != nil {
+			return nil, err
+		}
+		if s.StoredBalance, err = types.BigFromString(balanceText); err != nil {
+			return nil, xerrors.Errorf("parse balance of %s: %w", id, err)
+		}
+		stored = append(stored, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Epoch: epoch}
+	for _, s := range stored {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		act, err := p.node.StateGetActor(ctx, s.ID, ts.Parents())
+		if err != nil {
+			// the error lost its type on the way from a remote node.
+			if strings.Contains(err.Error(), types.ErrActorNotFound.Error()) {
+				s.Fields = []string{"missing"}
+				report.Mismatches = append(report.Mismatches, s)
+				continue
+			}
+			return nil, xerrors.Errorf("get actor %s at %d: %w", s.ID, epoch, err)
+		}
+
+		s.Chain = act
+		if act.Head != s.StoredHead {
+			s.Fields = append(s.Fields, "head")
+		}
+		if act.Nonce != s.StoredNonce {
+			s.Fields = append(s.Fields, "nonce")
+		}
+		if !act.Balance.Equals(s.StoredBalance) {
+			s.Fields = append(s.Fields, "balance")
+		}
+		if len(s.Fields) == 0 {
+			report.Matched++
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, s)
+	}
+	return report, nil
+}
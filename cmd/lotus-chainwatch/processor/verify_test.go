@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/specs-actors/actors/builtin"
+
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func TestVerifyActors(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	setupTestBlocks(t, db)
+	p := &Processor{db: db}
+
+	// the state of tipset i is stored at height i+1, the parent state of the tipset at 3 is the one of tipset 2.
+	actors, addrs := syntheticActorTips(t, 3, 3)
+	seedAddresses(t, db, addrs)
+	require.NoError(t, p.storeActorHeads(ctx, actors))
+	for i := 0; i < 3; i++ {
+		_, err := db.Exec(`insert into blocks (cid, parentstateroot, height) values ($1, $2, $3)`,
+			testCid(t, fmt.Sprintf("child-%d", i)).String(), testCid(t, fmt.Sprintf("stateroot-%d", i)).String(), i+1)
+		require.NoError(t, err)
+	}
+	_, err := db.Exec(`refresh materialized view state_heights`)
+	require.NoError(t, err)
+
+	bh := mock.MkBlock(nil, 1, 1)
+	bh.Height = 3
+	bh.Parents = []cid.Cid{testCid(t, "block-2")}
+	ts := mock.TipSet(bh)
+	node := newTestNode()
+	node.addTipSet(ts)
+	for _, info := range actors[builtin.AccountActorCodeID][ts.Parents()] {
+		node.setActor(ts.Parents(), info.addr, info.act)
+	}
+	p.node = node
+
+	report, err := p.VerifyActors(ctx, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Matched)
+	require.Empty(t, report.Mismatches)
+
+	// a corrupted row and an actor the node does not have.
+	_, err = db.Exec(`update actors set nonce = 99 where id = $1 and stateroot = $2`, addrs[0].String(), testCid(t, "stateroot-2").String())
+	require.NoError(t, err)
+	delete(node.actors[ts.Parents()], addrs[1])
+
+	report, err = p.VerifyActors(ctx, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Matched)
+	require.Len(t, report.Mismatches, 2)
+	byID := map[address.Address]ActorMismatch{}
+	for _, m := range report.Mismatches {
+		byID[m.ID] = m
+	}
+	require.Equal(t, []string{"nonce"}, byID[addrs[0]].Fields)
+	require.EqualValues(t, 99, byID[addrs[0]].StoredNonce)
+	require.EqualValues(t, 2, byID[addrs[0]].Chain.Nonce)
+	require.Equal(t, []string{"missing"}, byID[addrs[1]].Fields)
+	require.Nil(t, byID[addrs[1]].Chain)
+
+	// a sample checks only that many actors.
+	report, err = p.VerifyActors(ctx, 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Matched+len(report.Mismatches))
+}
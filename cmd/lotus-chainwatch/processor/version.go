@@ -0,0 +1,30 @@
+package processor
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+)
+
+type versioner interface {
+	Version(context.Context) (api.Version, error)
+}
+
+// CheckNodeVersion refuses nodes exposing an API chainwatch was not built against. The predicates and state lookups
+// depend on the shape of the node API, which may change between minor versions before 1.0, so the major and minor
+// versions must match build.APIVersion. Any patch version is accepted.
+func CheckNodeVersion(ctx context.Context, node versioner) error {
+	v, err := node.Version(ctx)
+	if err != nil {
+		return xerrors.Errorf("get node version: %w", err)
+	}
+
+	if !v.APIVersion.EqMajorMinor(build.APIVersion) {
+		return xerrors.Errorf("node %s exposes API version %s, chainwatch supports %s (any patch version): upgrade chainwatch or the node so they match",
+			v.Version, v.APIVersion, build.APIVersion)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/filecoin-project/lotus/api"
+	"github.com/filecoin-project/lotus/build"
+)
+
+type versionNode struct {
+	v api.Version
+}
+
+func (n versionNode) Version(context.Context) (api.Version, error) {
+	return n.v, nil
+}
+
+func TestCheckNodeVersion(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, CheckNodeVersion(ctx, versionNode{v: api.Version{Version: "supported", APIVersion: build.APIVersion}}))
+
+	// a patch release of the same API is fine.
+	require.NoError(t, CheckNodeVersion(ctx, versionNode{v: api.Version{Version: "patched", APIVersion: build.APIVersion + 1}}))
+
+	// a different minor version is not.
+	err := CheckNodeVersion(ctx, versionNode{v: api.Version{Version: "newer", APIVersion: build.APIVersion + 1<<8}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "newer")
+}
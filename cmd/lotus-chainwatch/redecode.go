@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var redecodeCmd = &cli.Command{
+	Name:  "redecode",
+	Usage: "Flag the blocks written by an older processor version for the running processor to process again",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "version",
+			Usage: "flag the blocks written below this writer version",
+			Value: processor.WriterVersion,
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+		ctx := lcli.ReqContext(cctx)
+
+		// the blocks are only flagged, the node is not used.
+		proc, err := openProcessor(cctx, nil)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+		n, err := proc.Redecode(ctx, cctx.Int("version"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("flagged %d blocks written below version %d\n", n, cctx.Int("version"))
+		return nil
+	},
+}
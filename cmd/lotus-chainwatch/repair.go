@@ -0,0 +1,38 @@
+package main
+
+import (
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var repairCmd = &cli.Command{
+	Name:  "repair",
+	Usage: "Add the IDs of stored actors missing from id_address_map, resolving their robust address on the node",
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+		ctx := lcli.ReqContext(cctx)
+
+		api, closer, err := lcli.GetFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		if err := processor.CheckNodeVersion(ctx, api); err != nil {
+			return err
+		}
+
+		proc, err := openProcessor(cctx, api)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+		return proc.RepairAddressMap(ctx)
+	},
+}
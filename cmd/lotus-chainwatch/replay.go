@@ -0,0 +1,39 @@
+package main
+
+import (
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var replayCmd = &cli.Command{
+	Name:      "replay",
+	Usage:     "Store the common actor changes of a chain segment recorded to a file, the node only resolves init actor addresses",
+	ArgsUsage: "<recorded chain file>",
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+		if cctx.NArg() != 1 {
+			return xerrors.Errorf("expected the path of the recorded chain file")
+		}
+		ctx := lcli.ReqContext(cctx)
+
+		api, closer, err := lcli.GetFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		proc, err := openProcessor(cctx, api)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+		return proc.Replay(ctx, cctx.Args().First())
+	},
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
-	"database/sql"
+	"net/http"
 	"os"
 
+	"contrib.go.opencensus.io/exporter/prometheus"
 	_ "github.com/lib/pq"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap/zapcore"
 
 	lcli "github.com/filecoin-project/lotus/cli"
 	logging "github.com/ipfs/go-log/v2"
@@ -23,6 +26,147 @@ var runCmd = &cli.Command{
 			Name:  "max-batch",
 			Value: 1000,
 		},
+		&cli.IntFlag{
+			Name:  "batch-heights",
+			Usage: "max number of distinct heights processed per cycle when catching up, 0 for no limit",
+			Value: 0,
+		},
+		&cli.IntFlag{
+			Name:  "head-lag",
+			Usage: "number of epochs below the head a block must be to be processed, so reorged blocks are rarely processed",
+			Value: processor.DefaultHeadLag,
+		},
+		&cli.DurationFlag{
+			Name:  "poll-interval",
+			Usage: "how long to wait before checking for new blocks once caught up",
+			Value: processor.DefaultPollInterval,
+		},
+		&cli.IntFlag{
+			Name:  "copy-batch-size",
+			Usage: "max number of rows written to a table per transaction, 0 for no limit",
+			Value: processor.DefaultBatchSize,
+		},
+		&cli.IntFlag{
+			Name:  "actor-state-cache-size",
+			Usage: "number of recently stored actor states remembered to skip rewriting them, 0 to disable",
+			Value: processor.DefaultStateCacheSize,
+		},
+		&cli.IntFlag{
+			Name:  "decode-cache-size",
+			Usage: "number of decoded actor states kept by head and code to skip decoding them again, 0 to disable",
+			Value: processor.DefaultDecodeCacheSize,
+		},
+		&cli.IntFlag{
+			Name:  "id-cache-size",
+			Usage: "number of robust addresses whose ID address is kept to skip looking it up on the node again, 0 to disable",
+			Value: processor.DefaultIDCacheSize,
+		},
+		&cli.Float64Flag{
+			Name:  "node-qps",
+			Usage: "most calls per second made to the lotus node, 0 for no limit",
+			Value: processor.DefaultNodeQPS,
+		},
+		&cli.IntFlag{
+			Name:  "node-burst",
+			Usage: "number of calls made to the lotus node at once before --node-qps applies",
+			Value: processor.DefaultNodeBurst,
+		},
+		&cli.StringFlag{
+			Name:  "actors-mode",
+			Usage: "what the actors table keeps: history for every head of an actor, latest for only its latest head",
+			Value: "history",
+		},
+		&cli.BoolFlag{
+			Name:  "canonical-state-json",
+			Usage: "store actor states as canonical JSON so identical states are byte identical",
+		},
+		&cli.IntFlag{
+			Name:  "state-retention",
+			Usage: "number of epochs of actor states to keep, older states are pruned periodically, 0 to keep every state",
+			Value: 0,
+		},
+		&cli.DurationFlag{
+			Name:  "prune-interval",
+			Usage: "how often actor states are pruned with --state-retention",
+			Value: processor.DefaultPruneInterval,
+		},
+		&cli.DurationFlag{
+			Name:  "statement-timeout",
+			Usage: "longest a statement of a store transaction may run before the transaction is rolled back, 0 for no limit",
+			Value: processor.DefaultStatementTimeout,
+		},
+		&cli.StringFlag{
+			Name:  "processor-log-level",
+			Usage: "log level of the processor, the one of --log-level if not set",
+		},
+		&cli.StringFlag{
+			Name:  "processor-log-file",
+			Usage: "write the logs of the processor to this file as JSON lines instead of with the other logs",
+		},
+		&cli.BoolFlag{
+			Name:  "atomic-range",
+			Usage: "store the common actors of a range in a single transaction, one phase at a time, so a failure stores none of it",
+		},
+		&cli.BoolFlag{
+			Name:  "no-state",
+			Usage: "store the heads of the actors but not their decoded states in actor_states",
+		},
+		&cli.BoolFlag{
+			Name:  "partition-actors",
+			Usage: "partition the actors table by epoch on start if it is not, copying every row of it in a single transaction",
+		},
+		&cli.StringSliceFlag{
+			Name:  "processors",
+			Usage: "comma separated processors to run out of market, miner, reward, power, init, account, multisig, paych, verifreg, cron, system, messages, actor_events and common_actors, or common, all of them if not set",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "process a single batch of the blocks already synced and log what it would write without committing it, the chain is not synced",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-sink",
+			Usage: "where to send processing metrics: prometheus or statsd",
+			Value: "prometheus",
+		},
+		&cli.StringFlag{
+			Name:  "metrics-addr",
+			Usage: "address to serve Prometheus metrics on at /metrics with --metrics-sink=prometheus, empty to disable",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "api-addr",
+			Usage: "address to serve the read only HTTP API on, empty to disable",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "statsd-addr",
+			Usage: "address of the StatsD daemon metrics are sent to with --metrics-sink=statsd",
+			Value: "127.0.0.1:8125",
+		},
+		&cli.StringFlag{
+			Name:  "statsd-prefix",
+			Usage: "prefix of the metric names sent to StatsD",
+			Value: processor.DefaultStatsdPrefix,
+		},
+		&cli.IntFlag{
+			Name:  "max-reorg-depth",
+			Usage: "deepest reorg to revert incrementally by marking its reverted blocks, deeper reorgs flag the affected heights for a full reprocess",
+			Value: syncer.DefaultMaxReorgDepth,
+		},
+		&cli.IntFlag{
+			Name:  "max-buffered-headers",
+			Usage: "unsynced block headers held in memory while syncing, the rest are spilled to disk, 0 holds them all in memory",
+			Value: syncer.DefaultMaxBufferedHeaders,
+		},
+		&cli.StringFlag{
+			Name:  "header-spill-dir",
+			Usage: "directory unsynced block headers are spilled to, the default temporary directory if empty",
+		},
+		&cli.Int64Flag{
+			Name:  "max-spill-bytes",
+			Usage: "size the file of spilled block headers may grow to, a sync needing more fails, 0 leaves it unbounded",
+			Value: syncer.DefaultMaxSpillBytes,
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		ll := cctx.String("log-level")
@@ -32,6 +176,13 @@ var runCmd = &cli.Command{
 		if err := logging.SetLogLevel("rpc", "error"); err != nil {
 			return err
 		}
+		processorLevel := ll
+		if lvl := cctx.String("processor-log-level"); lvl != "" {
+			if err := logging.SetLogLevel("processor", lvl); err != nil {
+				return err
+			}
+			processorLevel = lvl
+		}
 
 		api, closer, err := lcli.GetFullNodeAPI(cctx)
 		if err != nil {
@@ -47,31 +198,129 @@ var runCmd = &cli.Command{
 
 		log.Infof("Remote version: %s", v.Version)
 
+		if err := processor.CheckNodeVersion(ctx, api); err != nil {
+			return err
+		}
+
 		maxBatch := cctx.Int("max-batch")
 
-		db, err := sql.Open("postgres", cctx.String("db"))
-		if err != nil {
-			return err
+		// the syncer and the processing loop write to Postgres only, a SQLite database is filled by backfill.
+		if processor.BackendOf(cctx.String("db")) == processor.BackendSQLite {
+			return xerrors.Errorf("run needs a Postgres database, use backfill to write to %s", cctx.String("db"))
 		}
-		defer func() {
-			if err := db.Close(); err != nil {
-				log.Errorw("Failed to close database", "error", err)
-			}
-		}()
 
-		if err := db.Ping(); err != nil {
-			return xerrors.Errorf("Database failed to respond to ping (is it online?): %w", err)
+		db, err := openDB(cctx)
+		if err != nil {
+			return err
 		}
-		db.SetMaxOpenConns(1350)
+		defer closeDB(db)
 
 		sync := syncer.NewSyncer(db, api)
-		sync.Start(ctx)
+		sync.MaxReorgDepth = cctx.Int("max-reorg-depth")
+		sync.MaxBufferedHeaders = cctx.Int("max-buffered-headers")
+		sync.SpillDir = cctx.String("header-spill-dir")
+		sync.MaxSpillBytes = cctx.Int64("max-spill-bytes")
+		if !cctx.Bool("dry-run") {
+			sync.Start(ctx)
+		}
 
-		proc := processor.NewProcessor(db, api, maxBatch)
+		proc := processor.NewProcessorFromDB(db, api, maxBatch)
+		proc.PollInterval = cctx.Duration("poll-interval")
+		proc.BatchHeights = cctx.Int("batch-heights")
+		proc.HeadLag = cctx.Int("head-lag")
+		proc.BatchSize = cctx.Int("copy-batch-size")
+		proc.StateCacheSize = cctx.Int("actor-state-cache-size")
+		proc.DecodeCacheSize = cctx.Int("decode-cache-size")
+		proc.IDCacheSize = cctx.Int("id-cache-size")
+		proc.NodeQPS = cctx.Float64("node-qps")
+		proc.NodeBurst = cctx.Int("node-burst")
+		proc.CanonicalStateJSON = cctx.Bool("canonical-state-json")
+		proc.StateRetention = cctx.Int("state-retention")
+		proc.PruneInterval = cctx.Duration("prune-interval")
+		proc.StatementTimeout = cctx.Duration("statement-timeout")
+		proc.AtomicRange = cctx.Bool("atomic-range")
+		proc.PartitionActors = cctx.Bool("partition-actors")
+		proc.NoState = cctx.Bool("no-state")
+		if path := cctx.String("processor-log-file"); path != "" {
+			var level zapcore.Level
+			if err := level.UnmarshalText([]byte(processorLevel)); err != nil {
+				return xerrors.Errorf("processor log level: %w", err)
+			}
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return xerrors.Errorf("open processor log file: %w", err)
+			}
+			defer f.Close() //nolint:errcheck
+			proc.Log = processor.NewJSONLogger(f, level)
+		}
+		proc.Processors = cctx.StringSlice("processors")
+		proc.DryRun = cctx.Bool("dry-run")
+		switch mode := cctx.String("actors-mode"); mode {
+		case "history":
+			proc.Mode = processor.ModeHistory
+		case "latest":
+			proc.Mode = processor.ModeLatest
+		default:
+			return xerrors.Errorf("unknown actors mode %q", mode)
+		}
+		switch sink := cctx.String("metrics-sink"); sink {
+		case "prometheus":
+			if addr := cctx.String("metrics-addr"); addr != "" {
+				if err := serveMetrics(addr); err != nil {
+					return err
+				}
+			}
+		case "statsd":
+			statsd, err := processor.NewStatsdSink(cctx.String("statsd-addr"), cctx.String("statsd-prefix"))
+			if err != nil {
+				return err
+			}
+			defer statsd.Close() //nolint:errcheck
+			proc.Metrics = statsd
+		default:
+			return xerrors.Errorf("unknown metrics sink %q", sink)
+		}
 		proc.Start(ctx)
 
+		if addr := cctx.String("api-addr"); addr != "" {
+			serveAPI(addr, proc)
+		}
+
 		<-ctx.Done()
 		os.Exit(0)
 		return nil
 	},
 }
+
+// serveMetrics registers the processor views and serves them to Prometheus on addr.
+func serveMetrics(addr string) error {
+	if err := view.Register(processor.DefaultViews...); err != nil {
+		return xerrors.Errorf("register metric views: %w", err)
+	}
+
+	// the measures are already prefixed with chainwatch/, no namespace is added.
+	exporter, err := prometheus.NewExporter(prometheus.Options{})
+	if err != nil {
+		return xerrors.Errorf("create prometheus exporter: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+	go func() {
+		log.Infow("Serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorw("Metrics server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// serveAPI serves the read only HTTP API of proc on addr.
+func serveAPI(addr string, proc *processor.Processor) {
+	go func() {
+		log.Infow("Serving API", "addr", addr)
+		if err := http.ListenAndServe(addr, proc.APIHandler()); err != nil {
+			log.Errorw("API server stopped", "error", err)
+		}
+	}()
+}
@@ -3,9 +3,6 @@ package syncer
 import (
 	"context"
 	"time"
-
-	"github.com/filecoin-project/lotus/chain/types"
-	"github.com/ipfs/go-cid"
 )
 
 func (s *Syncer) subBlocks(ctx context.Context) {
@@ -16,10 +13,12 @@ func (s *Syncer) subBlocks(ctx context.Context) {
 	}
 
 	for bh := range sub {
-		err := s.storeHeaders(map[cid.Cid]*types.BlockHeader{
-			bh.Cid(): bh,
-		}, false, time.Now())
-		if err != nil {
+		bhs := newHeaderBuffer(0, "", 0)
+		if err := bhs.Add(bh); err != nil {
+			log.Errorf("%+v", err)
+			continue
+		}
+		if err := s.storeHeaders(bhs, false, time.Now()); err != nil {
 			log.Errorf("%+v", err)
 		}
 	}
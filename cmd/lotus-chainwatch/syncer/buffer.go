@@ -0,0 +1,167 @@
+package syncer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DefaultMaxBufferedHeaders is the number of unsynced block headers held in memory before the rest are spilled to disk.
+const DefaultMaxBufferedHeaders = 20000
+
+// DefaultMaxSpillBytes bounds the size of the file unsynced block headers are spilled to.
+const DefaultMaxSpillBytes = 4 << 30
+
+var errSpillFull = xerrors.New("unsynced block headers exceed the max spill size")
+
+// headerBuffer holds the block headers a sync walks to until they are stored. Up to maxHeaders are held in memory, the
+// ones beyond are spilled to a file in dir which grows to maxBytes at most, errSpillFull is returned past it. The cids
+// of every header added are kept in memory to skip the headers seen twice. A maxHeaders of 0 holds every header in
+// memory.
+type headerBuffer struct {
+	maxHeaders int
+	dir        string
+	maxBytes   int64
+
+	seen map[cid.Cid]struct{}
+	mem  []*types.BlockHeader
+
+	spill   *os.File
+	spilled int
+	size    int64
+}
+
+func newHeaderBuffer(maxHeaders int, dir string, maxBytes int64) *headerBuffer {
+	return &headerBuffer{
+		maxHeaders: maxHeaders,
+		dir:        dir,
+		maxBytes:   maxBytes,
+		seen:       map[cid.Cid]struct{}{},
+	}
+}
+
+// Has returns whether the header of c was added.
+func (b *headerBuffer) Has(c cid.Cid) bool {
+	_, ok := b.seen[c]
+	return ok
+}
+
+// Len returns the number of headers added.
+func (b *headerBuffer) Len() int {
+	return len(b.seen)
+}
+
+// Add adds bh, spilling the headers held in memory to disk first if there are maxHeaders of them. The buffer is not
+// usable past an error.
+func (b *headerBuffer) Add(bh *types.BlockHeader) error {
+	if b.maxHeaders > 0 && len(b.mem) >= b.maxHeaders {
+		if err := b.spillMem(); err != nil {
+			return err
+		}
+	}
+	b.seen[bh.Cid()] = struct{}{}
+	b.mem = append(b.mem, bh)
+	return nil
+}
+
+// spillMem appends the headers held in memory to the spill file, each as its length followed by its serialization.
+func (b *headerBuffer) spillMem() error {
+	if b.spill == nil {
+		f, err := ioutil.TempFile(b.dir, "chainwatch-headers-")
+		if err != nil {
+			return xerrors.Errorf("create header spill file: %w", err)
+		}
+		b.spill = f
+	}
+
+	w := bufio.NewWriter(b.spill)
+	var n [binary.MaxVarintLen64]byte
+	for _, bh := range b.mem {
+		data, err := bh.Serialize()
+		if err != nil {
+			return xerrors.Errorf("serialize block header %s: %w", bh.Cid(), err)
+		}
+		l := binary.PutUvarint(n[:], uint64(len(data)))
+		if b.maxBytes > 0 && b.size+int64(l+len(data)) > b.maxBytes {
+			return errSpillFull
+		}
+		if _, err := w.Write(n[:l]); err != nil {
+			return xerrors.Errorf("spill block header: %w", err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return xerrors.Errorf("spill block header: %w", err)
+		}
+		b.size += int64(l + len(data))
+	}
+	if err := w.Flush(); err != nil {
+		return xerrors.Errorf("spill block headers: %w", err)
+	}
+
+	b.spilled += len(b.mem)
+	b.mem = b.mem[:0]
+	return nil
+}
+
+// ForEachChunk calls cb with the headers added, the spilled ones read back from disk first, in chunks of at most
+// maxHeaders.
+func (b *headerBuffer) ForEachChunk(cb func([]*types.BlockHeader) error) error {
+	if b.spill != nil {
+		if _, err := b.spill.Seek(0, io.SeekStart); err != nil {
+			return xerrors.Errorf("rewind header spill file: %w", err)
+		}
+		r := bufio.NewReader(b.spill)
+		chunk := make([]*types.BlockHeader, 0, b.maxHeaders)
+		for i := 0; i < b.spilled; i++ {
+			l, err := binary.ReadUvarint(r)
+			if err != nil {
+				return xerrors.Errorf("read spilled block header: %w", err)
+			}
+			data := make([]byte, l)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return xerrors.Errorf("read spilled block header: %w", err)
+			}
+			bh, err := types.DecodeBlock(data)
+			if err != nil {
+				return xerrors.Errorf("decode spilled block header: %w", err)
+			}
+
+			chunk = append(chunk, bh)
+			if len(chunk) == b.maxHeaders {
+				if err := cb(chunk); err != nil {
+					return err
+				}
+				chunk = chunk[:0]
+			}
+		}
+		if len(chunk) > 0 {
+			if err := cb(chunk); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(b.mem) == 0 {
+		return nil
+	}
+	return cb(b.mem)
+}
+
+// Close removes the spill file.
+func (b *headerBuffer) Close() error {
+	if b.spill == nil {
+		return nil
+	}
+	name := b.spill.Name()
+	if err := b.spill.Close(); err != nil {
+		return err
+	}
+	b.spill = nil
+	return os.Remove(name)
+}
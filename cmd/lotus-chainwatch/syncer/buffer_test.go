@@ -0,0 +1,83 @@
+package syncer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "chainwatch-syncer-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestHeaderBufferSpill(t *testing.T) {
+	dir := tempDir(t)
+	b := newHeaderBuffer(3, dir, 0)
+
+	var added []*types.BlockHeader
+	ts := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	for i := 0; i < 8; i++ {
+		bh := mock.MkBlock(ts, 1, 1)
+		ts = mock.TipSet(bh)
+		require.NoError(t, b.Add(bh))
+		added = append(added, bh)
+
+		// no more than the memory bound is held in memory, the rest is on disk.
+		require.LessOrEqual(t, len(b.mem), 3)
+	}
+	require.Equal(t, 8, b.Len())
+	require.True(t, b.Has(added[0].Cid()))
+	require.Equal(t, 6, b.spilled)
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// every header is read back in the order it was added, in chunks no larger than the memory bound.
+	var got []*types.BlockHeader
+	require.NoError(t, b.ForEachChunk(func(chunk []*types.BlockHeader) error {
+		require.LessOrEqual(t, len(chunk), 3)
+		got = append(got, chunk...)
+		return nil
+	}))
+	require.Len(t, got, len(added))
+	for i := range added {
+		require.Equal(t, added[i].Cid(), got[i].Cid())
+	}
+
+	require.NoError(t, b.Close())
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestHeaderBufferSpillBound(t *testing.T) {
+	bh := mock.MkBlock(nil, 1, 1)
+	data, err := bh.Serialize()
+	require.NoError(t, err)
+
+	// room for a spilled header and a half.
+	b := newHeaderBuffer(1, tempDir(t), int64(len(data)*3/2))
+	defer b.Close() //nolint:errcheck
+
+	ts := mock.TipSet(bh)
+	require.NoError(t, b.Add(bh))
+	var errs []error
+	for i := 0; i < 3; i++ {
+		bh = mock.MkBlock(ts, 1, 1)
+		ts = mock.TipSet(bh)
+		errs = append(errs, b.Add(bh))
+	}
+	require.NoError(t, errs[0])
+	require.True(t, xerrors.Is(errs[1], errSpillFull), "%v", errs[1])
+}
@@ -0,0 +1,202 @@
+package syncer
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+)
+
+// DefaultMaxReorgDepth is the number of epochs the syncer will walk back from a reverted tipset looking for the
+// common ancestor before giving up on an incremental revert.
+const DefaultMaxReorgDepth = 100
+
+var errReorgTooDeep = xerrors.New("common ancestor is deeper than the max reorg depth")
+
+type tipSetGetter func(context.Context, types.TipSetKey) (*types.TipSet, error)
+
+// revertChain is the part of the node a revert reads the chain from.
+type revertChain interface {
+	ChainHead(context.Context) (*types.TipSet, error)
+	ChainGetTipSet(context.Context, types.TipSetKey) (*types.TipSet, error)
+	ChainGetTipSetByHeight(context.Context, abi.ChainEpoch, types.TipSetKey) (*types.TipSet, error)
+}
+
+// revertSet walks back from the reverted tipset and the new head until they meet at their common ancestor. It returns
+// the tipsets that were reverted (highest first) and the common ancestor. If the ancestor is more than maxDepth epochs
+// below the reverted tipset or the head errReorgTooDeep is returned, neither walk goes further.
+func revertSet(ctx context.Context, getTipSet tipSetGetter, reverted, head *types.TipSet, maxDepth int) ([]*types.TipSet, *types.TipSet, error) {
+	var out []*types.TipSet
+	var err error
+
+	left, right := reverted, head
+	for !left.Equals(right) {
+		if reverted.Height()-left.Height() > abi.ChainEpoch(maxDepth) || head.Height()-right.Height() > abi.ChainEpoch(maxDepth) {
+			return nil, nil, errReorgTooDeep
+		}
+
+		if left.Height() >= right.Height() {
+			out = append(out, left)
+			left, err = getTipSet(ctx, left.Parents())
+		} else {
+			right, err = getTipSet(ctx, right.Parents())
+		}
+		if err != nil {
+			return nil, nil, xerrors.Errorf("walking to common ancestor: %w", err)
+		}
+	}
+	return out, left, nil
+}
+
+// forkAncestor finds the common ancestor of the reverted tipset and the head by bisecting the heights below the
+// reverted tipset, the tipsets of both chains at a height are read by height so no walk is needed however deep the
+// fork is.
+func forkAncestor(ctx context.Context, chain revertChain, reverted, head *types.TipSet) (*types.TipSet, error) {
+	// the chains agree at lo, genesis, and disagree at hi, the reverted tipset.
+	lo, hi := abi.ChainEpoch(0), reverted.Height()
+	ancestor, err := chain.ChainGetTipSetByHeight(ctx, lo, reverted.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("get reverted chain tipset at %d: %w", lo, err)
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		fork, err := chain.ChainGetTipSetByHeight(ctx, mid, reverted.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("get reverted chain tipset at %d: %w", mid, err)
+		}
+		canonical, err := chain.ChainGetTipSetByHeight(ctx, mid, head.Key())
+		if err != nil {
+			return nil, xerrors.Errorf("get canonical tipset at %d: %w", mid, err)
+		}
+		if fork.Equals(canonical) {
+			lo, ancestor = mid, fork
+		} else {
+			hi = mid
+		}
+	}
+	return ancestor, nil
+}
+
+func (s *Syncer) handleRevert(ctx context.Context, reverted *types.TipSet) error {
+	return s.revert(ctx, s.node, reverted)
+}
+
+// revert undoes the reorg the reverted tipset is part of. A reorg within the max reorg depth is reverted
+// incrementally, the blocks of the tipsets it reverted are marked reverted and left out of processing. The reverted
+// tipsets of a deeper reorg are not walked to, the heights above the common ancestor through the height of the reverted
+// tipset are reprocessed in full instead: the canonical blocks of those heights are flagged for reprocess and every
+// other block of them is marked reverted.
+func (s *Syncer) revert(ctx context.Context, chain revertChain, reverted *types.TipSet) error {
+	head, err := chain.ChainHead(ctx)
+	if err != nil {
+		return xerrors.Errorf("get chain head: %w", err)
+	}
+
+	revert, ancestor, err := revertSet(ctx, chain.ChainGetTipSet, reverted, head, s.MaxReorgDepth)
+	if err != nil {
+		if !xerrors.Is(err, errReorgTooDeep) {
+			return err
+		}
+
+		if ancestor, err = forkAncestor(ctx, chain, reverted, head); err != nil {
+			return xerrors.Errorf("find common ancestor: %w", err)
+		}
+		log.Errorw("Reorg exceeds max reorg depth, flagging height range for full reprocess",
+			"reverted", reverted.Key().String(), "height", reverted.Height(), "maxDepth", s.MaxReorgDepth, "from", ancestor.Height()+1, "to", reverted.Height())
+		canonical, err := canonicalBlocks(ctx, chain, head, ancestor, reverted.Height())
+		if err != nil {
+			return xerrors.Errorf("gather canonical blocks: %w", err)
+		}
+		return s.flagForReprocess(ancestor.Height()+1, reverted.Height(), canonical, time.Now())
+	}
+
+	log.Infow("Reverted tipsets", "count", len(revert), "ancestor", ancestor.Key().String(), "ancestorHeight", ancestor.Height())
+	return s.markReverted(revert, time.Now())
+}
+
+// markReverted records the time the blocks of the tipsets were reverted at, the processor leaves reverted blocks
+// unprocessed.
+func (s *Syncer) markReverted(tss []*types.TipSet, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt, err := tx.Prepare(`update blocks_synced set reverted_at = $1 where cid = $2`)
+	if err != nil {
+		return err
+	}
+	for _, ts := range tss {
+		for _, c := range ts.Cids() {
+			if _, err := stmt.Exec(at.Unix(), c.String()); err != nil {
+				return xerrors.Errorf("mark block reverted: %w", err)
+			}
+		}
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// clearReverted clears the reverted marker of the blocks of an applied tipset, a reorg back to a reverted fork makes
+// its blocks canonical again.
+func (s *Syncer) clearReverted(ts *types.TipSet) error {
+	cids := make([]string, 0, len(ts.Cids()))
+	for _, c := range ts.Cids() {
+		cids = append(cids, c.String())
+	}
+	if _, err := s.db.Exec(`update blocks_synced set reverted_at = null where reverted_at is not null and cid = any($1)`, pq.Array(cids)); err != nil {
+		return xerrors.Errorf("clear reverted blocks: %w", err)
+	}
+	return nil
+}
+
+// canonicalBlocks returns the cids of the blocks of the head's chain above the ancestor through height to.
+func canonicalBlocks(ctx context.Context, chain revertChain, head, ancestor *types.TipSet, to abi.ChainEpoch) ([]string, error) {
+	ts, err := chain.ChainGetTipSetByHeight(ctx, to, head.Key())
+	if err != nil {
+		return nil, xerrors.Errorf("get canonical tipset at %d: %w", to, err)
+	}
+
+	var out []string
+	for ts.Height() > ancestor.Height() {
+		for _, c := range ts.Cids() {
+			out = append(out, c.String())
+		}
+		if ts, err = chain.ChainGetTipSet(ctx, ts.Parents()); err != nil {
+			return nil, xerrors.Errorf("get canonical tipset: %w", err)
+		}
+	}
+	return out, nil
+}
+
+// flagForReprocess clears the processed and reverted markers of the canonical blocks so the processor picks them up
+// again, and marks every other block in the (inclusive) height range reverted at the time given.
+func (s *Syncer) flagForReprocess(from, to abi.ChainEpoch, canonical []string, at time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(`
+update blocks_synced set reverted_at = $3
+where reverted_at is null and not (cid = any($4))
+	and cid in (select cid from blocks where height >= $1 and height <= $2)
+`, from, to, at.Unix(), pq.Array(canonical)); err != nil {
+		return xerrors.Errorf("mark fork blocks reverted: %w", err)
+	}
+	if _, err := tx.Exec(`update blocks_synced set processed_at = null, reverted_at = null where cid = any($1)`, pq.Array(canonical)); err != nil {
+		return xerrors.Errorf("flag blocks for reprocess: %w", err)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,235 @@
+package syncer
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"sort"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/chain/types"
+	"github.com/filecoin-project/lotus/chain/types/mock"
+)
+
+// testDBEnv names the Postgres database the tests needing one run against, they are skipped when it is not set.
+const testDBEnv = "LOTUS_CHAINWATCH_TEST_DB"
+
+type testChain map[types.TipSetKey]*types.TipSet
+
+func (tc testChain) extend(parent *types.TipSet, n int, ticket uint64) *types.TipSet {
+	cur := parent
+	for i := 0; i < n; i++ {
+		cur = mock.TipSet(mock.MkBlock(cur, 1, ticket))
+		tc[cur.Key()] = cur
+	}
+	return cur
+}
+
+func (tc testChain) get(_ context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, ok := tc[tsk]
+	if !ok {
+		return nil, xerrors.Errorf("tipset %s not found", tsk)
+	}
+	return ts, nil
+}
+
+// testNode is a chain of a testChain whose head is head.
+type testNode struct {
+	testChain
+	head *types.TipSet
+}
+
+func (n testNode) ChainHead(context.Context) (*types.TipSet, error) {
+	return n.head, nil
+}
+
+func (n testNode) ChainGetTipSet(ctx context.Context, tsk types.TipSetKey) (*types.TipSet, error) {
+	return n.get(ctx, tsk)
+}
+
+func (n testNode) ChainGetTipSetByHeight(ctx context.Context, h abi.ChainEpoch, tsk types.TipSetKey) (*types.TipSet, error) {
+	ts, err := n.get(ctx, tsk)
+	for err == nil && ts.Height() > h {
+		ts, err = n.get(ctx, ts.Parents())
+	}
+	return ts, err
+}
+
+func TestRevertSet(t *testing.T) {
+	ctx := context.Background()
+
+	tc := testChain{}
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	tc[gen.Key()] = gen
+
+	ancestor := tc.extend(gen, 1, 1)
+	reverted := tc.extend(ancestor, 4, 1)
+	head := tc.extend(ancestor, 5, 2)
+
+	revert, found, err := revertSet(ctx, tc.get, reverted, head, 10)
+	require.NoError(t, err)
+	require.True(t, found.Equals(ancestor))
+	require.Len(t, revert, 4)
+	require.True(t, revert[0].Equals(reverted))
+	for _, ts := range revert {
+		require.True(t, ts.Height() > ancestor.Height())
+	}
+}
+
+func TestRevertSetTooDeep(t *testing.T) {
+	ctx := context.Background()
+
+	tc := testChain{}
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	tc[gen.Key()] = gen
+
+	ancestor := tc.extend(gen, 1, 1)
+	reverted := tc.extend(ancestor, 4, 1)
+	head := tc.extend(ancestor, 5, 2)
+
+	_, _, err := revertSet(ctx, tc.get, reverted, head, 2)
+	require.True(t, xerrors.Is(err, errReorgTooDeep))
+}
+
+func TestRevertSetHeadTooFar(t *testing.T) {
+	ctx := context.Background()
+
+	tc := testChain{}
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	tc[gen.Key()] = gen
+
+	ancestor := tc.extend(gen, 1, 1)
+	reverted := tc.extend(ancestor, 1, 1)
+	head := tc.extend(ancestor, 5, 2)
+
+	// the walk down from the head is bounded as well.
+	_, _, err := revertSet(ctx, tc.get, reverted, head, 2)
+	require.True(t, xerrors.Is(err, errReorgTooDeep))
+}
+
+func TestForkAncestor(t *testing.T) {
+	ctx := context.Background()
+
+	tc := testChain{}
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	tc[gen.Key()] = gen
+
+	for _, depth := range []int{1, 2, 7} {
+		ancestor := tc.extend(gen, depth, 1)
+		reverted := tc.extend(ancestor, 6, 3)
+		head := tc.extend(ancestor, 9, 4)
+
+		found, err := forkAncestor(ctx, testNode{testChain: tc, head: head}, reverted, head)
+		require.NoError(t, err)
+		require.True(t, found.Equals(ancestor), "depth %d", depth)
+	}
+}
+
+func TestRevertShallowAndDeep(t *testing.T) {
+	dsn := os.Getenv(testDBEnv)
+	if dsn == "" {
+		t.Skipf("%s not set", testDBEnv)
+	}
+	db, err := sql.Open("postgres", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = db.Exec(`drop schema revert_test cascade; set search_path to default`)
+		_ = db.Close()
+	})
+	// the connection keeps the search path of the schema the tables are created in.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`
+drop schema if exists revert_test cascade;
+create schema revert_test;
+set search_path = revert_test;
+create table blocks (cid text not null primary key, height bigint not null);
+create table blocks_synced (cid text not null primary key, synced_at int not null, processed_at int, reverted_at int);
+`)
+	require.NoError(t, err)
+
+	tc := testChain{}
+	gen := mock.TipSet(mock.MkBlock(nil, 1, 1))
+	tc[gen.Key()] = gen
+	ancestor := tc.extend(gen, 3, 1)
+	reverted := tc.extend(ancestor, 4, 1)
+	head := tc.extend(ancestor, 5, 2)
+
+	// the blocks of the fork above the ancestor.
+	var fork []string
+	for ts := reverted; !ts.Equals(ancestor); ts = tc[ts.Parents()] {
+		for _, c := range ts.Cids() {
+			fork = append(fork, c.String())
+		}
+	}
+	// the blocks of the head's chain at the heights above the ancestor through the reverted tipset.
+	var canonical []string
+	for ts := head; !ts.Equals(ancestor); ts = tc[ts.Parents()] {
+		if ts.Height() <= reverted.Height() {
+			for _, c := range ts.Cids() {
+				canonical = append(canonical, c.String())
+			}
+		}
+	}
+
+	query := func(q string) []string {
+		rows, err := db.Query(q)
+		require.NoError(t, err)
+		var out []string
+		for rows.Next() {
+			var c string
+			require.NoError(t, rows.Scan(&c))
+			out = append(out, c)
+		}
+		require.NoError(t, rows.Err())
+		require.NoError(t, rows.Close())
+		sort.Strings(out)
+		return out
+	}
+
+	for _, tt := range []struct {
+		maxDepth int
+		reverted []string
+		flagged  []string
+	}{
+		// the reorg is walked, only the blocks of the reverted tipsets are marked and nothing is reprocessed.
+		{maxDepth: 10, reverted: fork},
+		// the reorg is too deep to walk, the canonical blocks of its heights are reprocessed and the fork blocks are
+		// marked reverted rather than reprocessed.
+		{maxDepth: 2, reverted: fork, flagged: canonical},
+	} {
+		// every block stored is processed.
+		_, err := db.Exec(`truncate blocks, blocks_synced`)
+		require.NoError(t, err)
+		for _, ts := range tc {
+			for _, c := range ts.Cids() {
+				_, err := db.Exec(`insert into blocks (cid, height) values ($1, $2)`, c.String(), ts.Height())
+				require.NoError(t, err)
+				_, err = db.Exec(`insert into blocks_synced (cid, synced_at, processed_at) values ($1, 1, 1)`, c.String())
+				require.NoError(t, err)
+			}
+		}
+
+		s := &Syncer{db: db, MaxReorgDepth: tt.maxDepth}
+		require.NoError(t, s.revert(context.Background(), testNode{testChain: tc, head: head}, reverted))
+
+		sort.Strings(tt.reverted)
+		sort.Strings(tt.flagged)
+		require.Equal(t, tt.reverted, query(`select cid from blocks_synced where reverted_at is not null`), "max depth %d", tt.maxDepth)
+		require.Equal(t, tt.flagged, query(`select cid from blocks_synced where processed_at is null`), "max depth %d", tt.maxDepth)
+	}
+
+	// applying the reverted tipset again makes its blocks canonical.
+	s := &Syncer{db: db}
+	_, err = db.Exec(`update blocks_synced set reverted_at = 1`)
+	require.NoError(t, err)
+	require.NoError(t, s.clearReverted(reverted))
+	var left int
+	require.NoError(t, db.QueryRow(`select count(*) from blocks_synced where reverted_at is not null`).Scan(&left))
+	require.Equal(t, len(tc)-len(reverted.Cids()), left)
+}
@@ -24,12 +24,28 @@ type Syncer struct {
 
 	headerLk sync.Mutex
 	node     api.FullNode
+
+	// MaxReorgDepth bounds how far back a revert will walk looking for the common ancestor. A reorg within it is
+	// reverted incrementally by marking the blocks of the reverted tipsets, the heights above the ancestor of a deeper
+	// one are flagged for a full reprocess instead.
+	MaxReorgDepth int
+
+	// MaxBufferedHeaders is the number of unsynced block headers a sync holds in memory, the ones beyond are spilled to
+	// a file in SpillDir, the default temporary directory if empty. 0 holds them all in memory.
+	MaxBufferedHeaders int
+	SpillDir           string
+	// MaxSpillBytes bounds the size of the spill file, a sync walking to more headers than fit fails. 0 leaves it
+	// unbounded.
+	MaxSpillBytes int64
 }
 
 func NewSyncer(db *sql.DB, node api.FullNode) *Syncer {
 	return &Syncer{
-		db:   db,
-		node: node,
+		db:                 db,
+		node:               node,
+		MaxReorgDepth:      DefaultMaxReorgDepth,
+		MaxBufferedHeaders: DefaultMaxBufferedHeaders,
+		MaxSpillBytes:      DefaultMaxSpillBytes,
 	}
 }
 
@@ -64,6 +80,8 @@ create table if not exists blocks_synced
 create unique index if not exists blocks_synced_cid_uindex
 	on blocks_synced (cid,processed_at);
 
+alter table blocks_synced add column if not exists reverted_at int;
+
 create table if not exists block_parents
 (
 	block text not null
@@ -153,6 +171,9 @@ func (s *Syncer) Start(ctx context.Context) {
 	if err := s.storeHeaders(unsynced, true, time.Now()); err != nil {
 		log.Fatalw("failed to store unsynced blocks", "error", err)
 	}
+	if err := unsynced.Close(); err != nil {
+		log.Errorw("failed to remove header spill file", "error", err)
+	}
 
 	// continue to keep the block headers table up to date.
 	notifs, err := s.node.ChainNotify(ctx)
@@ -166,12 +187,17 @@ func (s *Syncer) Start(ctx context.Context) {
 			for _, change := range notif {
 				switch change.Type {
 				case store.HCApply:
+					if err := s.clearReverted(change.Val); err != nil {
+						log.Errorw("failed to clear reverted blocks", "error", err)
+					}
+
 					unsynced, err := s.unsyncedBlocks(ctx, change.Val, lastSynced)
 					if err != nil {
 						log.Errorw("failed to gather unsynced blocks", "error", err)
+						continue
 					}
 
-					if len(unsynced) == 0 {
+					if unsynced.Len() == 0 {
 						continue
 					}
 
@@ -180,17 +206,24 @@ func (s *Syncer) Start(ctx context.Context) {
 						// for now just log an error and the blocks will be attempted again on next notifi
 						log.Errorw("failed to store unsynced blocks", "error", err)
 					}
+					if err := unsynced.Close(); err != nil {
+						log.Errorw("failed to remove header spill file", "error", err)
+					}
 
 					lastSynced = time.Now()
 				case store.HCRevert:
-					log.Debug("revert todo")
+					if err := s.handleRevert(ctx, change.Val); err != nil {
+						log.Errorw("failed to handle revert", "error", err)
+					}
 				}
 			}
 		}
 	}()
 }
 
-func (s *Syncer) unsyncedBlocks(ctx context.Context, head *types.TipSet, since time.Time) (map[cid.Cid]*types.BlockHeader, error) {
+// unsyncedBlocks walks back from head to the blocks synced since a little before since and returns the headers of the
+// blocks walked to. The caller closes the buffer returned once it is stored.
+func (s *Syncer) unsyncedBlocks(ctx context.Context, head *types.TipSet, since time.Time) (*headerBuffer, error) {
 	// get a list of blocks we have already synced in the past 3 mins. This ensures we aren't returning the entire
 	// table every time.
 	lookback := since.Add(-(time.Minute * 3))
@@ -206,18 +239,21 @@ func (s *Syncer) unsyncedBlocks(ctx context.Context, head *types.TipSet, since t
 		toVisit.PushBack(header)
 	}
 
-	toSync := map[cid.Cid]*types.BlockHeader{}
+	toSync := newHeaderBuffer(s.MaxBufferedHeaders, s.SpillDir, s.MaxSpillBytes)
 
 	for toVisit.Len() > 0 {
 		bh := toVisit.Remove(toVisit.Back()).(*types.BlockHeader)
 		_, has := hasList[bh.Cid()]
-		if _, seen := toSync[bh.Cid()]; seen || has {
+		if toSync.Has(bh.Cid()) || has {
 			continue
 		}
 
-		toSync[bh.Cid()] = bh
-		if len(toSync)%500 == 10 {
-			log.Debugw("To visit", "toVisit", toVisit.Len(), "toSync", len(toSync), "current_height", bh.Height)
+		if err := toSync.Add(bh); err != nil {
+			_ = toSync.Close()
+			return nil, err
+		}
+		if toSync.Len()%500 == 10 {
+			log.Debugw("To visit", "toVisit", toVisit.Len(), "toSync", toSync.Len(), "current_height", bh.Height)
 		}
 
 		if len(bh.Parents) == 0 {
@@ -234,7 +270,7 @@ func (s *Syncer) unsyncedBlocks(ctx context.Context, head *types.TipSet, since t
 			toVisit.PushBack(header)
 		}
 	}
-	log.Debugw("Gathered unsynced blocks", "count", len(toSync))
+	log.Debugw("Gathered unsynced blocks", "count", toSync.Len())
 	return toSync, nil
 }
 
@@ -262,18 +298,21 @@ func (s *Syncer) syncedBlocks(timestamp time.Time) (map[cid.Cid]struct{}, error)
 	return out, nil
 }
 
-func (s *Syncer) storeHeaders(bhs map[cid.Cid]*types.BlockHeader, sync bool, timestamp time.Time) error {
+// storeHeaders stores the headers of bhs in a single transaction. The headers are copied into temporary tables one
+// chunk of bhs at a time, so no more of them than bhs holds in memory are read at once.
+func (s *Syncer) storeHeaders(bhs *headerBuffer, sync bool, timestamp time.Time) error {
 	s.headerLk.Lock()
 	defer s.headerLk.Unlock()
-	if len(bhs) == 0 {
+	if bhs.Len() == 0 {
 		return nil
 	}
-	log.Debugw("Storing Headers", "count", len(bhs))
+	log.Debugw("Storing Headers", "count", bhs.Len())
 
 	tx, err := s.db.Begin()
 	if err != nil {
 		return xerrors.Errorf("begin: %w", err)
 	}
+	defer tx.Rollback() //nolint:errcheck
 
 	if _, err := tx.Exec(`
 
@@ -289,6 +328,38 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		return xerrors.Errorf("prep temp: %w", err)
 	}
 
+	if err := bhs.ForEachChunk(func(chunk []*types.BlockHeader) error {
+		return copyHeaders(tx, chunk, sync, timestamp)
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`insert into block_cids select * from bc on conflict do nothing `); err != nil {
+		return xerrors.Errorf("block cids put: %w", err)
+	}
+	if _, err := tx.Exec(`insert into drand_entries select * from de on conflict do nothing `); err != nil {
+		return xerrors.Errorf("drand entries put: %w", err)
+	}
+	if _, err := tx.Exec(`insert into block_drand_entries select * from bde on conflict do nothing `); err != nil {
+		return xerrors.Errorf("block drand entries put: %w", err)
+	}
+	if _, err := tx.Exec(`insert into block_parents select * from tbp on conflict do nothing `); err != nil {
+		return xerrors.Errorf("parent put: %w", err)
+	}
+	if sync {
+		if _, err := tx.Exec(`insert into blocks_synced select * from bs on conflict do nothing `); err != nil {
+			return xerrors.Errorf("syncd put: %w", err)
+		}
+	}
+	if _, err := tx.Exec(`insert into blocks select * from b on conflict do nothing `); err != nil {
+		return xerrors.Errorf("blk put: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// copyHeaders copies the rows of bhs into the temporary tables of storeHeaders.
+func copyHeaders(tx *sql.Tx, bhs []*types.BlockHeader, sync bool, timestamp time.Time) error {
 	{
 		stmt, err := tx.Prepare(`copy bc (cid) from STDIN`)
 		if err != nil {
@@ -304,10 +375,6 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		if err := stmt.Close(); err != nil {
 			return err
 		}
-
-		if _, err := tx.Exec(`insert into block_cids select * from bc on conflict do nothing `); err != nil {
-			return xerrors.Errorf("drand entries put: %w", err)
-		}
 	}
 
 	{
@@ -327,10 +394,6 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		if err := stmt.Close(); err != nil {
 			return err
 		}
-
-		if _, err := tx.Exec(`insert into drand_entries select * from de on conflict do nothing `); err != nil {
-			return xerrors.Errorf("drand entries put: %w", err)
-		}
 	}
 
 	{
@@ -350,10 +413,6 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		if err := stmt.Close(); err != nil {
 			return err
 		}
-
-		if _, err := tx.Exec(`insert into block_drand_entries select * from bde on conflict do nothing `); err != nil {
-			return xerrors.Errorf("block drand entries put: %w", err)
-		}
 	}
 
 	{
@@ -373,10 +432,6 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		if err := stmt.Close(); err != nil {
 			return err
 		}
-
-		if _, err := tx.Exec(`insert into block_parents select * from tbp on conflict do nothing `); err != nil {
-			return xerrors.Errorf("parent put: %w", err)
-		}
 	}
 
 	if sync {
@@ -395,10 +450,6 @@ create temp table b (like blocks excluding constraints) on commit drop;
 		if err := stmt.Close(); err != nil {
 			return err
 		}
-
-		if _, err := tx.Exec(`insert into blocks_synced select * from bs on conflict do nothing `); err != nil {
-			return xerrors.Errorf("syncd put: %w", err)
-		}
 	}
 
 	stmt2, err := tx.Prepare(`copy b (cid, parentWeight, parentStateRoot, height, miner, "timestamp", ticket, eprof, forksig) from stdin`)
@@ -437,10 +488,5 @@ create temp table b (like blocks excluding constraints) on commit drop;
 	if err := stmt2.Close(); err != nil {
 		return xerrors.Errorf("s2 close: %w", err)
 	}
-
-	if _, err := tx.Exec(`insert into blocks select * from b on conflict do nothing `); err != nil {
-		return xerrors.Errorf("blk put: %w", err)
-	}
-
-	return tx.Commit()
+	return nil
 }
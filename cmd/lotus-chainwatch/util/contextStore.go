@@ -7,19 +7,22 @@ import (
 
 	"github.com/ipfs/go-cid"
 	cbg "github.com/whyrusleeping/cbor-gen"
-
-	"github.com/filecoin-project/lotus/api"
 )
 
 // TODO extract this to a common location in lotus and reuse the code
 
+// ObjReader reads raw ipld objects, an api.FullNode is one.
+type ObjReader interface {
+	ChainReadObj(context.Context, cid.Cid) ([]byte, error)
+}
+
 // APIIpldStore is required for AMT and HAMT access.
 type APIIpldStore struct {
 	ctx context.Context
-	api api.FullNode
+	api ObjReader
 }
 
-func NewAPIIpldStore(ctx context.Context, api api.FullNode) *APIIpldStore {
+func NewAPIIpldStore(ctx context.Context, api ObjReader) *APIIpldStore {
 	return &APIIpldStore{
 		ctx: ctx,
 		api: api,
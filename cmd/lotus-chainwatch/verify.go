@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	lcli "github.com/filecoin-project/lotus/cli"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/xerrors"
+
+	"github.com/filecoin-project/specs-actors/actors/abi"
+
+	"github.com/filecoin-project/lotus/cmd/lotus-chainwatch/processor"
+)
+
+var verifyCmd = &cli.Command{
+	Name:  "verify",
+	Usage: "Compare the actors stored as of a height with the state the node has, failing on any mismatch",
+	Flags: []cli.Flag{
+		&cli.Int64Flag{
+			Name:     "epoch",
+			Usage:    "height to verify the actors at",
+			Required: true,
+		},
+		&cli.IntFlag{
+			Name:  "sample",
+			Usage: "number of actors picked at random to verify, 0 to verify every actor",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		ll := cctx.String("log-level")
+		if err := logging.SetLogLevel("*", ll); err != nil {
+			return err
+		}
+		ctx := lcli.ReqContext(cctx)
+
+		api, closer, err := lcli.GetFullNodeAPI(cctx)
+		if err != nil {
+			return err
+		}
+		defer closer()
+
+		if err := processor.CheckNodeVersion(ctx, api); err != nil {
+			return err
+		}
+
+		proc, err := openProcessor(cctx, api)
+		if err != nil {
+			return err
+		}
+		defer closeDB(proc.DB())
+		report, err := proc.VerifyActors(ctx, abi.ChainEpoch(cctx.Int64("epoch")), cctx.Int("sample"))
+		if err != nil {
+			return err
+		}
+
+		for _, m := range report.Mismatches {
+			fmt.Printf("mismatch %v: %s\n", m.Fields, m)
+		}
+		fmt.Printf("epoch %d: %d matched, %d mismatched\n", report.Epoch, report.Matched, len(report.Mismatches))
+		if len(report.Mismatches) > 0 {
+			return xerrors.Errorf("%d actors at %d differ from the node", len(report.Mismatches), report.Epoch)
+		}
+		return nil
+	},
+}